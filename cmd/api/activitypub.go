@@ -0,0 +1,718 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"com.github/jrovieri/golang/social/internal/activitypub"
+	"com.github/jrovieri/golang/social/internal/store"
+	"github.com/go-chi/chi/v5"
+)
+
+// maxActivitySize bounds the size of the activities accepted by the inbox.
+const maxActivitySize = 1 << 20
+
+// actorRefetchInterval is how long a cached actor is kept before a signature
+// its key does not verify makes it fetched again, so forged signatures cannot
+// have the server fetch actors over and over.
+const actorRefetchInterval = 10 * time.Minute
+
+// errActivityDropped is returned for deliveries of posts that were deleted or
+// are no longer public since they were queued, which must not be sent.
+var errActivityDropped = errors.New("activity dropped")
+
+func (app *application) actorURL(userID int64) string {
+	return fmt.Sprintf("%s/ap/users/%d", app.config.activityPub.baseURL, userID)
+}
+
+func (app *application) noteURL(postID int64) string {
+	return fmt.Sprintf("%s/ap/posts/%d", app.config.activityPub.baseURL, postID)
+}
+
+// postIDFromNoteURL returns the ID of the local post a note URL points to.
+func (app *application) postIDFromNoteURL(uri string) (int64, bool) {
+	value, ok := strings.CutPrefix(uri, app.config.activityPub.baseURL+"/ap/posts/")
+	if !ok {
+		return 0, false
+	}
+
+	id, err := strconv.ParseInt(value, 10, 64)
+	return id, err == nil
+}
+
+func writeActivityJSON(w http.ResponseWriter, status int, data any) error {
+	w.Header().Set("Content-Type", activitypub.ContentType)
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(data)
+}
+
+// WebFinger godoc
+//
+//	@Summary		Discovers an actor
+//	@Description	Resolves acct:username@domain to the ActivityPub actor of a user
+//	@Tags			activitypub
+//	@Produce		json
+//	@Param			resource	query		string	true	"acct:username@domain"
+//	@Success		200			{object}	activitypub.WebFinger
+//	@Failure		400			{object}	error
+//	@Failure		404			{object}	error
+//	@Router			/.well-known/webfinger [get]
+func (app *application) webfingerHandler(w http.ResponseWriter, r *http.Request) {
+
+	resource := r.URL.Query().Get("resource")
+	acct, ok := strings.CutPrefix(resource, "acct:")
+	if !ok {
+		app.badRequest(w, r, errors.New("resource must be an acct: URI"))
+		return
+	}
+
+	username, domain, ok := strings.Cut(acct, "@")
+	if !ok || !strings.EqualFold(domain, app.federationDomain()) {
+		app.notFound(w, r, store.ErrResourceNotFound)
+		return
+	}
+
+	user, err := app.store.Users.GetByUsername(r.Context(), username)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrResourceNotFound):
+			app.notFound(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	jrd := activitypub.WebFinger{
+		Subject: resource,
+		Aliases: []string{app.actorURL(user.ID)},
+		Links: []activitypub.WebFingerLink{
+			{Rel: "self", Type: activitypub.ContentType, Href: app.actorURL(user.ID)},
+			{Rel: "http://webfinger.net/rel/profile-page", Type: "text/html",
+				Href: fmt.Sprintf("%s/users/%d", app.config.frontendURL, user.ID)},
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/jrd+json")
+	if err := json.NewEncoder(w).Encode(jrd); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+func (app *application) federationDomain() string {
+	u, err := url.Parse(app.config.activityPub.baseURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// GetActor godoc
+//
+//	@Summary		Fetches the actor of a user
+//	@Description	Fetches the ActivityPub actor of a user, along with its public key
+//	@Tags			activitypub
+//	@Produce		json
+//	@Param			userID	path		int	true	"User ID"
+//	@Success		200		{object}	activitypub.Actor
+//	@Failure		404		{object}	error
+//	@Failure		500		{object}	error
+//	@Router			/ap/users/{userID} [get]
+func (app *application) getActorHandler(w http.ResponseWriter, r *http.Request) {
+	user := getTargetUserFromContext(r)
+
+	key, err := app.actorKey(r.Context(), user.ID)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	id := app.actorURL(user.ID)
+	actor := activitypub.Actor{
+		Context:           activitypub.Context,
+		ID:                id,
+		Type:              "Person",
+		PreferredUsername: user.Username,
+		Name:              user.Username,
+		URL:               fmt.Sprintf("%s/users/%d", app.config.frontendURL, user.ID),
+		Inbox:             id + "/inbox",
+		Outbox:            id + "/outbox",
+		Followers:         id + "/followers",
+		Published:         user.CreatedAt,
+		PublicKey: activitypub.PublicKey{
+			ID:           id + "#main-key",
+			Owner:        id,
+			PublicKeyPem: key.PublicKeyPem,
+		},
+	}
+
+	if err := writeActivityJSON(w, http.StatusOK, actor); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// GetOutbox godoc
+//
+//	@Summary		Fetches the outbox of a user
+//	@Description	Fetches the public posts of a user as Create activities. The collection links
+//	@Description	to its first page, and pages link to the next one
+//	@Tags			activitypub
+//	@Produce		json
+//	@Param			userID	path		int		true	"User ID"
+//	@Param			page	query		bool	false	"Fetch a page of the collection"
+//	@Param			cursor	query		string	false	"Cursor of the page"
+//	@Success		200		{object}	activitypub.OrderedCollectionPage
+//	@Failure		400		{object}	error
+//	@Failure		404		{object}	error
+//	@Failure		500		{object}	error
+//	@Router			/ap/users/{userID}/outbox [get]
+func (app *application) getOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	user := getTargetUserFromContext(r)
+	id := app.actorURL(user.ID) + "/outbox"
+
+	if r.URL.Query().Get("page") != "true" {
+		collection := activitypub.OrderedCollection{
+			Context: activitypub.Context,
+			ID:      id,
+			Type:    "OrderedCollection",
+			First:   id + "?page=true",
+		}
+
+		if err := writeActivityJSON(w, http.StatusOK, collection); err != nil {
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	cursor, err := app.decodeCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	fq := store.PaginatedFeedQuery{Limit: 20, Sort: "desc", Cursor: cursor}
+
+	page, err := app.store.Posts.GetUserPosts(r.Context(), user.ID, store.AnonymousUserID, fq)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrInvalidCursor):
+			app.badRequest(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	collectionPage := activitypub.OrderedCollectionPage{
+		Context:      activitypub.Context,
+		ID:           id + "?" + r.URL.RawQuery,
+		Type:         "OrderedCollectionPage",
+		PartOf:       id,
+		OrderedItems: []any{},
+	}
+
+	if page.Next != nil {
+		collectionPage.Next = id + "?page=true&cursor=" + url.QueryEscape(app.encodeCursor(page.Next))
+	}
+
+	for _, p := range page.Posts {
+		collectionPage.OrderedItems = append(collectionPage.OrderedItems, app.createActivity(&p.Post, user))
+	}
+
+	if err := writeActivityJSON(w, http.StatusOK, collectionPage); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// GetFollowers godoc
+//
+//	@Summary		Fetches the followers of a user
+//	@Description	Fetches the number of followers of a user, on this server and on others
+//	@Tags			activitypub
+//	@Produce		json
+//	@Param			userID	path		int	true	"User ID"
+//	@Success		200		{object}	activitypub.OrderedCollection
+//	@Failure		404		{object}	error
+//	@Failure		500		{object}	error
+//	@Router			/ap/users/{userID}/followers [get]
+func (app *application) getFollowersHandler(w http.ResponseWriter, r *http.Request) {
+	user := getTargetUserFromContext(r)
+
+	remote, err := app.store.ActivityPub.CountRemoteFollowers(r.Context(), user.ID)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	total := user.FollowersCount + remote
+	collection := activitypub.OrderedCollection{
+		Context:    activitypub.Context,
+		ID:         app.actorURL(user.ID) + "/followers",
+		Type:       "OrderedCollection",
+		TotalItems: &total,
+	}
+
+	if err := writeActivityJSON(w, http.StatusOK, collection); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// GetNote godoc
+//
+//	@Summary		Fetches a post as a Note
+//	@Description	Fetches a public post as an ActivityPub Note
+//	@Tags			activitypub
+//	@Produce		json
+//	@Param			postID	path		int	true	"Post ID"
+//	@Success		200		{object}	activitypub.Note
+//	@Failure		404		{object}	error
+//	@Failure		500		{object}	error
+//	@Router			/ap/posts/{postID} [get]
+func (app *application) getNoteHandler(w http.ResponseWriter, r *http.Request) {
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "postID"), 10, 64)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	post, err := app.store.Posts.GetByID(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrResourceNotFound):
+			app.notFound(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	if post.Visibility != "public" {
+		app.notFound(w, r, store.ErrResourceNotFound)
+		return
+	}
+
+	note := app.note(post)
+	note.Context = activitypub.Context
+
+	if err := writeActivityJSON(w, http.StatusOK, note); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+func (app *application) note(p *store.Post) activitypub.Note {
+	actor := app.actorURL(p.UserID)
+
+	var content strings.Builder
+	for _, paragraph := range strings.Split(p.Content, "\n\n") {
+		content.WriteString("<p>")
+		content.WriteString(strings.ReplaceAll(html.EscapeString(paragraph), "\n", "<br>"))
+		content.WriteString("</p>")
+	}
+
+	note := activitypub.Note{
+		ID:           app.noteURL(p.ID),
+		Type:         "Note",
+		AttributedTo: actor,
+		Name:         p.Title,
+		Content:      content.String(),
+		URL:          fmt.Sprintf("%s/posts/%d", app.config.frontendURL, p.ID),
+		Published:    p.CreatedAt,
+		To:           []string{activitypub.PublicAddress},
+		Cc:           []string{actor + "/followers"},
+	}
+
+	if p.UpdatedAt != "" && p.UpdatedAt != p.CreatedAt {
+		note.Updated = p.UpdatedAt
+	}
+
+	for _, tag := range p.Tags {
+		note.Tag = append(note.Tag, activitypub.Tag{
+			Type: "Hashtag",
+			Href: fmt.Sprintf("%s/tags/%s", app.config.frontendURL, tag),
+			Name: "#" + tag,
+		})
+	}
+	return note
+}
+
+func (app *application) createActivity(p *store.Post, author *store.User) activitypub.Activity {
+	note := app.note(p)
+	object, _ := json.Marshal(note)
+
+	return activitypub.Activity{
+		ID:        note.ID + "/activity",
+		Type:      "Create",
+		Actor:     app.actorURL(author.ID),
+		Object:    object,
+		Published: p.CreatedAt,
+		To:        note.To,
+		Cc:        note.Cc,
+	}
+}
+
+// actorKey returns the key pair of a user, generating it on first use.
+func (app *application) actorKey(ctx context.Context, userID int64) (*store.ActorKey, error) {
+	key, err := app.store.ActivityPub.GetKey(ctx, userID)
+	if err == nil || !errors.Is(err, store.ErrResourceNotFound) {
+		return key, err
+	}
+
+	private, public, err := activitypub.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return app.store.ActivityPub.SaveKey(ctx, &store.ActorKey{
+		UserID:        userID,
+		PublicKeyPem:  public,
+		PrivateKeyPem: private,
+	})
+}
+
+// Inbox godoc
+//
+//	@Summary		Receives activities
+//	@Description	Receives Follow, Undo, Like and Create activities from remote servers. Requests
+//	@Description	must carry an HTTP Signature of the actor covering the date and the body digest
+//	@Tags			activitypub
+//	@Accept			json
+//	@Param			userID	path		int		true	"User ID"
+//	@Success		202		{string}	string	"Activity accepted"
+//	@Failure		400		{object}	error
+//	@Failure		401		{object}	error
+//	@Failure		404		{object}	error
+//	@Failure		500		{object}	error
+//	@Router			/ap/users/{userID}/inbox [post]
+func (app *application) inboxHandler(w http.ResponseWriter, r *http.Request) {
+	user := getTargetUserFromContext(r)
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxActivitySize))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	actor, err := app.verifyActivitySignature(r, body)
+	if err != nil {
+		app.unauthorized(w, r, err)
+		return
+	}
+
+	var activity activitypub.Activity
+	if err := json.Unmarshal(body, &activity); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if activity.Actor != actor.URI {
+		app.unauthorized(w, r, errors.New("activity was not signed by its actor"))
+		return
+	}
+
+	ctx := r.Context()
+
+	switch activity.Type {
+	case "Follow":
+		err = app.handleFollowActivity(ctx, user, actor, &activity, body)
+	case "Undo":
+		err = app.handleUndoActivity(ctx, user, actor, &activity)
+	case "Like":
+		err = app.handleLikeActivity(ctx, actor, &activity)
+	case "Create":
+		err = app.handleCreateActivity(ctx, actor, &activity)
+	default:
+		app.logger.Infow("ignoring activity", "type", activity.Type, "actor", actor.URI)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrResourceNotFound):
+			app.notFound(w, r, err)
+		case errors.Is(err, errInvalidActivity):
+			app.badRequest(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+var errInvalidActivity = errors.New("invalid activity")
+
+// verifyActivitySignature checks the HTTP Signature of an inbox request and
+// returns the remote actor who signed it. Actors are fetched and cached on
+// first contact, and fetched again when their cached key no longer verifies,
+// in case it was rotated, at most once per actorRefetchInterval.
+func (app *application) verifyActivitySignature(r *http.Request, body []byte) (*store.RemoteActor, error) {
+	sig, err := activitypub.ParseSignature(r)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := r.Context()
+
+	actor, err := app.store.ActivityPub.GetRemoteActorByKeyID(ctx, sig.KeyID)
+	if err == nil {
+		key, err := activitypub.ParsePublicKey(actor.PublicKeyPem)
+		if err == nil && sig.Verify(r, body, key) == nil {
+			return actor, nil
+		}
+
+		fetchedAt, err := time.Parse(time.RFC3339Nano, actor.FetchedAt)
+		if err == nil && time.Since(fetchedAt) < actorRefetchInterval {
+			return nil, activitypub.ErrInvalidSignature
+		}
+	} else if !errors.Is(err, store.ErrResourceNotFound) {
+		return nil, err
+	}
+
+	actor, err = app.fetchRemoteActor(ctx, sig.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := activitypub.ParsePublicKey(actor.PublicKeyPem)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sig.Verify(r, body, key); err != nil {
+		return nil, err
+	}
+	return actor, nil
+}
+
+func (app *application) fetchRemoteActor(ctx context.Context, keyID string) (*store.RemoteActor, error) {
+	remote, err := app.federation.FetchActor(ctx, keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	if remote.PublicKey.ID != keyID || remote.PublicKey.Owner != remote.ID {
+		return nil, fmt.Errorf("key %s does not belong to actor %s", keyID, remote.ID)
+	}
+
+	// A server can only vouch for its own actors, or it could sign activities
+	// for the actors of another one and have us deliver to its inbox
+	urls := []string{remote.ID, keyID, remote.Inbox}
+	if remote.Endpoints != nil && remote.Endpoints.SharedInbox != "" {
+		urls = append(urls, remote.Endpoints.SharedInbox)
+	}
+	if !activitypub.SameOrigin(urls...) {
+		return nil, fmt.Errorf("actor %s is not served from the origin of key %s", remote.ID, keyID)
+	}
+
+	actor := &store.RemoteActor{
+		URI:          remote.ID,
+		Username:     remote.PreferredUsername,
+		Inbox:        remote.Inbox,
+		KeyID:        remote.PublicKey.ID,
+		PublicKeyPem: remote.PublicKey.PublicKeyPem,
+	}
+	if remote.Endpoints != nil && remote.Endpoints.SharedInbox != "" {
+		actor.SharedInbox = &remote.Endpoints.SharedInbox
+	}
+
+	if err := app.store.ActivityPub.SaveRemoteActor(ctx, actor); err != nil {
+		return nil, err
+	}
+	return actor, nil
+}
+
+// handleFollowActivity adds the remote actor to the followers of the user and
+// answers with an Accept.
+func (app *application) handleFollowActivity(ctx context.Context, user *store.User, actor *store.RemoteActor, activity *activitypub.Activity, body []byte) error {
+	if activity.ObjectID() != app.actorURL(user.ID) {
+		return fmt.Errorf("%w: follow is not for this actor", errInvalidActivity)
+	}
+
+	if err := app.store.ActivityPub.AddRemoteFollower(ctx, user.ID, actor.ID, activity.ID); err != nil {
+		return err
+	}
+
+	accept, err := json.Marshal(activitypub.Activity{
+		Context: activitypub.Context,
+		ID:      fmt.Sprintf("%s#accepts/follows/%d", app.actorURL(user.ID), actor.ID),
+		Type:    "Accept",
+		Actor:   app.actorURL(user.ID),
+		Object:  body,
+	})
+	if err != nil {
+		return err
+	}
+	return app.store.ActivityPub.EnqueueDelivery(ctx, user.ID, actor.Inbox, accept)
+}
+
+// handleUndoActivity undoes a Like or a Follow of the actor, matched by the URI
+// of the activity being undone. Undos of anything else are ignored.
+func (app *application) handleUndoActivity(ctx context.Context, user *store.User, actor *store.RemoteActor, activity *activitypub.Activity) error {
+	uri := activity.ObjectID()
+	if uri == "" {
+		return fmt.Errorf("%w: undo has no object", errInvalidActivity)
+	}
+
+	err := app.store.ActivityPub.RemoveRemoteReaction(ctx, actor.ID, uri)
+	if !errors.Is(err, store.ErrResourceNotFound) {
+		return err
+	}
+
+	err = app.store.ActivityPub.RemoveRemoteFollower(ctx, user.ID, actor.ID, uri)
+	if errors.Is(err, store.ErrResourceNotFound) {
+		app.logger.Infow("ignoring undo of an unknown activity", "object", uri, "actor", actor.URI)
+		return nil
+	}
+	return err
+}
+
+func (app *application) handleLikeActivity(ctx context.Context, actor *store.RemoteActor, activity *activitypub.Activity) error {
+	post, err := app.federatedPost(ctx, activity.ObjectID())
+	if err != nil {
+		return err
+	}
+
+	err = app.store.ActivityPub.AddRemoteReaction(ctx, post.ID, actor.ID, activity.ID)
+	if errors.Is(err, store.ErrConflict) {
+		return nil
+	}
+	return err
+}
+
+// handleCreateActivity keeps the notes replying to local posts. Other objects
+// are not stored. The content is kept as sent and must be sanitized before it
+// is ever rendered as HTML.
+func (app *application) handleCreateActivity(ctx context.Context, actor *store.RemoteActor, activity *activitypub.Activity) error {
+	note := activity.EmbeddedNote()
+	if note == nil || note.InReplyTo == "" {
+		return nil
+	}
+
+	if note.AttributedTo != actor.URI {
+		return fmt.Errorf("%w: note is not attributed to its sender", errInvalidActivity)
+	}
+
+	post, err := app.federatedPost(ctx, note.InReplyTo)
+	if err != nil {
+		if errors.Is(err, errInvalidActivity) {
+			return nil
+		}
+		return err
+	}
+
+	return app.store.ActivityPub.AddRemoteReply(ctx, post.ID, actor.ID, note.ID, note.Content)
+}
+
+// federatedPost returns the public local post a note URL points to.
+func (app *application) federatedPost(ctx context.Context, uri string) (*store.Post, error) {
+	id, ok := app.postIDFromNoteURL(uri)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is not a local post", errInvalidActivity, uri)
+	}
+
+	post, err := app.store.Posts.GetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if post.Visibility != "public" {
+		return nil, store.ErrResourceNotFound
+	}
+	return post, nil
+}
+
+// deliverActivitiesJob posts the queued activities to remote inboxes, signed
+// with the key of the user they are sent for. Failed deliveries are retried
+// with an exponential backoff until they run out of attempts.
+func (app *application) deliverActivitiesJob(ctx context.Context, args deliverActivitiesArgs) error {
+	for {
+		n, err := app.deliverActivities(ctx)
+		if err != nil {
+			return err
+		}
+
+		if n < app.config.activityPub.deliveryBatch {
+			return nil
+		}
+	}
+}
+
+// deliverActivities sends a batch of the deliveries that are due and returns
+// how many it claimed.
+func (app *application) deliverActivities(ctx context.Context) (int, error) {
+	deliveries, err := app.store.ActivityPub.ClaimDeliveries(ctx, app.config.activityPub.deliveryBatch)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, d := range deliveries {
+		err := app.deliverActivity(ctx, &d)
+		if errors.Is(err, errActivityDropped) {
+			app.logger.Infow("dropped activity delivery", "id", d.ID, "inbox", d.Inbox)
+		} else if err != nil {
+			app.logger.Warnw("error delivering activity", "inbox", d.Inbox, "attempts", d.Attempts, "error", err)
+
+			if err := app.store.ActivityPub.MarkFailed(ctx, &d, err); err != nil {
+				app.logger.Errorw("error rescheduling activity delivery", "id", d.ID, "error", err)
+			}
+			continue
+		}
+
+		if err := app.store.ActivityPub.MarkDelivered(ctx, d.ID); err != nil {
+			app.logger.Errorw("error marking activity delivered", "id", d.ID, "error", err)
+		}
+	}
+	return len(deliveries), nil
+}
+
+func (app *application) deliverActivity(ctx context.Context, d *store.ActivityDelivery) error {
+	payload := d.Payload
+
+	if d.PostID != nil {
+		post, err := app.store.Posts.GetByID(ctx, *d.PostID)
+		if errors.Is(err, store.ErrResourceNotFound) {
+			return errActivityDropped
+		}
+		if err != nil {
+			return err
+		}
+
+		if post.Visibility != "public" {
+			return errActivityDropped
+		}
+
+		author, err := app.store.Users.GetByID(ctx, post.UserID)
+		if err != nil {
+			return err
+		}
+
+		activity := app.createActivity(post, author)
+		activity.Context = activitypub.Context
+
+		payload, err = json.Marshal(activity)
+		if err != nil {
+			return err
+		}
+	}
+
+	key, err := app.actorKey(ctx, d.UserID)
+	if err != nil {
+		return err
+	}
+
+	private, err := activitypub.ParsePrivateKey(key.PrivateKeyPem)
+	if err != nil {
+		return err
+	}
+
+	return app.federation.Deliver(ctx, d.Inbox, payload, app.actorURL(d.UserID)+"#main-key", private)
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"com.github/jrovieri/golang/social/internal/activitypub"
+	"com.github/jrovieri/golang/social/internal/netguard"
+	"com.github/jrovieri/golang/social/internal/store"
+	"go.uber.org/zap"
+)
+
+// fakeActivityPubStore keeps in memory what the inbox stores.
+type fakeActivityPubStore struct {
+	actors     map[string]*store.RemoteActor
+	followers  map[int64]string
+	deliveries []activitypub.Activity
+
+	// claimable deliveries, and the ids of those marked delivered or failed
+	claimable []store.ActivityDelivery
+	delivered []int64
+	failed    []int64
+}
+
+func newFakeActivityPubStore() *fakeActivityPubStore {
+	return &fakeActivityPubStore{
+		actors:    map[string]*store.RemoteActor{},
+		followers: map[int64]string{},
+	}
+}
+
+func (s *fakeActivityPubStore) GetKey(context.Context, int64) (*store.ActorKey, error) {
+	return nil, store.ErrResourceNotFound
+}
+
+func (s *fakeActivityPubStore) SaveKey(_ context.Context, key *store.ActorKey) (*store.ActorKey, error) {
+	return key, nil
+}
+
+func (s *fakeActivityPubStore) GetRemoteActorByKeyID(_ context.Context, keyID string) (*store.RemoteActor, error) {
+	actor, ok := s.actors[keyID]
+	if !ok {
+		return nil, store.ErrResourceNotFound
+	}
+	return actor, nil
+}
+
+func (s *fakeActivityPubStore) SaveRemoteActor(_ context.Context, a *store.RemoteActor) error {
+	a.ID = int64(len(s.actors) + 1)
+	a.FetchedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	s.actors[a.KeyID] = a
+	return nil
+}
+
+func (s *fakeActivityPubStore) AddRemoteFollower(_ context.Context, userID, actorID int64, activityURI string) error {
+	s.followers[actorID] = activityURI
+	return nil
+}
+
+func (s *fakeActivityPubStore) RemoveRemoteFollower(_ context.Context, userID, actorID int64, activityURI string) error {
+	if s.followers[actorID] != activityURI {
+		return store.ErrResourceNotFound
+	}
+	delete(s.followers, actorID)
+	return nil
+}
+
+func (s *fakeActivityPubStore) CountRemoteFollowers(context.Context, int64) (int, error) {
+	return len(s.followers), nil
+}
+
+func (s *fakeActivityPubStore) AddRemoteReaction(context.Context, int64, int64, string) error {
+	return nil
+}
+
+func (s *fakeActivityPubStore) RemoveRemoteReaction(context.Context, int64, string) error {
+	return store.ErrResourceNotFound
+}
+
+func (s *fakeActivityPubStore) AddRemoteReply(context.Context, int64, int64, string, string) error {
+	return nil
+}
+
+func (s *fakeActivityPubStore) EnqueueDelivery(_ context.Context, userID int64, inbox string, payload []byte) error {
+	var activity activitypub.Activity
+	if err := json.Unmarshal(payload, &activity); err != nil {
+		return err
+	}
+	s.deliveries = append(s.deliveries, activity)
+	return nil
+}
+
+func (s *fakeActivityPubStore) ClaimDeliveries(context.Context, int) ([]store.ActivityDelivery, error) {
+	claimed := s.claimable
+	s.claimable = nil
+	return claimed, nil
+}
+
+func (s *fakeActivityPubStore) MarkDelivered(_ context.Context, id int64) error {
+	s.delivered = append(s.delivered, id)
+	return nil
+}
+
+func (s *fakeActivityPubStore) MarkFailed(_ context.Context, d *store.ActivityDelivery, _ error) error {
+	s.failed = append(s.failed, d.ID)
+	return nil
+}
+
+func (s *fakeActivityPubStore) PruneDeliveries(context.Context, time.Duration) (int64, error) {
+	return 0, nil
+}
+
+// fakePostStore serves the posts it holds by id.
+type fakePostStore struct {
+	posts map[int64]*store.Post
+}
+
+func (s *fakePostStore) Create(context.Context, *store.Post) error { return nil }
+
+func (s *fakePostStore) GetByID(_ context.Context, id int64) (*store.Post, error) {
+	post, ok := s.posts[id]
+	if !ok {
+		return nil, store.ErrResourceNotFound
+	}
+	return post, nil
+}
+
+func (s *fakePostStore) Update(context.Context, *store.Post) error { return nil }
+
+func (s *fakePostStore) Delete(context.Context, int64) error { return nil }
+
+func (s *fakePostStore) GetUserFeed(context.Context, int64, store.PaginatedFeedQuery) (*store.FeedPage, error) {
+	return nil, nil
+}
+
+func (s *fakePostStore) GetRankedFeed(context.Context, int64, store.PaginatedFeedQuery, store.RankingWeights) (*store.FeedPage, error) {
+	return nil, nil
+}
+
+func (s *fakePostStore) GetUserPosts(context.Context, int64, int64, store.PaginatedFeedQuery) (*store.FeedPage, error) {
+	return nil, nil
+}
+
+func (s *fakePostStore) GetPublicTimeline(context.Context, int64, store.PaginatedFeedQuery) (*store.FeedPage, error) {
+	return nil, nil
+}
+
+// remoteServer serves the actor bob of another server. inbox overrides the
+// inbox bob claims to have.
+type remoteServer struct {
+	*httptest.Server
+	key     string
+	fetches atomic.Int32
+}
+
+func newRemoteServer(t *testing.T, inbox string) *remoteServer {
+	t.Helper()
+
+	private, public, err := activitypub.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote := &remoteServer{key: private}
+	remote.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote.fetches.Add(1)
+
+		id := remote.URL + "/users/bob"
+		actor := activitypub.Actor{
+			ID:                id,
+			Type:              "Person",
+			PreferredUsername: "bob",
+			Inbox:             id + "/inbox",
+			PublicKey:         activitypub.PublicKey{ID: id + "#main-key", Owner: id, PublicKeyPem: public},
+		}
+		if inbox != "" {
+			actor.Inbox = inbox
+		}
+		writeActivityJSON(w, http.StatusOK, actor)
+	}))
+	t.Cleanup(remote.Close)
+	return remote
+}
+
+func (s *remoteServer) actorURL() string {
+	return s.URL + "/users/bob"
+}
+
+func newFederatedApplication(apStore *fakeActivityPubStore) *application {
+	return &application{
+		config: config{
+			activityPub: activityPubConfig{baseURL: "https://local.example"},
+		},
+		store:      store.Storage{ActivityPub: apStore},
+		logger:     zap.NewNop().Sugar(),
+		federation: activitypub.NewClient(5*time.Second, true),
+	}
+}
+
+// postToInbox posts an activity of bob to the inbox of the local user alice,
+// signed with the key of bob.
+func postToInbox(t *testing.T, app *application, remote *remoteServer, activity any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body, err := json.Marshal(activity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := activitypub.ParsePrivateKey(remote.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := &store.User{ID: 1, Username: "alice"}
+	r := httptest.NewRequest(http.MethodPost, app.actorURL(alice.ID)+"/inbox", strings.NewReader(string(body)))
+	if err := activitypub.Sign(r, body, remote.actorURL()+"#main-key", key); err != nil {
+		t.Fatal(err)
+	}
+	r = r.WithContext(context.WithValue(r.Context(), targetUserCtx, alice))
+
+	w := httptest.NewRecorder()
+	app.inboxHandler(w, r)
+	return w
+}
+
+func TestInboxFollowAndUndo(t *testing.T) {
+	apStore := newFakeActivityPubStore()
+	app := newFederatedApplication(apStore)
+	remote := newRemoteServer(t, "")
+
+	follow := map[string]any{
+		"id":     remote.URL + "/follows/1",
+		"type":   "Follow",
+		"actor":  remote.actorURL(),
+		"object": app.actorURL(1),
+	}
+
+	if w := postToInbox(t, app, remote, follow); w.Code != http.StatusAccepted {
+		t.Fatalf("follow: status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+
+	actor, err := apStore.GetRemoteActorByKeyID(context.Background(), remote.actorURL()+"#main-key")
+	if err != nil {
+		t.Fatalf("actor was not stored: %v", err)
+	}
+
+	if got := apStore.followers[actor.ID]; got != follow["id"] {
+		t.Fatalf("follow activity = %q, want %q", got, follow["id"])
+	}
+
+	if len(apStore.deliveries) != 1 || apStore.deliveries[0].Type != "Accept" {
+		t.Fatalf("deliveries = %+v, want one Accept", apStore.deliveries)
+	}
+
+	// An Undo of some other activity leaves the follow alone
+	undoOther := map[string]any{
+		"id":     remote.URL + "/undos/1",
+		"type":   "Undo",
+		"actor":  remote.actorURL(),
+		"object": remote.URL + "/follows/2",
+	}
+
+	if w := postToInbox(t, app, remote, undoOther); w.Code != http.StatusAccepted {
+		t.Fatalf("undo of another activity: status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+
+	if _, ok := apStore.followers[actor.ID]; !ok {
+		t.Fatal("undo of another activity removed the follow")
+	}
+
+	undo := map[string]any{
+		"id":     remote.URL + "/undos/2",
+		"type":   "Undo",
+		"actor":  remote.actorURL(),
+		"object": follow,
+	}
+
+	if w := postToInbox(t, app, remote, undo); w.Code != http.StatusAccepted {
+		t.Fatalf("undo: status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+
+	if _, ok := apStore.followers[actor.ID]; ok {
+		t.Fatal("undo did not remove the follow")
+	}
+
+	// The actor is cached after the first activity
+	if n := remote.fetches.Load(); n != 1 {
+		t.Errorf("actor fetched %d times, want 1", n)
+	}
+}
+
+func TestInboxRefusesActorsOfAnotherOrigin(t *testing.T) {
+	apStore := newFakeActivityPubStore()
+	app := newFederatedApplication(apStore)
+
+	// bob claims an inbox on a server that does not host him
+	remote := newRemoteServer(t, "https://victim.example/inbox")
+
+	follow := map[string]any{
+		"id":     remote.URL + "/follows/1",
+		"type":   "Follow",
+		"actor":  remote.actorURL(),
+		"object": app.actorURL(1),
+	}
+
+	if w := postToInbox(t, app, remote, follow); w.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	if len(apStore.actors) != 0 || len(apStore.deliveries) != 0 {
+		t.Errorf("actor of another origin was stored or answered")
+	}
+}
+
+func TestInboxRejectsForgedSignatures(t *testing.T) {
+	apStore := newFakeActivityPubStore()
+	app := newFederatedApplication(apStore)
+	remote := newRemoteServer(t, "")
+
+	follow := map[string]any{
+		"id":     remote.URL + "/follows/1",
+		"type":   "Follow",
+		"actor":  remote.actorURL(),
+		"object": app.actorURL(1),
+	}
+
+	if w := postToInbox(t, app, remote, follow); w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+
+	// Someone else signs as bob
+	forger := newRemoteServer(t, "")
+	forger.Server.URL = remote.URL
+
+	for range 3 {
+		if w := postToInbox(t, app, forger, follow); w.Code != http.StatusUnauthorized {
+			t.Fatalf("forged: status = %d, want %d", w.Code, http.StatusUnauthorized)
+		}
+	}
+
+	// The cached actor is recent, so bob is not fetched again
+	if n := remote.fetches.Load(); n != 1 {
+		t.Errorf("actor fetched %d times, want 1", n)
+	}
+}
+
+func TestFederationRefusesPrivateAddresses(t *testing.T) {
+	remote := newRemoteServer(t, "")
+
+	client := activitypub.NewClient(5*time.Second, false)
+	client.AllowHTTP = true
+
+	_, err := client.FetchActor(context.Background(), remote.actorURL())
+	if !errors.Is(err, netguard.ErrForbiddenAddress) {
+		t.Fatalf("FetchActor() = %v, want %v", err, netguard.ErrForbiddenAddress)
+	}
+
+	if n := remote.fetches.Load(); n != 0 {
+		t.Errorf("server was reached %d times", n)
+	}
+}
+
+func TestDeliveriesOfWithdrawnPostsAreDropped(t *testing.T) {
+	apStore := newFakeActivityPubStore()
+	app := newFederatedApplication(apStore)
+	app.store.Posts = &fakePostStore{posts: map[int64]*store.Post{
+		1: {ID: 1, UserID: 1, Visibility: "followers"},
+	}}
+
+	// Post 1 was made followers only and post 2 was deleted after they were
+	// queued. Sending them would fail, since alice has no key.
+	private, deleted := int64(1), int64(2)
+	apStore.claimable = []store.ActivityDelivery{
+		{ID: 10, UserID: 1, Inbox: "https://remote.example/inbox", PostID: &private},
+		{ID: 11, UserID: 1, Inbox: "https://remote.example/inbox", PostID: &deleted},
+	}
+
+	n, err := app.deliverActivities(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("deliverActivities() = %d, want 2", n)
+	}
+
+	if len(apStore.delivered) != 2 || len(apStore.failed) != 0 {
+		t.Errorf("delivered %v and failed %v, want both delivered", apStore.delivered, apStore.failed)
+	}
+}
@@ -1,14 +1,26 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"com.github/jrovieri/golang/social/docs"
+	"com.github/jrovieri/golang/social/internal/activitypub"
 	"com.github/jrovieri/golang/social/internal/auth"
+	"com.github/jrovieri/golang/social/internal/event"
+	"com.github/jrovieri/golang/social/internal/job"
 	"com.github/jrovieri/golang/social/internal/mailer"
 	"com.github/jrovieri/golang/social/internal/store"
+	"com.github/jrovieri/golang/social/internal/stream"
+	"com.github/jrovieri/golang/social/internal/webhook"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"go.uber.org/zap"
@@ -22,6 +34,17 @@ type application struct {
 	logger       *zap.SugaredLogger
 	mailer       mailer.Client
 	autheticator auth.Authenticator
+	federation   *activitypub.Client
+	streams      *stream.Hub
+	webhooks     *webhook.Client
+	jobs         *job.Client
+	events       *event.Bus
+	relay        *event.Relay
+
+	// ready is false until the server starts and once it shuts down
+	ready       atomic.Bool
+	workers     sync.WaitGroup
+	stopWorkers context.CancelFunc
 }
 
 type config struct {
@@ -32,6 +55,28 @@ type config struct {
 	mail        mailConfig
 	auth        authConfig
 	frontendURL string
+	trending    trendingConfig
+	pagination  paginationConfig
+	feed        feedConfig
+	search      searchConfig
+	suggestions suggestionsConfig
+	activityPub activityPubConfig
+	stream      streamConfig
+	webhooks    webhooksConfig
+	jobs        jobsConfig
+	events      eventsConfig
+	shutdown    shutdownConfig
+
+	notificationEmails notificationEmailsConfig
+}
+
+type shutdownConfig struct {
+	// delay is how long the replica reports it is not ready before it
+	// drains, for load balancers to stop sending it requests
+	delay time.Duration
+	// timeout bounds the whole shutdown, from draining the requests to
+	// stopping the workers
+	timeout time.Duration
 }
 
 type dbConfig struct {
@@ -57,10 +102,160 @@ type authConfig struct {
 	token tokenConfig
 }
 
+type feedConfig struct {
+	fanoutThreshold int
+	fanoutInterval  time.Duration
+	fanoutBatch     int
+	ranking         store.RankingWeights
+}
+
+type suggestionsConfig struct {
+	interval time.Duration
+	maxAge   time.Duration
+	batch    int
+}
+
+type activityPubConfig struct {
+	baseURL           string
+	allowHTTP         bool
+	deliveryInterval  time.Duration
+	deliveryBatch     int
+	deliveryRetention time.Duration
+}
+
+type streamConfig struct {
+	heartbeat    time.Duration
+	writeTimeout time.Duration
+	retry        time.Duration
+	batch        int
+	retention    time.Duration
+}
+
+type jobsConfig struct {
+	workers  int
+	interval time.Duration
+	lease    time.Duration
+}
+
+type eventsConfig struct {
+	interval  time.Duration
+	batch     int
+	timeout   time.Duration
+	retention time.Duration
+}
+
+type webhooksConfig struct {
+	interval  time.Duration
+	batch     int
+	timeout   time.Duration
+	insecure  bool
+	retention time.Duration
+}
+
+type searchConfig struct {
+	language string
+}
+
+type paginationConfig struct {
+	cursorSecret string
+}
+
+type trendingConfig struct {
+	interval time.Duration
+}
+
 type mailConfig struct {
-	apiKey    string
-	fromEmail string
-	exp       time.Duration
+	apiKey            string
+	fromEmail         string
+	exp               time.Duration
+	linkBaseURL       string
+	unsubscribeSecret string
+	unsubscribeMaxAge time.Duration
+	outboxRetention   time.Duration
+	provider          string
+	smtp              mailer.SMTPConfig
+	dir               string
+}
+
+type notificationEmailsConfig struct {
+	interval       time.Duration
+	batch          int
+	digestInterval time.Duration
+}
+
+// validate checks the settings the server cannot run with once they are zero
+// or negative: the intervals and batches of the workers, which tick and drain
+// their queues forever, the half-life the ranked feed divides by and the max
+// age of unsubscribe links. In production, the mail provider must be picked,
+// so emails are not printed to the logs by mistake, and the secrets must be
+// set, since their development default would let anyone forge what they sign.
+func (cfg *config) validate() error {
+	if cfg.env == "production" {
+		if cfg.mail.provider == "" {
+			return errors.New("MAIL_PROVIDER is required in production")
+		}
+
+		secrets := []struct {
+			name  string
+			value string
+		}{
+			{"MAIL_UNSUBSCRIBE_SECRET", cfg.mail.unsubscribeSecret},
+			{"CURSOR_SECRET", cfg.pagination.cursorSecret},
+		}
+		for _, s := range secrets {
+			if s.value == "" || s.value == "development" {
+				return fmt.Errorf("%s is required in production", s.name)
+			}
+		}
+	}
+
+	intervals := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"TRENDING_INTERVAL", cfg.trending.interval},
+		{"FEED_FANOUT_INTERVAL", cfg.feed.fanoutInterval},
+		{"SUGGESTIONS_INTERVAL", cfg.suggestions.interval},
+		{"AP_DELIVERY_INTERVAL", cfg.activityPub.deliveryInterval},
+		{"WEBHOOKS_INTERVAL", cfg.webhooks.interval},
+		{"NOTIFICATION_EMAILS_INTERVAL", cfg.notificationEmails.interval},
+		{"NOTIFICATION_DIGEST_INTERVAL", cfg.notificationEmails.digestInterval},
+		{"STREAM_HEARTBEAT", cfg.stream.heartbeat},
+		{"JOBS_INTERVAL", cfg.jobs.interval},
+		{"EVENTS_INTERVAL", cfg.events.interval},
+	}
+	for _, i := range intervals {
+		if i.value <= 0 {
+			return fmt.Errorf("%s must be positive, got %s", i.name, i.value)
+		}
+	}
+
+	if cfg.feed.ranking.HalfLife <= 0 {
+		return fmt.Errorf("FEED_RANK_HALF_LIFE must be positive, got %s", cfg.feed.ranking.HalfLife)
+	}
+
+	if cfg.mail.unsubscribeMaxAge <= 0 {
+		return fmt.Errorf("MAIL_UNSUBSCRIBE_MAX_AGE must be positive, got %s", cfg.mail.unsubscribeMaxAge)
+	}
+
+	batches := []struct {
+		name  string
+		value int
+	}{
+		{"FEED_FANOUT_BATCH", cfg.feed.fanoutBatch},
+		{"SUGGESTIONS_BATCH", cfg.suggestions.batch},
+		{"AP_DELIVERY_BATCH", cfg.activityPub.deliveryBatch},
+		{"WEBHOOKS_BATCH", cfg.webhooks.batch},
+		{"NOTIFICATION_EMAILS_BATCH", cfg.notificationEmails.batch},
+		{"STREAM_BATCH", cfg.stream.batch},
+		{"EVENTS_BATCH", cfg.events.batch},
+	}
+	for _, b := range batches {
+		if b.value <= 0 {
+			return fmt.Errorf("%s must be positive, got %d", b.name, b.value)
+		}
+	}
+	return nil
 }
 
 func (app *application) mount() http.Handler {
@@ -68,43 +263,163 @@ func (app *application) mount() http.Handler {
 
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
+	// The token streams take as a parameter must not reach the logs
+	r.Use(app.redactTokenMiddleware)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
-	r.Use(middleware.Timeout(60 * time.Second))
 
-	r.Route("/v1", func(r chi.Router) {
-		r.With(app.BasicAuthMiddleware()).Get("/health", app.healthCheckHandler)
+	// Streams outlive any request timeout, so it only applies to the other routes
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.Timeout(60 * time.Second))
 
-		docsURL := fmt.Sprintf("%s/swagger/doc.json", app.config.addr)
-		r.Get("/swagger/*", httpSwagger.Handler(httpSwagger.URL(docsURL)))
+		r.Get("/.well-known/webfinger", app.webfingerHandler)
 
-		r.Route("/posts", func(r chi.Router) {
-			r.Use(app.AuthTokenMiddleware())
-			r.Post("/", app.createPostHandler)
+		r.Route("/ap", func(r chi.Router) {
+			r.Get("/posts/{postID}", app.getNoteHandler)
 
-			r.Route("/{postID}", func(r chi.Router) {
-				r.Use(app.postsContextMiddleware)
-				r.Get("/", app.getPostHandler)
-				r.Patch("/", app.updatePostHandler)
-				r.Delete("/", app.deletePostHandler)
-				r.Post("/comments", app.createPostCommentHandler)
+			r.Route("/users/{userID}", func(r chi.Router) {
+				r.Use(app.usersContextMiddleware)
+				r.Get("/", app.getActorHandler)
+				r.Get("/outbox", app.getOutboxHandler)
+				r.Get("/followers", app.getFollowersHandler)
+				r.Post("/inbox", app.inboxHandler)
 			})
 		})
+	})
+
+	r.Route("/v1", func(r chi.Router) {
+		r.With(app.streamTokenMiddleware, app.AuthTokenMiddleware()).Get("/stream", app.streamHandler)
+
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.Timeout(60 * time.Second))
+
+			r.Get("/ready", app.readinessHandler)
+			r.With(app.BasicAuthMiddleware()).Get("/health", app.healthCheckHandler)
+			r.With(app.BasicAuthMiddleware()).Get("/jobs", app.getJobStatsHandler)
 
-		r.Route("/users", func(r chi.Router) {
-			r.Route("/{userID}", func(r chi.Router) {
+			docsURL := fmt.Sprintf("%s/swagger/doc.json", app.config.addr)
+			r.Get("/swagger/*", httpSwagger.Handler(httpSwagger.URL(docsURL)))
+
+			r.Route("/posts", func(r chi.Router) {
 				r.Use(app.AuthTokenMiddleware())
-				r.Get("/", app.getUserHandler)
-				r.Put("/follow", app.followUserHandler)
-				r.Put("/unfollow", app.unfollowUserHandler)
-				r.Get("/feed", app.getUserFeedHandler)
+				r.Post("/", app.createPostHandler)
+
+				r.Route("/{postID}", func(r chi.Router) {
+					r.Use(app.postsContextMiddleware)
+					r.Get("/", app.getPostHandler)
+					r.Patch("/", app.updatePostHandler)
+					r.Delete("/", app.deletePostHandler)
+					r.Get("/comments", app.getPostCommentsHandler)
+					r.Post("/comments", app.createPostCommentHandler)
+
+					r.Route("/comments/{commentID}", func(r chi.Router) {
+						r.Use(app.commentsContextMiddleware)
+						r.Patch("/", app.checkCommentOwnership("", app.updateCommentHandler))
+						r.Delete("/", app.checkCommentOwnership("moderator", app.deleteCommentHandler))
+						r.Put("/react", app.reactCommentHandler)
+						r.Put("/unreact", app.unreactCommentHandler)
+					})
+				})
 			})
-		})
 
-		r.Route("/auth", func(r chi.Router) {
-			r.Post("/", app.registerUserHandler)
-			r.Put("/activate/{token}", app.activateUserHandler)
-			r.Post("/token", app.createTokenHandler)
+			r.Route("/users", func(r chi.Router) {
+				r.With(app.AuthTokenMiddleware()).Get("/suggestions", app.getSuggestionsHandler)
+
+				r.Route("/{userID}", func(r chi.Router) {
+					r.Use(app.AuthTokenMiddleware())
+					r.With(app.usersContextMiddleware).Get("/", app.getUserHandler)
+					r.With(app.usersContextMiddleware).Get("/posts", app.getUserPostsHandler)
+					r.Put("/follow", app.followUserHandler)
+					r.Put("/unfollow", app.unfollowUserHandler)
+					r.Put("/block", app.blockUserHandler)
+					r.Put("/unblock", app.unblockUserHandler)
+					r.Get("/feed", app.getUserFeedHandler)
+					r.Get("/mentions", app.getUserMentionsHandler)
+				})
+			})
+
+			r.Route("/tags", func(r chi.Router) {
+				r.Use(app.AuthTokenMiddleware())
+				r.Get("/", app.searchTagsHandler)
+
+				r.Route("/{tag}", func(r chi.Router) {
+					r.Get("/posts", app.getTagPostsHandler)
+					r.Put("/follow", app.followTagHandler)
+					r.Put("/unfollow", app.unfollowTagHandler)
+				})
+			})
+
+			r.Route("/trending", func(r chi.Router) {
+				r.Use(app.AuthTokenMiddleware())
+				r.Get("/tags", app.getTrendingTagsHandler)
+				r.Get("/posts", app.getTrendingPostsHandler)
+			})
+
+			r.Route("/notifications", func(r chi.Router) {
+				r.Use(app.AuthTokenMiddleware())
+				r.Get("/", app.getNotificationsHandler)
+				r.Get("/unread-count", app.getUnreadNotificationsCountHandler)
+				r.Put("/read", app.readAllNotificationsHandler)
+				r.Put("/{notificationID}/read", app.readNotificationHandler)
+			})
+
+			r.Route("/webhooks", func(r chi.Router) {
+				r.Use(app.AuthTokenMiddleware())
+				r.Post("/", app.createWebhookHandler)
+				r.Get("/", app.getWebhooksHandler)
+
+				r.Route("/{webhookID}", func(r chi.Router) {
+					r.Use(app.webhooksContextMiddleware)
+					r.Get("/", app.getWebhookHandler)
+					r.Patch("/", app.updateWebhookHandler)
+					r.Delete("/", app.deleteWebhookHandler)
+					r.Get("/deliveries", app.getWebhookDeliveriesHandler)
+					r.Post("/deliveries/{deliveryID}/redeliver", app.redeliverWebhookHandler)
+				})
+			})
+
+			r.Route("/conversations", func(r chi.Router) {
+				r.Use(app.AuthTokenMiddleware())
+				r.Post("/", app.createConversationHandler)
+				r.Get("/", app.getConversationsHandler)
+				r.Get("/settings", app.getMessageSettingsHandler)
+				r.Put("/settings", app.updateMessageSettingsHandler)
+
+				r.Route("/{conversationID}", func(r chi.Router) {
+					r.Use(app.conversationsContextMiddleware)
+					r.Get("/", app.getConversationHandler)
+					r.Get("/messages", app.getMessagesHandler)
+					r.Post("/messages", app.sendMessageHandler)
+					r.Put("/read", app.readConversationHandler)
+				})
+			})
+
+			r.Route("/email", func(r chi.Router) {
+				r.With(app.AuthTokenMiddleware()).Get("/preferences", app.getEmailPreferencesHandler)
+				r.With(app.AuthTokenMiddleware()).Put("/preferences", app.updateEmailPreferencesHandler)
+				r.Get("/unsubscribe", app.unsubscribePageHandler)
+				r.Post("/unsubscribe", app.unsubscribeHandler)
+
+				r.Route("/templates", func(r chi.Router) {
+					r.Use(app.AuthTokenMiddleware())
+					r.Get("/", app.checkRole("admin", app.getEmailTemplatesHandler))
+					r.Get("/{template}", app.checkRole("admin", app.previewEmailTemplateHandler))
+				})
+			})
+
+			r.With(app.AuthTokenMiddleware()).Get("/search", app.searchHandler)
+			r.With(app.AuthTokenMiddleware()).Get("/timeline/public", app.getPublicTimelineHandler)
+
+			r.Route("/feeds", func(r chi.Router) {
+				r.Get("/users/{userID}/{format}", app.getUserSyndicationHandler)
+				r.Get("/tags/{tag}/{format}", app.getTagSyndicationHandler)
+			})
+
+			r.Route("/auth", func(r chi.Router) {
+				r.Post("/", app.registerUserHandler)
+				r.Put("/activate/{token}", app.activateUserHandler)
+				r.Post("/token", app.createTokenHandler)
+			})
 		})
 	})
 	return r
@@ -124,7 +439,90 @@ func (app *application) run(mux http.Handler) error {
 		IdleTimeout:  time.Minute,
 	}
 
+	shutdown := make(chan error, 1)
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		s := <-quit
+
+		// A second signal kills the process
+		signal.Stop(quit)
+
+		app.logger.Infow("server is shutting down", "signal", s.String())
+		shutdown <- app.shutdown(srv)
+	}()
+
+	app.ready.Store(true)
 	app.logger.Infow("server has started", "addr", app.config.addr, "env", app.config.env)
 
-	return srv.ListenAndServe()
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	if err := <-shutdown; err != nil {
+		return err
+	}
+
+	app.logger.Infow("server has stopped", "addr", app.config.addr)
+	return nil
+}
+
+// startWorkers runs the background workers until shutdown stops them.
+func (app *application) startWorkers(workers ...func(context.Context)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	app.stopWorkers = cancel
+
+	for _, worker := range workers {
+		app.workers.Add(1)
+		go func() {
+			defer app.workers.Done()
+			worker(ctx)
+		}()
+	}
+}
+
+// shutdown stops the replica in order: it reports it is not ready and waits
+// for load balancers to notice, ends the streams, drains the requests in
+// flight, then stops the event relay, the jobs and the workers, all within
+// the shutdown timeout. Connections still open after it are closed.
+func (app *application) shutdown(srv *http.Server) error {
+	app.ready.Store(false)
+	time.Sleep(app.config.shutdown.delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), app.config.shutdown.timeout)
+	defer cancel()
+
+	// Streams never end on their own, so the server would wait for them
+	app.streams.Close()
+
+	var errs []error
+	if err := srv.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("draining requests: %w", err))
+		srv.Close()
+	}
+
+	if err := app.relay.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("stopping the event relay: %w", err))
+	}
+
+	if err := app.jobs.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("stopping the jobs: %w", err))
+	}
+
+	if app.stopWorkers != nil {
+		app.stopWorkers()
+
+		stopped := make(chan struct{})
+		go func() {
+			app.workers.Wait()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			errs = append(errs, fmt.Errorf("stopping the workers: %w", ctx.Err()))
+		}
+	}
+	return errors.Join(errs...)
 }
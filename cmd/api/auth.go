@@ -18,6 +18,7 @@ type RegisterUserPayload struct {
 	Username string `json:"username" validate:"required,max=100"`
 	Email    string `json:"email" validate:"required,email,max=255"`
 	Password string `json:"password" validate:"required,min=3,max=72"`
+	Locale   string `json:"locale" validate:"omitempty,bcp47_language_tag,max=35"`
 }
 
 type UserWithToken struct {
@@ -52,6 +53,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	user := &store.User{
 		Username: payload.Username,
 		Email:    payload.Email,
+		Locale:   payload.Locale,
 	}
 
 	if err := user.Password.Set(payload.Password); err != nil {
@@ -63,27 +65,8 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	hash := sha256.Sum256([]byte(plainToken))
 	hashToken := hex.EncodeToString(hash[:])
 
-	err := app.store.Users.CreateAndInvite(r.Context(), user, hashToken, app.config.mail.exp)
-	if err != nil {
-		switch err {
-		case store.ErrDuplicateEmail:
-			app.badRequest(w, r, err)
-		case store.ErrDuplicateUsername:
-			app.badRequest(w, r, err)
-		default:
-			app.internalServerError(w, r, err)
-		}
-		return
-	}
-
-	userWithToken := UserWithToken{
-		User:  user,
-		Token: plainToken,
-	}
-
 	activationURL := fmt.Sprintf("%s/confirm/%s", app.config.frontendURL, plainToken)
 
-	isProdEnv := app.config.env == "production"
 	vars := struct {
 		Username      string
 		ActivationURL string
@@ -92,19 +75,30 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		ActivationURL: activationURL,
 	}
 
-	status, err := app.mailer.Send(mailer.UserWelcomeTemplate, user.Username, user.Email, vars, !isProdEnv)
+	invitation, err := store.NewOutboundEmail(mailer.UserWelcomeTemplate, user.Locale, user.Username, user.Email, vars)
 	if err != nil {
-		app.logger.Errorw("error sending welcome email", "error", err)
+		app.internalServerError(w, r, err)
+		return
+	}
 
-		// Rollback user creation if email fails
-		if err := app.store.Users.Delete(r.Context(), user.ID); err != nil {
-			app.logger.Errorw("error deleting user", "error", err)
+	// The invitation is sent by a job once the user is committed
+	err = app.store.Users.CreateAndInvite(r.Context(), user, hashToken, app.config.mail.exp, invitation)
+	if err != nil {
+		switch err {
+		case store.ErrDuplicateEmail:
+			app.badRequest(w, r, err)
+		case store.ErrDuplicateUsername:
+			app.badRequest(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
 		}
-		app.internalServerError(w, r, err)
 		return
 	}
 
-	app.logger.Infow("Email sent", "status code", status)
+	userWithToken := UserWithToken{
+		User:  user,
+		Token: plainToken,
+	}
 
 	if err := app.jsonResponse(w, http.StatusCreated, userWithToken); err != nil {
 		app.internalServerError(w, r, err)
@@ -151,8 +145,8 @@ type CreateUserToken struct {
 //	@Tags			authentication
 //	@Accept			json
 //	@Produce		json
-//	@Param			payload	body		CreateUserTokenPayload	true	"User credentials"
-//	@Success		200		{string}	string					"Token"
+//	@Param			payload	body		CreateUserToken	true	"User credentials"
+//	@Success		200		{string}	string			"Token"
 //	@Failure		400		{object}	error
 //	@Failure		401		{object}	error
 //	@Failure		500		{object}	error
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"com.github/jrovieri/golang/social/internal/store"
+	"github.com/go-chi/chi/v5"
+)
+
+type commentKey string
+
+const commentCtx commentKey = "comment"
+
+type UpdateCommentPayload struct {
+	Content string `json:"content" validate:"required,max=1000,min=3"`
+}
+
+// GetPostComments godoc
+//
+//	@Summary		Fetches the comments of a post
+//	@Description	Fetches a page of comments of a post using keyset pagination
+//	@Tags			comments
+//	@Produce		json
+//	@Param			postID	path		int		true	"Post ID"
+//	@Param			limit	query		int		false	"Limit"
+//	@Param			sort	query		string	false	"Sort (newest, oldest, most-reacted)"
+//	@Param			cursor	query		string	false	"Cursor returned by the previous page"
+//	@Success		200		{object}	[]store.Comment
+//	@Failure		400		{object}	error
+//	@Failure		404		{object}	error
+//	@Failure		500		{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/posts/{postID}/comments [get]
+func (app *application) getPostCommentsHandler(w http.ResponseWriter, r *http.Request) {
+	post := getPostFromContext(r)
+
+	cq := store.PaginatedCommentQuery{
+		Limit: 20,
+		Sort:  "newest",
+	}
+
+	cq, err := cq.Parse(r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if err := Validate.Struct(cq); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	cq.Cursor, err = app.decodeCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	comments, next, err := app.store.Comments.GetByPostID(r.Context(), post.ID, cq)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrInvalidCursor):
+			app.badRequest(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	if err := app.paginatedResponse(w, http.StatusOK, comments, app.encodeCursor(next), ""); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// UpdateComment godoc
+//
+//	@Summary		Updates a comment
+//	@Description	Updates a comment by ID. Only the author can edit a comment
+//	@Tags			comments
+//	@Accept			json
+//	@Produce		json
+//	@Param			postID		path		int						true	"Post ID"
+//	@Param			commentID	path		int						true	"Comment ID"
+//	@Param			payload		body		UpdateCommentPayload	true	"Comment payload"
+//	@Success		200			{object}	store.Comment
+//	@Failure		400			{object}	error
+//	@Failure		403			{object}	error
+//	@Failure		404			{object}	error
+//	@Failure		500			{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/posts/{postID}/comments/{commentID} [patch]
+func (app *application) updateCommentHandler(w http.ResponseWriter, r *http.Request) {
+	comment := getCommentFromContext(r)
+
+	var payload UpdateCommentPayload
+	if err := readJSON(w, r, &payload); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if err := Validate.Struct(payload); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	comment.Content = payload.Content
+
+	if err := app.store.Comments.Update(r.Context(), comment); err != nil {
+		switch {
+		case errors.Is(err, store.ErrResourceNotFound):
+			app.notFound(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	if err := app.jsonResponse(w, http.StatusOK, comment); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// DeleteComment godoc
+//
+//	@Summary		Deletes a comment
+//	@Description	Deletes a comment by ID. Comments with replies are kept as a "[deleted]" tombstone
+//	@Tags			comments
+//	@Produce		json
+//	@Param			postID		path		int	true	"Post ID"
+//	@Param			commentID	path		int	true	"Comment ID"
+//	@Success		204			{object}	string
+//	@Failure		403			{object}	error
+//	@Failure		404			{object}	error
+//	@Failure		500			{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/posts/{postID}/comments/{commentID} [delete]
+func (app *application) deleteCommentHandler(w http.ResponseWriter, r *http.Request) {
+	comment := getCommentFromContext(r)
+
+	if err := app.store.Comments.Delete(r.Context(), comment.ID); err != nil {
+		switch {
+		case errors.Is(err, store.ErrResourceNotFound):
+			app.notFound(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ReactComment godoc
+//
+//	@Summary		Reacts to a comment
+//	@Description	Reacts to a comment by ID
+//	@Tags			comments
+//	@Produce		json
+//	@Param			postID		path		int		true	"Post ID"
+//	@Param			commentID	path		int		true	"Comment ID"
+//	@Success		204			{string}	string	"Reaction added"
+//	@Failure		404			{object}	error
+//	@Failure		409			{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/posts/{postID}/comments/{commentID}/react [put]
+func (app *application) reactCommentHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromContext(r)
+	comment := getCommentFromContext(r)
+
+	if err := app.store.Comments.React(r.Context(), comment.ID, user.ID); err != nil {
+		switch {
+		case errors.Is(err, store.ErrConflict):
+			app.conflict(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UnreactComment godoc
+//
+//	@Summary		Removes a reaction from a comment
+//	@Description	Removes the user reaction from a comment by ID
+//	@Tags			comments
+//	@Produce		json
+//	@Param			postID		path		int		true	"Post ID"
+//	@Param			commentID	path		int		true	"Comment ID"
+//	@Success		204			{string}	string	"Reaction removed"
+//	@Failure		404			{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/posts/{postID}/comments/{commentID}/unreact [put]
+func (app *application) unreactCommentHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromContext(r)
+	comment := getCommentFromContext(r)
+
+	if err := app.store.Comments.UnReact(r.Context(), comment.ID, user.ID); err != nil {
+		switch {
+		case errors.Is(err, store.ErrResourceNotFound):
+			app.notFound(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *application) commentsContextMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "commentID"), 10, 64)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+
+		ctx := r.Context()
+
+		comment, err := app.store.Comments.GetByID(ctx, id)
+		if err != nil {
+			switch {
+			case errors.Is(err, store.ErrResourceNotFound):
+				app.notFound(w, r, err)
+			default:
+				app.internalServerError(w, r, err)
+			}
+			return
+		}
+
+		post := getPostFromContext(r)
+		if comment.PostID != post.ID || comment.IsDeleted {
+			app.notFound(w, r, store.ErrResourceNotFound)
+			return
+		}
+
+		ctx = context.WithValue(ctx, commentCtx, comment)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// checkCommentOwnership lets the author of the comment through. Other users
+// need at least requiredRole; an empty role restricts the action to the author.
+func (app *application) checkCommentOwnership(requiredRole string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := getUserFromContext(r)
+		comment := getCommentFromContext(r)
+
+		if comment.UserID == user.ID {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if requiredRole == "" {
+			app.forbidden(w, r)
+			return
+		}
+
+		allowed, err := app.checkRolePrecedence(r.Context(), user, requiredRole)
+		if err != nil {
+			app.internalServerError(w, r, err)
+			return
+		}
+
+		if !allowed {
+			app.forbidden(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+func getCommentFromContext(r *http.Request) *store.Comment {
+	comment, _ := r.Context().Value(commentCtx).(*store.Comment)
+	return comment
+}
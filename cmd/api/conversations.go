@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"com.github/jrovieri/golang/social/internal/store"
+	"github.com/go-chi/chi/v5"
+)
+
+type conversationKey string
+
+const conversationCtx conversationKey = "conversation"
+
+type CreateConversationPayload struct {
+	UserIDs []int64 `json:"user_ids" validate:"required,min=1,dive,gte=1"`
+	Title   *string `json:"title" validate:"omitempty,min=1,max=100"`
+}
+
+type SendMessagePayload struct {
+	Content string `json:"content" validate:"required,max=2000"`
+}
+
+type ReadConversationPayload struct {
+	MessageID int64 `json:"message_id" validate:"gte=0"`
+}
+
+type MessageSettingsPayload struct {
+	MessagePolicy string `json:"message_policy" validate:"required,oneof=everyone following"`
+}
+
+// CreateConversation godoc
+//
+//	@Summary		Starts a conversation
+//	@Description	Starts a direct conversation with a user, or a group conversation with up to 9
+//	@Description	users or with a title. Starting a direct conversation that already exists
+//	@Description	returns it. Users on either side of a block, or who only accept messages from
+//	@Description	people they follow, cannot be added
+//	@Tags			conversations
+//	@Accept			json
+//	@Produce		json
+//	@Param			payload	body		CreateConversationPayload	true	"Conversation payload"
+//	@Success		201		{object}	store.Conversation
+//	@Success		200		{object}	store.Conversation
+//	@Failure		400		{object}	error
+//	@Failure		403		{object}	error
+//	@Failure		404		{object}	error
+//	@Failure		500		{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/conversations [post]
+func (app *application) createConversationHandler(w http.ResponseWriter, r *http.Request) {
+
+	var payload CreateConversationPayload
+	if err := readJSON(w, r, &payload); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if err := Validate.Struct(payload); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	user := getUserFromContext(r)
+
+	seen := map[int64]bool{}
+	members := make([]int64, 0, len(payload.UserIDs))
+	for _, id := range payload.UserIDs {
+		if id == user.ID {
+			app.badRequest(w, r, errors.New("cannot start a conversation with yourself"))
+			return
+		}
+
+		if !seen[id] {
+			seen[id] = true
+			members = append(members, id)
+		}
+	}
+
+	if len(members) >= store.MaxConversationMembers {
+		app.badRequest(w, r, fmt.Errorf("conversations have at most %d members", store.MaxConversationMembers))
+		return
+	}
+
+	conversation, created, err := app.store.Conversations.Create(r.Context(), user.ID, members, payload.Title)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrResourceNotFound):
+			app.notFound(w, r, err)
+		case errors.Is(err, store.ErrMessagingNotAllowed):
+			app.forbidden(w, r)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+
+	if err := app.jsonResponse(w, status, conversation); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// GetConversations godoc
+//
+//	@Summary		Fetches the conversations of the user
+//	@Description	Fetches the conversations of the user, the most recently active first, with
+//	@Description	their last message, unread count and how far each member has read
+//	@Tags			conversations
+//	@Produce		json
+//	@Param			limit	query		int		false	"Limit"
+//	@Param			unread	query		bool	false	"Only conversations with unread messages"
+//	@Param			cursor	query		string	false	"Cursor returned by the previous page"
+//	@Success		200		{object}	[]store.Conversation
+//	@Failure		400		{object}	error
+//	@Failure		500		{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/conversations [get]
+func (app *application) getConversationsHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromContext(r)
+
+	cq := store.PaginatedConversationQuery{Limit: 20}
+
+	cq, err := cq.Parse(r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if err := Validate.Struct(cq); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	cq.Cursor, err = app.decodeCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	conversations, next, err := app.store.Conversations.GetByUserID(r.Context(), user.ID, cq)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrInvalidCursor):
+			app.badRequest(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	if err := app.paginatedResponse(w, http.StatusOK, conversations, app.encodeCursor(next), ""); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// GetConversation godoc
+//
+//	@Summary		Fetches a conversation
+//	@Description	Fetches a conversation of the user by ID
+//	@Tags			conversations
+//	@Produce		json
+//	@Param			conversationID	path		int	true	"Conversation ID"
+//	@Success		200				{object}	store.Conversation
+//	@Failure		404				{object}	error
+//	@Failure		500				{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/conversations/{conversationID} [get]
+func (app *application) getConversationHandler(w http.ResponseWriter, r *http.Request) {
+	conversation := getConversationFromContext(r)
+
+	if err := app.jsonResponse(w, http.StatusOK, conversation); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// GetMessages godoc
+//
+//	@Summary		Fetches the messages of a conversation
+//	@Description	Fetches the messages of a conversation, the most recent first. Clients that do
+//	@Description	not hold a stream poll with after, the ID of the last message they have, to get
+//	@Description	the new ones oldest first
+//	@Tags			conversations
+//	@Produce		json
+//	@Param			conversationID	path		int		true	"Conversation ID"
+//	@Param			limit			query		int		false	"Limit"
+//	@Param			after			query		int		false	"Only messages sent after this one"
+//	@Param			cursor			query		string	false	"Cursor returned by the previous page"
+//	@Success		200				{object}	[]store.Message
+//	@Failure		400				{object}	error
+//	@Failure		404				{object}	error
+//	@Failure		500				{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/conversations/{conversationID}/messages [get]
+func (app *application) getMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	conversation := getConversationFromContext(r)
+	user := getUserFromContext(r)
+
+	mq := store.PaginatedMessageQuery{Limit: 50}
+
+	mq, err := mq.Parse(r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if err := Validate.Struct(mq); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	mq.Cursor, err = app.decodeCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	messages, next, err := app.store.Conversations.GetMessages(r.Context(), conversation.ID, user.ID, mq)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrInvalidCursor):
+			app.badRequest(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	if err := app.paginatedResponse(w, http.StatusOK, messages, app.encodeCursor(next), ""); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// SendMessage godoc
+//
+//	@Summary		Sends a message
+//	@Description	Sends a message to a conversation and pushes it to the streams of the other
+//	@Description	members. Direct messages are refused once either user blocked the other
+//	@Tags			conversations
+//	@Accept			json
+//	@Produce		json
+//	@Param			conversationID	path		int					true	"Conversation ID"
+//	@Param			payload			body		SendMessagePayload	true	"Message payload"
+//	@Success		201				{object}	store.Message
+//	@Failure		400				{object}	error
+//	@Failure		403				{object}	error
+//	@Failure		404				{object}	error
+//	@Failure		500				{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/conversations/{conversationID}/messages [post]
+func (app *application) sendMessageHandler(w http.ResponseWriter, r *http.Request) {
+	conversation := getConversationFromContext(r)
+	user := getUserFromContext(r)
+
+	var payload SendMessagePayload
+	if err := readJSON(w, r, &payload); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if err := Validate.Struct(payload); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	message := &store.Message{
+		ConversationID: conversation.ID,
+		SenderID:       user.ID,
+		Content:        payload.Content,
+	}
+
+	if err := app.store.Conversations.Send(r.Context(), message); err != nil {
+		switch {
+		case errors.Is(err, store.ErrResourceNotFound):
+			app.notFound(w, r, err)
+		case errors.Is(err, store.ErrMessagingNotAllowed):
+			app.forbidden(w, r)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	if err := app.jsonResponse(w, http.StatusCreated, message); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// ReadConversation godoc
+//
+//	@Summary		Marks a conversation read
+//	@Description	Marks the messages of a conversation read up to message_id, or all of them when
+//	@Description	it is omitted, and sends a read receipt to the other members
+//	@Tags			conversations
+//	@Accept			json
+//	@Param			conversationID	path		int						true	"Conversation ID"
+//	@Param			payload			body		ReadConversationPayload	false	"Last message read"
+//	@Success		204				{string}	string					"Conversation marked read"
+//	@Failure		400				{object}	error
+//	@Failure		404				{object}	error
+//	@Failure		500				{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/conversations/{conversationID}/read [put]
+func (app *application) readConversationHandler(w http.ResponseWriter, r *http.Request) {
+	conversation := getConversationFromContext(r)
+	user := getUserFromContext(r)
+
+	var payload ReadConversationPayload
+	if r.ContentLength != 0 {
+		if err := readJSON(w, r, &payload); err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+
+		if err := Validate.Struct(payload); err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+	}
+
+	if err := app.store.Conversations.MarkRead(r.Context(), conversation.ID, user.ID, payload.MessageID); err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetMessageSettings godoc
+//
+//	@Summary		Fetches the message settings of the user
+//	@Description	Tells who may start a conversation with the user: everyone, or only the people
+//	@Description	the user follows
+//	@Tags			conversations
+//	@Produce		json
+//	@Success		200	{object}	MessageSettingsPayload
+//	@Failure		500	{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/conversations/settings [get]
+func (app *application) getMessageSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromContext(r)
+
+	policy, err := app.store.Conversations.GetMessagePolicy(r.Context(), user.ID)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	if err := app.jsonResponse(w, http.StatusOK, MessageSettingsPayload{MessagePolicy: policy}); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// UpdateMessageSettings godoc
+//
+//	@Summary		Updates the message settings of the user
+//	@Description	Changes who may start a conversation with the user. Conversations already
+//	@Description	started are kept
+//	@Tags			conversations
+//	@Accept			json
+//	@Produce		json
+//	@Param			payload	body		MessageSettingsPayload	true	"Message settings"
+//	@Success		200		{object}	MessageSettingsPayload
+//	@Failure		400		{object}	error
+//	@Failure		500		{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/conversations/settings [put]
+func (app *application) updateMessageSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromContext(r)
+
+	var payload MessageSettingsPayload
+	if err := readJSON(w, r, &payload); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if err := Validate.Struct(payload); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if err := app.store.Conversations.SetMessagePolicy(r.Context(), user.ID, payload.MessagePolicy); err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	if err := app.jsonResponse(w, http.StatusOK, payload); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// conversationsContextMiddleware loads the conversation of the route, which
+// only its members can see.
+func (app *application) conversationsContextMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "conversationID"), 10, 64)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+
+		user := getUserFromContext(r)
+		ctx := r.Context()
+
+		conversation, err := app.store.Conversations.GetByID(ctx, id, user.ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, store.ErrResourceNotFound):
+				app.notFound(w, r, err)
+			default:
+				app.internalServerError(w, r, err)
+			}
+			return
+		}
+
+		ctx = context.WithValue(ctx, conversationCtx, conversation)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func getConversationFromContext(r *http.Request) *store.Conversation {
+	conversation, _ := r.Context().Value(conversationCtx).(*store.Conversation)
+	return conversation
+}
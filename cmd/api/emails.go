@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"com.github/jrovieri/golang/social/internal/mailer"
+	"com.github/jrovieri/golang/social/internal/store"
+	"github.com/go-chi/chi/v5"
+)
+
+var errInvalidUnsubscribeToken = errors.New("invalid unsubscribe token")
+
+// unsubscribePage asks to confirm an unsubscribe link, as opening a link, which
+// mail scanners do too, must not change anything, and then tells it is done.
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Unsubscribe - GopherSocial</title></head>
+<body>
+<p>{{.Message}}</p>
+{{if not .Done}}<form method="post"><button type="submit">Unsubscribe</button></form>{{end}}
+</body>
+</html>`))
+
+var errNothingToUpdate = errors.New("either preferences or locale is required")
+
+type UpdateEmailPreferencesPayload struct {
+	Preferences map[string]string `json:"preferences" validate:"omitempty,dive,keys,oneof=follow comment reply reaction mention,endkeys,oneof=instant digest off"`
+	Locale      *string           `json:"locale" validate:"omitempty,bcp47_language_tag,max=35"`
+}
+
+type emailTemplatesResponse struct {
+	Templates []string `json:"templates"`
+	Locales   []string `json:"locales"`
+}
+
+type emailPreferencesResponse struct {
+	Preferences map[string]string `json:"preferences"`
+	Locale      string            `json:"locale"`
+}
+
+// notificationEmailData is the data of the notification and digest emails.
+// It goes through the email outbox as JSON, so its fields keep their names.
+type notificationEmailData struct {
+	Username         string
+	Notifications    []notificationEmailItem
+	NotificationsURL string
+	UnsubscribeURL   string
+}
+
+type notificationEmailItem struct {
+	Message string
+}
+
+// GetEmailPreferences godoc
+//
+//	@Summary		Fetches the email preferences of the user
+//	@Description	Tells, for every type of notification, whether the user is emailed right away
+//	@Description	(instant), in the daily digest (digest) or not at all (off), and the locale
+//	@Description	emails are written in
+//	@Tags			email
+//	@Produce		json
+//	@Success		200	{object}	emailPreferencesResponse
+//	@Failure		500	{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/email/preferences [get]
+func (app *application) getEmailPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromContext(r)
+
+	response, err := app.getEmailPreferences(r.Context(), user.ID)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	if err := app.jsonResponse(w, http.StatusOK, response); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// UpdateEmailPreferences godoc
+//
+//	@Summary		Updates the email preferences of the user
+//	@Description	Sets how the user is emailed about the types of notification given, leaving
+//	@Description	the others as they were, and the locale emails are written in. An empty
+//	@Description	locale goes back to the default one
+//	@Tags			email
+//	@Accept			json
+//	@Produce		json
+//	@Param			payload	body		UpdateEmailPreferencesPayload	true	"Email preferences"
+//	@Success		200		{object}	emailPreferencesResponse
+//	@Failure		400		{object}	error
+//	@Failure		500		{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/email/preferences [put]
+func (app *application) updateEmailPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromContext(r)
+
+	var payload UpdateEmailPreferencesPayload
+	if err := readJSON(w, r, &payload); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if err := Validate.Struct(payload); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if len(payload.Preferences) == 0 && payload.Locale == nil {
+		app.badRequest(w, r, errNothingToUpdate)
+		return
+	}
+
+	ctx := r.Context()
+
+	if len(payload.Preferences) > 0 {
+		if err := app.store.EmailPreferences.Update(ctx, user.ID, payload.Preferences); err != nil {
+			app.internalServerError(w, r, err)
+			return
+		}
+	}
+
+	if payload.Locale != nil {
+		if err := app.store.EmailPreferences.SetLocale(ctx, user.ID, *payload.Locale); err != nil {
+			app.internalServerError(w, r, err)
+			return
+		}
+	}
+
+	response, err := app.getEmailPreferences(ctx, user.ID)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	if err := app.jsonResponse(w, http.StatusOK, response); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+func (app *application) getEmailPreferences(ctx context.Context, userID int64) (*emailPreferencesResponse, error) {
+	preferences, err := app.store.EmailPreferences.Get(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	locale, err := app.store.EmailPreferences.GetLocale(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if locale == "" {
+		locale = mailer.DefaultLocale
+	}
+	return &emailPreferencesResponse{Preferences: preferences, Locale: locale}, nil
+}
+
+// UnsubscribePage godoc
+//
+//	@Summary		Confirms unsubscribing from emails
+//	@Description	Renders the page the link of an email opens, asking to confirm turning off the
+//	@Description	emails the signed token was issued for. Nothing changes until it is confirmed
+//	@Tags			email
+//	@Produce		html
+//	@Param			token	query		string	true	"Unsubscribe token"
+//	@Success		200		{string}	string	"Confirmation page"
+//	@Failure		400		{object}	error
+//	@Router			/email/unsubscribe [get]
+func (app *application) unsubscribePageHandler(w http.ResponseWriter, r *http.Request) {
+	_, typ, err := app.parseUnsubscribeToken(r.URL.Query().Get("token"))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	message := "Stop receiving emails from GopherSocial?"
+	if typ != "" {
+		message = fmt.Sprintf("Stop receiving %s emails from GopherSocial?", typ)
+	}
+	app.unsubscribePageResponse(w, r, message, false)
+}
+
+// Unsubscribe godoc
+//
+//	@Summary		Unsubscribes from emails
+//	@Description	Turns off the emails the signed token in the link of an email was issued for,
+//	@Description	without logging in. Mail clients send it as a one-click POST through
+//	@Description	List-Unsubscribe (RFC 8058)
+//	@Tags			email
+//	@Produce		html
+//	@Param			token	query		string	true	"Unsubscribe token"
+//	@Success		200		{string}	string	"Unsubscribed"
+//	@Failure		400		{object}	error
+//	@Failure		404		{object}	error
+//	@Failure		500		{object}	error
+//	@Router			/email/unsubscribe [post]
+func (app *application) unsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	userID, typ, err := app.parseUnsubscribeToken(r.URL.Query().Get("token"))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if err := app.store.EmailPreferences.Unsubscribe(r.Context(), userID, typ); err != nil {
+		switch {
+		case errors.Is(err, store.ErrResourceNotFound):
+			app.notFound(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	message := "You will no longer receive emails from GopherSocial"
+	if typ != "" {
+		message = fmt.Sprintf("You will no longer receive %s emails from GopherSocial", typ)
+	}
+
+	app.unsubscribePageResponse(w, r, message, true)
+}
+
+func (app *application) unsubscribePageResponse(w http.ResponseWriter, r *http.Request, message string, done bool) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	data := struct {
+		Message string
+		Done    bool
+	}{message, done}
+	if err := unsubscribePage.Execute(w, data); err != nil {
+		app.logger.Warnw("error writing unsubscribe page", "path", r.URL.Path, "error", err)
+	}
+}
+
+// GetEmailTemplates godoc
+//
+//	@Summary		Lists the email templates
+//	@Description	Lists the email templates and the locales they are written in, for previews
+//	@Tags			email
+//	@Produce		json
+//	@Success		200	{object}	emailTemplatesResponse
+//	@Failure		403	{object}	error
+//	@Failure		500	{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/email/templates [get]
+func (app *application) getEmailTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	templates, err := mailer.LoadTemplates()
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	response := emailTemplatesResponse{Templates: templates.Names(), Locales: templates.Locales()}
+	if err := app.jsonResponse(w, http.StatusOK, response); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// PreviewEmailTemplate godoc
+//
+//	@Summary		Previews an email template
+//	@Description	Renders an email template with sample data in the locale closest to the one
+//	@Description	given. The html and text formats answer with the body alone, to be seen as is
+//	@Tags			email
+//	@Produce		json
+//	@Produce		html
+//	@Produce		plain
+//	@Param			template	path		string	true	"Template name"
+//	@Param			locale		query		string	false	"Locale, the default one when empty"
+//	@Param			format		query		string	false	"json (default), html or text"
+//	@Success		200			{object}	mailer.Rendered
+//	@Failure		400			{object}	error
+//	@Failure		403			{object}	error
+//	@Failure		404			{object}	error
+//	@Failure		500			{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/email/templates/{template} [get]
+func (app *application) previewEmailTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "html" && format != "text" {
+		app.badRequest(w, r, fmt.Errorf("unknown format %q", format))
+		return
+	}
+
+	templates, err := mailer.LoadTemplates()
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	rendered, err := templates.Preview(chi.URLParam(r, "template"), r.URL.Query().Get("locale"))
+	if err != nil {
+		switch {
+		case errors.Is(err, mailer.ErrUnknownTemplate):
+			app.notFound(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	if format == "" || format == "json" {
+		if err := app.jsonResponse(w, http.StatusOK, rendered); err != nil {
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	contentType, body := "text/html; charset=utf-8", rendered.HTML
+	if format == "text" {
+		contentType, body = "text/plain; charset=utf-8", rendered.Text
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write([]byte(body)); err != nil {
+		app.logger.Warnw("error writing email preview", "path", r.URL.Path, "error", err)
+	}
+}
+
+// unsubscribeURL returns the link that turns off the emails of the user about
+// a type of notification, or all of them when typ is empty. Links are signed
+// so they work without logging in but cannot be made up for other users, and
+// carry when they were issued so they expire after the configured max age.
+func (app *application) unsubscribeURL(userID int64, typ string) string {
+	issued := strconv.FormatInt(time.Now().Unix(), 10)
+	payload := base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(userID, 10) + ":" + typ + ":" + issued))
+	token := payload + "." + app.signUnsubscribe(payload)
+
+	return fmt.Sprintf("%s/v1/email/unsubscribe?token=%s", app.config.mail.linkBaseURL, url.QueryEscape(token))
+}
+
+func (app *application) parseUnsubscribeToken(token string) (int64, string, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(app.signUnsubscribe(payload))) {
+		return 0, "", errInvalidUnsubscribeToken
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return 0, "", errInvalidUnsubscribeToken
+	}
+
+	fields := strings.Split(string(data), ":")
+	if len(fields) != 3 {
+		return 0, "", errInvalidUnsubscribeToken
+	}
+
+	id, typ := fields[0], fields[1]
+	userID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || (typ != "" && !slices.Contains(store.NotificationTypes, typ)) {
+		return 0, "", errInvalidUnsubscribeToken
+	}
+
+	issued, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || time.Since(time.Unix(issued, 0)) > app.config.mail.unsubscribeMaxAge {
+		return 0, "", errInvalidUnsubscribeToken
+	}
+	return userID, typ, nil
+}
+
+func (app *application) signUnsubscribe(payload string) string {
+	mac := hmac.New(sha256.New, []byte(app.config.mail.unsubscribeSecret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// queueNotificationEmailsJob queues emails about the notifications users
+// asked to get right away and, once per digest interval, about those they
+// asked to get in a digest. Notifications are marked emailed in the
+// transaction that queues their email; the jobs sending them retry the ones
+// that fail.
+func (app *application) queueNotificationEmailsJob(ctx context.Context, args queueNotificationEmailsArgs) error {
+	cfg := app.config.notificationEmails
+
+	claims := []struct {
+		name  string
+		claim func() (int, error)
+	}{
+		{"instant", func() (int, error) {
+			return app.store.EmailPreferences.ClaimInstant(ctx, cfg.batch, app.composeNotificationEmail)
+		}},
+		{"digests", func() (int, error) {
+			return app.store.EmailPreferences.ClaimDigests(ctx, cfg.digestInterval, cfg.batch, app.composeNotificationDigest)
+		}},
+	}
+
+	// A failing claim does not hold back the other one
+	var errs []error
+	for _, c := range claims {
+		for {
+			n, err := c.claim()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", c.name, err))
+				break
+			}
+
+			if n < cfg.batch {
+				break
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// composeNotificationEmail is the email about a notification to get right
+// away, which unsubscribes from its type.
+func (app *application) composeNotificationEmail(e store.NotificationEmail) (*store.OutboundEmail, error) {
+	typ := e.Notifications[0].Type
+	return app.notificationEmail(mailer.NotificationTemplate, e, app.unsubscribeURL(e.UserID, typ))
+}
+
+// composeNotificationDigest is the digest of notifications, which unsubscribes
+// from every email.
+func (app *application) composeNotificationDigest(e store.NotificationEmail) (*store.OutboundEmail, error) {
+	return app.notificationEmail(mailer.DigestTemplate, e, app.unsubscribeURL(e.UserID, ""))
+}
+
+func (app *application) notificationEmail(template string, e store.NotificationEmail, unsubscribeURL string) (*store.OutboundEmail, error) {
+	data := notificationEmailData{
+		Username:         e.Username,
+		Notifications:    make([]notificationEmailItem, len(e.Notifications)),
+		NotificationsURL: fmt.Sprintf("%s/notifications", app.config.frontendURL),
+		UnsubscribeURL:   unsubscribeURL,
+	}
+	for i, n := range e.Notifications {
+		data.Notifications[i] = notificationEmailItem{Message: n.Message}
+	}
+
+	return store.NewOutboundEmail(template, e.Locale, e.Username, e.Email, data)
+}
@@ -29,6 +29,11 @@ func (app *application) unauthorized(w http.ResponseWriter, r *http.Request, err
 	writeJSONError(w, http.StatusUnauthorized, err.Error())
 }
 
+func (app *application) forbidden(w http.ResponseWriter, r *http.Request) {
+	app.logger.Warnw("forbidden", "method", r.Method, "path", r.URL.Path)
+	writeJSONError(w, http.StatusForbidden, "forbidden")
+}
+
 func (app *application) unauthorizedBasicAuth(w http.ResponseWriter, r *http.Request, err error) {
 	app.logger.Errorw("", "method", r.Method, "path", r.URL.Path, "error", err.Error())
 	w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"time"
 
 	"com.github/jrovieri/golang/social/internal/store"
 )
@@ -9,15 +12,21 @@ import (
 // getUserFeedHandler godoc
 //
 //	@Summary		Fetches the user feed
-//	@Description	Fetches the user feed
+//	@Description	Fetches the user feed. Pages are walked with the next_cursor and prev_cursor
+//	@Description	returned in the response; offset pagination is deprecated. The ranked mode
+//	@Description	scores posts from follows, followed tags and trending content, and only pages
+//	@Description	with cursors
 //	@Tags			feed
 //	@Accept			json
 //	@Produce		json
-//	@Param			since	query		string	false	"Since"
-//	@Param			until	query		string	false	"Until"
+//	@Param			since	query		string	false	"Since, inclusive (RFC 3339 or YYYY-MM-DD)"
+//	@Param			until	query		string	false	"Until, exclusive (RFC 3339 or YYYY-MM-DD, a date covers the whole day)"
+//	@Param			tz		query		string	false	"IANA time zone for values without an offset, defaults to UTC"
 //	@Param			limit	query		int		false	"Limit"
-//	@Param			offset	query		int		false	"Offset"
+//	@Param			offset	query		int		false	"Offset (deprecated)"
+//	@Param			cursor	query		string	false	"Cursor returned by a previous page"
 //	@Param			sort	query		string	false	"Sort"
+//	@Param			mode	query		string	false	"Mode (chronological, ranked)"
 //	@Param			tags	query		string	false	"Tags"
 //	@Param			search	query		string	false	"Search"
 //	@Success		200		{object}	[]store.PostWithMetadata
@@ -27,30 +36,144 @@ import (
 //	@Router			/users/feed [get]
 func (app *application) getUserFeedHandler(w http.ResponseWriter, r *http.Request) {
 
+	user := getUserFromContext(r)
+
+	fq, err := app.parseFeedQuery(r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	// Offset pagination is kept for existing clients until they move to cursors
+	if r.URL.Query().Has("offset") {
+		w.Header().Set("Deprecation", "true")
+	}
+
+	var page *store.FeedPage
+	switch fq.Mode {
+	case "ranked":
+		page, err = app.store.Posts.GetRankedFeed(r.Context(), user.ID, fq, app.config.feed.ranking)
+	default:
+		page, err = app.store.Posts.GetUserFeed(r.Context(), user.ID, fq)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrInvalidCursor):
+			app.badRequest(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	next, prev := app.encodeCursor(page.Next), app.encodeCursor(page.Prev)
+	if err := app.paginatedResponse(w, http.StatusOK, page.Posts, next, prev); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// GetPublicTimeline godoc
+//
+//	@Summary		Fetches the public timeline
+//	@Description	Fetches the most recent public posts of everyone, using the same filters as the feed
+//	@Tags			feed
+//	@Produce		json
+//	@Param			since	query		string	false	"Since, inclusive (RFC 3339 or YYYY-MM-DD)"
+//	@Param			until	query		string	false	"Until, exclusive (RFC 3339 or YYYY-MM-DD, a date covers the whole day)"
+//	@Param			tz		query		string	false	"IANA time zone for values without an offset, defaults to UTC"
+//	@Param			limit	query		int		false	"Limit"
+//	@Param			cursor	query		string	false	"Cursor returned by a previous page"
+//	@Param			sort	query		string	false	"Sort"
+//	@Param			tags	query		string	false	"Tags"
+//	@Param			search	query		string	false	"Search"
+//	@Success		200		{object}	[]store.PostWithMetadata
+//	@Failure		400		{object}	error
+//	@Failure		500		{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/timeline/public [get]
+func (app *application) getPublicTimelineHandler(w http.ResponseWriter, r *http.Request) {
+
+	user := getUserFromContext(r)
+
+	fq, err := app.parseFeedQuery(r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	page, err := app.store.Posts.GetPublicTimeline(r.Context(), user.ID, fq)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrInvalidCursor):
+			app.badRequest(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	next, prev := app.encodeCursor(page.Next), app.encodeCursor(page.Prev)
+	if err := app.paginatedResponse(w, http.StatusOK, page.Posts, next, prev); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// parseFeedQuery reads and validates the filters and cursor of a request for
+// a list of posts.
+func (app *application) parseFeedQuery(r *http.Request) (store.PaginatedFeedQuery, error) {
 	fq := store.PaginatedFeedQuery{
 		Limit:  20,
 		Offset: 0,
 		Sort:   "desc",
+		Mode:   "chronological",
 	}
 
 	fq, err := fq.Parse(r)
 	if err != nil {
-		app.badRequest(w, r, err)
-		return
+		return fq, err
 	}
 
 	if err := Validate.Struct(fq); err != nil {
-		app.badRequest(w, r, err)
-		return
+		return fq, err
 	}
 
-	feed, err := app.store.Posts.GetUserFeed(r.Context(), int64(96), fq)
+	fq.Cursor, err = app.decodeCursor(r.URL.Query().Get("cursor"))
 	if err != nil {
-		app.internalServerError(w, r, err)
-		return
+		return fq, err
 	}
 
-	if err := app.jsonResponse(w, http.StatusOK, feed); err != nil {
-		app.internalServerError(w, r, err)
+	if fq.Cursor != nil && fq.Offset > 0 {
+		return fq, errors.New("cursor and offset cannot be used together")
+	}
+
+	if fq.Mode == "ranked" && fq.Offset > 0 {
+		return fq, errors.New("offset cannot be used with the ranked mode")
+	}
+	return fq, nil
+}
+
+// fanoutWorker copies new posts into the timelines of their audience. It
+// drains the queue in batches and waits for the next tick once it is empty.
+func (app *application) fanoutWorker(ctx context.Context) {
+	ticker := time.NewTicker(app.config.feed.fanoutInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			n, err := app.store.Timelines.Fanout(ctx, app.config.feed.fanoutBatch)
+			if err != nil {
+				app.logger.Errorw("error fanning out posts", "error", err)
+				break
+			}
+			if n < app.config.feed.fanoutBatch {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
 }
@@ -22,3 +22,24 @@ func (app *application) healthCheckHandler(w http.ResponseWriter, r *http.Reques
 		writeJSONError(w, http.StatusInternalServerError, err.Error())
 	}
 }
+
+// readinessHandler godoc
+//
+//	@Summary		Readiness
+//	@Description	Tells load balancers whether to send requests to this replica. It turns
+//	@Description	unavailable as soon as the replica starts shutting down, before it drains its connections
+//	@Tags			ops
+//	@Produce		json
+//	@Success		200	{object}	string	"ready"
+//	@Failure		503	{object}	string	"draining"
+//	@Router			/ready [get]
+func (app *application) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	status, code := "ready", http.StatusOK
+	if !app.ready.Load() {
+		status, code = "draining", http.StatusServiceUnavailable
+	}
+
+	if err := app.jsonResponse(w, code, map[string]string{"status": status}); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"com.github/jrovieri/golang/social/internal/job"
+)
+
+// Arguments of the recurring jobs, which have none.
+type (
+	recomputeTrendingArgs        struct{}
+	refreshSuggestionsArgs       struct{}
+	deleteExpiredInvitationsArgs struct{}
+	reconcileCountersArgs        struct{}
+	pruneEventsArgs              struct{}
+	pruneEmailOutboxArgs         struct{}
+	pruneActivityDeliveriesArgs  struct{}
+	pruneWebhookDeliveriesArgs   struct{}
+	deliverActivitiesArgs        struct{}
+	deliverWebhooksArgs          struct{}
+	queueNotificationEmailsArgs  struct{}
+)
+
+func (recomputeTrendingArgs) Kind() string        { return "recompute_trending" }
+func (refreshSuggestionsArgs) Kind() string       { return "refresh_suggestions" }
+func (deleteExpiredInvitationsArgs) Kind() string { return "delete_expired_invitations" }
+func (reconcileCountersArgs) Kind() string        { return "reconcile_counters" }
+func (pruneEventsArgs) Kind() string              { return "prune_events" }
+func (pruneEmailOutboxArgs) Kind() string         { return "prune_email_outbox" }
+func (pruneActivityDeliveriesArgs) Kind() string  { return "prune_activity_deliveries" }
+func (pruneWebhookDeliveriesArgs) Kind() string   { return "prune_webhook_deliveries" }
+func (deliverActivitiesArgs) Kind() string        { return "deliver_activities" }
+func (deliverWebhooksArgs) Kind() string          { return "deliver_webhooks" }
+func (queueNotificationEmailsArgs) Kind() string  { return "queue_notification_emails" }
+
+// setupJobs registers the handlers of every kind of job and schedules the
+// recurring ones.
+func (app *application) setupJobs() error {
+	job.Register(app.jobs, app.sendEmailJob)
+	job.Register(app.jobs, app.recomputeTrendingJob)
+	job.Register(app.jobs, app.refreshSuggestionsJob)
+	job.Register(app.jobs, app.deleteExpiredInvitationsJob)
+	job.Register(app.jobs, app.reconcileCountersJob)
+	job.Register(app.jobs, app.pruneEventsJob)
+	job.Register(app.jobs, app.pruneEmailOutboxJob)
+	job.Register(app.jobs, app.pruneActivityDeliveriesJob)
+	job.Register(app.jobs, app.pruneWebhookDeliveriesJob)
+	job.Register(app.jobs, app.deliverActivitiesJob)
+	job.Register(app.jobs, app.deliverWebhooksJob)
+	job.Register(app.jobs, app.queueNotificationEmailsJob)
+
+	schedules := []struct {
+		name string
+		spec string
+		args job.Args
+	}{
+		{"trending", fmt.Sprintf("@every %s", app.config.trending.interval), recomputeTrendingArgs{}},
+		{"suggestions", fmt.Sprintf("@every %s", app.config.suggestions.interval), refreshSuggestionsArgs{}},
+		{"invitations", "@hourly", deleteExpiredInvitationsArgs{}},
+		// Counters are only off after bugs or manual changes, so once a day
+		// at a quiet hour is enough
+		{"counters", "0 4 * * *", reconcileCountersArgs{}},
+		{"events", "@hourly", pruneEventsArgs{}},
+		{"email_outbox", "@hourly", pruneEmailOutboxArgs{}},
+		{"activity_deliveries", "@hourly", pruneActivityDeliveriesArgs{}},
+		{"webhook_deliveries", "@hourly", pruneWebhookDeliveriesArgs{}},
+		{"activities", fmt.Sprintf("@every %s", app.config.activityPub.deliveryInterval), deliverActivitiesArgs{}},
+		{"webhooks", fmt.Sprintf("@every %s", app.config.webhooks.interval), deliverWebhooksArgs{}},
+		{"notification_emails", fmt.Sprintf("@every %s", app.config.notificationEmails.interval), queueNotificationEmailsArgs{}},
+	}
+
+	for _, s := range schedules {
+		if err := app.jobs.Schedule(s.name, s.spec, s.args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (app *application) deleteExpiredInvitationsJob(ctx context.Context, args deleteExpiredInvitationsArgs) error {
+	deleted, err := app.store.Users.DeleteExpiredInvitations(ctx)
+	if err != nil {
+		return err
+	}
+
+	if deleted > 0 {
+		app.logger.Infow("deleted users who never activated their account", "users", deleted)
+	}
+	return nil
+}
+
+func (app *application) reconcileCountersJob(ctx context.Context, args reconcileCountersArgs) error {
+	fixed, err := app.store.Counters.Reconcile(ctx)
+	if err != nil {
+		return err
+	}
+
+	if fixed > 0 {
+		app.logger.Warnw("fixed counters that drifted", "rows", fixed)
+	}
+	return nil
+}
+
+func (app *application) pruneEventsJob(ctx context.Context, args pruneEventsArgs) error {
+	pruned, err := app.relay.Prune(ctx, app.config.events.retention)
+	if err != nil {
+		return err
+	}
+
+	if pruned > 0 {
+		app.logger.Infow("pruned published domain events", "events", pruned)
+	}
+	return nil
+}
+
+func (app *application) pruneEmailOutboxJob(ctx context.Context, args pruneEmailOutboxArgs) error {
+	pruned, err := app.store.EmailOutbox.Prune(ctx, app.config.mail.outboxRetention)
+	if err != nil {
+		return err
+	}
+
+	if pruned > 0 {
+		app.logger.Infow("pruned sent and dead emails", "emails", pruned)
+	}
+	return nil
+}
+
+func (app *application) pruneActivityDeliveriesJob(ctx context.Context, args pruneActivityDeliveriesArgs) error {
+	pruned, err := app.store.ActivityPub.PruneDeliveries(ctx, app.config.activityPub.deliveryRetention)
+	if err != nil {
+		return err
+	}
+
+	if pruned > 0 {
+		app.logger.Infow("pruned delivered and dead activity deliveries", "deliveries", pruned)
+	}
+	return nil
+}
+
+func (app *application) pruneWebhookDeliveriesJob(ctx context.Context, args pruneWebhookDeliveriesArgs) error {
+	pruned, err := app.store.Webhooks.PruneDeliveries(ctx, app.config.webhooks.retention)
+	if err != nil {
+		return err
+	}
+
+	if pruned > 0 {
+		app.logger.Infow("pruned delivered and dead webhook deliveries", "deliveries", pruned)
+	}
+	return nil
+}
+
+// getJobStatsHandler godoc
+//
+//	@Summary		Fetches the depth of the job queues
+//	@Description	Counts the jobs of every queue that are ready, scheduled, running or dead, and
+//	@Description	tells how long the oldest ready job has waited
+//	@Tags			ops
+//	@Produce		json
+//	@Success		200	{array}		job.QueueStats
+//	@Failure		500	{object}	error
+//	@Router			/jobs [get]
+func (app *application) getJobStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := app.jobs.Stats(r.Context())
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	if err := app.jsonResponse(w, http.StatusOK, stats); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
@@ -40,3 +40,13 @@ type envelope struct {
 func (app *application) jsonResponse(w http.ResponseWriter, status int, data any) error {
 	return writeJSON(w, status, &envelope{Data: data})
 }
+
+type paginatedEnvelope struct {
+	Data       any    `json:"data"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	PrevCursor string `json:"prev_cursor,omitempty"`
+}
+
+func (app *application) paginatedResponse(w http.ResponseWriter, status int, data any, next, prev string) error {
+	return writeJSON(w, status, &paginatedEnvelope{Data: data, NextCursor: next, PrevCursor: prev})
+}
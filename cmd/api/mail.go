@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"com.github/jrovieri/golang/social/internal/job"
+	"com.github/jrovieri/golang/social/internal/mailer"
+	"com.github/jrovieri/golang/social/internal/store"
+)
+
+// sendEmailJob sends an email of the outbox. Failed emails are retried by the
+// job with a jittered exponential backoff until they run out of attempts and
+// are moved to the dead letters.
+func (app *application) sendEmailJob(ctx context.Context, args store.SendEmailArgs) error {
+	e, err := app.store.EmailOutbox.GetPending(ctx, args.EmailID)
+	if err != nil {
+		// Emails sent by an attempt that could not complete its job are done
+		if errors.Is(err, store.ErrResourceNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	var data mailer.Data
+	if err := json.Unmarshal(e.Data, &data); err != nil {
+		return app.failEmail(ctx, e, job.Permanent(err))
+	}
+
+	isProdEnv := app.config.env == "production"
+
+	status, err := app.mailer.Send(ctx, e.Template, e.Locale, e.Username, e.Email, data, !isProdEnv)
+	if err != nil {
+		return app.failEmail(ctx, e, err)
+	}
+
+	if err := app.store.EmailOutbox.MarkSent(ctx, e.ID); err != nil {
+		app.logger.Errorw("error marking email sent", "id", e.ID, "error", err)
+	}
+	app.logger.Infow("Email sent", "id", e.ID, "template", e.Template, "status code", status)
+	return nil
+}
+
+// failEmail records the failed attempt to send an email and returns its
+// error, for the job to be retried.
+func (app *application) failEmail(ctx context.Context, e *store.OutboundEmail, cause error) error {
+	dead := job.IsPermanent(cause)
+	if j := job.FromContext(ctx); j != nil {
+		dead = dead || j.LastAttempt()
+	}
+
+	if err := app.store.EmailOutbox.MarkFailed(ctx, e.ID, cause, dead); err != nil {
+		app.logger.Errorw("error recording failed email", "id", e.ID, "error", err)
+	}
+	return cause
+}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
+	"os"
 	"time"
 
+	"com.github/jrovieri/golang/social/internal/activitypub"
 	"com.github/jrovieri/golang/social/internal/auth"
 	"com.github/jrovieri/golang/social/internal/db"
 	"com.github/jrovieri/golang/social/internal/env"
+	"com.github/jrovieri/golang/social/internal/event"
+	"com.github/jrovieri/golang/social/internal/job"
 	"com.github/jrovieri/golang/social/internal/mailer"
 	"com.github/jrovieri/golang/social/internal/store"
+	"com.github/jrovieri/golang/social/internal/stream"
+	"com.github/jrovieri/golang/social/internal/webhook"
 	"go.uber.org/zap"
 )
 
@@ -46,6 +53,85 @@ func main() {
 			exp:       time.Hour * 24 * 3,
 			fromEmail: env.GetString("FROM_EMAIL", ""),
 			apiKey:    env.GetString("MAIL_API_KEY", ""),
+			provider:  env.GetString("MAIL_PROVIDER", ""),
+			smtp: mailer.SMTPConfig{
+				Host:     env.GetString("SMTP_HOST", "localhost"),
+				Port:     env.GetInt("SMTP_PORT", 587),
+				Username: env.GetString("SMTP_USERNAME", ""),
+				Password: env.GetString("SMTP_PASSWORD", ""),
+				Security: env.GetString("SMTP_SECURITY", mailer.SMTPStartTLS),
+			},
+			dir:               env.GetString("MAIL_DIR", "tmp/mail"),
+			linkBaseURL:       env.GetString("MAIL_LINK_BASE_URL", "http://localhost:8080"),
+			unsubscribeSecret: env.GetString("MAIL_UNSUBSCRIBE_SECRET", "development"),
+			unsubscribeMaxAge: env.GetDuration("MAIL_UNSUBSCRIBE_MAX_AGE", 60*24*time.Hour),
+			outboxRetention:   env.GetDuration("MAIL_OUTBOX_RETENTION", 7*24*time.Hour),
+		},
+		notificationEmails: notificationEmailsConfig{
+			interval:       env.GetDuration("NOTIFICATION_EMAILS_INTERVAL", time.Minute),
+			batch:          env.GetInt("NOTIFICATION_EMAILS_BATCH", 50),
+			digestInterval: env.GetDuration("NOTIFICATION_DIGEST_INTERVAL", 24*time.Hour),
+		},
+		feed: feedConfig{
+			fanoutThreshold: env.GetInt("FEED_FANOUT_THRESHOLD", store.DefaultFanoutThreshold),
+			fanoutInterval:  env.GetDuration("FEED_FANOUT_INTERVAL", time.Second),
+			fanoutBatch:     env.GetInt("FEED_FANOUT_BATCH", 50),
+			ranking: store.RankingWeights{
+				Recency:    env.GetFloat("FEED_RANK_RECENCY_WEIGHT", 1.0),
+				Affinity:   env.GetFloat("FEED_RANK_AFFINITY_WEIGHT", 0.5),
+				Engagement: env.GetFloat("FEED_RANK_ENGAGEMENT_WEIGHT", 0.3),
+				HalfLife:   env.GetDuration("FEED_RANK_HALF_LIFE", 12*time.Hour),
+			},
+		},
+		suggestions: suggestionsConfig{
+			interval: env.GetDuration("SUGGESTIONS_INTERVAL", time.Minute),
+			maxAge:   env.GetDuration("SUGGESTIONS_MAX_AGE", 24*time.Hour),
+			batch:    env.GetInt("SUGGESTIONS_BATCH", 20),
+		},
+		activityPub: activityPubConfig{
+			baseURL:           env.GetString("AP_BASE_URL", "http://localhost:8080"),
+			allowHTTP:         env.GetBool("AP_ALLOW_HTTP", false),
+			deliveryInterval:  env.GetDuration("AP_DELIVERY_INTERVAL", 10*time.Second),
+			deliveryBatch:     env.GetInt("AP_DELIVERY_BATCH", 50),
+			deliveryRetention: env.GetDuration("AP_DELIVERY_RETENTION", 7*24*time.Hour),
+		},
+		stream: streamConfig{
+			heartbeat:    env.GetDuration("STREAM_HEARTBEAT", 25*time.Second),
+			writeTimeout: env.GetDuration("STREAM_WRITE_TIMEOUT", 10*time.Second),
+			retry:        env.GetDuration("STREAM_RETRY", 3*time.Second),
+			batch:        env.GetInt("STREAM_BATCH", 100),
+			retention:    env.GetDuration("STREAM_RETENTION", 24*time.Hour),
+		},
+		webhooks: webhooksConfig{
+			interval:  env.GetDuration("WEBHOOKS_INTERVAL", 5*time.Second),
+			batch:     env.GetInt("WEBHOOKS_BATCH", 50),
+			timeout:   env.GetDuration("WEBHOOKS_TIMEOUT", 10*time.Second),
+			insecure:  env.GetBool("WEBHOOKS_ALLOW_INSECURE", false),
+			retention: env.GetDuration("WEBHOOKS_RETENTION", 7*24*time.Hour),
+		},
+		jobs: jobsConfig{
+			workers:  env.GetInt("JOBS_WORKERS", 10),
+			interval: env.GetDuration("JOBS_INTERVAL", time.Second),
+			lease:    env.GetDuration("JOBS_LEASE", 5*time.Minute),
+		},
+		events: eventsConfig{
+			interval:  env.GetDuration("EVENTS_INTERVAL", time.Second),
+			batch:     env.GetInt("EVENTS_BATCH", 100),
+			timeout:   env.GetDuration("EVENTS_TIMEOUT", 30*time.Second),
+			retention: env.GetDuration("EVENTS_RETENTION", 7*24*time.Hour),
+		},
+		shutdown: shutdownConfig{
+			delay:   env.GetDuration("SHUTDOWN_DELAY", 5*time.Second),
+			timeout: env.GetDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+		},
+		search: searchConfig{
+			language: env.GetString("SEARCH_LANGUAGE", store.DefaultSearchLanguage),
+		},
+		pagination: paginationConfig{
+			cursorSecret: env.GetString("CURSOR_SECRET", "development"),
+		},
+		trending: trendingConfig{
+			interval: env.GetDuration("TRENDING_INTERVAL", 5*time.Minute),
 		},
 		auth: authConfig{
 			basic: basicConfig{
@@ -60,10 +146,28 @@ func main() {
 		},
 	}
 
+	// Exits with an error once the deferred cleanups below ran, when the
+	// server failed
+	failed := false
+	defer func() {
+		if failed {
+			os.Exit(1)
+		}
+	}()
+
 	// Logger
 	logger := zap.Must(zap.NewProduction()).Sugar()
 	defer logger.Sync()
 
+	if err := cfg.validate(); err != nil {
+		logger.Fatal(err)
+	}
+
+	// Outside of production, emails are printed unless a provider is picked
+	if cfg.mail.provider == "" {
+		cfg.mail.provider = mailer.ProviderConsole
+	}
+
 	db, err := db.New(
 		cfg.db.url,
 		cfg.db.maxOpenConns,
@@ -77,23 +181,77 @@ func main() {
 	defer db.Close()
 	logger.Info("database connection established")
 
-	appStore := store.NewStorage(db)
+	if !store.SearchLanguages[cfg.search.language] {
+		logger.Fatalw("unsupported search language", "language", cfg.search.language)
+	}
+	appStore := store.NewStorage(db, store.Config{
+		FanoutThreshold: cfg.feed.fanoutThreshold,
+		SearchLanguage:  cfg.search.language,
+	})
 
 	// Mail
-	mailsender, err := mailer.NewMailSender(cfg.mail.apiKey, cfg.mail.fromEmail)
+	mailsender, err := mailer.New(mailer.Config{
+		Provider:  cfg.mail.provider,
+		FromEmail: cfg.mail.fromEmail,
+		APIKey:    cfg.mail.apiKey,
+		SMTP:      cfg.mail.smtp,
+		Dir:       cfg.mail.dir,
+	})
 	if err != nil {
 		logger.Fatal(err)
 	}
 
 	jwtAuth := auth.NewJWTAuthenticator(cfg.auth.token.secret, cfg.auth.token.iss, cfg.auth.token.iss)
 
+	// Domain events are relayed to the subscribers of the bus
+	bus := event.NewBus(db)
+
 	app := &application{
 		config:       *cfg,
 		store:        appStore,
 		logger:       logger,
 		mailer:       mailsender,
 		autheticator: jwtAuth,
+		federation:   activitypub.NewClient(10*time.Second, cfg.activityPub.allowHTTP),
+		streams:      stream.NewHub(),
+		webhooks:     webhook.NewClient(cfg.webhooks.timeout, cfg.webhooks.insecure),
+		jobs: job.NewClient(db, job.Config{
+			Workers:  cfg.jobs.workers,
+			Interval: cfg.jobs.interval,
+			Lease:    cfg.jobs.lease,
+			Logger:   logger,
+		}),
+		events: bus,
+		relay: event.NewRelay(db, bus, event.RelayConfig{
+			Interval: cfg.events.interval,
+			Batch:    cfg.events.batch,
+			Timeout:  cfg.events.timeout,
+			Logger:   logger,
+		}),
+	}
+
+	// Webhooks are queued the domain events they subscribed to
+	app.events.Subscribe("webhooks", app.store.Webhooks.EnqueueEvent, store.WebhookEvents...)
+
+	// Jobs
+	if err := app.setupJobs(); err != nil {
+		logger.Fatal(err)
+	}
+
+	if err := app.jobs.Start(context.Background()); err != nil {
+		logger.Fatal(err)
 	}
 
-	logger.Fatal(app.run(app.mount()))
+	app.relay.Start(context.Background())
+
+	app.startWorkers(
+		app.fanoutWorker,
+		app.streamListener,
+		app.streamEventsWorker,
+	)
+
+	if err := app.run(app.mount()); err != nil {
+		logger.Errorw("server has failed", "error", err)
+		failed = true
+	}
 }
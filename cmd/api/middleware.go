@@ -8,6 +8,7 @@ import (
 	"strconv"
 	"strings"
 
+	"com.github/jrovieri/golang/social/internal/store"
 	"github.com/golang-jwt/jwt/v5"
 )
 
@@ -43,7 +44,7 @@ func (app *application) AuthTokenMiddleware() func(http.Handler) http.Handler {
 
 			ctx := r.Context()
 
-			user, err := app.store.Posts.GetByID(ctx, userID)
+			user, err := app.store.Users.GetByID(ctx, userID)
 			if err != nil {
 				app.unauthorizedBasicAuth(w, r, fmt.Errorf("authorization header is malformed"))
 				return
@@ -89,3 +90,31 @@ func (app *application) BasicAuthMiddleware() func(http.Handler) http.Handler {
 		})
 	}
 }
+
+// checkRole lets only users with the required role, or a higher one, through
+// to next.
+func (app *application) checkRole(requiredRole string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := getUserFromContext(r)
+
+		allowed, err := app.checkRolePrecedence(r.Context(), user, requiredRole)
+		if err != nil {
+			app.internalServerError(w, r, err)
+			return
+		}
+
+		if !allowed {
+			app.forbidden(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+func (app *application) checkRolePrecedence(ctx context.Context, user *store.User, roleName string) (bool, error) {
+	role, err := app.store.Roles.GetByName(ctx, roleName)
+	if err != nil {
+		return false, err
+	}
+	return user.Role.Level >= role.Level, nil
+}
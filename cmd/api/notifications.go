@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"com.github/jrovieri/golang/social/internal/store"
+	"github.com/go-chi/chi/v5"
+)
+
+// GetNotifications godoc
+//
+//	@Summary		Fetches the notifications of the user
+//	@Description	Fetches follows, comments, replies, reactions and mentions, most recent
+//	@Description	first. Unread events on the same target are grouped, as in "alice and 4 others
+//	@Description	liked your comment"
+//	@Tags			notifications
+//	@Produce		json
+//	@Param			limit	query		int		false	"Limit"
+//	@Param			unread	query		bool	false	"Only unread notifications"
+//	@Param			cursor	query		string	false	"Cursor returned by the previous page"
+//	@Success		200		{object}	[]store.Notification
+//	@Failure		400		{object}	error
+//	@Failure		500		{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/notifications [get]
+func (app *application) getNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromContext(r)
+
+	nq := store.PaginatedNotificationQuery{Limit: 20}
+
+	nq, err := nq.Parse(r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if err := Validate.Struct(nq); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	nq.Cursor, err = app.decodeCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	notifications, next, err := app.store.Notifications.GetByUserID(r.Context(), user.ID, nq)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrInvalidCursor):
+			app.badRequest(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	if err := app.paginatedResponse(w, http.StatusOK, notifications, app.encodeCursor(next), ""); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+type unreadCountResponse struct {
+	Count int `json:"count"`
+}
+
+// GetUnreadNotificationsCount godoc
+//
+//	@Summary		Counts the unread notifications
+//	@Description	Counts the unread notifications of the user, each group once
+//	@Tags			notifications
+//	@Produce		json
+//	@Success		200	{object}	unreadCountResponse
+//	@Failure		500	{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/notifications/unread-count [get]
+func (app *application) getUnreadNotificationsCountHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromContext(r)
+
+	count, err := app.store.Notifications.CountUnread(r.Context(), user.ID)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	if err := app.jsonResponse(w, http.StatusOK, unreadCountResponse{Count: count}); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// ReadNotification godoc
+//
+//	@Summary		Marks a notification read
+//	@Description	Marks a notification read, along with every event grouped in it
+//	@Tags			notifications
+//	@Param			notificationID	path		int		true	"Notification ID"
+//	@Success		204				{string}	string	"Notification marked read"
+//	@Failure		400				{object}	error
+//	@Failure		404				{object}	error
+//	@Failure		500				{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/notifications/{notificationID}/read [put]
+func (app *application) readNotificationHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromContext(r)
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "notificationID"), 10, 64)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if err := app.store.Notifications.MarkRead(r.Context(), user.ID, id); err != nil {
+		switch {
+		case errors.Is(err, store.ErrResourceNotFound):
+			app.notFound(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ReadAllNotifications godoc
+//
+//	@Summary		Marks all notifications read
+//	@Description	Marks every notification of the user read
+//	@Tags			notifications
+//	@Success		204	{string}	string	"Notifications marked read"
+//	@Failure		500	{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/notifications/read [put]
+func (app *application) readAllNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromContext(r)
+
+	if err := app.store.Notifications.MarkAllRead(r.Context(), user.ID); err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
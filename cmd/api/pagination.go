@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"com.github/jrovieri/golang/social/internal/store"
+)
+
+// encodeCursor turns a store cursor into the opaque token handed to clients.
+// Tokens are signed so clients cannot craft cursors pointing anywhere they
+// like.
+func (app *application) encodeCursor(c *store.Cursor) string {
+	if c == nil {
+		return ""
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + app.signCursor(payload)
+}
+
+func (app *application) decodeCursor(token string) (*store.Cursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(app.signCursor(payload))) {
+		return nil, store.ErrInvalidCursor
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, store.ErrInvalidCursor
+	}
+
+	var c store.Cursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, store.ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+func (app *application) signCursor(payload string) string {
+	mac := hmac.New(sha256.New, []byte(app.config.pagination.cursorSecret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 
@@ -15,18 +16,23 @@ type postKey string
 const postCtx postKey = "post"
 
 type CreatePostPayload struct {
-	Title   string   `json:"title" validate:"required,max=100"`
-	Content string   `json:"content" validate:"required,max=1000"`
-	Tags    []string `json:"tags"`
+	Title      string   `json:"title" validate:"required,max=100"`
+	Content    string   `json:"content" validate:"required,max=1000"`
+	Tags       []string `json:"tags" validate:"omitempty,max=10"`
+	Language   string   `json:"language"`
+	Visibility string   `json:"visibility" validate:"omitempty,oneof=public followers"`
 }
 
 type UpdatePostPayload struct {
-	Title   string `json:"title" validate:"required,max=100,min=3"`
-	Content string `json:"content" validate:"required,max=1000,min=3"`
+	Title      string   `json:"title" validate:"required,max=100,min=3"`
+	Content    string   `json:"content" validate:"required,max=1000,min=3"`
+	Tags       []string `json:"tags" validate:"omitempty,max=10"`
+	Visibility *string  `json:"visibility" validate:"omitempty,oneof=public followers"`
 }
 
 type CreatPostCommentPayload struct {
-	Content string `json:"content" validate:"required,max=1000,min=3"`
+	Content  string `json:"content" validate:"required,max=1000,min=3"`
+	ParentID *int64 `json:"parent_id"`
 }
 
 // CreatePost godoc
@@ -56,13 +62,20 @@ func (app *application) createPostHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if payload.Language != "" && !store.SearchLanguages[payload.Language] {
+		app.badRequest(w, r, fmt.Errorf("unsupported language %q", payload.Language))
+		return
+	}
+
 	user := getUserFromContext(r)
 
 	post := &store.Post{
-		Title:   payload.Title,
-		Content: payload.Content,
-		Tags:    payload.Tags,
-		UserID:  user.ID,
+		Title:      payload.Title,
+		Content:    payload.Content,
+		Tags:       payload.Tags,
+		Language:   payload.Language,
+		Visibility: payload.Visibility,
+		UserID:     user.ID,
 	}
 
 	if err := app.store.Posts.Create(r.Context(), post); err != nil {
@@ -93,12 +106,24 @@ func (app *application) getPostHandler(w http.ResponseWriter, r *http.Request) {
 
 	post := getPostFromContext(r)
 
-	comments, err := app.store.Comments.GetByPostID(r.Context(), post.ID)
+	cq := store.PaginatedCommentQuery{
+		Limit: 20,
+		Sort:  "newest",
+	}
+
+	comments, next, err := app.store.Comments.GetByPostID(r.Context(), post.ID, cq)
 	if err != nil {
 		app.internalServerError(w, r, err)
 		return
 	}
 	post.Comments = comments
+	post.CommentsNextCursor = app.encodeCursor(next)
+
+	post.CommentCount, err = app.store.Comments.CountByPostID(r.Context(), post.ID)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
 
 	if err = app.jsonResponse(w, http.StatusCreated, post); err != nil {
 		app.internalServerError(w, r, err)
@@ -168,8 +193,19 @@ func (app *application) updatePostHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	// Tags left out of the payload are kept, while the ones coming from the
+	// hashtags of the old content are recomputed from the new one.
+	if payload.Tags != nil {
+		post.Tags = payload.Tags
+	} else {
+		post.Tags = store.WithoutHashtags(post.Tags, post.Content)
+	}
+
 	post.Title = payload.Title
 	post.Content = payload.Content
+	if payload.Visibility != nil {
+		post.Visibility = *payload.Visibility
+	}
 
 	if err := app.store.Posts.Update(r.Context(), post); err != nil {
 		app.internalServerError(w, r, err)
@@ -182,8 +218,24 @@ func (app *application) updatePostHandler(w http.ResponseWriter, r *http.Request
 	}
 }
 
+// CreatePostComment godoc
+//
+//	@Summary		Creates a comment
+//	@Description	Creates a comment on a post, optionally as a reply to another comment
+//	@Tags			comments
+//	@Accept			json
+//	@Produce		json
+//	@Param			postID	path		int						true	"Post ID"
+//	@Param			payload	body		CreatPostCommentPayload	true	"Comment payload"
+//	@Success		201		{object}	store.Comment
+//	@Failure		400		{object}	error
+//	@Failure		404		{object}	error
+//	@Failure		500		{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/posts/{postID}/comments [post]
 func (app *application) createPostCommentHandler(w http.ResponseWriter, r *http.Request) {
 	post := getPostFromContext(r)
+	user := getUserFromContext(r)
 
 	var payload CreatPostCommentPayload
 	if err := readJSON(w, r, &payload); err != nil {
@@ -196,10 +248,29 @@ func (app *application) createPostCommentHandler(w http.ResponseWriter, r *http.
 		return
 	}
 
+	if payload.ParentID != nil {
+		parent, err := app.store.Comments.GetByID(r.Context(), *payload.ParentID)
+		if err != nil {
+			switch {
+			case errors.Is(err, store.ErrResourceNotFound):
+				app.badRequest(w, r, errors.New("parent comment not found"))
+			default:
+				app.internalServerError(w, r, err)
+			}
+			return
+		}
+
+		if parent.PostID != post.ID || parent.IsDeleted {
+			app.badRequest(w, r, errors.New("cannot reply to this comment"))
+			return
+		}
+	}
+
 	comment := store.Comment{
-		UserID:  post.UserID,
-		PostID:  post.ID,
-		Content: payload.Content,
+		UserID:   user.ID,
+		PostID:   post.ID,
+		ParentID: payload.ParentID,
+		Content:  payload.Content,
 	}
 
 	newComment, err := app.store.Comments.Create(r.Context(), &comment)
@@ -236,6 +307,21 @@ func (app *application) postsContextMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
+		// Posts for followers only are hidden from everyone else as if they
+		// did not exist.
+		if user := getUserFromContext(r); post.Visibility != "public" && post.UserID != user.ID {
+			following, err := app.store.Users.IsFollowing(ctx, user.ID, post.UserID)
+			if err != nil {
+				app.internalServerError(w, r, err)
+				return
+			}
+
+			if !following {
+				app.notFound(w, r, store.ErrResourceNotFound)
+				return
+			}
+		}
+
 		ctx = context.WithValue(ctx, postCtx, post)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
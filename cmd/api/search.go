@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"com.github/jrovieri/golang/social/internal/store"
+)
+
+// Search godoc
+//
+//	@Summary		Searches posts, comments or users
+//	@Description	Full-text search ranked by relevance, with highlighted snippets. Supports
+//	@Description	"quoted phrases", OR, -exclusions and prefix* terms. Usernames also match
+//	@Description	on similarity, so small typos still find them
+//	@Tags			search
+//	@Produce		json
+//	@Param			q		query		string	true	"Search query"
+//	@Param			type	query		string	false	"Type (posts, comments, users)"
+//	@Param			lang	query		string	false	"Text search language"
+//	@Param			limit	query		int		false	"Limit"
+//	@Param			cursor	query		string	false	"Cursor returned by the previous page"
+//	@Success		200		{object}	[]store.SearchResult
+//	@Failure		400		{object}	error
+//	@Failure		500		{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/search [get]
+func (app *application) searchHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromContext(r)
+
+	sq := store.SearchQuery{
+		Type:     "posts",
+		Language: app.config.search.language,
+		Limit:    20,
+	}
+
+	sq, err := sq.Parse(r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if err := Validate.Struct(sq); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	sq.Cursor, err = app.decodeCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	results, next, err := app.store.Search.Search(r.Context(), user.ID, sq)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrInvalidCursor):
+			app.badRequest(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	if err := app.paginatedResponse(w, http.StatusOK, results, app.encodeCursor(next), ""); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
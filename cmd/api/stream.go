@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"com.github/jrovieri/golang/social/internal/store"
+	"com.github/jrovieri/golang/social/internal/stream"
+	"github.com/lib/pq"
+)
+
+type streamKey string
+
+const accessTokenCtx streamKey = "accessToken"
+
+// eventWriter sends stream events over SSE or WebSocket.
+type eventWriter interface {
+	WriteEvent(e store.StreamEvent) error
+	WriteHeartbeat() error
+}
+
+type sseWriter struct{ *stream.SSE }
+
+func (w sseWriter) WriteEvent(e store.StreamEvent) error {
+	return w.SSE.WriteEvent(e.ID, e.Type, e.Data)
+}
+
+type websocketWriter struct{ *stream.WebSocket }
+
+func (w websocketWriter) WriteEvent(e store.StreamEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return w.WebSocket.WriteEvent(data)
+}
+
+// Stream godoc
+//
+//	@Summary		Streams events
+//	@Description	Pushes new feed items, notifications, comments on the conversations of the
+//	@Description	user, direct messages and read receipts as they happen, over Server-Sent
+//	@Description	Events or, when the request asks to upgrade, WebSocket. Streams resume after
+//	@Description	the event in the Last-Event-ID header or the last_event_id parameter. Clients
+//	@Description	that cannot set headers may pass their token in access_token. WebSockets
+//	@Description	opened by browsers must come from the frontend
+//	@Tags			stream
+//	@Produce		text/event-stream
+//	@Param			last_event_id	query		int		false	"Resume after this event"
+//	@Param			access_token	query		string	false	"Token, when it cannot be sent in a header"
+//	@Success		200				{string}	string	"Event stream"
+//	@Success		101				{string}	string	"Switching to WebSocket"
+//	@Failure		400				{object}	error
+//	@Failure		401				{object}	error
+//	@Failure		403				{object}	error
+//	@Failure		500				{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/stream [get]
+func (app *application) streamHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromContext(r)
+	ctx := r.Context()
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+
+	var after int64
+	if lastEventID != "" {
+		var err error
+		after, err = strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || after < 0 {
+			app.badRequest(w, r, errors.New("invalid Last-Event-ID"))
+			return
+		}
+	} else {
+		var err error
+		after, err = app.store.Streams.LatestEventID(ctx, user.ID)
+		if err != nil {
+			app.internalServerError(w, r, err)
+			return
+		}
+	}
+
+	// Subscribe before catching up so nothing published meanwhile is missed
+	sub := app.streams.Subscribe(user.ID)
+	defer sub.Close()
+
+	cfg := app.config.stream
+
+	if stream.IsWebSocket(r) {
+		ws, err := stream.Upgrade(w, r, app.config.frontendURL, cfg.writeTimeout, 2*cfg.heartbeat)
+		if err != nil {
+			switch {
+			case errors.Is(err, stream.ErrNotWebSocket):
+				app.badRequest(w, r, err)
+				return
+			case errors.Is(err, stream.ErrForbiddenOrigin):
+				app.forbidden(w, r)
+				return
+			}
+			app.logger.Warnw("error upgrading to websocket", "error", err)
+			return
+		}
+
+		// The connection is ours now, so its end cancels the stream
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			defer cancel()
+			if err := ws.ReadLoop(); err != nil {
+				app.logger.Debugw("websocket closed", "user", user.ID, "error", err)
+			}
+		}()
+
+		err = app.pumpEvents(ctx, sub, websocketWriter{ws}, after)
+		code := stream.CloseNormal
+		if err != nil {
+			code = stream.CloseGoingAway
+		}
+		ws.Close(code)
+		return
+	}
+
+	sse, err := stream.NewSSE(w, cfg.writeTimeout, cfg.retry)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	if err := app.pumpEvents(ctx, sub, sseWriter{sse}, after); err != nil {
+		app.logger.Debugw("event stream closed", "user", user.ID, "error", err)
+	}
+}
+
+// pumpEvents sends the events of the user that came after the given ID, then
+// keeps sending new ones as the subscription is woken, until ctx is done, a
+// write fails or the hub is closed on shutdown, which returns
+// stream.ErrClosed. Writes that take longer than the write timeout fail,
+// which drops clients that stop reading; they resume from the last event
+// they got.
+func (app *application) pumpEvents(ctx context.Context, sub *stream.Subscription, out eventWriter, after int64) error {
+	cfg := app.config.stream
+
+	heartbeat := time.NewTicker(cfg.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		for {
+			events, err := app.store.Streams.GetEvents(ctx, sub.UserID, after, cfg.batch)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+
+			for _, e := range events {
+				if err := out.WriteEvent(e); err != nil {
+					return err
+				}
+				after = e.ID
+			}
+
+			if len(events) < cfg.batch {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-sub.Done:
+			return stream.ErrClosed
+		case <-sub.C:
+		case <-heartbeat.C:
+			if err := out.WriteHeartbeat(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// redactTokenMiddleware takes the access_token parameter out of the URL
+// before the request is logged, keeping it in the context for
+// streamTokenMiddleware.
+func (app *application) redactTokenMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		token := query.Get("access_token")
+		if token == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		query.Del("access_token")
+		r = r.Clone(context.WithValue(r.Context(), accessTokenCtx, token))
+		r.URL.RawQuery = query.Encode()
+		r.RequestURI = r.URL.RequestURI()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// streamTokenMiddleware lets clients that cannot set headers, such as
+// browsers opening an EventSource or a WebSocket, pass their token in the
+// access_token parameter.
+func (app *application) streamTokenMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := r.Context().Value(accessTokenCtx).(string)
+		if token != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// streamListener wakes up the streams of this replica as Postgres notifies
+// new events, whichever replica published them.
+func (app *application) streamListener(ctx context.Context) {
+	listener := pq.NewListener(app.config.db.url, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			app.logger.Warnw("stream listener", "event", ev, "error", err)
+		}
+	})
+
+	if err := app.streams.Listen(ctx, listener, store.StreamChannel); err != nil {
+		app.logger.Errorw("error listening to stream events", "error", err)
+	}
+}
+
+// streamEventsWorker deletes the events that are too old to resume from.
+func (app *application) streamEventsWorker(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		if err := app.store.Streams.Prune(ctx, app.config.stream.retention); err != nil {
+			app.logger.Errorw("error pruning stream events", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
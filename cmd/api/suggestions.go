@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"com.github/jrovieri/golang/social/internal/store"
+)
+
+// GetSuggestions godoc
+//
+//	@Summary		Fetches who to follow
+//	@Description	Fetches accounts the user may want to follow, based on the accounts followed
+//	@Description	by the people they follow, the tags they follow and popular accounts
+//	@Tags			users
+//	@Produce		json
+//	@Param			limit	query		int	false	"Limit"
+//	@Success		200		{object}	[]store.Suggestion
+//	@Failure		400		{object}	error
+//	@Failure		500		{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/users/suggestions [get]
+func (app *application) getSuggestionsHandler(w http.ResponseWriter, r *http.Request) {
+
+	user := getUserFromContext(r)
+
+	limit := 10
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > store.MaxSuggestions {
+			app.badRequest(w, r, errors.New("limit must be between 1 and 50"))
+			return
+		}
+	}
+
+	suggestions, err := app.store.Suggestions.Get(r.Context(), user.ID, limit)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	if err := app.jsonResponse(w, http.StatusOK, suggestions); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// refreshSuggestionsJob keeps the follow suggestions up to date. Users whose
+// follows or tags changed are queued by the store as it happens; everyone
+// else is queued again once their suggestions get older than maxAge. It runs
+// every suggestions interval.
+func (app *application) refreshSuggestionsJob(ctx context.Context, args refreshSuggestionsArgs) error {
+	if err := app.store.Suggestions.EnqueueStale(ctx, app.config.suggestions.maxAge); err != nil {
+		return err
+	}
+
+	for {
+		n, err := app.store.Suggestions.Refresh(ctx, app.config.suggestions.batch)
+		if err != nil {
+			return err
+		}
+		if n < app.config.suggestions.batch {
+			return nil
+		}
+	}
+}
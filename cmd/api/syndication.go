@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"com.github/jrovieri/golang/social/internal/store"
+	"com.github/jrovieri/golang/social/internal/syndication"
+	"github.com/go-chi/chi/v5"
+)
+
+// syndicationSize is the number of posts in a syndication feed.
+const syndicationSize = 20
+
+// GetUserSyndication godoc
+//
+//	@Summary		Syndicates the posts of a user
+//	@Description	Renders the latest public posts of a user as Atom 1.0, RSS 2.0 or JSON Feed 1.1.
+//	@Description	Supports conditional requests with If-None-Match and If-Modified-Since
+//	@Tags			syndication
+//	@Produce		xml,json
+//	@Param			userID	path		int		true	"User ID"
+//	@Param			format	path		string	true	"Format (atom, rss, json)"
+//	@Success		200		{string}	string	"Feed document"
+//	@Success		304		{string}	string	"Not modified"
+//	@Failure		404		{object}	error
+//	@Failure		500		{object}	error
+//	@Router			/feeds/users/{userID}/{format} [get]
+func (app *application) getUserSyndicationHandler(w http.ResponseWriter, r *http.Request) {
+
+	format, ok := syndication.Formats[chi.URLParam(r, "format")]
+	if !ok {
+		app.notFound(w, r, errors.New("unknown feed format"))
+		return
+	}
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	user, err := app.store.Users.GetByID(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrResourceNotFound):
+			app.notFound(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	if !user.IsActive {
+		app.notFound(w, r, store.ErrResourceNotFound)
+		return
+	}
+
+	fq := store.PaginatedFeedQuery{Limit: syndicationSize, Sort: "desc"}
+
+	page, err := app.store.Posts.GetUserPosts(r.Context(), user.ID, store.AnonymousUserID, fq)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	author := app.syndicationAuthor(user.ID, user.Username)
+	feed := &syndication.Feed{
+		ID:          author.URI,
+		Title:       fmt.Sprintf("Posts by %s", user.Username),
+		Description: fmt.Sprintf("The latest public posts by %s on GopherSocial", user.Username),
+		Link:        author.URI,
+		Self:        requestURL(r),
+		Author:      &author,
+	}
+	app.addSyndicationEntries(feed, page.Posts)
+
+	app.writeSyndication(w, r, format, feed)
+}
+
+// GetTagSyndication godoc
+//
+//	@Summary		Syndicates the posts of a tag
+//	@Description	Renders the latest public posts of a tag as Atom 1.0, RSS 2.0 or JSON Feed 1.1.
+//	@Description	Supports conditional requests with If-None-Match and If-Modified-Since
+//	@Tags			syndication
+//	@Produce		xml,json
+//	@Param			tag		path		string	true	"Tag"
+//	@Param			format	path		string	true	"Format (atom, rss, json)"
+//	@Success		200		{string}	string	"Feed document"
+//	@Success		304		{string}	string	"Not modified"
+//	@Failure		404		{object}	error
+//	@Failure		500		{object}	error
+//	@Router			/feeds/tags/{tag}/{format} [get]
+func (app *application) getTagSyndicationHandler(w http.ResponseWriter, r *http.Request) {
+
+	format, ok := syndication.Formats[chi.URLParam(r, "format")]
+	if !ok {
+		app.notFound(w, r, errors.New("unknown feed format"))
+		return
+	}
+
+	tag := store.NormalizeTag(chi.URLParam(r, "tag"))
+	if tag == "" {
+		app.notFound(w, r, store.ErrResourceNotFound)
+		return
+	}
+
+	fq := store.PaginatedFeedQuery{Limit: syndicationSize, Sort: "desc"}
+
+	posts, err := app.store.Tags.GetPosts(r.Context(), tag, store.AnonymousUserID, fq)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	link := fmt.Sprintf("%s/tags/%s", app.config.frontendURL, tag)
+	feed := &syndication.Feed{
+		ID:          link,
+		Title:       fmt.Sprintf("#%s", tag),
+		Description: fmt.Sprintf("The latest public posts tagged #%s on GopherSocial", tag),
+		Link:        link,
+		Self:        requestURL(r),
+	}
+	app.addSyndicationEntries(feed, posts)
+
+	app.writeSyndication(w, r, format, feed)
+}
+
+func (app *application) syndicationAuthor(id int64, username string) syndication.Author {
+	return syndication.Author{
+		Name: username,
+		URI:  fmt.Sprintf("%s/users/%d", app.config.frontendURL, id),
+	}
+}
+
+// addSyndicationEntries adds the posts to the feed, which is last updated when
+// the most recently changed of them was.
+func (app *application) addSyndicationEntries(feed *syndication.Feed, posts []store.PostWithMetadata) {
+	for _, p := range posts {
+		link := fmt.Sprintf("%s/posts/%d", app.config.frontendURL, p.ID)
+
+		published, _ := time.Parse(time.RFC3339Nano, p.CreatedAt)
+		updated, _ := time.Parse(time.RFC3339Nano, p.UpdatedAt)
+		if updated.Before(published) {
+			updated = published
+		}
+
+		feed.Entries = append(feed.Entries, syndication.Entry{
+			ID:        link,
+			Title:     p.Title,
+			Link:      link,
+			Content:   p.Content,
+			Author:    app.syndicationAuthor(p.User.ID, p.User.Username),
+			Tags:      p.Tags,
+			Published: published,
+			Updated:   updated,
+		})
+
+		if updated.After(feed.Updated) {
+			feed.Updated = updated
+		}
+	}
+}
+
+// writeSyndication renders the feed, answering with 304 Not Modified when the
+// client already has the current version of it.
+func (app *application) writeSyndication(w http.ResponseWriter, r *http.Request, format syndication.Format, feed *syndication.Feed) {
+
+	body, err := format.Render(feed)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(body))
+	lastModified := feed.Updated.UTC().Truncate(time.Second)
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	}
+
+	if notModified(r, etag, lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.ContentType)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(body); err != nil {
+		app.logger.Warnw("error writing feed", "path", r.URL.Path, "error", err)
+	}
+}
+
+// notModified evaluates the conditional headers of a GET request. As in RFC
+// 9110, If-Modified-Since is ignored when If-None-Match is present.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !lastModified.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !lastModified.After(t)
+	}
+	return false
+}
+
+// requestURL rebuilds the absolute URL the client used to reach the API.
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, r.Host, r.URL.Path)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"com.github/jrovieri/golang/social/internal/store"
+	"github.com/go-chi/chi/v5"
+)
+
+// SearchTags godoc
+//
+//	@Summary		Autocompletes tags
+//	@Description	Fetches the most used tags starting with the given prefix
+//	@Tags			tags
+//	@Produce		json
+//	@Param			q		query		string	true	"Tag prefix"
+//	@Param			limit	query		int		false	"Limit"
+//	@Success		200		{object}	[]store.Tag
+//	@Failure		400		{object}	error
+//	@Failure		500		{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/tags [get]
+func (app *application) searchTagsHandler(w http.ResponseWriter, r *http.Request) {
+
+	prefix := store.NormalizeTag(r.URL.Query().Get("q"))
+	if prefix == "" {
+		app.badRequest(w, r, errors.New("q is required"))
+		return
+	}
+
+	limit := 10
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > 20 {
+			app.badRequest(w, r, errors.New("limit must be between 1 and 20"))
+			return
+		}
+	}
+
+	tags, err := app.store.Tags.Search(r.Context(), prefix, limit)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	if err := app.jsonResponse(w, http.StatusOK, tags); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// GetTagPosts godoc
+//
+//	@Summary		Fetches the posts of a tag
+//	@Description	Fetches the posts tagged with the given tag, leaving out those of users on
+//	@Description	either side of a block with the user
+//	@Tags			tags
+//	@Produce		json
+//	@Param			tag		path		string	true	"Tag"
+//	@Param			limit	query		int		false	"Limit"
+//	@Param			offset	query		int		false	"Offset"
+//	@Param			sort	query		string	false	"Sort"
+//	@Param			search	query		string	false	"Search"
+//	@Success		200		{object}	[]store.PostWithMetadata
+//	@Failure		400		{object}	error
+//	@Failure		500		{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/tags/{tag}/posts [get]
+func (app *application) getTagPostsHandler(w http.ResponseWriter, r *http.Request) {
+
+	fq := store.PaginatedFeedQuery{
+		Limit:  20,
+		Offset: 0,
+		Sort:   "desc",
+	}
+
+	fq, err := fq.Parse(r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if err := Validate.Struct(fq); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	user := getUserFromContext(r)
+
+	posts, err := app.store.Tags.GetPosts(r.Context(), chi.URLParam(r, "tag"), user.ID, fq)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	if err := app.jsonResponse(w, http.StatusOK, posts); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// FollowTag godoc
+//
+//	@Summary		Follows a tag
+//	@Description	Follows a tag so its posts show up in the user feed
+//	@Tags			tags
+//	@Produce		json
+//	@Param			tag	path		string	true	"Tag"
+//	@Success		204	{string}	string	"Tag followed"
+//	@Failure		400	{object}	error
+//	@Failure		409	{object}	error	"Tag already followed"
+//	@Security		ApiKeyAuth
+//	@Router			/tags/{tag}/follow [put]
+func (app *application) followTagHandler(w http.ResponseWriter, r *http.Request) {
+
+	user := getUserFromContext(r)
+
+	tag := store.NormalizeTag(chi.URLParam(r, "tag"))
+	if tag == "" {
+		app.badRequest(w, r, errors.New("invalid tag"))
+		return
+	}
+
+	if err := app.store.Tags.Follow(r.Context(), tag, user.ID); err != nil {
+		switch err {
+		case store.ErrConflict:
+			app.conflict(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UnfollowTag godoc
+//
+//	@Summary		Unfollows a tag
+//	@Description	Unfollows a tag
+//	@Tags			tags
+//	@Produce		json
+//	@Param			tag	path		string	true	"Tag"
+//	@Success		204	{string}	string	"Tag unfollowed"
+//	@Security		ApiKeyAuth
+//	@Router			/tags/{tag}/unfollow [put]
+func (app *application) unfollowTagHandler(w http.ResponseWriter, r *http.Request) {
+
+	user := getUserFromContext(r)
+
+	if err := app.store.Tags.UnFollow(r.Context(), chi.URLParam(r, "tag"), user.ID); err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"com.github/jrovieri/golang/social/internal/store"
+)
+
+// GetTrendingTags godoc
+//
+//	@Summary		Fetches the trending tags
+//	@Description	Fetches the trending tags over the last hour, day or week
+//	@Tags			trending
+//	@Produce		json
+//	@Param			window	query		string	false	"Window (hour, day, week)"
+//	@Param			limit	query		int		false	"Limit"
+//	@Success		200		{object}	[]store.TrendingTag
+//	@Failure		400		{object}	error
+//	@Failure		500		{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/trending/tags [get]
+func (app *application) getTrendingTagsHandler(w http.ResponseWriter, r *http.Request) {
+
+	window, limit, err := parseTrendingQuery(r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	tags, err := app.store.Trending.GetTags(r.Context(), window, limit)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	if err := app.jsonResponse(w, http.StatusOK, tags); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// GetTrendingPosts godoc
+//
+//	@Summary		Fetches the trending posts
+//	@Description	Fetches the trending posts over the last hour, day or week
+//	@Tags			trending
+//	@Produce		json
+//	@Param			window	query		string	false	"Window (hour, day, week)"
+//	@Param			limit	query		int		false	"Limit"
+//	@Success		200		{object}	[]store.TrendingPost
+//	@Failure		400		{object}	error
+//	@Failure		500		{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/trending/posts [get]
+func (app *application) getTrendingPostsHandler(w http.ResponseWriter, r *http.Request) {
+
+	window, limit, err := parseTrendingQuery(r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	posts, err := app.store.Trending.GetPosts(r.Context(), window, limit)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	if err := app.jsonResponse(w, http.StatusOK, posts); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+func parseTrendingQuery(r *http.Request) (string, int, error) {
+	window := r.URL.Query().Get("window")
+	if window == "" {
+		window = "day"
+	}
+
+	if _, ok := store.TrendingWindows[window]; !ok {
+		return "", 0, errors.New("window must be one of hour, day, week")
+	}
+
+	limit := 20
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > store.MaxTrendingResults {
+			return "", 0, errors.New("limit must be between 1 and 100")
+		}
+	}
+	return window, limit, nil
+}
+
+// recomputeTrendingJob recomputes the trending scores of every window so
+// reads only hit the precomputed tables. It runs every trending interval.
+func (app *application) recomputeTrendingJob(ctx context.Context, args recomputeTrendingArgs) error {
+	var errs []error
+	for window := range store.TrendingWindows {
+		if err := app.store.Trending.Recompute(ctx, window); err != nil {
+			errs = append(errs, fmt.Errorf("window %s: %w", window, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"strconv"
 
@@ -10,7 +12,10 @@ import (
 
 type UserKey string
 
-const userCtx UserKey = "user"
+const (
+	userCtx       UserKey = "user"
+	targetUserCtx UserKey = "targetUser"
+)
 
 type FollowUser struct {
 	UserID int64 `json:"user_id"`
@@ -32,13 +37,68 @@ type FollowUser struct {
 //	@Router			/users/{id} [get]
 func (app *application) getUserHandler(w http.ResponseWriter, r *http.Request) {
 
-	user := getUserFromContext(r)
+	user := *getTargetUserFromContext(r)
+
+	// The email is only shown to its owner
+	if user.ID != getUserFromContext(r).ID {
+		user.Email = ""
+	}
 
 	if err := app.jsonResponse(w, http.StatusOK, &user); err != nil {
 		app.internalServerError(w, r, err)
 	}
 }
 
+// GetUserPosts godoc
+//
+//	@Summary		Fetches the posts of a user
+//	@Description	Fetches the posts written by a user. Posts for followers only are left out
+//	@Description	unless the authenticated user follows the author
+//	@Tags			users
+//	@Produce		json
+//	@Param			userID	path		int		true	"User ID"
+//	@Param			since	query		string	false	"Since, inclusive (RFC 3339 or YYYY-MM-DD)"
+//	@Param			until	query		string	false	"Until, exclusive (RFC 3339 or YYYY-MM-DD, a date covers the whole day)"
+//	@Param			tz		query		string	false	"IANA time zone for values without an offset, defaults to UTC"
+//	@Param			limit	query		int		false	"Limit"
+//	@Param			cursor	query		string	false	"Cursor returned by a previous page"
+//	@Param			sort	query		string	false	"Sort"
+//	@Param			tags	query		string	false	"Tags"
+//	@Param			search	query		string	false	"Search"
+//	@Success		200		{object}	[]store.PostWithMetadata
+//	@Failure		400		{object}	error
+//	@Failure		404		{object}	error
+//	@Failure		500		{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/users/{userID}/posts [get]
+func (app *application) getUserPostsHandler(w http.ResponseWriter, r *http.Request) {
+
+	user := getUserFromContext(r)
+	author := getTargetUserFromContext(r)
+
+	fq, err := app.parseFeedQuery(r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	page, err := app.store.Posts.GetUserPosts(r.Context(), author.ID, user.ID, fq)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrInvalidCursor):
+			app.badRequest(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	next, prev := app.encodeCursor(page.Next), app.encodeCursor(page.Prev)
+	if err := app.paginatedResponse(w, http.StatusOK, page.Posts, next, prev); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
 // FollowUser godoc
 //
 //	@Summary		Follows a user
@@ -118,6 +178,187 @@ func (app *application) unfollowUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 }
 
+// BlockUser godoc
+//
+//	@Summary		Blocks a user
+//	@Description	Blocks a user by ID and removes the follow relationship between both users
+//	@Tags			users
+//	@Produce		json
+//	@Param			userID	path		int		true	"User ID"
+//	@Success		204		{string}	string	"User blocked"
+//	@Failure		400		{object}	error
+//	@Failure		404		{object}	error	"User not found"
+//	@Failure		409		{object}	error	"User already blocked"
+//	@Security		ApiKeyAuth
+//	@Router			/users/{userID}/block [put]
+func (app *application) blockUserHandler(w http.ResponseWriter, r *http.Request) {
+
+	user := getUserFromContext(r)
+
+	blockedID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if blockedID == user.ID {
+		app.badRequest(w, r, errors.New("users cannot block themselves"))
+		return
+	}
+
+	if err := app.store.Users.Block(r.Context(), user.ID, blockedID); err != nil {
+		switch err {
+		case store.ErrConflict:
+			app.conflict(w, r, err)
+		case store.ErrResourceNotFound:
+			app.notFound(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UnblockUser godoc
+//
+//	@Summary		Unblocks a user
+//	@Description	Unblocks a user by ID
+//	@Tags			users
+//	@Produce		json
+//	@Param			userID	path		int		true	"User ID"
+//	@Success		204		{string}	string	"User unblocked"
+//	@Failure		400		{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/users/{userID}/unblock [put]
+func (app *application) unblockUserHandler(w http.ResponseWriter, r *http.Request) {
+
+	user := getUserFromContext(r)
+
+	blockedID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if err := app.store.Users.UnBlock(r.Context(), user.ID, blockedID); err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetUserMentions godoc
+//
+//	@Summary		Fetches the posts mentioning the user
+//	@Description	Fetches the posts mentioning a user. Users can only see their own mentions
+//	@Tags			users
+//	@Produce		json
+//	@Param			userID	path		int		true	"User ID"
+//	@Param			limit	query		int		false	"Limit"
+//	@Param			offset	query		int		false	"Offset"
+//	@Param			sort	query		string	false	"Sort"
+//	@Success		200		{object}	[]store.PostWithMetadata
+//	@Failure		400		{object}	error
+//	@Failure		403		{object}	error
+//	@Failure		500		{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/users/{userID}/mentions [get]
+func (app *application) getUserMentionsHandler(w http.ResponseWriter, r *http.Request) {
+
+	user := getUserFromContext(r)
+
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if userID != user.ID {
+		app.forbidden(w, r)
+		return
+	}
+
+	fq := store.PaginatedFeedQuery{
+		Limit:  20,
+		Offset: 0,
+		Sort:   "desc",
+	}
+
+	fq, err = fq.Parse(r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if err := Validate.Struct(fq); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	posts, err := app.store.Mentions.GetMentionedPosts(r.Context(), user.ID, fq)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	if err := app.jsonResponse(w, http.StatusOK, posts); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// usersContextMiddleware loads the user of the {userID} path parameter. Inactive
+// users and users on either side of a block are not found.
+func (app *application) usersContextMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+
+		ctx := r.Context()
+
+		user, err := app.store.Users.GetByID(ctx, id)
+		if err != nil {
+			switch {
+			case errors.Is(err, store.ErrResourceNotFound):
+				app.notFound(w, r, err)
+			default:
+				app.internalServerError(w, r, err)
+			}
+			return
+		}
+
+		if !user.IsActive {
+			app.notFound(w, r, store.ErrResourceNotFound)
+			return
+		}
+
+		if viewer := getUserFromContext(r); viewer != nil {
+			blocked, err := app.store.Users.IsBlocked(ctx, viewer.ID, user.ID)
+			if err != nil {
+				app.internalServerError(w, r, err)
+				return
+			}
+
+			if blocked {
+				app.notFound(w, r, store.ErrResourceNotFound)
+				return
+			}
+		}
+
+		ctx = context.WithValue(ctx, targetUserCtx, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func getTargetUserFromContext(r *http.Request) *store.User {
+	user, _ := r.Context().Value(targetUserCtx).(*store.User)
+	return user
+}
+
 func getUserFromContext(r *http.Request) *store.User {
 	user, _ := r.Context().Value(userCtx).(*store.User)
 	return user
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"com.github/jrovieri/golang/social/internal/store"
+	"github.com/go-chi/chi/v5"
+)
+
+type webhookKey string
+
+const webhookCtx webhookKey = "webhook"
+
+type CreateWebhookPayload struct {
+	URL    string   `json:"url" validate:"required,url,max=2000"`
+	Events []string `json:"events" validate:"required,min=1,dive,oneof=post.created post.updated post.deleted user.followed comment.created"`
+	Global bool     `json:"global"`
+}
+
+type UpdateWebhookPayload struct {
+	URL    *string  `json:"url" validate:"omitempty,url,max=2000"`
+	Events []string `json:"events" validate:"omitempty,min=1,dive,oneof=post.created post.updated post.deleted user.followed comment.created"`
+	Active *bool    `json:"active"`
+}
+
+// CreateWebhook godoc
+//
+//	@Summary		Registers a webhook
+//	@Description	Registers an URL to receive the events it subscribes to, about the posts,
+//	@Description	followers and comments of the user. Admins may register global webhooks, which
+//	@Description	receive every event. Payloads are signed with the returned secret, which is
+//	@Description	not shown again
+//	@Tags			webhooks
+//	@Accept			json
+//	@Produce		json
+//	@Param			payload	body		CreateWebhookPayload	true	"Webhook payload"
+//	@Success		201		{object}	store.Webhook
+//	@Failure		400		{object}	error
+//	@Failure		403		{object}	error
+//	@Failure		500		{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/webhooks [post]
+func (app *application) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+
+	var payload CreateWebhookPayload
+	if err := readJSON(w, r, &payload); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if err := Validate.Struct(payload); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if err := app.webhooks.CheckURL(payload.URL); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	user := getUserFromContext(r)
+	ctx := r.Context()
+
+	if payload.Global {
+		allowed, err := app.checkRolePrecedence(ctx, user, "admin")
+		if err != nil {
+			app.internalServerError(w, r, err)
+			return
+		}
+
+		if !allowed {
+			app.forbidden(w, r)
+			return
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	webhook := &store.Webhook{
+		UserID: user.ID,
+		URL:    payload.URL,
+		Secret: "whsec_" + hex.EncodeToString(secret),
+		Events: payload.Events,
+		Global: payload.Global,
+	}
+
+	if err := app.store.Webhooks.Create(ctx, webhook); err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	if err := app.jsonResponse(w, http.StatusCreated, webhook); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// GetWebhooks godoc
+//
+//	@Summary		Fetches the webhooks of the user
+//	@Description	Fetches the webhooks registered by the user
+//	@Tags			webhooks
+//	@Produce		json
+//	@Success		200	{object}	[]store.Webhook
+//	@Failure		500	{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/webhooks [get]
+func (app *application) getWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromContext(r)
+
+	webhooks, err := app.store.Webhooks.GetByUserID(r.Context(), user.ID)
+	if err != nil {
+		app.internalServerError(w, r, err)
+		return
+	}
+
+	if err := app.jsonResponse(w, http.StatusOK, webhooks); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// GetWebhook godoc
+//
+//	@Summary		Fetches a webhook
+//	@Description	Fetches a webhook by ID
+//	@Tags			webhooks
+//	@Produce		json
+//	@Param			webhookID	path		int	true	"Webhook ID"
+//	@Success		200			{object}	store.Webhook
+//	@Failure		404			{object}	error
+//	@Failure		500			{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/webhooks/{webhookID} [get]
+func (app *application) getWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook := *getWebhookFromContext(r)
+	webhook.Secret = ""
+
+	if err := app.jsonResponse(w, http.StatusOK, webhook); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// UpdateWebhook godoc
+//
+//	@Summary		Updates a webhook
+//	@Description	Changes the URL or the events of a webhook, or pauses it. Deliveries due while
+//	@Description	a webhook is paused are sent once it is active again
+//	@Tags			webhooks
+//	@Accept			json
+//	@Produce		json
+//	@Param			webhookID	path		int						true	"Webhook ID"
+//	@Param			payload		body		UpdateWebhookPayload	true	"Webhook payload"
+//	@Success		200			{object}	store.Webhook
+//	@Failure		400			{object}	error
+//	@Failure		404			{object}	error
+//	@Failure		500			{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/webhooks/{webhookID} [patch]
+func (app *application) updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook := getWebhookFromContext(r)
+
+	var payload UpdateWebhookPayload
+	if err := readJSON(w, r, &payload); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if err := Validate.Struct(payload); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if payload.URL != nil {
+		if err := app.webhooks.CheckURL(*payload.URL); err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+		webhook.URL = *payload.URL
+	}
+
+	if payload.Events != nil {
+		webhook.Events = payload.Events
+	}
+
+	if payload.Active != nil {
+		webhook.Active = *payload.Active
+	}
+
+	if err := app.store.Webhooks.Update(r.Context(), webhook); err != nil {
+		switch {
+		case errors.Is(err, store.ErrResourceNotFound):
+			app.notFound(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	webhook.Secret = ""
+	if err := app.jsonResponse(w, http.StatusOK, webhook); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// DeleteWebhook godoc
+//
+//	@Summary		Deletes a webhook
+//	@Description	Deletes a webhook along with its delivery log
+//	@Tags			webhooks
+//	@Param			webhookID	path		int		true	"Webhook ID"
+//	@Success		204			{string}	string	"Webhook deleted"
+//	@Failure		404			{object}	error
+//	@Failure		500			{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/webhooks/{webhookID} [delete]
+func (app *application) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook := getWebhookFromContext(r)
+
+	if err := app.store.Webhooks.Delete(r.Context(), webhook.ID); err != nil {
+		switch {
+		case errors.Is(err, store.ErrResourceNotFound):
+			app.notFound(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetWebhookDeliveries godoc
+//
+//	@Summary		Fetches the delivery log of a webhook
+//	@Description	Fetches the deliveries of a webhook, most recent first, with the status code and
+//	@Description	error of their last attempt. Dead deliveries ran out of attempts
+//	@Tags			webhooks
+//	@Produce		json
+//	@Param			webhookID	path		int		true	"Webhook ID"
+//	@Param			status		query		string	false	"Status (pending, delivered, dead)"
+//	@Param			limit		query		int		false	"Limit"
+//	@Param			cursor		query		string	false	"Cursor returned by the previous page"
+//	@Success		200			{object}	[]store.WebhookDelivery
+//	@Failure		400			{object}	error
+//	@Failure		404			{object}	error
+//	@Failure		500			{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/webhooks/{webhookID}/deliveries [get]
+func (app *application) getWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	webhook := getWebhookFromContext(r)
+
+	dq := store.PaginatedDeliveryQuery{Limit: 20}
+
+	dq, err := dq.Parse(r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if err := Validate.Struct(dq); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	dq.Cursor, err = app.decodeCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	deliveries, next, err := app.store.Webhooks.GetDeliveries(r.Context(), webhook.ID, dq)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrInvalidCursor):
+			app.badRequest(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	if err := app.paginatedResponse(w, http.StatusOK, deliveries, app.encodeCursor(next), ""); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// RedeliverWebhook godoc
+//
+//	@Summary		Redelivers an event
+//	@Description	Queues the payload of a past delivery again, as a new delivery
+//	@Tags			webhooks
+//	@Produce		json
+//	@Param			webhookID	path		int	true	"Webhook ID"
+//	@Param			deliveryID	path		int	true	"Delivery ID"
+//	@Success		202			{object}	store.WebhookDelivery
+//	@Failure		400			{object}	error
+//	@Failure		404			{object}	error
+//	@Failure		500			{object}	error
+//	@Security		ApiKeyAuth
+//	@Router			/webhooks/{webhookID}/deliveries/{deliveryID}/redeliver [post]
+func (app *application) redeliverWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook := getWebhookFromContext(r)
+
+	deliveryID, err := strconv.ParseInt(chi.URLParam(r, "deliveryID"), 10, 64)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	delivery, err := app.store.Webhooks.Redeliver(r.Context(), webhook.ID, deliveryID)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrResourceNotFound):
+			app.notFound(w, r, err)
+		default:
+			app.internalServerError(w, r, err)
+		}
+		return
+	}
+
+	if err := app.jsonResponse(w, http.StatusAccepted, delivery); err != nil {
+		app.internalServerError(w, r, err)
+	}
+}
+
+// webhooksContextMiddleware loads the webhook of the route. Users only see
+// their own webhooks; admins also manage the global ones.
+func (app *application) webhooksContextMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "webhookID"), 10, 64)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+
+		ctx := r.Context()
+
+		webhook, err := app.store.Webhooks.GetByID(ctx, id)
+		if err != nil {
+			switch {
+			case errors.Is(err, store.ErrResourceNotFound):
+				app.notFound(w, r, err)
+			default:
+				app.internalServerError(w, r, err)
+			}
+			return
+		}
+
+		user := getUserFromContext(r)
+		if webhook.UserID != user.ID {
+			allowed := false
+			if webhook.Global {
+				allowed, err = app.checkRolePrecedence(ctx, user, "admin")
+				if err != nil {
+					app.internalServerError(w, r, err)
+					return
+				}
+			}
+
+			if !allowed {
+				app.notFound(w, r, store.ErrResourceNotFound)
+				return
+			}
+		}
+
+		ctx = context.WithValue(ctx, webhookCtx, webhook)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func getWebhookFromContext(r *http.Request) *store.Webhook {
+	webhook, _ := r.Context().Value(webhookCtx).(*store.Webhook)
+	return webhook
+}
+
+// deliverWebhooksJob sends the queued webhook deliveries. Failed deliveries
+// are retried with an exponential backoff until they run out of attempts and
+// are moved to the dead letters, from where they can be redelivered by hand.
+func (app *application) deliverWebhooksJob(ctx context.Context, args deliverWebhooksArgs) error {
+	for {
+		n, err := app.deliverWebhooks(ctx)
+		if err != nil {
+			return err
+		}
+
+		if n < app.config.webhooks.batch {
+			return nil
+		}
+	}
+}
+
+// deliverWebhooks sends a batch of the deliveries that are due and returns
+// how many it claimed.
+func (app *application) deliverWebhooks(ctx context.Context) (int, error) {
+	deliveries, err := app.store.Webhooks.ClaimDeliveries(ctx, app.config.webhooks.batch)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, d := range deliveries {
+		status, err := app.webhooks.Deliver(ctx, d.URL, d.Secret, d.ID, d.Event, d.Payload)
+		if err != nil {
+			app.logger.Warnw("error delivering webhook", "webhook", d.WebhookID, "delivery", d.ID,
+				"attempts", d.Attempts, "error", err)
+
+			if err := app.store.Webhooks.MarkFailed(ctx, &d, status, err); err != nil {
+				app.logger.Errorw("error rescheduling webhook delivery", "id", d.ID, "error", err)
+			}
+			continue
+		}
+
+		if err := app.store.Webhooks.MarkDelivered(ctx, d.ID, status); err != nil {
+			app.logger.Errorw("error marking webhook delivered", "id", d.ID, "error", err)
+		}
+	}
+	return len(deliveries), nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"com.github/jrovieri/golang/social/internal/event"
+	"com.github/jrovieri/golang/social/internal/store"
+	"com.github/jrovieri/golang/social/internal/webhook"
+	"go.uber.org/zap"
+)
+
+// fakeWebhookStore keeps the deliveries in memory. Claiming counts an
+// attempt, and failures are pending until they run out of attempts.
+type fakeWebhookStore struct {
+	deliveries []*store.WebhookDelivery
+	statuses   []int
+}
+
+func (s *fakeWebhookStore) Create(context.Context, *store.Webhook) error { return nil }
+
+func (s *fakeWebhookStore) GetByID(context.Context, int64) (*store.Webhook, error) {
+	return nil, store.ErrResourceNotFound
+}
+
+func (s *fakeWebhookStore) GetByUserID(context.Context, int64) ([]store.Webhook, error) {
+	return nil, nil
+}
+
+func (s *fakeWebhookStore) Update(context.Context, *store.Webhook) error { return nil }
+
+func (s *fakeWebhookStore) Delete(context.Context, int64) error { return nil }
+
+func (s *fakeWebhookStore) GetDeliveries(context.Context, int64, store.PaginatedDeliveryQuery) ([]store.WebhookDelivery, *store.Cursor, error) {
+	return nil, nil, nil
+}
+
+func (s *fakeWebhookStore) Redeliver(context.Context, int64, int64) (*store.WebhookDelivery, error) {
+	return nil, store.ErrResourceNotFound
+}
+
+func (s *fakeWebhookStore) ClaimDeliveries(_ context.Context, batch int) ([]store.WebhookDelivery, error) {
+	claimed := []store.WebhookDelivery{}
+	for _, d := range s.deliveries {
+		if d.Status != "pending" || len(claimed) == batch {
+			continue
+		}
+		d.Attempts++
+		claimed = append(claimed, *d)
+	}
+	return claimed, nil
+}
+
+func (s *fakeWebhookStore) EnqueueEvent(context.Context, event.Event) error { return nil }
+
+func (s *fakeWebhookStore) PruneDeliveries(context.Context, time.Duration) (int64, error) {
+	return 0, nil
+}
+
+func (s *fakeWebhookStore) get(id int64) *store.WebhookDelivery {
+	for _, d := range s.deliveries {
+		if d.ID == id {
+			return d
+		}
+	}
+	return nil
+}
+
+func (s *fakeWebhookStore) MarkDelivered(_ context.Context, id int64, statusCode int) error {
+	d := s.get(id)
+	d.Status = "delivered"
+	d.LastStatusCode = &statusCode
+	s.statuses = append(s.statuses, statusCode)
+	return nil
+}
+
+func (s *fakeWebhookStore) MarkFailed(_ context.Context, claimed *store.WebhookDelivery, statusCode int, cause error) error {
+	d := s.get(claimed.ID)
+	if claimed.Attempts >= store.MaxWebhookAttempts {
+		d.Status = "dead"
+	}
+	msg := cause.Error()
+	d.LastStatusCode, d.LastError = &statusCode, &msg
+	s.statuses = append(s.statuses, statusCode)
+	return nil
+}
+
+// receiver is a webhook endpoint answering with the status codes it is given,
+// then 200, and checking the signature of every request.
+type receiver struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	requests   int
+	deliveries []string
+	invalid    int
+}
+
+func newReceiver(t *testing.T, secret string, statuses ...int) *receiver {
+	t.Helper()
+
+	rec := &receiver{}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+
+		body, _ := io.ReadAll(r.Body)
+		if !validSignature(r.Header.Get("X-Webhook-Signature"), secret, body) {
+			rec.invalid++
+		}
+		rec.deliveries = append(rec.deliveries, r.Header.Get("X-Webhook-Delivery"))
+
+		status := http.StatusOK
+		if rec.requests < len(statuses) {
+			status = statuses[rec.requests]
+		}
+		rec.requests++
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(rec.Close)
+	return rec
+}
+
+// validSignature checks a t=<timestamp>,v1=<hmac> header against the body.
+func validSignature(header, secret string, body []byte) bool {
+	t, _, ok := strings.Cut(strings.TrimPrefix(header, "t="), ",")
+	if !ok {
+		return false
+	}
+
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || time.Since(time.Unix(unix, 0)) > 5*time.Minute {
+		return false
+	}
+	return webhook.Sign(secret, time.Unix(unix, 0), body) == header
+}
+
+func newWebhookApplication(webhooks *fakeWebhookStore) *application {
+	return &application{
+		config: config{
+			webhooks: webhooksConfig{batch: 10},
+		},
+		store:    store.Storage{Webhooks: webhooks},
+		logger:   zap.NewNop().Sugar(),
+		webhooks: webhook.NewClient(5*time.Second, true),
+	}
+}
+
+func newDelivery(id int64, url, secret string) *store.WebhookDelivery {
+	return &store.WebhookDelivery{
+		ID:        id,
+		WebhookID: 1,
+		Event:     "post.created",
+		Payload:   []byte(`{"id":"evt_1","event":"post.created"}`),
+		Status:    "pending",
+		URL:       url,
+		Secret:    secret,
+	}
+}
+
+func TestWebhookDeliveryIsRetried(t *testing.T) {
+	rec := newReceiver(t, "secret", http.StatusServiceUnavailable, http.StatusInternalServerError)
+
+	webhooks := &fakeWebhookStore{}
+	webhooks.deliveries = []*store.WebhookDelivery{newDelivery(7, rec.URL, "secret")}
+	app := newWebhookApplication(webhooks)
+
+	for range 3 {
+		if _, err := app.deliverWebhooks(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := webhooks.deliveries[0]
+	if d.Status != "delivered" || d.Attempts != 3 {
+		t.Fatalf("delivery is %s after %d attempts, want delivered after 3", d.Status, d.Attempts)
+	}
+
+	want := []int{http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusOK}
+	if len(webhooks.statuses) != len(want) {
+		t.Fatalf("statuses = %v, want %v", webhooks.statuses, want)
+	}
+	for i := range want {
+		if webhooks.statuses[i] != want[i] {
+			t.Fatalf("statuses = %v, want %v", webhooks.statuses, want)
+		}
+	}
+
+	if rec.invalid != 0 {
+		t.Errorf("%d requests had an invalid signature", rec.invalid)
+	}
+
+	// Every attempt carries the same delivery ID
+	for _, id := range rec.deliveries {
+		if id != "7" {
+			t.Errorf("X-Webhook-Delivery = %q, want 7", id)
+		}
+	}
+
+	// Delivered ones are not sent again
+	if n, _ := app.deliverWebhooks(context.Background()); n != 0 || rec.requests != 3 {
+		t.Errorf("claimed %d and sent %d requests after delivery", n, rec.requests)
+	}
+}
+
+func TestWebhookDeliveryDies(t *testing.T) {
+	statuses := make([]int, store.MaxWebhookAttempts+5)
+	for i := range statuses {
+		statuses[i] = http.StatusBadGateway
+	}
+	rec := newReceiver(t, "secret", statuses...)
+
+	webhooks := &fakeWebhookStore{}
+	webhooks.deliveries = []*store.WebhookDelivery{newDelivery(1, rec.URL, "secret")}
+	app := newWebhookApplication(webhooks)
+
+	for range store.MaxWebhookAttempts + 5 {
+		if _, err := app.deliverWebhooks(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := webhooks.deliveries[0]
+	if d.Status != "dead" {
+		t.Fatalf("delivery is %s, want dead", d.Status)
+	}
+
+	if rec.requests != store.MaxWebhookAttempts {
+		t.Errorf("sent %d times, want %d", rec.requests, store.MaxWebhookAttempts)
+	}
+
+	if d.LastStatusCode == nil || *d.LastStatusCode != http.StatusBadGateway || d.LastError == nil {
+		t.Errorf("last status = %v, error = %v", d.LastStatusCode, d.LastError)
+	}
+}
+
+func TestWebhookSignedWithTheWebhookSecret(t *testing.T) {
+	rec := newReceiver(t, "secret of the receiver")
+
+	webhooks := &fakeWebhookStore{}
+	webhooks.deliveries = []*store.WebhookDelivery{newDelivery(1, rec.URL, "another secret")}
+	app := newWebhookApplication(webhooks)
+
+	if _, err := app.deliverWebhooks(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.invalid != 1 {
+		t.Errorf("signature with another secret was accepted")
+	}
+}
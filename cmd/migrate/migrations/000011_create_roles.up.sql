@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS roles (
+    id bigserial PRIMARY KEY,
+    name varchar(255) NOT NULL UNIQUE,
+    level int NOT NULL DEFAULT 0,
+    description text
+);
+
+INSERT INTO roles (name, description, level)
+VALUES
+    ('user', 'A user can create posts and comments', 1),
+    ('moderator', 'A moderator can remove other users comments', 2),
+    ('admin', 'An admin can update and delete other users posts and comments', 3);
\ No newline at end of file
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_comments_parent_id;
+
+ALTER TABLE comments
+    DROP COLUMN parent_id,
+    DROP COLUMN updated_at,
+    DROP COLUMN deleted_at,
+    DROP COLUMN version;
\ No newline at end of file
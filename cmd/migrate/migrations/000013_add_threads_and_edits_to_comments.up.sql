@@ -0,0 +1,7 @@
+ALTER TABLE comments
+    ADD COLUMN parent_id bigint REFERENCES comments (id) ON DELETE SET NULL,
+    ADD COLUMN updated_at timestamp(0) WITH TIME ZONE,
+    ADD COLUMN deleted_at timestamp(0) WITH TIME ZONE,
+    ADD COLUMN version INT NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_comments_parent_id ON comments (parent_id);
\ No newline at end of file
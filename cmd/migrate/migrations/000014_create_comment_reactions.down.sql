@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_comments_post_id_reactions;
+DROP INDEX IF EXISTS idx_comments_post_id_created_at;
+
+ALTER TABLE comments
+    DROP COLUMN reactions_count;
+
+DROP TABLE IF EXISTS comment_reactions;
\ No newline at end of file
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS comment_reactions (
+    comment_id bigint NOT NULL,
+    user_id bigint NOT NULL,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (comment_id, user_id),
+    FOREIGN KEY (comment_id) REFERENCES comments (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+ALTER TABLE comments
+    ADD COLUMN reactions_count INT NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_comments_post_id_created_at ON comments (post_id, created_at, id);
+CREATE INDEX IF NOT EXISTS idx_comments_post_id_reactions ON comments (post_id, reactions_count, id);
\ No newline at end of file
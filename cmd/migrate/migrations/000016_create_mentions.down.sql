@@ -0,0 +1 @@
+DROP TABLE IF EXISTS mentions;
\ No newline at end of file
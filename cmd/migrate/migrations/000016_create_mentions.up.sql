@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS mentions (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    author_id bigint NOT NULL,
+    post_id bigint NOT NULL,
+    comment_id bigint,
+    start_offset int NOT NULL,
+    end_offset int NOT NULL,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (author_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (post_id) REFERENCES posts (id) ON DELETE CASCADE,
+    FOREIGN KEY (comment_id) REFERENCES comments (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_mentions_user_id ON mentions (user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_mentions_post_id ON mentions (post_id);
+CREATE INDEX IF NOT EXISTS idx_mentions_comment_id ON mentions (comment_id);
\ No newline at end of file
@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS tags (
+    id bigserial PRIMARY KEY,
+    name varchar(100) UNIQUE NOT NULL,
+    usage_count INT NOT NULL DEFAULT 0,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_tags_name_prefix ON tags (name varchar_pattern_ops);
+
+CREATE TABLE IF NOT EXISTS tag_followers (
+    tag_id bigint NOT NULL,
+    user_id bigint NOT NULL,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (tag_id, user_id),
+    FOREIGN KEY (tag_id) REFERENCES tags (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_tag_followers_user_id ON tag_followers (user_id);
+
+UPDATE posts SET tags = ARRAY(
+    SELECT DISTINCT left(lower(regexp_replace(ltrim(t, '#'), '\s+', '', 'g')), 100)
+    FROM unnest(tags) t
+    WHERE regexp_replace(ltrim(t, '#'), '\s+', '', 'g') <> ''
+);
+
+INSERT INTO tags (name, usage_count)
+SELECT t, COUNT(*) FROM posts, unnest(tags) t GROUP BY t;
\ No newline at end of file
@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS idx_posts_created_at;
+DROP INDEX IF EXISTS idx_comments_created_at;
+
+ALTER TABLE posts
+    DROP COLUMN reactions_count,
+    DROP COLUMN reposts_count;
+
+DROP TABLE IF EXISTS reposts;
+DROP TABLE IF EXISTS post_reactions;
\ No newline at end of file
@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS post_reactions (
+    post_id bigint NOT NULL,
+    user_id bigint NOT NULL,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (post_id, user_id),
+    FOREIGN KEY (post_id) REFERENCES posts (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS reposts (
+    post_id bigint NOT NULL,
+    user_id bigint NOT NULL,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (post_id, user_id),
+    FOREIGN KEY (post_id) REFERENCES posts (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+ALTER TABLE posts
+    ADD COLUMN reactions_count INT NOT NULL DEFAULT 0,
+    ADD COLUMN reposts_count INT NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_post_reactions_created_at ON post_reactions (created_at);
+CREATE INDEX IF NOT EXISTS idx_reposts_created_at ON reposts (created_at);
+CREATE INDEX IF NOT EXISTS idx_comments_created_at ON comments (created_at);
+CREATE INDEX IF NOT EXISTS idx_posts_created_at ON posts (created_at);
\ No newline at end of file
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS trending_posts;
+DROP TABLE IF EXISTS trending_tags;
\ No newline at end of file
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS trending_tags (
+    time_window varchar(10) NOT NULL,
+    tag varchar(100) NOT NULL,
+    score double precision NOT NULL,
+    computed_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (time_window, tag)
+);
+
+CREATE TABLE IF NOT EXISTS trending_posts (
+    time_window varchar(10) NOT NULL,
+    post_id bigint NOT NULL,
+    score double precision NOT NULL,
+    computed_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (time_window, post_id),
+    FOREIGN KEY (post_id) REFERENCES posts (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_trending_tags_score ON trending_tags (time_window, score DESC);
+CREATE INDEX IF NOT EXISTS idx_trending_posts_score ON trending_posts (time_window, score DESC);
\ No newline at end of file
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS timeline_fanout_queue;
+DROP TABLE IF EXISTS timelines;
+
+ALTER TABLE users
+    DROP COLUMN followers_count;
\ No newline at end of file
@@ -0,0 +1,33 @@
+ALTER TABLE users
+    ADD COLUMN followers_count INT NOT NULL DEFAULT 0;
+
+UPDATE users u SET followers_count = (SELECT COUNT(*) FROM followers f WHERE f.user_id = u.id);
+
+CREATE TABLE IF NOT EXISTS timelines (
+    user_id bigint NOT NULL,
+    post_id bigint NOT NULL,
+    author_id bigint NOT NULL,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (user_id, post_id),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (post_id) REFERENCES posts (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_timelines_user_id_created_at ON timelines (user_id, created_at, post_id);
+CREATE INDEX IF NOT EXISTS idx_timelines_user_id_author_id ON timelines (user_id, author_id);
+
+CREATE TABLE IF NOT EXISTS timeline_fanout_queue (
+    post_id bigint PRIMARY KEY,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    FOREIGN KEY (post_id) REFERENCES posts (id) ON DELETE CASCADE
+);
+
+INSERT INTO timelines (user_id, post_id, author_id, created_at)
+SELECT p.user_id, p.id, p.user_id, p.created_at FROM posts p
+UNION
+SELECT f.follower_id, p.id, p.user_id, p.created_at FROM posts p
+    JOIN followers f ON f.user_id = p.user_id
+UNION
+SELECT tf.user_id, p.id, p.user_id, p.created_at FROM posts p
+    JOIN tags t ON t.name = ANY (p.tags)
+    JOIN tag_followers tf ON tf.tag_id = t.id;
\ No newline at end of file
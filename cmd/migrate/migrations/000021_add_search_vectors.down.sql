@@ -0,0 +1,21 @@
+DROP INDEX IF EXISTS idx_users_username_trgm;
+DROP INDEX IF EXISTS idx_users_search_vector;
+DROP INDEX IF EXISTS idx_comments_search_vector;
+DROP INDEX IF EXISTS idx_posts_search_vector;
+
+DROP TRIGGER IF EXISTS trg_users_search_vector ON users;
+DROP TRIGGER IF EXISTS trg_comments_search_vector ON comments;
+DROP TRIGGER IF EXISTS trg_posts_language_changed ON posts;
+DROP TRIGGER IF EXISTS trg_posts_search_vector ON posts;
+
+DROP FUNCTION IF EXISTS posts_language_changed;
+DROP FUNCTION IF EXISTS users_search_vector;
+DROP FUNCTION IF EXISTS comments_search_vector;
+DROP FUNCTION IF EXISTS posts_search_vector;
+
+ALTER TABLE users DROP COLUMN IF EXISTS search_vector;
+ALTER TABLE comments DROP COLUMN IF EXISTS search_vector;
+
+ALTER TABLE posts
+    DROP COLUMN IF EXISTS search_vector,
+    DROP COLUMN IF EXISTS language;
\ No newline at end of file
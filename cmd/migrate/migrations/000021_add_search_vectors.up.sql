@@ -0,0 +1,70 @@
+ALTER TABLE posts
+    ADD COLUMN language regconfig NOT NULL DEFAULT 'english',
+    ADD COLUMN search_vector tsvector;
+
+ALTER TABLE comments
+    ADD COLUMN search_vector tsvector;
+
+ALTER TABLE users
+    ADD COLUMN search_vector tsvector;
+
+CREATE OR REPLACE FUNCTION posts_search_vector() RETURNS trigger AS $$
+BEGIN
+    NEW.search_vector :=
+        setweight(to_tsvector(NEW.language, COALESCE(NEW.title, '')), 'A') ||
+        setweight(to_tsvector(NEW.language, COALESCE(array_to_string(NEW.tags, ' '), '')), 'B') ||
+        setweight(to_tsvector(NEW.language, COALESCE(NEW.content, '')), 'C');
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION comments_search_vector() RETURNS trigger AS $$
+BEGIN
+    NEW.search_vector := CASE WHEN NEW.deleted_at IS NULL THEN
+        to_tsvector((SELECT p.language FROM posts p WHERE p.id = NEW.post_id), COALESCE(NEW.content, ''))
+    END;
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION users_search_vector() RETURNS trigger AS $$
+BEGIN
+    NEW.search_vector := to_tsvector('simple', COALESCE(NEW.username, ''));
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+-- Comments take the language of their post, so they are reindexed along with it
+CREATE OR REPLACE FUNCTION posts_language_changed() RETURNS trigger AS $$
+BEGIN
+    UPDATE comments SET search_vector = to_tsvector(NEW.language, content)
+    WHERE post_id = NEW.id AND deleted_at IS NULL;
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trg_posts_search_vector
+    BEFORE INSERT OR UPDATE OF title, content, tags, language ON posts
+    FOR EACH ROW EXECUTE FUNCTION posts_search_vector();
+
+CREATE TRIGGER trg_posts_language_changed
+    AFTER UPDATE OF language ON posts
+    FOR EACH ROW WHEN (OLD.language IS DISTINCT FROM NEW.language)
+    EXECUTE FUNCTION posts_language_changed();
+
+CREATE TRIGGER trg_comments_search_vector
+    BEFORE INSERT OR UPDATE OF content, deleted_at ON comments
+    FOR EACH ROW EXECUTE FUNCTION comments_search_vector();
+
+CREATE TRIGGER trg_users_search_vector
+    BEFORE INSERT OR UPDATE OF username ON users
+    FOR EACH ROW EXECUTE FUNCTION users_search_vector();
+
+UPDATE posts SET title = title;
+UPDATE comments SET content = content;
+UPDATE users SET username = username;
+
+CREATE INDEX IF NOT EXISTS idx_posts_search_vector ON posts USING gin (search_vector);
+CREATE INDEX IF NOT EXISTS idx_comments_search_vector ON comments USING gin (search_vector);
+CREATE INDEX IF NOT EXISTS idx_users_search_vector ON users USING gin (search_vector);
+CREATE INDEX IF NOT EXISTS idx_users_username_trgm ON users USING gin (username gin_trgm_ops);
\ No newline at end of file
@@ -0,0 +1,6 @@
+ALTER TABLE posts
+    ADD COLUMN visibility varchar(20) NOT NULL DEFAULT 'public'
+        CHECK (visibility IN ('public', 'followers'));
+
+CREATE INDEX IF NOT EXISTS idx_posts_public_created_at ON posts (created_at, id) WHERE visibility = 'public';
+CREATE INDEX IF NOT EXISTS idx_posts_user_id_created_at ON posts (user_id, created_at, id);
\ No newline at end of file
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_followers_follower_id;
+DROP INDEX IF EXISTS idx_users_followers_count;
+
+DROP TABLE IF EXISTS follow_suggestions_refreshes;
+DROP TABLE IF EXISTS follow_suggestions_queue;
+DROP TABLE IF EXISTS follow_suggestions;
\ No newline at end of file
@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS follow_suggestions (
+    user_id bigint NOT NULL,
+    suggested_id bigint NOT NULL,
+    score double precision NOT NULL,
+    reason varchar(20) NOT NULL,
+    mutual_count INT NOT NULL DEFAULT 0,
+    shared_tags_count INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, suggested_id),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (suggested_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_follow_suggestions_user_id_score ON follow_suggestions (user_id, score DESC);
+
+CREATE TABLE IF NOT EXISTS follow_suggestions_queue (
+    user_id bigint PRIMARY KEY,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS follow_suggestions_refreshes (
+    user_id bigint PRIMARY KEY,
+    refreshed_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_users_followers_count ON users (followers_count DESC);
+CREATE INDEX IF NOT EXISTS idx_followers_follower_id ON followers (follower_id);
\ No newline at end of file
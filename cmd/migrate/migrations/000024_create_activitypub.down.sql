@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS idx_activity_deliveries_pending;
+DROP INDEX IF EXISTS idx_remote_replies_post_id;
+
+DROP TABLE IF EXISTS activity_deliveries;
+DROP TABLE IF EXISTS remote_replies;
+DROP TABLE IF EXISTS remote_reactions;
+DROP TABLE IF EXISTS remote_followers;
+DROP TABLE IF EXISTS remote_actors;
+DROP TABLE IF EXISTS actor_keys;
\ No newline at end of file
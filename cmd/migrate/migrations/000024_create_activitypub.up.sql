@@ -0,0 +1,67 @@
+CREATE TABLE IF NOT EXISTS actor_keys (
+    user_id bigint PRIMARY KEY,
+    public_key_pem text NOT NULL,
+    private_key_pem text NOT NULL,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS remote_actors (
+    id bigserial PRIMARY KEY,
+    uri text UNIQUE NOT NULL,
+    username text NOT NULL DEFAULT '',
+    inbox text NOT NULL,
+    shared_inbox text,
+    key_id text UNIQUE NOT NULL,
+    public_key_pem text NOT NULL,
+    fetched_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS remote_followers (
+    user_id bigint NOT NULL,
+    actor_id bigint NOT NULL,
+    activity_uri text NOT NULL,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, actor_id),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (actor_id) REFERENCES remote_actors (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS remote_reactions (
+    post_id bigint NOT NULL,
+    actor_id bigint NOT NULL,
+    activity_uri text UNIQUE NOT NULL,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (post_id, actor_id),
+    FOREIGN KEY (post_id) REFERENCES posts (id) ON DELETE CASCADE,
+    FOREIGN KEY (actor_id) REFERENCES remote_actors (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS remote_replies (
+    id bigserial PRIMARY KEY,
+    post_id bigint NOT NULL,
+    actor_id bigint NOT NULL,
+    object_uri text UNIQUE NOT NULL,
+    content text NOT NULL,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    FOREIGN KEY (post_id) REFERENCES posts (id) ON DELETE CASCADE,
+    FOREIGN KEY (actor_id) REFERENCES remote_actors (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS activity_deliveries (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    inbox text NOT NULL,
+    post_id bigint,
+    payload jsonb,
+    status varchar(20) NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    last_error text,
+    next_attempt_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (post_id) REFERENCES posts (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_remote_replies_post_id ON remote_replies (post_id);
+CREATE INDEX IF NOT EXISTS idx_activity_deliveries_pending ON activity_deliveries (next_attempt_at) WHERE status = 'pending';
\ No newline at end of file
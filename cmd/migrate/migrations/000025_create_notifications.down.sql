@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_notifications_actor_id;
+DROP INDEX IF EXISTS idx_notifications_unread;
+DROP INDEX IF EXISTS idx_notifications_user_id_group_id;
+
+DROP TABLE IF EXISTS notifications;
\ No newline at end of file
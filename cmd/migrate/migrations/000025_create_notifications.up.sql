@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS notifications (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    actor_id bigint NOT NULL,
+    type varchar(20) NOT NULL,
+    post_id bigint,
+    comment_id bigint,
+    group_key text NOT NULL,
+    group_id bigint NOT NULL,
+    read_at timestamp(0) WITH TIME ZONE,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (actor_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (post_id) REFERENCES posts (id) ON DELETE CASCADE,
+    FOREIGN KEY (comment_id) REFERENCES comments (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_notifications_user_id_group_id ON notifications (user_id, group_id);
+CREATE INDEX IF NOT EXISTS idx_notifications_unread ON notifications (user_id, group_key) WHERE read_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_notifications_actor_id ON notifications (actor_id, group_key);
\ No newline at end of file
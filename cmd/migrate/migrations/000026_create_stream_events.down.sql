@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_stream_events_created_at;
+DROP INDEX IF EXISTS idx_stream_events_user_id_id;
+
+DROP TABLE IF EXISTS stream_events;
\ No newline at end of file
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS stream_events (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    type varchar(50) NOT NULL,
+    data jsonb NOT NULL,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_stream_events_user_id_id ON stream_events (user_id, id);
+CREATE INDEX IF NOT EXISTS idx_stream_events_created_at ON stream_events (created_at);
\ No newline at end of file
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_webhook_deliveries_pending;
+DROP INDEX IF EXISTS idx_webhook_deliveries_webhook_id;
+DROP INDEX IF EXISTS idx_webhooks_global;
+DROP INDEX IF EXISTS idx_webhooks_user_id;
+
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
\ No newline at end of file
@@ -0,0 +1,35 @@
+CREATE TABLE IF NOT EXISTS webhooks (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    url text NOT NULL,
+    secret varchar(100) NOT NULL,
+    events varchar(50)[] NOT NULL,
+    global boolean NOT NULL DEFAULT FALSE,
+    active boolean NOT NULL DEFAULT TRUE,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhooks_user_id ON webhooks (user_id);
+CREATE INDEX IF NOT EXISTS idx_webhooks_global ON webhooks (id) WHERE global;
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id bigserial PRIMARY KEY,
+    webhook_id bigint NOT NULL,
+    event varchar(50) NOT NULL,
+    payload jsonb NOT NULL,
+    status varchar(20) NOT NULL DEFAULT 'pending',
+    attempts int NOT NULL DEFAULT 0,
+    next_attempt_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    last_status_code int,
+    last_error text,
+    delivered_at timestamp(0) WITH TIME ZONE,
+    redelivery_of bigint,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    FOREIGN KEY (webhook_id) REFERENCES webhooks (id) ON DELETE CASCADE,
+    FOREIGN KEY (redelivery_of) REFERENCES webhook_deliveries (id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook_id ON webhook_deliveries (webhook_id, id);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_pending ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
\ No newline at end of file
@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS idx_messages_conversation_id;
+DROP INDEX IF EXISTS idx_conversation_members_user_id;
+
+DROP TABLE IF EXISTS messages;
+DROP TABLE IF EXISTS conversation_members;
+DROP TABLE IF EXISTS conversations;
+
+ALTER TABLE users DROP COLUMN IF EXISTS message_policy;
\ No newline at end of file
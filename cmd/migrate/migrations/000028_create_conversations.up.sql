@@ -0,0 +1,37 @@
+ALTER TABLE users
+    ADD COLUMN message_policy varchar(20) NOT NULL DEFAULT 'everyone'
+        CHECK (message_policy IN ('everyone', 'following'));
+
+CREATE TABLE IF NOT EXISTS conversations (
+    id bigserial PRIMARY KEY,
+    creator_id bigint,
+    title varchar(100),
+    direct_key text UNIQUE,
+    last_message_at timestamp(0) WITH TIME ZONE,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    FOREIGN KEY (creator_id) REFERENCES users (id) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS conversation_members (
+    conversation_id bigint NOT NULL,
+    user_id bigint NOT NULL,
+    last_read_message_id bigint NOT NULL DEFAULT 0,
+    last_read_at timestamp(0) WITH TIME ZONE,
+    joined_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (conversation_id, user_id),
+    FOREIGN KEY (conversation_id) REFERENCES conversations (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+    id bigserial PRIMARY KEY,
+    conversation_id bigint NOT NULL,
+    sender_id bigint NOT NULL,
+    content text NOT NULL,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    FOREIGN KEY (conversation_id) REFERENCES conversations (id) ON DELETE CASCADE,
+    FOREIGN KEY (sender_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_conversation_members_user_id ON conversation_members (user_id);
+CREATE INDEX IF NOT EXISTS idx_messages_conversation_id ON messages (conversation_id, id);
\ No newline at end of file
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_notifications_unemailed;
+
+ALTER TABLE notifications DROP COLUMN IF EXISTS emailed_at;
+
+DROP TABLE IF EXISTS email_digests;
+DROP TABLE IF EXISTS email_preferences;
\ No newline at end of file
@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS email_preferences (
+    user_id bigint NOT NULL,
+    type varchar(20) NOT NULL,
+    delivery varchar(20) NOT NULL CHECK (delivery IN ('instant', 'digest', 'off')),
+    updated_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, type),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS email_digests (
+    user_id bigint PRIMARY KEY,
+    sent_at timestamp(0) WITH TIME ZONE NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+ALTER TABLE notifications ADD COLUMN emailed_at timestamp(0) WITH TIME ZONE;
+
+-- Notifications from before emails were sent are not emailed
+UPDATE notifications SET emailed_at = created_at;
+
+CREATE INDEX IF NOT EXISTS idx_notifications_unemailed ON notifications (user_id, id) WHERE emailed_at IS NULL AND read_at IS NULL;
\ No newline at end of file
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_email_outbox_pending;
+
+DROP TABLE IF EXISTS email_outbox;
\ No newline at end of file
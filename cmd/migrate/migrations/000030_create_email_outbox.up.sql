@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS email_outbox (
+    id bigserial PRIMARY KEY,
+    template varchar(100) NOT NULL,
+    username varchar(255) NOT NULL,
+    email varchar(255) NOT NULL,
+    data jsonb NOT NULL,
+    status varchar(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'sent', 'dead')),
+    attempts INT NOT NULL DEFAULT 0,
+    last_error text,
+    next_attempt_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    sent_at timestamp(0) WITH TIME ZONE,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_email_outbox_pending ON email_outbox (next_attempt_at) WHERE status = 'pending';
\ No newline at end of file
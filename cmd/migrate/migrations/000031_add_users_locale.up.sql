@@ -0,0 +1,4 @@
+-- A NULL locale follows the default locale of the mailer
+ALTER TABLE users ADD COLUMN locale varchar(35);
+
+ALTER TABLE email_outbox ADD COLUMN locale varchar(35) NOT NULL DEFAULT '';
\ No newline at end of file
@@ -0,0 +1,10 @@
+ALTER TABLE email_outbox ADD COLUMN IF NOT EXISTS next_attempt_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW();
+
+CREATE INDEX IF NOT EXISTS idx_email_outbox_pending ON email_outbox (next_attempt_at) WHERE status = 'pending';
+
+DROP TABLE IF EXISTS job_schedules;
+
+DROP INDEX IF EXISTS idx_jobs_queue_status;
+DROP INDEX IF EXISTS idx_jobs_run_at;
+
+DROP TABLE IF EXISTS jobs;
\ No newline at end of file
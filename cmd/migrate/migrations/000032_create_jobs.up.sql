@@ -0,0 +1,31 @@
+CREATE TABLE IF NOT EXISTS jobs (
+    id bigserial PRIMARY KEY,
+    queue varchar(50) NOT NULL DEFAULT 'default',
+    kind varchar(100) NOT NULL,
+    args jsonb NOT NULL DEFAULT '{}',
+    status varchar(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'running', 'dead')),
+    attempts INT NOT NULL DEFAULT 0,
+    max_attempts INT NOT NULL DEFAULT 10,
+    last_error text,
+    run_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_jobs_run_at ON jobs (run_at, id) WHERE status IN ('pending', 'running');
+CREATE INDEX IF NOT EXISTS idx_jobs_queue_status ON jobs (queue, status);
+
+CREATE TABLE IF NOT EXISTS job_schedules (
+    name varchar(100) PRIMARY KEY,
+    spec varchar(100) NOT NULL,
+    next_run_at timestamp(0) WITH TIME ZONE NOT NULL
+);
+
+-- Emails are now sent by jobs, which take over their retries
+INSERT INTO jobs (queue, kind, args, attempts, max_attempts, run_at)
+SELECT 'mail', 'send_email', jsonb_build_object('email_id', id), attempts, 8, next_attempt_at
+FROM email_outbox
+WHERE status = 'pending';
+
+DROP INDEX IF EXISTS idx_email_outbox_pending;
+
+ALTER TABLE email_outbox DROP COLUMN IF EXISTS next_attempt_at;
\ No newline at end of file
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS domain_event_receipts;
+DROP TABLE IF EXISTS domain_event_sequences;
+
+DROP INDEX IF EXISTS idx_domain_events_published_at;
+DROP INDEX IF EXISTS idx_domain_events_pending;
+
+DROP TABLE IF EXISTS domain_events;
\ No newline at end of file
@@ -0,0 +1,38 @@
+CREATE TABLE IF NOT EXISTS domain_events (
+    id bigserial PRIMARY KEY,
+    aggregate varchar(50) NOT NULL,
+    aggregate_id bigint NOT NULL,
+    sequence bigint NOT NULL,
+    type varchar(100) NOT NULL,
+    data jsonb NOT NULL,
+    status varchar(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'published', 'dead')),
+    attempts int NOT NULL DEFAULT 0,
+    last_error text,
+    next_attempt_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    published_at timestamp(0) WITH TIME ZONE,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    UNIQUE (aggregate, aggregate_id, sequence)
+);
+
+CREATE INDEX IF NOT EXISTS idx_domain_events_pending ON domain_events (id) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS idx_domain_events_published_at ON domain_events (published_at) WHERE status = 'published';
+
+-- The last sequence of every aggregate. Recording an event locks the row of
+-- its aggregate until the transaction ends, so the events of an aggregate are
+-- committed in the order of their sequence
+CREATE TABLE IF NOT EXISTS domain_event_sequences (
+    aggregate varchar(50) NOT NULL,
+    aggregate_id bigint NOT NULL,
+    sequence bigint NOT NULL,
+    PRIMARY KEY (aggregate, aggregate_id)
+);
+
+-- The subscribers that handled an event that is still to be published, so
+-- they are skipped when it is published again
+CREATE TABLE IF NOT EXISTS domain_event_receipts (
+    event_id bigint NOT NULL,
+    subscriber varchar(100) NOT NULL,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (event_id, subscriber),
+    FOREIGN KEY (event_id) REFERENCES domain_events (id) ON DELETE CASCADE
+);
\ No newline at end of file
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_stream_events_user_id_sequence;
+CREATE INDEX IF NOT EXISTS idx_stream_events_user_id_id ON stream_events (user_id, id);
+
+ALTER TABLE stream_events DROP COLUMN IF EXISTS sequence;
+
+DROP TABLE IF EXISTS stream_sequences;
\ No newline at end of file
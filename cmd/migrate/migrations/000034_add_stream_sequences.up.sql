@@ -0,0 +1,23 @@
+-- The last sequence of the stream events of every user. Publishing an event
+-- locks the row of the user until the transaction ends, so the events of a
+-- user are committed in the order of their sequence and streams resuming
+-- after one never skip an event committed late
+CREATE TABLE IF NOT EXISTS stream_sequences (
+    user_id bigint PRIMARY KEY,
+    sequence bigint NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+ALTER TABLE stream_events ADD COLUMN IF NOT EXISTS sequence bigint;
+
+-- Streams resume from the IDs they were sent so far, so sequences carry on
+-- from the last of them
+UPDATE stream_events SET sequence = id;
+
+INSERT INTO stream_sequences (user_id, sequence)
+SELECT id, (SELECT last_value FROM stream_events_id_seq) FROM users;
+
+ALTER TABLE stream_events ALTER COLUMN sequence SET NOT NULL;
+
+DROP INDEX IF EXISTS idx_stream_events_user_id_id;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_stream_events_user_id_sequence ON stream_events (user_id, sequence);
\ No newline at end of file
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_jobs_schedule_name;
+
+ALTER TABLE jobs DROP COLUMN IF EXISTS schedule_name;
\ No newline at end of file
@@ -0,0 +1,6 @@
+-- The schedule a recurring job was enqueued by. A schedule does not enqueue
+-- another run while one is pending or running
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS schedule_name varchar(100);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_jobs_schedule_name ON jobs (schedule_name)
+WHERE status IN ('pending', 'running');
\ No newline at end of file
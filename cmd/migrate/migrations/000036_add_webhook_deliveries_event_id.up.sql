@@ -0,0 +1,5 @@
+-- The domain event a delivery was queued for. A webhook is queued an event
+-- once, however many times the event is published; redeliveries have none
+ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS event_id bigint;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_webhook_deliveries_event_id ON webhook_deliveries (webhook_id, event_id);
\ No newline at end of file
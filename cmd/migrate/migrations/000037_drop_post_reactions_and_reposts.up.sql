@@ -0,0 +1,11 @@
+-- Posts are scored on their comments, the reactions to them and the likes
+-- of remote users. Local users cannot react to or repost posts, so these
+-- tables are never written
+DROP TABLE IF EXISTS reposts;
+DROP TABLE IF EXISTS post_reactions;
+
+ALTER TABLE posts
+    DROP COLUMN IF EXISTS reactions_count,
+    DROP COLUMN IF EXISTS reposts_count;
+
+CREATE INDEX IF NOT EXISTS idx_comment_reactions_created_at ON comment_reactions (created_at);
\ No newline at end of file
@@ -0,0 +1,2 @@
+-- Mentions match usernames regardless of case
+CREATE INDEX IF NOT EXISTS idx_users_lower_username ON users (lower(username));
\ No newline at end of file
@@ -17,7 +17,10 @@ func main() {
 
 	defer conn.Close()
 
-	store := store.NewStorage(conn)
+	store := store.NewStorage(conn, store.Config{
+		FanoutThreshold: store.DefaultFanoutThreshold,
+		SearchLanguage:  store.DefaultSearchLanguage,
+	})
 
 	db.Seed(store, conn)
 }
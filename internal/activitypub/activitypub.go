@@ -0,0 +1,165 @@
+package activitypub
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+const (
+	// ContentType is the media type of ActivityPub documents.
+	ContentType = "application/activity+json"
+	// PublicAddress addresses an activity to everyone.
+	PublicAddress = "https://www.w3.org/ns/activitystreams#Public"
+)
+
+var Context = []string{
+	"https://www.w3.org/ns/activitystreams",
+	"https://w3id.org/security/v1",
+}
+
+// SameOrigin tells whether the URLs share their scheme and host. The id, key
+// and inbox of an actor must, as a server only speaks for the actors it hosts.
+func SameOrigin(urls ...string) bool {
+	var origin string
+	for i, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			return false
+		}
+
+		o := strings.ToLower(u.Scheme + "://" + u.Host)
+		if i > 0 && o != origin {
+			return false
+		}
+		origin = o
+	}
+	return true
+}
+
+type PublicKey struct {
+	ID           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+type Endpoints struct {
+	SharedInbox string `json:"sharedInbox,omitempty"`
+}
+
+type Actor struct {
+	Context           any        `json:"@context,omitempty"`
+	ID                string     `json:"id"`
+	Type              string     `json:"type"`
+	PreferredUsername string     `json:"preferredUsername"`
+	Name              string     `json:"name,omitempty"`
+	URL               string     `json:"url,omitempty"`
+	Inbox             string     `json:"inbox"`
+	Outbox            string     `json:"outbox,omitempty"`
+	Followers         string     `json:"followers,omitempty"`
+	Published         string     `json:"published,omitempty"`
+	Endpoints         *Endpoints `json:"endpoints,omitempty"`
+	PublicKey         PublicKey  `json:"publicKey"`
+}
+
+type Tag struct {
+	Type string `json:"type"`
+	Href string `json:"href,omitempty"`
+	Name string `json:"name"`
+}
+
+type Note struct {
+	Context      any      `json:"@context,omitempty"`
+	ID           string   `json:"id"`
+	Type         string   `json:"type"`
+	AttributedTo string   `json:"attributedTo"`
+	Name         string   `json:"name,omitempty"`
+	Content      string   `json:"content"`
+	InReplyTo    string   `json:"inReplyTo,omitempty"`
+	URL          string   `json:"url,omitempty"`
+	Published    string   `json:"published,omitempty"`
+	Updated      string   `json:"updated,omitempty"`
+	To           []string `json:"to,omitempty"`
+	Cc           []string `json:"cc,omitempty"`
+	Tag          []Tag    `json:"tag,omitempty"`
+}
+
+// Activity is an incoming or outgoing activity. Object is kept raw because it
+// is either the URI of an object or the object itself.
+type Activity struct {
+	Context   any             `json:"@context,omitempty"`
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Actor     string          `json:"actor"`
+	Object    json.RawMessage `json:"object"`
+	Published string          `json:"published,omitempty"`
+	To        []string        `json:"to,omitempty"`
+	Cc        []string        `json:"cc,omitempty"`
+}
+
+// ObjectID returns the id of the object of the activity, whether it was sent
+// by reference or embedded.
+func (a *Activity) ObjectID() string {
+	var id string
+	if err := json.Unmarshal(a.Object, &id); err == nil {
+		return id
+	}
+
+	var object struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(a.Object, &object); err == nil {
+		return object.ID
+	}
+	return ""
+}
+
+// EmbeddedActivity returns the object of the activity when it is itself an
+// activity, as in Undo. It returns nil when the object was sent by reference.
+func (a *Activity) EmbeddedActivity() *Activity {
+	var inner Activity
+	if err := json.Unmarshal(a.Object, &inner); err != nil || inner.Type == "" {
+		return nil
+	}
+	return &inner
+}
+
+// EmbeddedNote returns the object of the activity when it is a Note, as in
+// Create. It returns nil otherwise.
+func (a *Activity) EmbeddedNote() *Note {
+	var note Note
+	if err := json.Unmarshal(a.Object, &note); err != nil || note.Type != "Note" {
+		return nil
+	}
+	return &note
+}
+
+type OrderedCollection struct {
+	Context    any    `json:"@context,omitempty"`
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	TotalItems *int   `json:"totalItems,omitempty"`
+	First      string `json:"first,omitempty"`
+}
+
+type OrderedCollectionPage struct {
+	Context      any    `json:"@context,omitempty"`
+	ID           string `json:"id"`
+	Type         string `json:"type"`
+	PartOf       string `json:"partOf"`
+	Next         string `json:"next,omitempty"`
+	OrderedItems []any  `json:"orderedItems"`
+}
+
+// WebFinger is the JSON Resource Descriptor served by WebFinger (RFC 7033).
+type WebFinger struct {
+	Subject string          `json:"subject"`
+	Aliases []string        `json:"aliases,omitempty"`
+	Links   []WebFingerLink `json:"links"`
+}
+
+type WebFingerLink struct {
+	Rel  string `json:"rel"`
+	Type string `json:"type,omitempty"`
+	Href string `json:"href"`
+}
@@ -0,0 +1,122 @@
+package activitypub
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"com.github/jrovieri/golang/social/internal/netguard"
+)
+
+// maxDocumentSize bounds the size of the documents fetched from remote servers.
+const maxDocumentSize = 1 << 20
+
+var ErrInsecureURL = errors.New("remote URL must use https")
+
+// Client talks to remote servers. Plain HTTP and addresses on private,
+// loopback and link-local networks are only allowed when AllowHTTP is set,
+// which is meant for running two local instances against each other.
+// Otherwise remote actors could point the server at internal services.
+type Client struct {
+	HTTP      *http.Client
+	AllowHTTP bool
+}
+
+func NewClient(timeout time.Duration, allowHTTP bool) *Client {
+	return &Client{
+		HTTP: &http.Client{
+			Timeout:   timeout,
+			Transport: netguard.Transport(timeout, allowHTTP),
+			// Redirects would take requests past the URLs that were checked
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		AllowHTTP: allowHTTP,
+	}
+}
+
+func (c *Client) checkURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid remote URL %q", raw)
+	}
+
+	if u.Scheme != "https" && !(c.AllowHTTP && u.Scheme == "http") {
+		return nil, ErrInsecureURL
+	}
+	return u, nil
+}
+
+// FetchActor retrieves a remote actor. The fragment of uri is dropped, so the
+// id of a key such as https://example.com/users/alice#main-key can be used.
+func (c *Client) FetchActor(ctx context.Context, uri string) (*Actor, error) {
+	u, err := c.checkURL(uri)
+	if err != nil {
+		return nil, err
+	}
+	u.Fragment = ""
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", ContentType)
+
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching actor %s: status %d", u, res.StatusCode)
+	}
+
+	var actor Actor
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxDocumentSize)).Decode(&actor); err != nil {
+		return nil, err
+	}
+
+	if actor.ID == "" || actor.Inbox == "" || actor.PublicKey.PublicKeyPem == "" {
+		return nil, fmt.Errorf("actor %s is incomplete", u)
+	}
+	return &actor, nil
+}
+
+// Deliver posts a signed activity to a remote inbox.
+func (c *Client) Deliver(ctx context.Context, inbox string, body []byte, keyID string, key *rsa.PrivateKey) error {
+	u, err := c.checkURL(inbox)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ContentType)
+
+	if err := Sign(req, body, keyID, key); err != nil {
+		return err
+	}
+
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, maxDocumentSize))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("delivering to %s: status %d", inbox, res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package activitypub
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// MaxClockSkew is how far the Date of a signed request can be from now.
+const MaxClockSkew = time.Hour
+
+var (
+	ErrMissingSignature = errors.New("missing signature")
+	ErrInvalidSignature = errors.New("invalid signature")
+)
+
+// signedHeaders are the headers covered by the signatures of outgoing requests.
+var signedHeaders = []string{"(request-target)", "host", "date", "digest"}
+
+// Signature is a parsed Signature header of the draft-cavage HTTP Signatures
+// used across the fediverse.
+type Signature struct {
+	KeyID     string
+	Algorithm string
+	Headers   []string
+	Signature []byte
+}
+
+// GenerateKey creates the RSA key pair of an actor, PEM encoded.
+func GenerateKey() (string, string, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", "", err
+	}
+
+	private, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	privatePEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: private})
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public})
+	return string(privatePEM), string(publicPEM), nil
+}
+
+func ParsePrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("invalid private key")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+func ParsePublicKey(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("invalid public key")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// Digest returns the value of the Digest header of a body.
+func Digest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Sign adds the Date, Digest and Signature headers to a request carrying body.
+func Sign(r *http.Request, body []byte, keyID string, key *rsa.PrivateKey) error {
+	r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	r.Header.Set("Digest", Digest(body))
+	if r.Host == "" {
+		r.Host = r.URL.Host
+	}
+
+	hash := sha256.Sum256([]byte(signingString(r, signedHeaders)))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return err
+	}
+
+	r.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyID, strings.Join(signedHeaders, " "), base64.StdEncoding.EncodeToString(signature)))
+	return nil
+}
+
+// ParseSignature reads the Signature header of a request.
+func ParseSignature(r *http.Request) (*Signature, error) {
+	header := r.Header.Get("Signature")
+	if header == "" {
+		return nil, ErrMissingSignature
+	}
+
+	sig := &Signature{Headers: []string{"date"}}
+	for _, param := range strings.Split(header, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok {
+			return nil, ErrInvalidSignature
+		}
+		value = strings.Trim(value, `"`)
+
+		switch name {
+		case "keyId":
+			sig.KeyID = value
+		case "algorithm":
+			sig.Algorithm = value
+		case "headers":
+			sig.Headers = strings.Fields(strings.ToLower(value))
+		case "signature":
+			data, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return nil, ErrInvalidSignature
+			}
+			sig.Signature = data
+		}
+	}
+
+	if sig.KeyID == "" || len(sig.Signature) == 0 {
+		return nil, ErrInvalidSignature
+	}
+	return sig, nil
+}
+
+// Verify checks the signature of a request against the public key of its
+// sender. The signature must cover the request target, the host, the date and
+// the digest of the body, and the date must be recent.
+func (sig *Signature) Verify(r *http.Request, body []byte, key *rsa.PublicKey) error {
+	if sig.Algorithm != "" && sig.Algorithm != "rsa-sha256" && sig.Algorithm != "hs2019" {
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidSignature, sig.Algorithm)
+	}
+
+	for _, required := range signedHeaders {
+		if !slices.Contains(sig.Headers, required) {
+			return fmt.Errorf("%w: %s is not signed", ErrInvalidSignature, required)
+		}
+	}
+
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil || time.Since(date).Abs() > MaxClockSkew {
+		return fmt.Errorf("%w: date is missing or too far off", ErrInvalidSignature)
+	}
+
+	if r.Header.Get("Digest") != Digest(body) {
+		return fmt.Errorf("%w: digest does not match the body", ErrInvalidSignature)
+	}
+
+	hash := sha256.Sum256([]byte(signingString(r, sig.Headers)))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig.Signature); err != nil {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func signingString(r *http.Request, headers []string) string {
+	lines := make([]string, len(headers))
+	for i, h := range headers {
+		switch h {
+		case "(request-target)":
+			lines[i] = fmt.Sprintf("(request-target): %s %s", strings.ToLower(r.Method), r.URL.RequestURI())
+		case "host":
+			lines[i] = "host: " + r.Host
+		default:
+			lines[i] = h + ": " + r.Header.Get(h)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,185 @@
+package activitypub
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testKeyID = "https://remote.example/users/bob#main-key"
+
+func newSignedRequest(t *testing.T, body string, privatePEM string) *http.Request {
+	t.Helper()
+
+	key, err := ParsePrivateKey(privatePEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "https://local.example/ap/users/1/inbox", strings.NewReader(body))
+	if err := Sign(r, []byte(body), testKeyID, key); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestSignatureRoundTrip(t *testing.T) {
+	private, public, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey, err := ParsePublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, otherPublic, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherKey, err := ParsePublicKey(otherPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"type":"Follow"}`
+
+	tests := []struct {
+		name   string
+		tamper func(r *http.Request) []byte
+		wrong  bool
+		ok     bool
+	}{
+		{
+			name:   "valid",
+			tamper: func(r *http.Request) []byte { return []byte(body) },
+			ok:     true,
+		},
+		{
+			name:   "body changed",
+			tamper: func(r *http.Request) []byte { return []byte(`{"type":"Undo"}`) },
+		},
+		{
+			name: "digest changed along with the body",
+			tamper: func(r *http.Request) []byte {
+				changed := []byte(`{"type":"Undo"}`)
+				r.Header.Set("Digest", Digest(changed))
+				return changed
+			},
+		},
+		{
+			name: "other target",
+			tamper: func(r *http.Request) []byte {
+				r.URL.Path = "/ap/users/2/inbox"
+				return []byte(body)
+			},
+		},
+		{
+			name: "other host",
+			tamper: func(r *http.Request) []byte {
+				r.Host = "attacker.example"
+				return []byte(body)
+			},
+		},
+		{
+			name: "stale date",
+			tamper: func(r *http.Request) []byte {
+				r.Header.Set("Date", time.Now().Add(-2*MaxClockSkew).UTC().Format(http.TimeFormat))
+				return []byte(body)
+			},
+		},
+		{
+			name:   "signed by another key",
+			tamper: func(r *http.Request) []byte { return []byte(body) },
+			wrong:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newSignedRequest(t, body, private)
+			received := tt.tamper(r)
+
+			sig, err := ParseSignature(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if sig.KeyID != testKeyID {
+				t.Errorf("key id = %q, want %q", sig.KeyID, testKeyID)
+			}
+
+			key := publicKey
+			if tt.wrong {
+				key = otherKey
+			}
+
+			err = sig.Verify(r, received, key)
+			switch {
+			case tt.ok && err != nil:
+				t.Errorf("Verify() = %v, want nil", err)
+			case !tt.ok && !errors.Is(err, ErrInvalidSignature):
+				t.Errorf("Verify() = %v, want %v", err, ErrInvalidSignature)
+			}
+		})
+	}
+}
+
+func TestVerifyRequiresSignedHeaders(t *testing.T) {
+	private, public, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ParsePublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"type":"Like"}`
+	r := newSignedRequest(t, body, private)
+
+	// A signature leaving out the digest does not vouch for the body
+	r.Header.Set("Signature", strings.Replace(r.Header.Get("Signature"), " digest", "", 1))
+
+	sig, err := ParseSignature(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sig.Verify(r, []byte(body), key); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify() = %v, want %v", err, ErrInvalidSignature)
+	}
+}
+
+func TestParseSignatureMissing(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "https://local.example/ap/users/1/inbox", nil)
+
+	if _, err := ParseSignature(r); !errors.Is(err, ErrMissingSignature) {
+		t.Errorf("ParseSignature() = %v, want %v", err, ErrMissingSignature)
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	tests := []struct {
+		urls []string
+		want bool
+	}{
+		{[]string{"https://a.example/users/bob", "https://a.example/users/bob#main-key", "https://A.example/inbox"}, true},
+		{[]string{"https://a.example/users/bob", "https://b.example/users/bob#main-key"}, false},
+		{[]string{"https://a.example/users/bob", "http://a.example/inbox"}, false},
+		{[]string{"https://a.example/users/bob", "https://a.example:8443/inbox"}, false},
+		{[]string{"https://a.example/users/bob", "/inbox"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := SameOrigin(tt.urls...); got != tt.want {
+			t.Errorf("SameOrigin(%q) = %v, want %v", tt.urls, got, tt.want)
+		}
+	}
+}
@@ -116,9 +116,9 @@ func generateUsers(num int) []*store.User {
 		users[i] = &store.User{
 			Username: usernames[i%len(usernames)] + fmt.Sprintf("%d", i),
 			Email:    usernames[i%len(usernames)] + fmt.Sprintf("%d", i) + "@example.com",
-			// Role: store.Role{
-			// 	Name: "user",
-			// },
+			Role: store.Role{
+				Name: "user",
+			},
 		}
 	}
 
@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"time"
 )
 
 func GetString(key, fallback string) string {
@@ -27,3 +28,45 @@ func GetInt(key string, fallback int) int {
 	}
 	return valueAsInt
 }
+
+func GetDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	valueAsDuration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Println(err)
+		return fallback
+	}
+	return valueAsDuration
+}
+
+func GetFloat(key string, fallback float64) float64 {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	valueAsFloat, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Println(err)
+		return fallback
+	}
+	return valueAsFloat
+}
+
+func GetBool(key string, fallback bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	valueAsBool, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Println(err)
+		return fallback
+	}
+	return valueAsBool
+}
@@ -0,0 +1,140 @@
+package event
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// Handler handles the events a subscriber is subscribed to. It may be called
+// more than once with the same event, for instance when the replica died
+// while publishing it, so it should drop the events whose ID it has seen or
+// be safe to repeat.
+type Handler func(context.Context, Event) error
+
+type subscriber struct {
+	name  string
+	types []string
+	fn    Handler
+}
+
+// Bus is a Publisher delivering events to the subscribers of this replica.
+// An event is published once every subscriber handled it. When some of them
+// fail, the ones that did not are remembered and skipped when the event is
+// published again.
+type Bus struct {
+	db *sql.DB
+
+	mu          sync.RWMutex
+	subscribers []subscriber
+}
+
+func NewBus(db *sql.DB) *Bus {
+	return &Bus{db: db}
+}
+
+// Subscribe delivers the events of the given types to fn, or every event
+// when no type is given. The name identifies the subscriber across restarts
+// and must be unique.
+func (b *Bus) Subscribe(name string, fn Handler, types ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subscribers = append(b.subscribers, subscriber{name: name, types: types, fn: fn})
+}
+
+// Publish hands the event to its subscribers one after the other, returning
+// the errors of the ones that failed.
+func (b *Bus) Publish(ctx context.Context, e Event) error {
+	b.mu.RLock()
+	subscribers := slices.Clone(b.subscribers)
+	b.mu.RUnlock()
+
+	// There is nothing to skip the first time the event is published
+	handled := map[string]bool{}
+	if e.Attempt > 1 {
+		var err error
+		if handled, err = b.receipts(ctx, e.ID); err != nil {
+			return err
+		}
+	}
+
+	var done []string
+	var errs []error
+	for _, s := range subscribers {
+		if handled[s.name] || (len(s.types) > 0 && !slices.Contains(s.types, e.Type)) {
+			continue
+		}
+
+		if err := deliver(ctx, s, e); err != nil {
+			errs = append(errs, fmt.Errorf("subscriber %s: %w", s.name, err))
+			continue
+		}
+		done = append(done, s.name)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	if err := b.saveReceipts(ctx, e.ID, done); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func deliver(ctx context.Context, s subscriber, e Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panicked: %v", r)
+		}
+	}()
+	return s.fn(ctx, e)
+}
+
+func (b *Bus) receipts(ctx context.Context, eventID int64) (map[string]bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	query := `SELECT subscriber FROM domain_event_receipts WHERE event_id = $1`
+
+	rows, err := b.db.QueryContext(ctx, query, eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	handled := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		handled[name] = true
+	}
+	return handled, rows.Err()
+}
+
+func (b *Bus) saveReceipts(ctx context.Context, eventID int64, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	// Receipts are saved even when publishing was cancelled, since the
+	// subscribers did handle the event
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), queryTimeout)
+	defer cancel()
+
+	query := `
+		INSERT INTO domain_event_receipts (event_id, subscriber)
+		SELECT $1, unnest($2::text[])
+		ON CONFLICT DO NOTHING
+	`
+	_, err := b.db.ExecContext(ctx, query, eventID, pq.Array(names))
+	return err
+}
@@ -0,0 +1,47 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestBusSkipsTheSubscribersThatHandledTheEvent(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	aggregate := newTestAggregate(t, db)
+
+	e := Event{ID: recordEvent(t, db, aggregate, 1), Aggregate: aggregate, AggregateID: 1, Type: "test.happened", Attempt: 1}
+
+	calls := map[string]int{}
+	failing := errors.New("subscriber is down")
+
+	b := NewBus(db)
+	b.Subscribe("test.counter", func(context.Context, Event) error {
+		calls["counter"]++
+		return nil
+	})
+	b.Subscribe("test.mailer", func(context.Context, Event) error {
+		calls["mailer"]++
+		return failing
+	}, "test.happened")
+	b.Subscribe("test.other", func(context.Context, Event) error {
+		calls["other"]++
+		return nil
+	}, "test.other")
+
+	if err := b.Publish(ctx, e); !errors.Is(err, failing) {
+		t.Fatalf("Publish() = %v, want %v", err, failing)
+	}
+
+	// Published again, the event only goes to the subscriber that failed
+	failing = nil
+	e.Attempt++
+	if err := b.Publish(ctx, e); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls["counter"] != 1 || calls["mailer"] != 2 || calls["other"] != 0 {
+		t.Errorf("subscribers were called %v, want counter once, mailer twice and other never", calls)
+	}
+}
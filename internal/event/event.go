@@ -0,0 +1,87 @@
+// Package event publishes the domain events recorded by the store.
+//
+// Events are rows of the domain_events table, recorded with Record in the
+// transaction of the change they describe, so there is an event for every
+// committed change and none for the ones rolled back. A Relay reads them
+// back and hands them to a Publisher until it succeeds, so events are
+// published at least once. The events of an aggregate are published in the
+// order of their sequence; events of different aggregates may be published
+// in any order. The Bus is a Publisher delivering them to in-process
+// subscribers.
+package event
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+const queryTimeout = 5 * time.Second
+
+// MaxAttempts is how many times an event is published before it is left
+// dead, letting the events after it in its aggregate through.
+const MaxAttempts = 10
+
+// Event is a change to an aggregate, such as a post or a user. Its ID is
+// the same every time it is published, so consumers can drop duplicates,
+// and Sequence numbers the events of its aggregate from one.
+type Event struct {
+	ID          int64           `json:"id"`
+	Aggregate   string          `json:"aggregate"`
+	AggregateID int64           `json:"aggregate_id"`
+	Sequence    int64           `json:"sequence"`
+	Type        string          `json:"type"`
+	Data        json.RawMessage `json:"data"`
+	Attempt     int             `json:"attempt"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+// Decode decodes the data of the event into v.
+func (e *Event) Decode(v any) error {
+	return json.Unmarshal(e.Data, v)
+}
+
+// Publisher publishes events. It is called with the events of an aggregate
+// one at a time and in order, and an event it fails to publish is retried,
+// holding back the events after it in its aggregate.
+type Publisher interface {
+	Publish(context.Context, Event) error
+}
+
+// PublisherFunc is a function used as a Publisher.
+type PublisherFunc func(context.Context, Event) error
+
+func (f PublisherFunc) Publish(ctx context.Context, e Event) error {
+	return f(ctx, e)
+}
+
+// Querier runs the query of Record. Both *sql.DB and *sql.Tx are one.
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// Record records an event of type typ about the aggregate, with data stored
+// as JSON. Pass the transaction of the change so the event is only published
+// if the change is committed. The aggregate is locked until the transaction
+// ends, so concurrent changes to it record their events one after the other.
+func Record(ctx context.Context, q Querier, aggregate string, aggregateID int64, typ string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		WITH seq AS (
+			INSERT INTO domain_event_sequences (aggregate, aggregate_id, sequence) VALUES ($1, $2, 1)
+			ON CONFLICT (aggregate, aggregate_id) DO UPDATE
+				SET sequence = domain_event_sequences.sequence + 1
+			RETURNING sequence
+		)
+		INSERT INTO domain_events (aggregate, aggregate_id, sequence, type, data)
+		SELECT $1, $2, seq.sequence, $3, $4 FROM seq
+	`
+
+	_, err = q.ExecContext(ctx, query, aggregate, aggregateID, typ, payload)
+	return err
+}
@@ -0,0 +1,312 @@
+package event
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"slices"
+	"time"
+
+	"com.github/jrovieri/golang/social/internal/job"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// relayLock is the key of the advisory lock held by the replica claiming
+// events.
+const relayLock = 4_935_021_733
+
+// RelayConfig tunes a relay.
+type RelayConfig struct {
+	// Interval is how often the relay looks for events once it has
+	// published the ones there were.
+	Interval time.Duration
+	// Batch is how many events are read at once.
+	Batch int
+	// Timeout is how long publishing an event may take.
+	Timeout time.Duration
+	// Logger reports the events that fail. Nothing is logged when it is nil.
+	Logger *zap.SugaredLogger
+}
+
+// Relay publishes the recorded events. It claims them in batches, leasing
+// them in a short transaction, and publishes them once it is committed, so
+// no transaction is held open while publishers run. An event is only claimed
+// once the events before it in its aggregate are published or dead, so the
+// events of an aggregate are never published by two replicas at once. An
+// event that fails is retried with the backoff of jobs, and the events after
+// it in its aggregate wait for it.
+type Relay struct {
+	db        *sql.DB
+	publisher Publisher
+	cfg       RelayConfig
+	logger    *zap.SugaredLogger
+
+	stop        context.CancelFunc
+	cancelBatch context.CancelFunc
+	done        chan struct{}
+}
+
+func NewRelay(db *sql.DB, publisher Publisher, cfg RelayConfig) *Relay {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = zap.NewNop().Sugar()
+	}
+
+	return &Relay{db: db, publisher: publisher, cfg: cfg, logger: logger}
+}
+
+// Start starts relaying events until Shutdown or until ctx is done.
+func (r *Relay) Start(ctx context.Context) {
+	// The batch being published is only cancelled by Shutdown, so it can
+	// finish
+	batchCtx, cancelBatch := context.WithCancel(context.WithoutCancel(ctx))
+	loopCtx, stop := context.WithCancel(ctx)
+	r.stop, r.cancelBatch = stop, cancelBatch
+	r.done = make(chan struct{})
+
+	go func() {
+		defer close(r.done)
+		r.loop(loopCtx, batchCtx)
+	}()
+}
+
+// Shutdown stops relaying and waits for the batch being published. When ctx
+// is done first, the batch is cancelled and its error is returned; the events
+// that were not published are released and published again.
+func (r *Relay) Shutdown(ctx context.Context) error {
+	if r.stop == nil {
+		return nil
+	}
+
+	r.stop()
+	defer r.cancelBatch()
+
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *Relay) loop(ctx, batchCtx context.Context) {
+	ticker := time.NewTicker(r.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		// A full batch means there are likely more events waiting
+		for ctx.Err() == nil {
+			n, err := r.relay(batchCtx)
+			if err != nil {
+				r.logger.Errorw("error relaying events", "error", err)
+				break
+			}
+			if n < r.cfg.Batch {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type aggregateKey struct {
+	aggregate string
+	id        int64
+}
+
+// relay publishes a batch of the events that are due and returns how many it
+// claimed. Every event is marked as soon as it is published or fails, and the
+// events held back behind a failure are released for the next batch.
+func (r *Relay) relay(ctx context.Context) (int, error) {
+	events, err := r.claim(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var released []int64
+	blocked := map[aggregateKey]bool{}
+	for _, e := range events {
+		key := aggregateKey{e.Aggregate, e.AggregateID}
+		if blocked[key] || ctx.Err() != nil {
+			released = append(released, e.ID)
+			continue
+		}
+
+		err := r.publish(ctx, e)
+		if err == nil {
+			if err := r.markPublished(ctx, e.ID); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		dead := e.Attempt >= MaxAttempts
+		if !dead {
+			blocked[key] = true
+		}
+
+		if err := r.fail(ctx, e, err, dead); err != nil {
+			return 0, err
+		}
+	}
+	return len(events), r.release(ctx, released)
+}
+
+// claim leases a batch of the pending events that are due, leaving out those
+// behind an event of their aggregate that is leased or waits for its retry,
+// and counts an attempt for each. The lease is how long publishing the batch
+// may take, so the events of a replica that died are claimed again after it.
+// Only one replica claims at a time, holding an advisory lock for as long as
+// the claim takes, so two replicas never lease events of the same aggregate.
+func (r *Relay) claim(ctx context.Context) ([]Event, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock($1)`, relayLock).Scan(&locked); err != nil {
+		return nil, err
+	}
+
+	// Another replica is claiming
+	if !locked {
+		return nil, nil
+	}
+
+	query := `
+		UPDATE domain_events
+		SET attempts = attempts + 1, next_attempt_at = NOW() + $2 * INTERVAL '1 second'
+		WHERE id IN (
+			SELECT e.id
+			FROM domain_events e
+			WHERE e.status = 'pending' AND e.next_attempt_at <= NOW()
+				AND NOT EXISTS (
+					SELECT 1 FROM domain_events b
+					WHERE b.aggregate = e.aggregate AND b.aggregate_id = e.aggregate_id
+						AND b.status = 'pending' AND b.sequence < e.sequence AND b.next_attempt_at > NOW()
+				)
+			ORDER BY e.id
+			LIMIT $1
+		)
+		RETURNING id, aggregate, aggregate_id, sequence, type, data, attempts, created_at
+	`
+
+	lease := (r.cfg.Timeout + queryTimeout) * time.Duration(r.cfg.Batch)
+	rows, err := tx.QueryContext(ctx, query, r.cfg.Batch, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		var e Event
+		err := rows.Scan(&e.ID, &e.Aggregate, &e.AggregateID, &e.Sequence, &e.Type, &e.Data, &e.Attempt, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The events of an aggregate are published in the order of their
+	// sequence, which is the order of their IDs
+	slices.SortFunc(events, func(a, b Event) int { return cmp.Compare(a.ID, b.ID) })
+	return events, tx.Commit()
+}
+
+func (r *Relay) publish(ctx context.Context, e Event) error {
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.Timeout)
+	defer cancel()
+
+	return r.publisher.Publish(ctx, e)
+}
+
+// markPublished and fail record the outcome of an event even when the batch
+// was cancelled, so it is not published again once its lease runs out.
+func (r *Relay) markPublished(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), queryTimeout)
+	defer cancel()
+
+	query := `UPDATE domain_events SET status = 'published', published_at = NOW() WHERE id = $1`
+	_, err := r.db.ExecContext(ctx, query, id)
+	return err
+}
+
+func (r *Relay) fail(ctx context.Context, e Event, cause error, dead bool) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), queryTimeout)
+	defer cancel()
+
+	status := "pending"
+	if dead {
+		status = "dead"
+	}
+
+	query := `
+		UPDATE domain_events
+		SET status = $2, last_error = $3, next_attempt_at = NOW() + $4 * INTERVAL '1 second'
+		WHERE id = $1
+	`
+	if _, err := r.db.ExecContext(ctx, query, e.ID, status, cause.Error(), job.Backoff(e.Attempt).Seconds()); err != nil {
+		return err
+	}
+
+	fields := []any{"id", e.ID, "type", e.Type, "aggregate", e.Aggregate, "aggregate_id", e.AggregateID,
+		"attempt", e.Attempt, "error", cause}
+	if dead {
+		r.logger.Errorw("event is dead", fields...)
+	} else {
+		r.logger.Warnw("error publishing event", fields...)
+	}
+	return nil
+}
+
+// release ends the lease of the events that were claimed but not published,
+// taking back the attempt they were counted.
+func (r *Relay) release(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), queryTimeout)
+	defer cancel()
+
+	query := `
+		UPDATE domain_events SET attempts = attempts - 1, next_attempt_at = NOW()
+		WHERE id = ANY($1) AND status = 'pending'
+	`
+	_, err := r.db.ExecContext(ctx, query, pq.Array(ids))
+	return err
+}
+
+// Prune deletes the events published before the retention, along with their
+// receipts, returning how many were deleted. Dead events are kept for
+// inspection.
+func (r *Relay) Prune(ctx context.Context, retention time.Duration) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	query := `
+		DELETE FROM domain_events
+		WHERE status = 'published' AND published_at < NOW() - $1 * INTERVAL '1 second'
+	`
+
+	res, err := r.db.ExecContext(ctx, query, retention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,479 @@
+package job
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+const queryTimeout = 5 * time.Second
+
+// Config tunes the workers of a client.
+type Config struct {
+	// Workers is how many jobs the replica runs at once.
+	Workers int
+	// Interval is how often idle workers look for jobs and the scheduler
+	// for recurring jobs that are due.
+	Interval time.Duration
+	// Lease is how long a job may run. A job still running after it is
+	// cancelled, and one whose replica died is retried once it is over.
+	Lease time.Duration
+	// Logger reports the jobs that fail. Nothing is logged when it is nil.
+	Logger *zap.SugaredLogger
+}
+
+type recurring struct {
+	name     string
+	spec     string
+	schedule Schedule
+	args     Args
+	opts     []Option
+}
+
+// Client runs the jobs of the kinds registered with it and enqueues the
+// recurring ones.
+type Client struct {
+	db       *sql.DB
+	cfg      Config
+	logger   *zap.SugaredLogger
+	handlers map[string]func(context.Context, *Job) error
+	schedule []recurring
+
+	stop       context.CancelFunc
+	cancelJobs context.CancelFunc
+	loops      sync.WaitGroup
+	running    sync.WaitGroup
+	slots      chan struct{}
+	wake       chan struct{}
+}
+
+func NewClient(db *sql.DB, cfg Config) *Client {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = zap.NewNop().Sugar()
+	}
+
+	return &Client{
+		db:       db,
+		cfg:      cfg,
+		logger:   logger,
+		handlers: map[string]func(context.Context, *Job) error{},
+		slots:    make(chan struct{}, max(cfg.Workers, 1)),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Register runs the jobs of the kind of T with fn. The kind is taken from the
+// zero value of T. A job whose arguments cannot be decoded is left dead.
+// Handlers are registered before Start.
+func Register[T Args](c *Client, fn func(context.Context, T) error) {
+	var zero T
+	c.handlers[zero.Kind()] = func(ctx context.Context, job *Job) error {
+		var args T
+		if err := json.Unmarshal(job.Args, &args); err != nil {
+			return Permanent(fmt.Errorf("decoding the arguments: %w", err))
+		}
+		return fn(ctx, args)
+	}
+}
+
+// Schedule enqueues a job with args on the schedule of spec, as parsed by
+// ParseSchedule. The name identifies the schedule across replicas, which
+// enqueue each run once between them. Runs that come while the previous one
+// is still pending or running are skipped, so slow jobs do not pile up. A new
+// schedule runs right away. Schedules are added before Start.
+func (c *Client) Schedule(name, spec string, args Args, opts ...Option) error {
+	schedule, err := ParseSchedule(spec)
+	if err != nil {
+		return err
+	}
+
+	c.schedule = append(c.schedule, recurring{name: name, spec: spec, schedule: schedule, args: args, opts: opts})
+	return nil
+}
+
+// Start saves the schedules and starts the workers and the scheduler, which
+// run until Shutdown or until ctx is done.
+func (c *Client) Start(ctx context.Context) error {
+	if err := c.saveSchedules(ctx); err != nil {
+		return err
+	}
+
+	// Running jobs are only cancelled by Shutdown, so they can finish
+	jobsCtx, cancelJobs := context.WithCancel(context.WithoutCancel(ctx))
+	loopsCtx, stop := context.WithCancel(ctx)
+	c.stop, c.cancelJobs = stop, cancelJobs
+
+	c.loops.Add(2)
+	go func() {
+		defer c.loops.Done()
+		c.work(loopsCtx, jobsCtx)
+	}()
+	go func() {
+		defer c.loops.Done()
+		c.enqueueRecurring(loopsCtx)
+	}()
+	return nil
+}
+
+// Shutdown stops taking jobs and waits for the running ones to finish. When
+// ctx is done first, they are cancelled and its error is returned; they are
+// retried once their lease is over.
+func (c *Client) Shutdown(ctx context.Context) error {
+	if c.stop == nil {
+		return nil
+	}
+
+	c.stop()
+	c.loops.Wait()
+
+	drained := make(chan struct{})
+	go func() {
+		c.running.Wait()
+		close(drained)
+	}()
+
+	defer c.cancelJobs()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// work takes jobs as long as there are free workers, and looks for more when
+// one finishes or every interval.
+func (c *Client) work(ctx, jobsCtx context.Context) {
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			free := cap(c.slots) - len(c.slots)
+			if free == 0 {
+				break
+			}
+
+			jobs, err := c.claim(ctx, free)
+			if err != nil {
+				if ctx.Err() == nil {
+					c.logger.Errorw("error claiming jobs", "error", err)
+				}
+				break
+			}
+
+			for i := range jobs {
+				c.slots <- struct{}{}
+				c.running.Add(1)
+				go c.run(jobsCtx, &jobs[i])
+			}
+
+			if len(jobs) < free {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-c.wake:
+		}
+	}
+}
+
+// claim takes up to n jobs of the registered kinds that are due, along with
+// the ones whose lease is over, and leases them, counting the attempt.
+func (c *Client) claim(ctx context.Context, n int) ([]Job, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	kinds := make([]string, 0, len(c.handlers))
+	for kind := range c.handlers {
+		kinds = append(kinds, kind)
+	}
+
+	query := `
+		UPDATE jobs
+		SET status = 'running', attempts = attempts + 1, run_at = NOW() + $3 * INTERVAL '1 second'
+		WHERE id IN (
+			SELECT id FROM jobs
+			WHERE status IN ('pending', 'running') AND run_at <= NOW() AND kind = ANY($2)
+			ORDER BY run_at, id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, queue, kind, args, attempts, max_attempts, created_at
+	`
+
+	rows, err := c.db.QueryContext(ctx, query, n, pq.Array(kinds), c.cfg.Lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		var j Job
+		err := rows.Scan(&j.ID, &j.Queue, &j.Kind, &j.Args, &j.Attempt, &j.MaxAttempts, &j.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+func (c *Client) run(ctx context.Context, job *Job) {
+	defer func() {
+		<-c.slots
+		c.running.Done()
+
+		select {
+		case c.wake <- struct{}{}:
+		default:
+		}
+	}()
+
+	start := time.Now()
+	err := c.execute(ctx, job)
+
+	// The outcome is recorded even when the job was cancelled by Shutdown.
+	// Only the attempt holding the lease records it: once the lease is over,
+	// the job belongs to the attempt that took it over.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), queryTimeout)
+	defer cancel()
+
+	if err == nil {
+		query := `DELETE FROM jobs WHERE id = $1 AND attempts = $2 AND status = 'running'`
+		res, err := c.db.ExecContext(ctx, query, job.ID, job.Attempt)
+		if err != nil {
+			c.logger.Errorw("error completing job", "id", job.ID, "kind", job.Kind, "error", err)
+			return
+		}
+		c.checkLease(res, job)
+		return
+	}
+
+	status := "pending"
+	if job.LastAttempt() || IsPermanent(err) {
+		status = "dead"
+	}
+
+	query := `
+		UPDATE jobs SET status = $3, last_error = $4, run_at = NOW() + $5 * INTERVAL '1 second'
+		WHERE id = $1 AND attempts = $2 AND status = 'running'
+	`
+	res, updateErr := c.db.ExecContext(ctx, query, job.ID, job.Attempt, status, err.Error(), Backoff(job.Attempt).Seconds())
+	if updateErr != nil {
+		c.logger.Errorw("error rescheduling job", "id", job.ID, "kind", job.Kind, "error", updateErr)
+	} else {
+		c.checkLease(res, job)
+	}
+
+	fields := []any{"id", job.ID, "kind", job.Kind, "attempt", job.Attempt, "duration", time.Since(start), "error", err}
+	if status == "dead" {
+		c.logger.Errorw("job is dead", fields...)
+	} else {
+		c.logger.Warnw("job failed", fields...)
+	}
+}
+
+// checkLease reports the outcomes that were not recorded because the lease of
+// the attempt was over and another attempt took the job over.
+func (c *Client) checkLease(res sql.Result, job *Job) {
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		c.logger.Warnw("job outlived its lease", "id", job.ID, "kind", job.Kind, "attempt", job.Attempt)
+	}
+}
+
+func (c *Client) execute(ctx context.Context, job *Job) (err error) {
+	// Jobs whose replica died on their last attempt are not tried again
+	if job.Attempt > job.MaxAttempts {
+		return Permanent(errors.New("lease over on the last attempt"))
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Lease)
+	defer cancel()
+
+	return c.handlers[job.Kind](context.WithValue(ctx, jobCtx, job), job)
+}
+
+func (c *Client) saveSchedules(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	// A schedule whose spec changed starts over from now
+	query := `
+		INSERT INTO job_schedules (name, spec, next_run_at) VALUES ($1, $2, NOW())
+		ON CONFLICT (name) DO UPDATE SET spec = EXCLUDED.spec, next_run_at = $3
+			WHERE job_schedules.spec <> EXCLUDED.spec
+	`
+
+	for _, r := range c.schedule {
+		if _, err := c.db.ExecContext(ctx, query, r.name, r.spec, r.schedule.Next(time.Now())); err != nil {
+			return fmt.Errorf("saving schedule %s: %w", r.name, err)
+		}
+	}
+	return nil
+}
+
+// enqueueRecurring enqueues the recurring jobs that are due every interval.
+func (c *Client) enqueueRecurring(ctx context.Context) {
+	if len(c.schedule) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.enqueueDue(ctx); err != nil && ctx.Err() == nil {
+			c.logger.Errorw("error enqueueing recurring jobs", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// enqueueDue enqueues the runs of the schedules that are due, unless their
+// previous run is not done, and moves the schedules to their next run, in one
+// transaction so each run is enqueued once across replicas.
+func (c *Client) enqueueDue(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	names := make([]string, len(c.schedule))
+	for i, r := range c.schedule {
+		names[i] = r.name
+	}
+
+	query := `
+		SELECT name FROM job_schedules
+		WHERE name = ANY($1) AND next_run_at <= NOW()
+		FOR UPDATE SKIP LOCKED
+	`
+
+	rows, err := tx.QueryContext(ctx, query, pq.Array(names))
+	if err != nil {
+		return err
+	}
+
+	due := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		due[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(due) == 0 {
+		return nil
+	}
+
+	for _, r := range c.schedule {
+		if !due[r.name] {
+			continue
+		}
+
+		var busy bool
+		query := `SELECT EXISTS (SELECT 1 FROM jobs WHERE schedule_name = $1 AND status IN ('pending', 'running'))`
+		if err := tx.QueryRowContext(ctx, query, r.name).Scan(&busy); err != nil {
+			return err
+		}
+
+		if busy {
+			c.logger.Warnw("skipping a run of a schedule whose previous run is not done", "schedule", r.name)
+		} else {
+			opts := append(slices.Clone(r.opts), fromSchedule(r.name))
+			if _, err := Enqueue(ctx, tx, r.args, opts...); err != nil {
+				return err
+			}
+		}
+
+		query = `UPDATE job_schedules SET next_run_at = $2 WHERE name = $1`
+		if _, err := tx.ExecContext(ctx, query, r.name, r.schedule.Next(time.Now())); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// QueueStats is the depth of a queue.
+type QueueStats struct {
+	Queue string `json:"queue"`
+	// Ready jobs are due and wait for a worker.
+	Ready int64 `json:"ready"`
+	// Scheduled jobs wait for their time or their retry.
+	Scheduled int64 `json:"scheduled"`
+	Running   int64 `json:"running"`
+	Dead      int64 `json:"dead"`
+	// Latency is how long, in seconds, the oldest ready job has waited.
+	Latency float64 `json:"latency"`
+}
+
+// Stats returns the depth of every queue with jobs.
+func (c *Client) Stats(ctx context.Context) ([]QueueStats, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	query := `
+		SELECT queue
+			, COUNT(*) FILTER (WHERE status = 'pending' AND run_at <= NOW())
+			, COUNT(*) FILTER (WHERE status = 'pending' AND run_at > NOW())
+			, COUNT(*) FILTER (WHERE status = 'running')
+			, COUNT(*) FILTER (WHERE status = 'dead')
+			, COALESCE(EXTRACT(EPOCH FROM NOW() - MIN(run_at) FILTER (WHERE status = 'pending' AND run_at <= NOW())), 0)
+		FROM jobs
+		GROUP BY queue
+		ORDER BY queue
+	`
+
+	rows, err := c.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []QueueStats{}
+	for rows.Next() {
+		var s QueueStats
+		if err := rows.Scan(&s.Queue, &s.Ready, &s.Scheduled, &s.Running, &s.Dead, &s.Latency); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
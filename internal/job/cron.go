@@ -0,0 +1,181 @@
+package job
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule tells when a recurring job runs next.
+type Schedule interface {
+	Next(time.Time) time.Time
+}
+
+// ParseSchedule parses a cron expression with five fields (minute, hour, day
+// of month, month and day of week) in UTC, one of the shorthands
+// (@yearly, @annually, @monthly, @weekly, @daily, @midnight, @hourly), or
+// a duration after @every, such as "@every 5m". Fields take *, numbers,
+// ranges, lists and steps, as in "*/15" or "1-5". Expressions that never run,
+// such as "0 0 31 2 *", are refused.
+func ParseSchedule(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+
+	if every, ok := strings.CutPrefix(spec, "@every "); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(every))
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %w", spec, err)
+		}
+		if d < time.Second {
+			return nil, fmt.Errorf("schedule %q: runs more than once a second", spec)
+		}
+		return interval(d), nil
+	}
+
+	switch spec {
+	case "@yearly", "@annually":
+		spec = "0 0 1 1 *"
+	case "@monthly":
+		spec = "0 0 1 * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	case "@daily", "@midnight":
+		spec = "0 0 * * *"
+	case "@hourly":
+		spec = "0 * * * *"
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q: expected 5 fields, got %d", spec, len(fields))
+	}
+
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+	var c cron
+	sets := []*uint64{&c.minute, &c.hour, &c.dom, &c.month, &c.dow}
+	for i, field := range fields {
+		set, err := parseField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %w", spec, err)
+		}
+		*sets[i] = set
+	}
+
+	// Sunday is both 0 and 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.anyDom = fields[2] == "*"
+	c.anyDow = fields[4] == "*"
+
+	if c.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("schedule %q: never runs", spec)
+	}
+	return &c, nil
+}
+
+func parseField(field string, lo, hi int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		expr, stepText, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+		}
+
+		from, to := lo, hi
+		switch {
+		case expr == "*":
+		case strings.Contains(expr, "-"):
+			a, b, _ := strings.Cut(expr, "-")
+			var errA, errB error
+			from, errA = strconv.Atoi(a)
+			to, errB = strconv.Atoi(b)
+			if errA != nil || errB != nil {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			n, err := strconv.Atoi(expr)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			from = n
+			if !hasStep {
+				to = n
+			}
+		}
+
+		if from < lo || to > hi || from > to {
+			return 0, fmt.Errorf("%q is out of %d-%d", part, lo, hi)
+		}
+
+		for i := from; i <= to; i += step {
+			set |= 1 << i
+		}
+	}
+	return set, nil
+}
+
+// cron is a parsed cron expression, each field a set of bits.
+type cron struct {
+	minute, hour, dom, month, dow uint64
+	anyDom, anyDow                bool
+}
+
+// Next returns the first minute after t matching the expression, or the zero
+// time when there is none within five years.
+func (c *cron) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// matchDay follows cron: when both the day of month and the day of week are
+// restricted, a day matching either of them matches.
+func (c *cron) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+
+	switch {
+	case c.anyDom && c.anyDow:
+		return true
+	case c.anyDom:
+		return dow
+	case c.anyDow:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+type interval time.Duration
+
+func (i interval) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(i))
+}
@@ -0,0 +1,98 @@
+package job
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	valid := []string{
+		"* * * * *",
+		"*/15 * * * *",
+		"0 4 * * 1-5",
+		"0,30 8-18/2 1 1,7 *",
+		"0 0 * * 7",
+		"0 0 29 2 *",
+		"@hourly",
+		"@daily",
+		"@every 5m",
+		"  @every 1h30m  ",
+	}
+	for _, spec := range valid {
+		if _, err := ParseSchedule(spec); err != nil {
+			t.Errorf("ParseSchedule(%q) = %v", spec, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"@every 500ms",
+		"@every soon",
+		"@fortnightly",
+		// February never has 31 days
+		"0 0 31 2 *",
+	}
+	for _, spec := range invalid {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("ParseSchedule(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2025, time.January, 15, 10, 7, 30, 0, time.UTC)
+
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2025, time.January, 15, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2025, time.January, 15, 10, 15, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2025, time.January, 15, 11, 0, 0, 0, time.UTC)},
+		{"0 4 * * *", time.Date(2025, time.January, 16, 4, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2025, time.January, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2025, time.January, 19, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2025, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		// Either the day of month or the day of week matches
+		{"0 0 20 * 5", time.Date(2025, time.January, 17, 0, 0, 0, 0, time.UTC)},
+		{"@every 90s", from.Add(90 * time.Second)},
+	}
+
+	for _, tt := range tests {
+		s, err := ParseSchedule(tt.spec)
+		if err != nil {
+			t.Fatalf("ParseSchedule(%q) = %v", tt.spec, err)
+		}
+
+		if got := s.Next(from); !got.Equal(tt.want) {
+			t.Errorf("%q: Next(%s) = %s, want %s", tt.spec, from, got, tt.want)
+		}
+	}
+}
+
+func TestScheduleNextIsUTC(t *testing.T) {
+	s, err := ParseSchedule("0 4 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 23:00 on January 15 in São Paulo is 02:00 on January 16 in UTC
+	from := time.Date(2025, time.January, 15, 23, 0, 0, 0, time.FixedZone("BRT", -3*60*60))
+	want := time.Date(2025, time.January, 16, 4, 0, 0, 0, time.UTC)
+	if got := s.Next(from); !got.Equal(want) {
+		t.Errorf("Next(%s) = %s, want %s", from, got, want)
+	}
+}
@@ -0,0 +1,165 @@
+// Package job runs background jobs queued in Postgres.
+//
+// Jobs are rows of the jobs table. They are enqueued with Enqueue, usually in
+// the transaction of the change they are about so they only run once it is
+// committed, and taken by the workers of any replica with FOR UPDATE SKIP
+// LOCKED. A job that fails is retried with an exponential backoff until it
+// runs out of attempts and is left dead for inspection. Recurring jobs are
+// enqueued by a cron-style scheduler, once per run across replicas.
+package job
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	// DefaultQueue is the queue of jobs enqueued without one.
+	DefaultQueue = "default"
+
+	// DefaultMaxAttempts is how many times a job is tried unless enqueued
+	// with MaxAttempts.
+	DefaultMaxAttempts = 10
+)
+
+// Args are the arguments of a kind of job, stored as JSON. Kind names the
+// handler the job runs with.
+type Args interface {
+	Kind() string
+}
+
+// Job is a job taken by a worker.
+type Job struct {
+	ID          int64
+	Queue       string
+	Kind        string
+	Args        json.RawMessage
+	Attempt     int
+	MaxAttempts int
+	CreatedAt   time.Time
+}
+
+// LastAttempt tells whether the job is dead if this attempt fails.
+func (j *Job) LastAttempt() bool {
+	return j.Attempt >= j.MaxAttempts
+}
+
+type jobKey string
+
+const jobCtx jobKey = "job"
+
+// FromContext returns the job a handler runs, or nil outside of a handler.
+func FromContext(ctx context.Context) *Job {
+	job, _ := ctx.Value(jobCtx).(*Job)
+	return job
+}
+
+// Querier runs the queries of Enqueue. Both *sql.DB and *sql.Tx are one.
+type Querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+type options struct {
+	queue        string
+	runAt        time.Time
+	maxAttempts  int
+	scheduleName string
+}
+
+// Option changes how a job is enqueued.
+type Option func(*options)
+
+// InQueue enqueues the job in a queue other than the default one.
+func InQueue(queue string) Option {
+	return func(o *options) { o.queue = queue }
+}
+
+// RunAt delays the job until t.
+func RunAt(t time.Time) Option {
+	return func(o *options) { o.runAt = t }
+}
+
+// Delay delays the job by d.
+func Delay(d time.Duration) Option {
+	return func(o *options) { o.runAt = time.Now().Add(d) }
+}
+
+// MaxAttempts changes how many times the job is tried.
+func MaxAttempts(n int) Option {
+	return func(o *options) { o.maxAttempts = n }
+}
+
+// fromSchedule records the schedule that enqueued the job.
+func fromSchedule(name string) Option {
+	return func(o *options) { o.scheduleName = name }
+}
+
+// Enqueue adds a job with args, returning its ID. Pass the transaction of the
+// change the job is about to run it if and only if the change is committed.
+func Enqueue(ctx context.Context, q Querier, args Args, opts ...Option) (int64, error) {
+	o := options{queue: DefaultQueue, maxAttempts: DefaultMaxAttempts}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	payload, err := json.Marshal(args)
+	if err != nil {
+		return 0, err
+	}
+
+	var runAt *time.Time
+	if !o.runAt.IsZero() {
+		runAt = &o.runAt
+	}
+
+	var scheduleName *string
+	if o.scheduleName != "" {
+		scheduleName = &o.scheduleName
+	}
+
+	query := `
+		INSERT INTO jobs (queue, kind, args, max_attempts, run_at, schedule_name)
+		VALUES ($1, $2, $3, $4, COALESCE($5, NOW()), $6)
+		RETURNING id
+	`
+
+	var id int64
+	err = q.QueryRowContext(ctx, query, o.queue, args.Kind(), payload, o.maxAttempts, runAt, scheduleName).Scan(&id)
+	return id, err
+}
+
+// Backoff is how long to wait before retrying a job that failed attempts
+// times: ten seconds, doubling up to six hours, with a random half of it
+// taken off so jobs that failed together are not retried together.
+func Backoff(attempts int) time.Duration {
+	backoff := 10 * time.Second
+	for i := 1; i < attempts && backoff < 6*time.Hour; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, 6*time.Hour)
+
+	return backoff/2 + rand.N(backoff/2)
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps the error of a job that retrying cannot fix, so the job
+// is left dead at once.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// IsPermanent tells whether err was wrapped with Permanent.
+func IsPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
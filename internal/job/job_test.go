@@ -0,0 +1,50 @@
+package job
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 10 * time.Second},
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{10, 10 * time.Second << 9},
+		{12, 10 * time.Second << 11},
+		{13, 6 * time.Hour},
+		{1000, 6 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		// A random half of the backoff is taken off
+		for range 20 {
+			got := Backoff(tt.attempts)
+			if got < tt.want/2 || got >= tt.want {
+				t.Errorf("Backoff(%d) = %s, want in [%s, %s)", tt.attempts, got, tt.want/2, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	cause := errors.New("bad arguments")
+	err := fmt.Errorf("sending: %w", Permanent(cause))
+
+	if !IsPermanent(err) {
+		t.Error("IsPermanent() = false for a wrapped permanent error")
+	}
+	if !errors.Is(err, cause) {
+		t.Error("permanent error does not unwrap to its cause")
+	}
+	if IsPermanent(cause) {
+		t.Error("IsPermanent() = true for a plain error")
+	}
+}
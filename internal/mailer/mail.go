@@ -1,88 +1,128 @@
 package mailer
 
 import (
-	"bytes"
+	"context"
 	"embed"
-	"errors"
 	"fmt"
-	"html/template"
-	"time"
+)
 
-	"github.com/sendgrid/sendgrid-go"
-	"github.com/sendgrid/sendgrid-go/helpers/mail"
+const (
+	FromName             = "GopherSocial"
+	FromEmail            = "contact@gophersocial.com"
+	UserWelcomeTemplate  = "user_invitation.tmpl"
+	NotificationTemplate = "notification.tmpl"
+	DigestTemplate       = "notification_digest.tmpl"
 )
 
+// Providers.
 const (
-	FromName            = "GopherSocial"
-	FromEmail           = "contact@gophersocial.com"
-	MaxRetry            = 3
-	UserWelcomeTemplate = "user_invitation.tmpl"
+	ProviderSendGrid = "sendgrid"
+	ProviderSMTP     = "smtp"
+	ProviderFile     = "file"
+	ProviderConsole  = "console"
 )
 
 //go:embed "templates"
 var FS embed.FS
 
+// Client sends templated emails in the locale closest to the one of the
+// recipient. The status is the one reported by the provider: the HTTP status
+// for SendGrid, the SMTP reply code for SMTP and zero for the sinks.
+// Providers without a sandbox ignore isSandBox. Sending stops when ctx is
+// done.
 type Client interface {
-	Send(templateFile, username, email string, data any, isSandBox bool) (int, error)
+	Send(ctx context.Context, templateFile, locale, username, email string, data any, isSandBox bool) (int, error)
 }
 
-type MailSender struct {
-	from   string
-	apiKey string
-	client *sendgrid.Client
+// Unsubscribable is implemented by the data of emails the recipient can
+// unsubscribe from. Their unsubscribe link is also sent in the
+// List-Unsubscribe header, which mail clients offer as a one-click button.
+type Unsubscribable interface {
+	UnsubscribeLink() string
 }
 
-func NewMailSender(apiKey, fromEmail string) (*MailSender, error) {
+// Data is template data read back from JSON, as queued in the email outbox.
+// An UnsubscribeURL in it is sent in the List-Unsubscribe header.
+type Data map[string]any
 
-	if apiKey == "" {
-		return &MailSender{}, errors.New("mail apiKey is required")
-	}
+func (d Data) UnsubscribeLink() string {
+	link, _ := d["UnsubscribeURL"].(string)
+	return link
+}
 
-	client := sendgrid.NewSendClient(apiKey)
-	return &MailSender{
-		from:   FromEmail,
-		apiKey: apiKey,
-		client: client,
-	}, nil
+// Config picks the provider and holds the settings of each one.
+type Config struct {
+	Provider  string
+	FromEmail string
+	APIKey    string
+	SMTP      SMTPConfig
+	Dir       string
 }
 
-func (m *MailSender) Send(templateFile, username, email string, data any, inSandbox bool) (int, error) {
+// New returns the client of the configured provider. It fails when the
+// templates are not valid, so they are checked on startup.
+func New(cfg Config) (Client, error) {
+	if _, err := LoadTemplates(); err != nil {
+		return nil, err
+	}
+
+	from := cfg.FromEmail
+	if from == "" {
+		from = FromEmail
+	}
+
+	switch cfg.Provider {
+	case ProviderSendGrid:
+		return NewMailSender(cfg.APIKey, from)
+	case ProviderSMTP:
+		return NewSMTPSender(cfg.SMTP, from)
+	case ProviderFile:
+		return NewFileSink(cfg.Dir, from)
+	case ProviderConsole:
+		return NewConsoleSink(nil, from), nil
+	default:
+		return nil, fmt.Errorf("unknown mail provider %q", cfg.Provider)
+	}
+}
 
-	from := mail.NewEmail(FromName, m.from)
-	to := mail.NewEmail(username, email)
+// message is an email rendered from its template, ready for any provider.
+// It has an HTML body and its plain-text alternative.
+type message struct {
+	fromName string
+	from     string
+	toName   string
+	to       string
+	subject  string
+	html     string
+	text     string
+	headers  map[string]string
+}
 
-	tmpl, err := template.ParseFS(FS, "templates/"+templateFile)
+func render(templateFile, locale, fromName, from, toName, to string, data any) (*message, error) {
+	templates, err := LoadTemplates()
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
 
-	subject := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(subject, "subject", data)
+	rendered, err := templates.Render(templateFile, locale, data)
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
 
-	body := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(body, "body", data)
-	if err != nil {
-		return -1, err
+	m := &message{
+		fromName: fromName,
+		from:     from,
+		toName:   toName,
+		to:       to,
+		subject:  rendered.Subject,
+		html:     rendered.HTML,
+		text:     rendered.Text,
+		headers:  map[string]string{"Content-Language": rendered.Locale},
 	}
 
-	message := mail.NewSingleEmail(from, subject.String(), to, "", body.String())
-	message.SetMailSettings(&mail.MailSettings{
-		SandboxMode: &mail.Setting{
-			Enable: &inSandbox,
-		},
-	})
-
-	for i := 0; i < MaxRetry; i++ {
-		response, err := m.client.Send(message)
-
-		if err != nil {
-			time.Sleep(time.Second * time.Duration(i+1))
-			continue
-		}
-		return response.StatusCode, nil
+	if u, ok := data.(Unsubscribable); ok && u.UnsubscribeLink() != "" {
+		m.headers["List-Unsubscribe"] = "<" + u.UnsubscribeLink() + ">"
+		m.headers["List-Unsubscribe-Post"] = "List-Unsubscribe=One-Click"
 	}
-	return -1, fmt.Errorf("failed to send email after %d attempt, error: %v", MaxRetry, err)
+	return m, nil
 }
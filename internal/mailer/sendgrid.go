@@ -0,0 +1,63 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/sendgrid/sendgrid-go"
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+)
+
+// MailSender sends emails through the SendGrid API.
+type MailSender struct {
+	from   string
+	apiKey string
+	client *sendgrid.Client
+}
+
+func NewMailSender(apiKey, fromEmail string) (*MailSender, error) {
+
+	if apiKey == "" {
+		return &MailSender{}, errors.New("mail apiKey is required")
+	}
+
+	client := sendgrid.NewSendClient(apiKey)
+	return &MailSender{
+		from:   fromEmail,
+		apiKey: apiKey,
+		client: client,
+	}, nil
+}
+
+func (m *MailSender) Send(ctx context.Context, templateFile, locale, username, email string, data any, inSandbox bool) (int, error) {
+
+	msg, err := render(templateFile, locale, FromName, m.from, username, email, data)
+	if err != nil {
+		return -1, err
+	}
+
+	from := mail.NewEmail(msg.fromName, msg.from)
+	to := mail.NewEmail(msg.toName, msg.to)
+
+	message := mail.NewSingleEmail(from, msg.subject, to, msg.text, msg.html)
+	for key, value := range msg.headers {
+		message.SetHeader(key, value)
+	}
+
+	message.SetMailSettings(&mail.MailSettings{
+		SandboxMode: &mail.Setting{
+			Enable: &inSandbox,
+		},
+	})
+
+	response, err := m.client.SendWithContext(ctx, message)
+	if err != nil {
+		return -1, err
+	}
+
+	if response.StatusCode >= 400 {
+		return response.StatusCode, fmt.Errorf("sendgrid answered %d: %s", response.StatusCode, response.Body)
+	}
+	return response.StatusCode, nil
+}
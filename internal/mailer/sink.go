@@ -0,0 +1,96 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileSink writes emails to .eml files instead of sending them, so they can
+// be opened with any mail client during development.
+type FileSink struct {
+	dir  string
+	from string
+}
+
+func NewFileSink(dir, fromEmail string) (*FileSink, error) {
+	if dir == "" {
+		return nil, errors.New("mail dir is required")
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileSink{dir: dir, from: fromEmail}, nil
+}
+
+func (s *FileSink) Send(_ context.Context, templateFile, locale, username, email string, data any, isSandBox bool) (int, error) {
+	msg, err := render(templateFile, locale, FromName, s.from, username, email, data)
+	if err != nil {
+		return -1, err
+	}
+
+	to := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == os.PathSeparator {
+			return '_'
+		}
+		return r
+	}, email)
+
+	raw, err := msg.encode()
+	if err != nil {
+		return -1, err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), to)
+	if err := os.WriteFile(filepath.Join(s.dir, name), raw, 0o644); err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
+
+// ConsoleSink prints emails instead of sending them, for development. Only
+// their plain-text alternative is printed.
+type ConsoleSink struct {
+	mu   sync.Mutex
+	w    io.Writer
+	from string
+}
+
+// NewConsoleSink returns a sink printing to w, or to the standard output when
+// w is nil.
+func NewConsoleSink(w io.Writer, fromEmail string) *ConsoleSink {
+	if w == nil {
+		w = os.Stdout
+	}
+	return &ConsoleSink{w: w, from: fromEmail}
+}
+
+func (s *ConsoleSink) Send(_ context.Context, templateFile, locale, username, email string, data any, isSandBox bool) (int, error) {
+	msg, err := render(templateFile, locale, FromName, s.from, username, email, data)
+	if err != nil {
+		return -1, err
+	}
+
+	var b strings.Builder
+	b.WriteString("----- email -----\n")
+	for _, h := range msg.header() {
+		b.WriteString(h[0] + ": " + h[1] + "\n")
+	}
+	b.WriteString("\n" + msg.text)
+	b.WriteString("-----------------\n")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := io.WriteString(s.w, b.String()); err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
@@ -0,0 +1,237 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SMTP security modes. STARTTLS upgrades a plain connection and is required
+// when picked; TLS connects over TLS from the start, usually on port 465;
+// none sends in the clear and is only meant for local test servers.
+const (
+	SMTPStartTLS = "starttls"
+	SMTPTLS      = "tls"
+	SMTPNone     = "none"
+)
+
+const smtpTimeout = 30 * time.Second
+
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	Security string
+}
+
+// SMTPSender sends emails through an SMTP server, authenticating with PLAIN
+// when a username is set.
+type SMTPSender struct {
+	cfg  SMTPConfig
+	from string
+}
+
+func NewSMTPSender(cfg SMTPConfig, fromEmail string) (*SMTPSender, error) {
+	if cfg.Host == "" {
+		return nil, errors.New("smtp host is required")
+	}
+
+	switch cfg.Security {
+	case SMTPStartTLS, SMTPTLS, SMTPNone:
+	default:
+		return nil, fmt.Errorf("unknown smtp security %q", cfg.Security)
+	}
+
+	return &SMTPSender{cfg: cfg, from: fromEmail}, nil
+}
+
+func (s *SMTPSender) Send(ctx context.Context, templateFile, locale, username, email string, data any, isSandBox bool) (int, error) {
+	msg, err := render(templateFile, locale, FromName, s.from, username, email, data)
+	if err != nil {
+		return -1, err
+	}
+
+	return s.send(ctx, msg)
+}
+
+func (s *SMTPSender) send(ctx context.Context, msg *message) (int, error) {
+	addr := net.JoinHostPort(s.cfg.Host, strconv.Itoa(s.cfg.Port))
+	tlsConfig := &tls.Config{ServerName: s.cfg.Host}
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+
+	var conn net.Conn
+	var err error
+	if s.cfg.Security == SMTPTLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return -1, err
+	}
+
+	deadline := time.Now().Add(smtpTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	// Closing the connection interrupts the command waiting for a reply
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, s.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return -1, err
+	}
+	defer c.Close()
+
+	if s.cfg.Security == SMTPStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return -1, fmt.Errorf("smtp server %s does not support STARTTLS", addr)
+		}
+
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return smtpStatus(err), err
+		}
+	}
+
+	if s.cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, s.cfg.Host)); err != nil {
+			return smtpStatus(err), err
+		}
+	}
+
+	if err := c.Mail(msg.from); err != nil {
+		return smtpStatus(err), err
+	}
+
+	if err := c.Rcpt(msg.to); err != nil {
+		return smtpStatus(err), err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return smtpStatus(err), err
+	}
+
+	raw, err := msg.encode()
+	if err != nil {
+		return -1, err
+	}
+
+	if _, err := w.Write(raw); err != nil {
+		return -1, err
+	}
+
+	if err := w.Close(); err != nil {
+		return smtpStatus(err), err
+	}
+
+	if err := c.Quit(); err != nil {
+		return smtpStatus(err), err
+	}
+	return 250, nil
+}
+
+// smtpStatus returns the reply code of a failed SMTP command.
+func smtpStatus(err error) int {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code
+	}
+	return -1
+}
+
+// encode formats the message as sent over SMTP and stored in .eml files: the
+// plain-text alternative and the HTML body in quoted-printable, with CRLF
+// line endings.
+func (m *message) encode() ([]byte, error) {
+	var parts bytes.Buffer
+	w := multipart.NewWriter(&parts)
+
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=UTF-8", m.text},
+		{"text/html; charset=UTF-8", m.html},
+	} {
+		pw, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		body := strings.ReplaceAll(part.body, "\r\n", "\n")
+		body = strings.ReplaceAll(body, "\n", "\r\n")
+
+		qp := quotedprintable.NewWriter(pw)
+		if _, err := qp.Write([]byte(body)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	for _, h := range m.header() {
+		b.WriteString(h[0] + ": " + h[1] + "\r\n")
+	}
+	b.WriteString("Content-Type: multipart/alternative; boundary=\"" + w.Boundary() + "\"\r\n")
+	b.WriteString("\r\n")
+	b.Write(parts.Bytes())
+
+	return b.Bytes(), nil
+}
+
+// header returns the header fields of the message in the order they are
+// written, extra fields last and sorted.
+func (m *message) header() [][2]string {
+	from := mail.Address{Name: m.fromName, Address: m.from}
+	to := mail.Address{Name: m.toName, Address: m.to}
+
+	_, domain, _ := strings.Cut(m.from, "@")
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	header := [][2]string{
+		{"From", from.String()},
+		{"To", to.String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", strings.TrimSpace(m.subject))},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", "<" + hex.EncodeToString(id) + "@" + domain + ">"},
+		{"MIME-Version", "1.0"},
+	}
+
+	keys := make([]string, 0, len(m.headers))
+	for key := range m.headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		header = append(header, [2]string{key, m.headers[key]})
+	}
+	return header
+}
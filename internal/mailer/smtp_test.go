@@ -0,0 +1,271 @@
+package mailer
+
+import (
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testUnsubscribeURL = "https://api.example/v1/email/unsubscribe?token=abc"
+
+func notificationData() Data {
+	return Data{
+		"Username":         "alice",
+		"Notifications":    []any{map[string]any{"Message": "bob followed you"}},
+		"NotificationsURL": "https://app.example/notifications",
+		"UnsubscribeURL":   testUnsubscribeURL,
+	}
+}
+
+// smtpServer is an SMTP server accepting every email and keeping the data of
+// the last one.
+type smtpServer struct {
+	ln       net.Listener
+	received chan []byte
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	s := &smtpServer{ln: ln, received: make(chan []byte, 1)}
+	go s.serve()
+	return s
+}
+
+func (s *smtpServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *smtpServer) handle(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+
+	tp.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		switch cmd, _, _ := strings.Cut(strings.ToUpper(line), " "); cmd {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 localhost")
+		case "MAIL", "RCPT", "RSET", "NOOP":
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 Go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.received <- data
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+// checkNotificationEmail checks a notification email as received: a
+// multipart/alternative body with a plain-text and an HTML part, and the
+// one-click List-Unsubscribe headers.
+func checkNotificationEmail(t *testing.T, raw []byte) {
+	t.Helper()
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := msg.Header.Get("List-Unsubscribe"); got != "<"+testUnsubscribeURL+">" {
+		t.Errorf("List-Unsubscribe = %q", got)
+	}
+
+	if got := msg.Header.Get("List-Unsubscribe-Post"); got != "List-Unsubscribe=One-Click" {
+		t.Errorf("List-Unsubscribe-Post = %q", got)
+	}
+
+	if got := msg.Header.Get("To"); !strings.Contains(got, "alice@example.com") {
+		t.Errorf("To = %q", got)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type = %q, %v", msg.Header.Get("Content-Type"), err)
+	}
+
+	parts := map[string]string{}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := io.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		contentType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		parts[contentType] = string(body)
+	}
+
+	if len(parts) != 2 {
+		t.Fatalf("parts = %d, want a plain-text and an HTML one", len(parts))
+	}
+
+	text, html := parts["text/plain"], parts["text/html"]
+	if !strings.Contains(text, "bob followed you") || !strings.Contains(text, testUnsubscribeURL) {
+		t.Errorf("plain-text part misses the notification or the unsubscribe link:\n%s", text)
+	}
+
+	if !strings.Contains(html, "bob followed you") || !strings.Contains(html, "<html") {
+		t.Errorf("HTML part misses the notification:\n%s", html)
+	}
+}
+
+func TestSMTPSend(t *testing.T) {
+	server := newSMTPServer(t)
+	host, port, _ := net.SplitHostPort(server.ln.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+
+	sender, err := NewSMTPSender(SMTPConfig{Host: host, Port: portNumber, Security: SMTPNone}, "noreply@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := sender.Send(context.Background(), NotificationTemplate, "en", "alice", "alice@example.com", notificationData(), false)
+	if err != nil {
+		t.Fatalf("Send() = %v", err)
+	}
+
+	if status != 250 {
+		t.Errorf("status = %d, want 250", status)
+	}
+
+	select {
+	case raw := <-server.received:
+		checkNotificationEmail(t, raw)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email was received")
+	}
+}
+
+// TestSMTPSendMailpit sends through a mailpit server and reads the email back
+// from its API. It runs when MAILPIT_SMTP_ADDR, such as localhost:1025, is
+// set; MAILPIT_API_URL defaults to http://localhost:8025.
+func TestSMTPSendMailpit(t *testing.T) {
+	addr := os.Getenv("MAILPIT_SMTP_ADDR")
+	if addr == "" {
+		t.Skip("MAILPIT_SMTP_ADDR is not set")
+	}
+
+	apiURL := os.Getenv("MAILPIT_API_URL")
+	if apiURL == "" {
+		apiURL = "http://localhost:8025"
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNumber, _ := strconv.Atoi(port)
+
+	sender, err := NewSMTPSender(SMTPConfig{Host: host, Port: portNumber, Security: SMTPNone}, "noreply@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sender.Send(context.Background(), NotificationTemplate, "en", "alice", "alice@example.com", notificationData(), false); err != nil {
+		t.Fatalf("Send() = %v", err)
+	}
+
+	resp, err := http.Get(apiURL + "/api/v1/message/latest/raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("mailpit answered %s", resp.Status)
+	}
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNotificationEmail(t, raw)
+}
+
+func TestSMTPSendStopsWithContext(t *testing.T) {
+	// A server that accepts connections but never greets
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conns <- conn
+		}
+	}()
+	defer func() {
+		select {
+		case conn := <-conns:
+			conn.Close()
+		default:
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+
+	sender, err := NewSMTPSender(SMTPConfig{Host: host, Port: portNumber, Security: SMTPNone}, "noreply@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := sender.Send(ctx, NotificationTemplate, "en", "alice", "alice@example.com", notificationData(), false); err == nil {
+		t.Fatal("Send() = nil, want an error")
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Send() took %s after its context was done", elapsed)
+	}
+}
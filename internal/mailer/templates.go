@@ -0,0 +1,284 @@
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrUnknownTemplate is returned when rendering a template that does not
+// exist in any locale.
+var ErrUnknownTemplate = errors.New("unknown template")
+
+// DefaultLocale is the locale emails fall back to when there is no version
+// of their template in the locale of the recipient.
+const DefaultLocale = "en"
+
+// Templates are laid out as:
+//
+//	layout.tmpl               the "layout" shared by every email
+//	partials/*.tmpl           partials shared by every locale
+//	<locale>/partials/*.tmpl  partials of a locale, overriding the shared ones
+//	<locale>/<name>.tmpl      the emails of a locale
+//
+// Emails define a "subject" and the "content" of the layout, and may define
+// its "footer". Their plain-text alternative is generated from the HTML.
+const (
+	layoutFile  = "layout.tmpl"
+	partialsDir = "partials"
+)
+
+// Templates holds the emails of every locale, parsed along with the layout
+// and the partials.
+type Templates struct {
+	defaultLocale string
+	sets          map[string]map[string]*template.Template
+}
+
+// Rendered is an email rendered from its template.
+type Rendered struct {
+	Template string `json:"template"`
+	Locale   string `json:"locale"`
+	Subject  string `json:"subject"`
+	HTML     string `json:"html"`
+	Text     string `json:"text"`
+}
+
+var loadTemplates = sync.OnceValues(func() (*Templates, error) {
+	sub, err := fs.Sub(FS, "templates")
+	if err != nil {
+		return nil, err
+	}
+	return ParseTemplates(sub, DefaultLocale)
+})
+
+// LoadTemplates returns the embedded templates, parsed and validated once.
+func LoadTemplates() (*Templates, error) {
+	return loadTemplates()
+}
+
+// ParseTemplates parses the templates of every locale in fsys and validates
+// them: each defines a subject and a content, exists in the default locale
+// and renders its sample data.
+func ParseTemplates(fsys fs.FS, defaultLocale string) (*Templates, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := fs.Glob(fsys, path.Join(partialsDir, "*.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Templates{
+		defaultLocale: strings.ToLower(defaultLocale),
+		sets:          map[string]map[string]*template.Template{},
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == partialsDir {
+			continue
+		}
+
+		locale := entry.Name()
+		set, err := parseLocale(fsys, locale, shared)
+		if err != nil {
+			return nil, err
+		}
+		t.sets[strings.ToLower(locale)] = set
+	}
+
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func parseLocale(fsys fs.FS, locale string, shared []string) (map[string]*template.Template, error) {
+	own, err := fs.Glob(fsys, path.Join(locale, partialsDir, "*.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := fs.Glob(fsys, path.Join(locale, "*.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+
+	funcs := template.FuncMap{
+		"locale": func() string { return locale },
+		"dict":   dict,
+	}
+
+	set := make(map[string]*template.Template, len(files))
+	for _, file := range files {
+		name := path.Base(file)
+
+		// Partials of the locale come after the shared ones to override them
+		patterns := append([]string{layoutFile}, shared...)
+		patterns = append(patterns, own...)
+		patterns = append(patterns, file)
+
+		tmpl, err := template.New(name).Funcs(funcs).Option("missingkey=error").ParseFS(fsys, patterns...)
+		if err != nil {
+			return nil, fmt.Errorf("template %s: %w", file, err)
+		}
+
+		for _, block := range []string{"subject", "content"} {
+			if tmpl.Lookup(block) == nil {
+				return nil, fmt.Errorf("template %s does not define %q", file, block)
+			}
+		}
+		set[name] = tmpl
+	}
+	return set, nil
+}
+
+func (t *Templates) validate() error {
+	defaults, ok := t.sets[t.defaultLocale]
+	if !ok {
+		return fmt.Errorf("there are no templates for the default locale %q", t.defaultLocale)
+	}
+
+	for locale, set := range t.sets {
+		for name := range set {
+			if _, ok := defaults[name]; !ok {
+				return fmt.Errorf("template %s of locale %s has no %s version", name, locale, t.defaultLocale)
+			}
+
+			if _, err := t.Preview(name, locale); err != nil {
+				return fmt.Errorf("template %s of locale %s: %w", name, locale, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Names returns the names of the templates, sorted.
+func (t *Templates) Names() []string {
+	names := make([]string, 0, len(t.sets[t.defaultLocale]))
+	for name := range t.sets[t.defaultLocale] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Locales returns the locales with templates, sorted.
+func (t *Templates) Locales() []string {
+	locales := make([]string, 0, len(t.sets))
+	for locale := range t.sets {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// lookup returns the template of the locale closest to the one asked for:
+// the locale itself, its language, then the default locale. It also returns
+// the locale of the template.
+func (t *Templates) lookup(name, locale string) (*template.Template, string, error) {
+	locale = strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+	language, _, _ := strings.Cut(locale, "-")
+
+	for _, candidate := range []string{locale, language, t.defaultLocale} {
+		if tmpl, ok := t.sets[candidate][name]; ok {
+			return tmpl, candidate, nil
+		}
+	}
+	return nil, "", fmt.Errorf("%w %q", ErrUnknownTemplate, name)
+}
+
+// Render renders the template in the locale closest to the one asked for.
+func (t *Templates) Render(name, locale string, data any) (*Rendered, error) {
+	tmpl, locale, err := t.lookup(name, locale)
+	if err != nil {
+		return nil, err
+	}
+
+	subject := new(bytes.Buffer)
+	if err := tmpl.ExecuteTemplate(subject, "subject", data); err != nil {
+		return nil, err
+	}
+
+	body := new(bytes.Buffer)
+	if err := tmpl.ExecuteTemplate(body, "layout", data); err != nil {
+		return nil, err
+	}
+
+	text, err := htmlToText(body.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return &Rendered{
+		Template: name,
+		Locale:   locale,
+		// The subject is a header, not HTML, so it is sent unescaped
+		Subject: strings.Join(strings.Fields(html.UnescapeString(subject.String())), " "),
+		HTML:    body.String(),
+		Text:    text,
+	}, nil
+}
+
+// Preview renders the template with its sample data.
+func (t *Templates) Preview(name, locale string) (*Rendered, error) {
+	data, ok := sampleData[name]
+	if !ok {
+		return nil, fmt.Errorf("template %q has no sample data", name)
+	}
+	return t.Render(name, locale, data)
+}
+
+// dict builds a map from key and value pairs, to pass several values to a
+// partial.
+func dict(pairs ...any) (map[string]any, error) {
+	if len(pairs)%2 != 0 {
+		return nil, errors.New("dict expects key and value pairs")
+	}
+
+	m := make(map[string]any, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		key, ok := pairs[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("dict key %v is not a string", pairs[i])
+		}
+		m[key] = pairs[i+1]
+	}
+	return m, nil
+}
+
+// sampleData is the data every template is validated and previewed with. It
+// has the shape the data of the template has once read back from the outbox.
+var sampleData = map[string]any{
+	UserWelcomeTemplate: Data{
+		"Username":      "gopher",
+		"ActivationURL": "https://gophersocial.com/confirm/4f1c2a9e-6d3b-4c8e-9a7f-2b5d8e1c0a34",
+	},
+	NotificationTemplate: Data{
+		"Username": "gopher",
+		"Notifications": []any{
+			map[string]any{"Message": "rob and 2 others liked your post"},
+		},
+		"NotificationsURL": "https://gophersocial.com/notifications",
+		"UnsubscribeURL":   "https://api.gophersocial.com/v1/email/unsubscribe?token=sample",
+	},
+	DigestTemplate: Data{
+		"Username": "gopher",
+		"Notifications": []any{
+			map[string]any{"Message": "rob and 2 others liked your post"},
+			map[string]any{"Message": "ken commented on your post"},
+			map[string]any{"Message": "russ followed you"},
+		},
+		"NotificationsURL": "https://gophersocial.com/notifications",
+		"UnsubscribeURL":   "https://api.gophersocial.com/v1/email/unsubscribe?token=sample",
+	},
+}
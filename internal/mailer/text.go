@@ -0,0 +1,109 @@
+package mailer
+
+import (
+	"io"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// htmlToText generates the plain-text alternative of an HTML email: blocks
+// become paragraphs, list items get a dash and links are followed by their
+// URL in parentheses.
+func htmlToText(body string) (string, error) {
+	var b strings.Builder
+	var hrefs []string
+	var anchors []int
+	skip := 0
+
+	z := html.NewTokenizer(strings.NewReader(body))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if err := z.Err(); err != io.EOF {
+				return "", err
+			}
+			break
+		}
+
+		token := z.Token()
+		switch tt {
+		case html.TextToken:
+			// Line breaks in the source are only spaces, as in the browser
+			if skip == 0 {
+				b.WriteString(strings.Map(unbreak, token.Data))
+			}
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			switch token.Data {
+			case "head", "style", "script", "title":
+				if tt == html.StartTagToken {
+					skip++
+				}
+			case "br":
+				b.WriteString("\n")
+			case "li":
+				b.WriteString("\n- ")
+			case "p", "div", "h1", "h2", "h3", "h4", "h5", "h6", "ul", "ol", "table", "tr", "blockquote", "hr":
+				b.WriteString("\n\n")
+			case "a":
+				href := ""
+				for _, attr := range token.Attr {
+					if attr.Key == "href" {
+						href = attr.Val
+					}
+				}
+				hrefs = append(hrefs, href)
+				anchors = append(anchors, b.Len())
+			}
+
+		case html.EndTagToken:
+			switch token.Data {
+			case "head", "style", "script", "title":
+				skip = max(skip-1, 0)
+			case "p", "div", "h1", "h2", "h3", "h4", "h5", "h6", "ul", "ol", "table", "tr", "blockquote":
+				b.WriteString("\n\n")
+			case "a":
+				if len(hrefs) == 0 {
+					break
+				}
+				href, start := hrefs[len(hrefs)-1], anchors[len(anchors)-1]
+				hrefs, anchors = hrefs[:len(hrefs)-1], anchors[:len(anchors)-1]
+
+				// Links showing their own URL are not repeated
+				if href != "" && strings.Join(strings.Fields(b.String()[start:]), " ") != href {
+					b.WriteString(" (" + href + ")")
+				}
+			}
+		}
+	}
+
+	return tidyText(b.String()), nil
+}
+
+// tidyText collapses the spaces in the lines of the text and keeps at most
+// one blank line between paragraphs.
+func tidyText(text string) string {
+	var lines []string
+	blank := true
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" {
+			if !blank {
+				lines = append(lines, "")
+			}
+			blank = true
+			continue
+		}
+		lines = append(lines, line)
+		blank = false
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n")) + "\n"
+}
+
+func unbreak(r rune) rune {
+	if r == '\n' || r == '\r' {
+		return ' '
+	}
+	return r
+}
@@ -0,0 +1,47 @@
+// Package netguard keeps the requests the server makes to URLs it was handed,
+// such as webhooks and the servers of remote actors, away from the services
+// of its own network.
+package netguard
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+var ErrForbiddenAddress = errors.New("netguard: address is not allowed")
+
+// Transport returns an HTTP transport dialing with timeout. Unless
+// allowPrivate is set, addresses on private, loopback and link-local networks
+// are refused. Proxies are not used, as they would resolve the hosts
+// themselves.
+func Transport(timeout time.Duration, allowPrivate bool) *http.Transport {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = refusePrivateAddresses
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+	return transport
+}
+
+// refusePrivateAddresses is a dialer control that runs once the host was
+// resolved, so names pointing at internal addresses are refused as well.
+func refusePrivateAddresses(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, host)
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+package parser
+
+import "regexp"
+
+var hashtagRegexp = regexp.MustCompile(`(?:^|[^\w#&])(#([\p{L}\p{N}_]*\p{L}[\p{L}\p{N}_]*))`)
+
+// Hashtags returns every #hashtag found in text. Value holds the tag without
+// the leading # while the span covers the whole hashtag.
+func Hashtags(text string) []Span {
+	return findSpans(hashtagRegexp, text)
+}
@@ -0,0 +1,50 @@
+package parser
+
+import (
+	"regexp"
+	"unicode/utf8"
+)
+
+// Span is a token found in a text. Start and End are character (rune) offsets
+// so clients can slice the original text regardless of its encoding.
+type Span struct {
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+	Value string `json:"value"`
+}
+
+var mentionRegexp = regexp.MustCompile(`(?:^|[^\w@])(@([A-Za-z0-9_](?:[A-Za-z0-9_.-]*[A-Za-z0-9_])?))`)
+
+// Mentions returns every @username found in text. Value holds the username
+// without the leading @ while the span covers the whole mention.
+func Mentions(text string) []Span {
+	return findSpans(mentionRegexp, text)
+}
+
+func findSpans(re *regexp.Regexp, text string) []Span {
+	var spans []Span
+	for _, m := range re.FindAllStringSubmatchIndex(text, -1) {
+		start := utf8.RuneCountInString(text[:m[2]])
+		spans = append(spans, Span{
+			Start: start,
+			End:   start + utf8.RuneCountInString(text[m[2]:m[3]]),
+			Value: text[m[4]:m[5]],
+		})
+	}
+	return spans
+}
+
+// Unique returns the distinct values of spans, keeping their first occurrence
+// order.
+func Unique(spans []Span) []string {
+	seen := make(map[string]bool, len(spans))
+	values := []string{}
+	for _, s := range spans {
+		if seen[s.Value] {
+			continue
+		}
+		seen[s.Value] = true
+		values = append(values, s.Value)
+	}
+	return values
+}
@@ -0,0 +1,410 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"com.github/jrovieri/golang/social/internal/event"
+	"github.com/lib/pq"
+)
+
+const (
+	// MaxDeliveryAttempts is the number of times an activity is sent before its
+	// delivery is given up.
+	MaxDeliveryAttempts = 8
+	// DeliveryLease is how long a claimed delivery is hidden from other
+	// workers while it is being sent.
+	DeliveryLease = 5 * time.Minute
+)
+
+// ActorKey is the key pair local users sign their activities with.
+type ActorKey struct {
+	UserID        int64
+	PublicKeyPem  string
+	PrivateKeyPem string
+}
+
+// RemoteActor is a user of another server that interacted with local users.
+type RemoteActor struct {
+	ID           int64
+	URI          string
+	Username     string
+	Inbox        string
+	SharedInbox  *string
+	KeyID        string
+	PublicKeyPem string
+	FetchedAt    string
+}
+
+// ActivityDelivery is an activity waiting to be posted to a remote inbox.
+// Deliveries of new posts carry PostID and are rendered when sent; the others
+// carry their Payload.
+type ActivityDelivery struct {
+	ID       int64
+	UserID   int64
+	Inbox    string
+	PostID   *int64
+	Payload  []byte
+	Attempts int
+}
+
+// DeliveryBackoff is how long to wait before retrying a delivery that failed
+// attempts times: one minute, doubling up to a day.
+func DeliveryBackoff(attempts int) time.Duration {
+	backoff := time.Minute
+	for i := 1; i < attempts && backoff < 24*time.Hour; i++ {
+		backoff *= 2
+	}
+	return min(backoff, 24*time.Hour)
+}
+
+// failedDeliveryStatus is the status of a delivery that failed attempts
+// times: pending until it reaches maxAttempts, dead from then on.
+func failedDeliveryStatus(attempts, maxAttempts int) string {
+	if attempts >= maxAttempts {
+		return "dead"
+	}
+	return "pending"
+}
+
+type ActivityPubStore struct {
+	db *sql.DB
+}
+
+func (s *ActivityPubStore) GetKey(ctx context.Context, userID int64) (*ActorKey, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `SELECT user_id, public_key_pem, private_key_pem FROM actor_keys WHERE user_id = $1`
+
+	var key ActorKey
+	err := s.db.QueryRowContext(ctx, query, userID).Scan(&key.UserID, &key.PublicKeyPem, &key.PrivateKeyPem)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrResourceNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &key, nil
+}
+
+// SaveKey stores the key pair of a user unless one was stored concurrently,
+// and returns the one that was kept.
+func (s *ActivityPubStore) SaveKey(ctx context.Context, key *ActorKey) (*ActorKey, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `
+		INSERT INTO actor_keys (user_id, public_key_pem, private_key_pem) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO NOTHING
+	`
+	if _, err := s.db.ExecContext(ctx, query, key.UserID, key.PublicKeyPem, key.PrivateKeyPem); err != nil {
+		return nil, err
+	}
+	return s.GetKey(ctx, key.UserID)
+}
+
+func (s *ActivityPubStore) GetRemoteActorByKeyID(ctx context.Context, keyID string) (*RemoteActor, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `
+		SELECT id, uri, username, inbox, shared_inbox, key_id, public_key_pem, fetched_at
+		FROM remote_actors WHERE key_id = $1
+	`
+
+	var a RemoteActor
+	err := s.db.QueryRowContext(ctx, query, keyID).Scan(
+		&a.ID,
+		&a.URI,
+		&a.Username,
+		&a.Inbox,
+		&a.SharedInbox,
+		&a.KeyID,
+		&a.PublicKeyPem,
+		&a.FetchedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrResourceNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &a, nil
+}
+
+// SaveRemoteActor inserts a remote actor or refreshes the stored copy of it.
+// A stored key is never replaced by one served from another origin; that
+// returns ErrConflict.
+func (s *ActivityPubStore) SaveRemoteActor(ctx context.Context, a *RemoteActor) error {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `
+		INSERT INTO remote_actors (uri, username, inbox, shared_inbox, key_id, public_key_pem)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (uri) DO UPDATE SET username = EXCLUDED.username, inbox = EXCLUDED.inbox,
+			shared_inbox = EXCLUDED.shared_inbox, key_id = EXCLUDED.key_id,
+			public_key_pem = EXCLUDED.public_key_pem, fetched_at = NOW()
+		WHERE lower(substring(remote_actors.key_id FROM '^[^:]+://[^/?#]+'))
+			= lower(substring(EXCLUDED.key_id FROM '^[^:]+://[^/?#]+'))
+		RETURNING id, fetched_at
+	`
+	err := s.db.QueryRowContext(ctx, query, a.URI, a.Username, a.Inbox, a.SharedInbox, a.KeyID, a.PublicKeyPem).
+		Scan(&a.ID, &a.FetchedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ActivityPubStore) AddRemoteFollower(ctx context.Context, userID, actorID int64, activityURI string) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		query := `
+			INSERT INTO remote_followers (user_id, actor_id, activity_uri) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, actor_id) DO UPDATE SET activity_uri = EXCLUDED.activity_uri
+		`
+		if _, err := tx.ExecContext(ctx, query, userID, actorID, activityURI); err != nil {
+			return err
+		}
+
+		data := RemoteEvent{ActorID: actorID, URI: activityURI}
+		return event.Record(ctx, tx, AggregateUser, userID, EventUserRemoteFollowed, data)
+	})
+}
+
+// RemoveRemoteFollower undoes a Follow, identified by the URI of the activity.
+func (s *ActivityPubStore) RemoveRemoteFollower(ctx context.Context, userID, actorID int64, activityURI string) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		query := `DELETE FROM remote_followers WHERE user_id = $1 AND actor_id = $2 AND activity_uri = $3`
+		res, err := tx.ExecContext(ctx, query, userID, actorID, activityURI)
+		if err != nil {
+			return err
+		}
+
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rows == 0 {
+			return ErrResourceNotFound
+		}
+
+		data := RemoteEvent{ActorID: actorID, URI: activityURI}
+		return event.Record(ctx, tx, AggregateUser, userID, EventUserRemoteUnfollowed, data)
+	})
+}
+
+func (s *ActivityPubStore) CountRemoteFollowers(ctx context.Context, userID int64) (int, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	var count int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM remote_followers WHERE user_id = $1`, userID).Scan(&count)
+	return count, err
+}
+
+// AddRemoteReaction records the Like of a remote actor on a post.
+func (s *ActivityPubStore) AddRemoteReaction(ctx context.Context, postID, actorID int64, activityURI string) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		query := `INSERT INTO remote_reactions (post_id, actor_id, activity_uri) VALUES ($1, $2, $3)`
+		if _, err := tx.ExecContext(ctx, query, postID, actorID, activityURI); err != nil {
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+				return ErrConflict
+			}
+			return err
+		}
+
+		data := RemoteEvent{ActorID: actorID, URI: activityURI}
+		return event.Record(ctx, tx, AggregatePost, postID, EventPostRemoteLiked, data)
+	})
+}
+
+// RemoveRemoteReaction undoes a Like, identified by the URI of the activity.
+func (s *ActivityPubStore) RemoveRemoteReaction(ctx context.Context, actorID int64, activityURI string) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		query := `DELETE FROM remote_reactions WHERE actor_id = $1 AND activity_uri = $2 RETURNING post_id`
+
+		var postID int64
+		if err := tx.QueryRowContext(ctx, query, actorID, activityURI).Scan(&postID); err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrResourceNotFound
+			default:
+				return err
+			}
+		}
+
+		data := RemoteEvent{ActorID: actorID, URI: activityURI}
+		return event.Record(ctx, tx, AggregatePost, postID, EventPostRemoteUnliked, data)
+	})
+}
+
+// AddRemoteReply stores a Note of a remote actor replying to a post. Replies
+// already received are ignored.
+func (s *ActivityPubStore) AddRemoteReply(ctx context.Context, postID, actorID int64, objectURI, content string) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		query := `
+			INSERT INTO remote_replies (post_id, actor_id, object_uri, content) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (object_uri) DO NOTHING
+		`
+		res, err := tx.ExecContext(ctx, query, postID, actorID, objectURI, content)
+		if err != nil {
+			return err
+		}
+
+		rows, err := res.RowsAffected()
+		if err != nil || rows == 0 {
+			return err
+		}
+
+		data := RemoteEvent{ActorID: actorID, URI: objectURI, Content: content}
+		return event.Record(ctx, tx, AggregatePost, postID, EventPostRemoteReplied, data)
+	})
+}
+
+// EnqueueDelivery queues an activity to be posted to a remote inbox on behalf
+// of a user.
+func (s *ActivityPubStore) EnqueueDelivery(ctx context.Context, userID int64, inbox string, payload []byte) error {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `INSERT INTO activity_deliveries (user_id, inbox, payload) VALUES ($1, $2, $3)`
+	_, err := s.db.ExecContext(ctx, query, userID, inbox, payload)
+	return err
+}
+
+// ClaimDeliveries takes up to batch deliveries that are due and leases them to
+// the caller, counting the attempt. Deliveries that are neither marked
+// delivered nor failed before the lease ends are picked up again.
+func (s *ActivityPubStore) ClaimDeliveries(ctx context.Context, batch int) ([]ActivityDelivery, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `
+		UPDATE activity_deliveries
+		SET attempts = attempts + 1, next_attempt_at = NOW() + $2 * INTERVAL '1 second'
+		WHERE id IN (
+			SELECT id FROM activity_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, user_id, inbox, post_id, payload, attempts
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, batch, DeliveryLease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []ActivityDelivery{}
+	for rows.Next() {
+		var d ActivityDelivery
+		if err := rows.Scan(&d.ID, &d.UserID, &d.Inbox, &d.PostID, &d.Payload, &d.Attempts); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (s *ActivityPubStore) MarkDelivered(ctx context.Context, id int64) error {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `UPDATE activity_deliveries SET status = 'delivered', last_error = NULL WHERE id = $1`
+	_, err := s.db.ExecContext(ctx, query, id)
+	return err
+}
+
+// MarkFailed schedules the retry of a delivery with an exponential backoff,
+// or gives up on it once it ran out of attempts.
+func (s *ActivityPubStore) MarkFailed(ctx context.Context, d *ActivityDelivery, cause error) error {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	status := failedDeliveryStatus(d.Attempts, MaxDeliveryAttempts)
+
+	query := `
+		UPDATE activity_deliveries
+		SET status = $2, last_error = $3, next_attempt_at = NOW() + $4 * INTERVAL '1 second'
+		WHERE id = $1
+	`
+	_, err := s.db.ExecContext(ctx, query, d.ID, status, cause.Error(), DeliveryBackoff(d.Attempts).Seconds())
+	return err
+}
+
+// PruneDeliveries deletes the deliveries that were delivered or gave up on
+// and were queued before the retention, returning how many were deleted.
+func (s *ActivityPubStore) PruneDeliveries(ctx context.Context, retention time.Duration) (int64, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `
+		DELETE FROM activity_deliveries
+		WHERE status IN ('delivered', 'dead') AND created_at < NOW() - make_interval(secs => $1)
+	`
+
+	res, err := s.db.ExecContext(ctx, query, retention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// enqueuePostDelivery queues a new public post to be sent to the remote
+// followers of its author, once per server when they share an inbox.
+func enqueuePostDelivery(ctx context.Context, tx *sql.Tx, p *Post) error {
+	if p.Visibility != "public" {
+		return nil
+	}
+
+	query := `
+		INSERT INTO activity_deliveries (user_id, inbox, post_id)
+		SELECT DISTINCT $1::bigint, COALESCE(ra.shared_inbox, ra.inbox), $2::bigint
+		FROM remote_followers rf
+			JOIN remote_actors ra ON ra.id = rf.actor_id
+		WHERE rf.user_id = $1
+	`
+	_, err := tx.ExecContext(ctx, query, p.UserID, p.ID)
+	return err
+}
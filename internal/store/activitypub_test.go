@@ -0,0 +1,41 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeliveryBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{10, 512 * time.Minute},
+		{11, 1024 * time.Minute},
+		{12, 24 * time.Hour},
+		{100, 24 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := DeliveryBackoff(tt.attempts); got != tt.want {
+			t.Errorf("DeliveryBackoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestFailedDeliveryStatus(t *testing.T) {
+	for attempts := 1; attempts < MaxWebhookAttempts; attempts++ {
+		if got := failedDeliveryStatus(attempts, MaxWebhookAttempts); got != "pending" {
+			t.Errorf("failedDeliveryStatus(%d) = %q, want pending", attempts, got)
+		}
+	}
+
+	for _, attempts := range []int{MaxWebhookAttempts, MaxWebhookAttempts + 1} {
+		if got := failedDeliveryStatus(attempts, MaxWebhookAttempts); got != "dead" {
+			t.Errorf("failedDeliveryStatus(%d) = %q, want dead", attempts, got)
+		}
+	}
+}
@@ -3,36 +3,101 @@ package store
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"strconv"
+
+	"com.github/jrovieri/golang/social/internal/event"
+	"github.com/lib/pq"
 )
 
+const DeletedCommentContent = "[deleted]"
+
 type CommentStore struct {
 	db *sql.DB
 }
 
 type Comment struct {
-	ID        int64  `json:"id"`
-	PostID    int64  `json:"post_id"`
-	UserID    int64  `json:"user_id"`
-	Content   string `json:"content"`
-	CreatedAt string `json:"created_at"`
-	User      User   `json:"user"`
+	ID        int64     `json:"id"`
+	PostID    int64     `json:"post_id"`
+	UserID    int64     `json:"user_id"`
+	ParentID  *int64    `json:"parent_id"`
+	Content   string    `json:"content"`
+	CreatedAt string    `json:"created_at"`
+	EditedAt  *string   `json:"edited_at"`
+	IsDeleted bool      `json:"is_deleted"`
+	Version   int       `json:"version"`
+	User      User      `json:"user"`
+	Mentions  []Mention `json:"mentions"`
+
+	ReactionsCount int `json:"reactions_count"`
+}
+
+// commentSorts maps a sort option to the keyset condition and ordering used to
+// page through a post's comments.
+var commentSorts = map[string]struct {
+	after string
+	order string
+	key   func(Comment) string
+	parse func(*Cursor) (any, error)
+}{
+	"newest": {
+		after: `($2::timestamptz IS NULL OR (c.created_at, c.id) < ($2::timestamptz, $3::bigint))`,
+		order: `c.created_at DESC, c.id DESC`,
+		key:   func(c Comment) string { return c.CreatedAt },
+		parse: func(c *Cursor) (any, error) { return c.timeKey() },
+	},
+	"oldest": {
+		after: `($2::timestamptz IS NULL OR (c.created_at, c.id) > ($2::timestamptz, $3::bigint))`,
+		order: `c.created_at ASC, c.id ASC`,
+		key:   func(c Comment) string { return c.CreatedAt },
+		parse: func(c *Cursor) (any, error) { return c.timeKey() },
+	},
+	"most-reacted": {
+		after: `($2::int IS NULL OR (c.reactions_count, c.id) < ($2::int, $3::bigint))`,
+		order: `c.reactions_count DESC, c.id DESC`,
+		key:   func(c Comment) string { return strconv.Itoa(c.ReactionsCount) },
+		parse: func(c *Cursor) (any, error) { return c.intKey() },
+	},
 }
 
-func (s *CommentStore) GetByPostID(ctx context.Context, postID int64) ([]Comment, error) {
+// GetByPostID returns a page of comments for a post along with the cursor of
+// the next page, which is nil when there are no more comments.
+func (s *CommentStore) GetByPostID(ctx context.Context, postID int64, q PaginatedCommentQuery) ([]Comment, *Cursor, error) {
 
 	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
 	defer cancel()
 
+	sort, ok := commentSorts[q.Sort]
+	if !ok {
+		return nil, nil, ErrInvalidSort
+	}
+
+	var key any
+	var id int64
+	if q.Cursor != nil {
+		if q.Cursor.Sort != q.Sort {
+			return nil, nil, ErrInvalidCursor
+		}
+
+		var err error
+		if key, err = sort.parse(q.Cursor); err != nil {
+			return nil, nil, err
+		}
+		id = q.Cursor.ID
+	}
+
 	query := `
-		SELECT c.id, c.post_id, c.user_id, c.content, c.created_at, u.username, u.id  
-			FROM comments c 
-				JOIN users u ON u.id = c.user_id 
-			WHERE c.post_id = $1 
-			ORDER BY c.created_at DESC;`
+		SELECT c.id, c.post_id, c.user_id, c.parent_id, c.content, c.created_at, c.updated_at
+			, c.deleted_at IS NOT NULL, c.version, c.reactions_count, u.username, u.id
+			FROM comments c
+				JOIN users u ON u.id = c.user_id
+			WHERE c.post_id = $1 AND ` + sort.after + `
+			ORDER BY ` + sort.order + `
+			LIMIT $4;`
 
-	rows, err := s.db.QueryContext(ctx, query, postID)
+	rows, err := s.db.QueryContext(ctx, query, postID, key, id, q.Limit+1)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer rows.Close()
 
@@ -45,32 +110,415 @@ func (s *CommentStore) GetByPostID(ctx context.Context, postID int64) ([]Comment
 		err := rows.Scan(&c.ID,
 			&c.PostID,
 			&c.UserID,
+			&c.ParentID,
 			&c.Content,
 			&c.CreatedAt,
+			&c.EditedAt,
+			&c.IsDeleted,
+			&c.Version,
+			&c.ReactionsCount,
 			&c.User.Username,
 			&c.User.ID)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		// Tombstones do not tell who wrote the comment
+		if c.IsDeleted {
+			c.UserID = 0
+			c.User = User{}
 		}
 		comments = append(comments, c)
 	}
-	return comments, nil
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var next *Cursor
+	if len(comments) > q.Limit {
+		comments = comments[:q.Limit]
+		last := comments[len(comments)-1]
+		next = &Cursor{Sort: q.Sort, Key: sort.key(last), ID: last.ID}
+	}
+
+	ids := make([]int64, len(comments))
+	for i, c := range comments {
+		ids[i] = c.ID
+	}
+
+	mentions, err := getCommentMentions(ctx, s.db, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i := range comments {
+		comments[i].Mentions = mentions[comments[i].ID]
+	}
+	return comments, next, nil
 }
 
-func (s *CommentStore) Create(ctx context.Context, c *Comment) (*Comment, error) {
+func (s *CommentStore) CountByPostID(ctx context.Context, postID int64) (int, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `SELECT COUNT(*) FROM comments WHERE post_id = $1`
+
+	var count int
+	if err := s.db.QueryRowContext(ctx, query, postID).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (s *CommentStore) React(ctx context.Context, commentID int64, userID int64) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		query := `INSERT INTO comment_reactions (comment_id, user_id) VALUES ($1, $2)`
+		if _, err := tx.ExecContext(ctx, query, commentID, userID); err != nil {
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+				return ErrConflict
+			}
+			return err
+		}
+
+		query = `UPDATE comments SET reactions_count = reactions_count + 1 WHERE id = $1
+			RETURNING user_id, post_id`
+
+		n := notification{actorID: userID, typ: NotificationReaction, commentID: &commentID}
+		if err := tx.QueryRowContext(ctx, query, commentID).Scan(&n.userID, &n.postID); err != nil {
+			return err
+		}
+		if err := notify(ctx, tx, n); err != nil {
+			return err
+		}
+
+		data := EngagementEvent{UserID: userID, AuthorID: n.userID}
+		return event.Record(ctx, tx, AggregateComment, commentID, EventCommentReacted, data)
+	})
+}
+
+func (s *CommentStore) UnReact(ctx context.Context, commentID int64, userID int64) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		query := `DELETE FROM comment_reactions WHERE comment_id = $1 AND user_id = $2`
+		res, err := tx.ExecContext(ctx, query, commentID, userID)
+		if err != nil {
+			return err
+		}
+
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rows == 0 {
+			return ErrResourceNotFound
+		}
+
+		query = `UPDATE comments SET reactions_count = reactions_count - 1 WHERE id = $1
+			RETURNING user_id, post_id`
+
+		n := notification{actorID: userID, typ: NotificationReaction, commentID: &commentID}
+		if err := tx.QueryRowContext(ctx, query, commentID).Scan(&n.userID, &n.postID); err != nil {
+			return err
+		}
+		if err := unnotify(ctx, tx, n); err != nil {
+			return err
+		}
+
+		data := EngagementEvent{UserID: userID, AuthorID: n.userID}
+		return event.Record(ctx, tx, AggregateComment, commentID, EventCommentUnreacted, data)
+	})
+}
+
+func (s *CommentStore) GetByID(ctx context.Context, id int64) (*Comment, error) {
 
 	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
 	defer cancel()
 
 	query := `
-		INSERT INTO comments (post_id, user_id, content) VALUES ($1, $2, $3)
-		RETURNING id, created_at 
-	`
+		SELECT id, post_id, user_id, parent_id, content, created_at, updated_at
+			, deleted_at IS NOT NULL, version, reactions_count
+		FROM comments WHERE id = $1`
+
+	var c Comment
+	err := s.db.QueryRowContext(ctx, query, id).Scan(
+		&c.ID,
+		&c.PostID,
+		&c.UserID,
+		&c.ParentID,
+		&c.Content,
+		&c.CreatedAt,
+		&c.EditedAt,
+		&c.IsDeleted,
+		&c.Version,
+		&c.ReactionsCount)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrResourceNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+func (s *CommentStore) Create(ctx context.Context, c *Comment) (*Comment, error) {
+	err := withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		query := `
+			INSERT INTO comments (post_id, user_id, parent_id, content) VALUES ($1, $2, $3, $4)
+			RETURNING id, created_at
+		`
 
-	err := s.db.QueryRowContext(ctx, query, c.PostID, c.UserID, c.Content).
-		Scan(&c.ID, &c.CreatedAt)
+		err := tx.QueryRowContext(ctx, query, c.PostID, c.UserID, c.ParentID, c.Content).
+			Scan(&c.ID, &c.CreatedAt)
+		if err != nil {
+			return err
+		}
+
+		var postAuthorID int64
+		query = `SELECT user_id FROM posts WHERE id = $1`
+		if err := tx.QueryRowContext(ctx, query, c.PostID).Scan(&postAuthorID); err != nil {
+			return err
+		}
+
+		if err := notifyComment(ctx, tx, c, postAuthorID); err != nil {
+			return err
+		}
+
+		data := CommentEvent{
+			ID:           c.ID,
+			PostID:       c.PostID,
+			PostAuthorID: postAuthorID,
+			UserID:       c.UserID,
+			ParentID:     c.ParentID,
+			Content:      c.Content,
+			CreatedAt:    c.CreatedAt,
+		}
+		if err := publishComment(ctx, tx, data); err != nil {
+			return err
+		}
+
+		c.Mentions, err = syncMentions(ctx, tx, c.UserID, c.PostID, &c.ID, c.Content)
+		if err != nil {
+			return err
+		}
+
+		return event.Record(ctx, tx, AggregateComment, c.ID, EventCommentCreated, data)
+	})
 	if err != nil {
 		return &Comment{}, err
 	}
 	return c, nil
 }
+
+func (s *CommentStore) Update(ctx context.Context, c *Comment) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		query := `
+			UPDATE comments SET content = $1, updated_at = NOW(), version = version + 1
+				WHERE id = $2 AND version = $3 AND deleted_at IS NULL
+				RETURNING updated_at, version
+		`
+		err := tx.QueryRowContext(ctx, query, c.Content, c.ID, c.Version).
+			Scan(&c.EditedAt, &c.Version)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrResourceNotFound
+			default:
+				return err
+			}
+		}
+
+		c.Mentions, err = syncMentions(ctx, tx, c.UserID, c.PostID, &c.ID, c.Content)
+		if err != nil {
+			return err
+		}
+
+		data := CommentEvent{
+			ID:       c.ID,
+			PostID:   c.PostID,
+			UserID:   c.UserID,
+			ParentID: c.ParentID,
+			Content:  c.Content,
+			Version:  c.Version,
+		}
+		return event.Record(ctx, tx, AggregateComment, c.ID, EventCommentUpdated, data)
+	})
+}
+
+// Delete removes a comment. Comments that still have replies are replaced by a
+// tombstone so the thread stays intact, and tombstones left without replies
+// are cleaned up along the way.
+func (s *CommentStore) Delete(ctx context.Context, commentID int64) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		var postID int64
+		var parentID *int64
+		var hasReplies bool
+
+		query := `
+			SELECT post_id, parent_id, EXISTS (SELECT 1 FROM comments r WHERE r.parent_id = c.id)
+			FROM comments c
+			WHERE c.id = $1 AND c.deleted_at IS NULL
+			FOR UPDATE
+		`
+		err := tx.QueryRowContext(ctx, query, commentID).Scan(&postID, &parentID, &hasReplies)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrResourceNotFound
+			default:
+				return err
+			}
+		}
+
+		data := CommentEvent{ID: commentID, PostID: postID}
+		if err := event.Record(ctx, tx, AggregateComment, commentID, EventCommentDeleted, data); err != nil {
+			return err
+		}
+
+		if hasReplies {
+			query = `UPDATE comments SET content = $1, deleted_at = NOW() WHERE id = $2`
+			if _, err := tx.ExecContext(ctx, query, DeletedCommentContent, commentID); err != nil {
+				return err
+			}
+
+			_, err := tx.ExecContext(ctx, `DELETE FROM mentions WHERE comment_id = $1`, commentID)
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `DELETE FROM comments WHERE id = $1`, commentID); err != nil {
+			return err
+		}
+
+		for parentID != nil {
+			query = `
+				DELETE FROM comments c
+				WHERE c.id = $1 AND c.deleted_at IS NOT NULL
+					AND NOT EXISTS (SELECT 1 FROM comments r WHERE r.parent_id = c.id)
+				RETURNING c.parent_id
+			`
+			err := tx.QueryRowContext(ctx, query, *parentID).Scan(&parentID)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return nil
+				}
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// notifyComment tells the author of the post about a new comment, and the
+// author of the parent comment about a reply.
+func notifyComment(ctx context.Context, tx *sql.Tx, c *Comment, postAuthorID int64) error {
+	var parentAuthorID int64
+	if c.ParentID != nil {
+		query := `SELECT user_id FROM comments WHERE id = $1`
+		if err := tx.QueryRowContext(ctx, query, *c.ParentID).Scan(&parentAuthorID); err != nil {
+			return err
+		}
+
+		err := notify(ctx, tx, notification{
+			userID:    parentAuthorID,
+			actorID:   c.UserID,
+			typ:       NotificationReply,
+			postID:    &c.PostID,
+			commentID: &c.ID,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// The author of the post already hears about replies to their comments
+	if postAuthorID == parentAuthorID {
+		return nil
+	}
+
+	return notify(ctx, tx, notification{
+		userID:    postAuthorID,
+		actorID:   c.UserID,
+		typ:       NotificationComment,
+		postID:    &c.PostID,
+		commentID: &c.ID,
+	})
+}
+
+// commentEvent is the data of the stream and webhook events sent for a new
+// comment, taken from its domain event without the author of the post.
+type commentEvent struct {
+	ID        int64  `json:"id"`
+	PostID    int64  `json:"post_id"`
+	UserID    int64  `json:"user_id"`
+	ParentID  *int64 `json:"parent_id"`
+	Content   string `json:"content"`
+	CreatedAt string `json:"created_at"`
+}
+
+func newCommentEvent(c CommentEvent) commentEvent {
+	return commentEvent{
+		ID:        c.ID,
+		PostID:    c.PostID,
+		UserID:    c.UserID,
+		ParentID:  c.ParentID,
+		Content:   c.Content,
+		CreatedAt: c.CreatedAt,
+	}
+}
+
+// publishComment pushes a new comment to the streams of the people in the
+// conversation: the author of the post and everyone who commented on it,
+// leaving out the commenter and users on either side of a block with them.
+func publishComment(ctx context.Context, tx *sql.Tx, c CommentEvent) error {
+	query := `
+		SELECT $3::bigint AS user_id
+		UNION
+		SELECT c.user_id FROM comments c WHERE c.post_id = $1 AND c.deleted_at IS NULL
+	`
+	query = `
+		SELECT r.user_id FROM (` + query + `) r
+		WHERE r.user_id <> $2
+			AND NOT EXISTS (
+				SELECT 1 FROM user_blocks b
+				WHERE (b.user_id = r.user_id AND b.blocked_id = $2)
+					OR (b.user_id = $2 AND b.blocked_id = r.user_id)
+			)
+	`
+
+	rows, err := tx.QueryContext(ctx, query, c.PostID, c.UserID, c.PostAuthorID)
+	if err != nil {
+		return err
+	}
+
+	var userIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		userIDs = append(userIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return publish(ctx, tx, StreamCommentCreated, newCommentEvent(c), userIDs)
+}
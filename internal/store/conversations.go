@@ -0,0 +1,586 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"com.github/jrovieri/golang/social/internal/event"
+	"github.com/lib/pq"
+)
+
+// Message policies, which tell who may start a conversation with a user.
+const (
+	MessagePolicyEveryone  = "everyone"
+	MessagePolicyFollowing = "following"
+)
+
+// MaxConversationMembers caps the size of group conversations, creator
+// included.
+const MaxConversationMembers = 10
+
+var ErrMessagingNotAllowed = errors.New("the user does not accept messages from you")
+
+// Conversation is a one-to-one conversation, or a group one when it was
+// started with several users or a title. There is a single direct
+// conversation between any two users. UnreadCount and LastMessage are those
+// of the user who fetched it.
+type Conversation struct {
+	ID          int64                `json:"id"`
+	Title       *string              `json:"title"`
+	Direct      bool                 `json:"direct"`
+	Members     []ConversationMember `json:"members"`
+	LastMessage *Message             `json:"last_message"`
+	UnreadCount int                  `json:"unread_count"`
+	CreatedAt   string               `json:"created_at"`
+	UpdatedAt   string               `json:"updated_at"`
+}
+
+// ConversationMember tells how far a member has read, which is what read
+// receipts are shown from.
+type ConversationMember struct {
+	ID                int64   `json:"id"`
+	Username          string  `json:"username"`
+	LastReadMessageID int64   `json:"last_read_message_id"`
+	LastReadAt        *string `json:"last_read_at"`
+}
+
+type Message struct {
+	ID             int64  `json:"id"`
+	ConversationID int64  `json:"conversation_id"`
+	SenderID       int64  `json:"sender_id"`
+	Content        string `json:"content"`
+	CreatedAt      string `json:"created_at"`
+}
+
+// messageRead is the data of the stream event sent as a member reads a
+// conversation.
+type messageRead struct {
+	ConversationID    int64  `json:"conversation_id"`
+	UserID            int64  `json:"user_id"`
+	LastReadMessageID int64  `json:"last_read_message_id"`
+	ReadAt            string `json:"read_at"`
+}
+
+type ConversationStore struct {
+	db *sql.DB
+}
+
+// notBlocked is the condition under which neither of the users whose IDs are
+// in a and b blocked the other.
+func notBlocked(a, b string) string {
+	return `NOT EXISTS (
+		SELECT 1 FROM user_blocks nb
+		WHERE (nb.user_id = ` + a + ` AND nb.blocked_id = ` + b + `)
+			OR (nb.user_id = ` + b + ` AND nb.blocked_id = ` + a + `)
+	)`
+}
+
+// conversationsQuery selects the conversations of the user in $1 that match
+// where, with the members, the last message and the unread count as that
+// user sees them: messages of users on either side of a block with them are
+// left out.
+func conversationsQuery(where string) string {
+	return `
+		SELECT c.id, c.title, c.direct_key IS NOT NULL AS direct, c.created_at
+			, COALESCE(c.last_message_at, c.created_at) AS updated_at
+			, lm.id AS last_id, lm.sender_id AS last_sender_id
+			, lm.content AS last_content, lm.created_at AS last_created_at
+			, (
+				SELECT COUNT(*) FROM messages um
+				WHERE um.conversation_id = c.id AND um.id > cm.last_read_message_id
+					AND um.sender_id <> $1 AND ` + notBlocked("um.sender_id", "$1") + `
+			) AS unread
+			, mb.members
+		FROM conversation_members cm
+			JOIN conversations c ON c.id = cm.conversation_id
+			LEFT JOIN LATERAL (
+				SELECT m.id, m.sender_id, m.content, m.created_at FROM messages m
+				WHERE m.conversation_id = c.id AND ` + notBlocked("m.sender_id", "$1") + `
+				ORDER BY m.id DESC
+				LIMIT 1
+			) lm ON TRUE
+			CROSS JOIN LATERAL (
+				SELECT json_agg(json_build_object(
+					'id', u.id,
+					'username', u.username,
+					'last_read_message_id', x.last_read_message_id,
+					'last_read_at', x.last_read_at
+				) ORDER BY x.joined_at, u.id) AS members
+				FROM conversation_members x
+					JOIN users u ON u.id = x.user_id
+				WHERE x.conversation_id = c.id
+			) mb
+		WHERE cm.user_id = $1 AND ` + where
+}
+
+func scanConversation(row interface{ Scan(...any) error }, c *Conversation) error {
+	var lastID, lastSenderID sql.NullInt64
+	var lastContent, lastCreatedAt sql.NullString
+	var members []byte
+
+	err := row.Scan(&c.ID,
+		&c.Title,
+		&c.Direct,
+		&c.CreatedAt,
+		&c.UpdatedAt,
+		&lastID,
+		&lastSenderID,
+		&lastContent,
+		&lastCreatedAt,
+		&c.UnreadCount,
+		&members)
+	if err != nil {
+		return err
+	}
+
+	c.LastMessage = nil
+	if lastID.Valid {
+		c.LastMessage = &Message{
+			ID:             lastID.Int64,
+			ConversationID: c.ID,
+			SenderID:       lastSenderID.Int64,
+			Content:        lastContent.String,
+			CreatedAt:      lastCreatedAt.String,
+		}
+	}
+	return json.Unmarshal(members, &c.Members)
+}
+
+// Create starts a conversation between the creator and the members. Starting
+// a direct conversation that already exists returns it, and false tells it
+// was not created. Members who blocked the creator, were blocked by them or
+// only accept messages from people they follow are refused.
+func (s *ConversationStore) Create(ctx context.Context, creatorID int64, memberIDs []int64, title *string) (*Conversation, bool, error) {
+
+	var id int64
+	created := true
+
+	err := withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		if err := checkMessaging(ctx, tx, creatorID, memberIDs, true); err != nil {
+			return err
+		}
+
+		if len(memberIDs) == 1 && title == nil {
+			a, b := creatorID, memberIDs[0]
+			if a > b {
+				a, b = b, a
+			}
+			key := fmt.Sprintf("%d:%d", a, b)
+
+			query := `
+				INSERT INTO conversations (creator_id, direct_key) VALUES ($1, $2)
+				ON CONFLICT (direct_key) DO NOTHING
+				RETURNING id
+			`
+			err := tx.QueryRowContext(ctx, query, creatorID, key).Scan(&id)
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				created = false
+				query = `SELECT id FROM conversations WHERE direct_key = $1`
+				return tx.QueryRowContext(ctx, query, key).Scan(&id)
+			case err != nil:
+				return err
+			}
+		} else {
+			query := `INSERT INTO conversations (creator_id, title) VALUES ($1, $2) RETURNING id`
+			if err := tx.QueryRowContext(ctx, query, creatorID, title).Scan(&id); err != nil {
+				return err
+			}
+		}
+
+		query := `
+			INSERT INTO conversation_members (conversation_id, user_id)
+			SELECT $1, u FROM unnest($2::bigint[]) u
+		`
+		if _, err := tx.ExecContext(ctx, query, id, pq.Array(append([]int64{creatorID}, memberIDs...))); err != nil {
+			return err
+		}
+
+		data := ConversationEvent{ID: id, CreatorID: creatorID, MemberIDs: memberIDs, Title: title}
+		return event.Record(ctx, tx, AggregateConversation, id, EventConversationCreated, data)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	c, err := s.GetByID(ctx, id, creatorID)
+	return c, created, err
+}
+
+// GetByID returns a conversation of the user. Conversations the user is not
+// a member of are not found.
+func (s *ConversationStore) GetByID(ctx context.Context, id, userID int64) (*Conversation, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := conversationsQuery(`c.id = $2`)
+
+	var c Conversation
+	if err := scanConversation(s.db.QueryRowContext(ctx, query, userID, id), &c); err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrResourceNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+// GetByUserID returns a page of the conversations of a user, the most
+// recently active first, along with the cursor of the next page.
+func (s *ConversationStore) GetByUserID(ctx context.Context, userID int64, q PaginatedConversationQuery) ([]Conversation, *Cursor, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	var key any
+	var id int64
+	if q.Cursor != nil {
+		if q.Cursor.Sort != "conversations" {
+			return nil, nil, ErrInvalidCursor
+		}
+
+		t, err := q.Cursor.timeKey()
+		if err != nil {
+			return nil, nil, err
+		}
+		key, id = t, q.Cursor.ID
+	}
+
+	query := `
+		SELECT * FROM (` + conversationsQuery(`TRUE`) + `) cs
+		WHERE ($2::timestamptz IS NULL OR (cs.updated_at, cs.id) < ($2::timestamptz, $3::bigint))
+			AND (NOT $4 OR cs.unread > 0)
+		ORDER BY cs.updated_at DESC, cs.id DESC
+		LIMIT $5
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, userID, key, id, q.Unread, q.Limit+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	conversations := []Conversation{}
+	for rows.Next() {
+		var c Conversation
+		if err := scanConversation(rows, &c); err != nil {
+			return nil, nil, err
+		}
+		conversations = append(conversations, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var next *Cursor
+	if len(conversations) > q.Limit {
+		conversations = conversations[:q.Limit]
+		last := conversations[len(conversations)-1]
+		next = &Cursor{Sort: "conversations", Key: last.UpdatedAt, ID: last.ID}
+	}
+	return conversations, next, nil
+}
+
+// GetMessages returns a page of the messages of a conversation as the user
+// sees them, the most recent first, along with the cursor of the next page.
+// When After is set, the messages sent after it are returned instead, oldest
+// first, which is how clients without a stream poll for new messages.
+func (s *ConversationStore) GetMessages(ctx context.Context, conversationID, userID int64, q PaginatedMessageQuery) ([]Message, *Cursor, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	var before *int64
+	if q.Cursor != nil {
+		if q.Cursor.Sort != "messages" || q.After != nil {
+			return nil, nil, ErrInvalidCursor
+		}
+		before = &q.Cursor.ID
+	}
+
+	order := "DESC"
+	if q.After != nil {
+		order = "ASC"
+	}
+
+	query := `
+		SELECT m.id, m.conversation_id, m.sender_id, m.content, m.created_at
+		FROM messages m
+		WHERE m.conversation_id = $1 AND ` + notBlocked("m.sender_id", "$2") + `
+			AND ($3::bigint IS NULL OR m.id < $3)
+			AND ($4::bigint IS NULL OR m.id > $4)
+		ORDER BY m.id ` + order + `
+		LIMIT $5
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, conversationID, userID, before, q.After, q.Limit+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		var m Message
+		if err := rows.Scan(&m.ID, &m.ConversationID, &m.SenderID, &m.Content, &m.CreatedAt); err != nil {
+			return nil, nil, err
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var next *Cursor
+	if len(messages) > q.Limit {
+		messages = messages[:q.Limit]
+		if q.After == nil {
+			next = &Cursor{Sort: "messages", ID: messages[q.Limit-1].ID}
+		}
+	}
+	return messages, next, nil
+}
+
+// Send adds a message to a conversation the sender is a member of and pushes
+// it to the streams of the other members. Direct messages are refused once
+// either user blocked the other; the message policy only governs who may
+// start a conversation. In groups, members on either side of a block with the
+// sender just do not see the message.
+func (s *ConversationStore) Send(ctx context.Context, m *Message) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		query := `
+			SELECT c.direct_key IS NOT NULL
+				, COALESCE(array_agg(cm.user_id) FILTER (WHERE cm.user_id <> $2), '{}')
+			FROM conversations c
+				JOIN conversation_members cm ON cm.conversation_id = c.id
+			WHERE c.id = $1
+			GROUP BY c.id
+			HAVING bool_or(cm.user_id = $2)
+		`
+
+		var direct bool
+		var others []int64
+		err := tx.QueryRowContext(ctx, query, m.ConversationID, m.SenderID).Scan(&direct, pq.Array(&others))
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrResourceNotFound
+			default:
+				return err
+			}
+		}
+
+		if direct {
+			if err := checkMessaging(ctx, tx, m.SenderID, others, false); err != nil {
+				return err
+			}
+		}
+
+		query = `
+			INSERT INTO messages (conversation_id, sender_id, content) VALUES ($1, $2, $3)
+			RETURNING id, created_at
+		`
+		if err := tx.QueryRowContext(ctx, query, m.ConversationID, m.SenderID, m.Content).Scan(&m.ID, &m.CreatedAt); err != nil {
+			return err
+		}
+
+		query = `UPDATE conversations SET last_message_at = $2 WHERE id = $1`
+		if _, err := tx.ExecContext(ctx, query, m.ConversationID, m.CreatedAt); err != nil {
+			return err
+		}
+
+		// Senders have read what they wrote
+		query = `
+			UPDATE conversation_members SET last_read_message_id = $3, last_read_at = NOW()
+			WHERE conversation_id = $1 AND user_id = $2
+		`
+		if _, err := tx.ExecContext(ctx, query, m.ConversationID, m.SenderID, m.ID); err != nil {
+			return err
+		}
+
+		recipients, err := conversationAudience(ctx, tx, m.ConversationID, m.SenderID)
+		if err != nil {
+			return err
+		}
+
+		if err := publish(ctx, tx, StreamMessageCreated, m, recipients); err != nil {
+			return err
+		}
+		return event.Record(ctx, tx, AggregateConversation, m.ConversationID, EventMessageSent, m)
+	})
+}
+
+// MarkRead marks the messages of a conversation read by the user, up to
+// messageID or, when it is zero, up to the last one. The other members are
+// sent a read receipt. Marking read what was already read does nothing.
+func (s *ConversationStore) MarkRead(ctx context.Context, conversationID, userID, messageID int64) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		query := `
+			UPDATE conversation_members cm SET last_read_message_id = r.id, last_read_at = NOW()
+			FROM (
+				SELECT COALESCE(MAX(id), 0) AS id FROM messages
+				WHERE conversation_id = $1 AND ($3::bigint = 0 OR id <= $3)
+			) r
+			WHERE cm.conversation_id = $1 AND cm.user_id = $2 AND r.id > cm.last_read_message_id
+			RETURNING cm.last_read_message_id, cm.last_read_at
+		`
+
+		receipt := messageRead{ConversationID: conversationID, UserID: userID}
+		err := tx.QueryRowContext(ctx, query, conversationID, userID, messageID).Scan(&receipt.LastReadMessageID, &receipt.ReadAt)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return nil
+			default:
+				return err
+			}
+		}
+
+		members, err := conversationAudience(ctx, tx, conversationID, userID)
+		if err != nil {
+			return err
+		}
+
+		if err := publish(ctx, tx, StreamMessageRead, receipt, members); err != nil {
+			return err
+		}
+		return event.Record(ctx, tx, AggregateConversation, conversationID, EventMessageRead, receipt)
+	})
+}
+
+// GetMessagePolicy returns who may start a conversation with the user.
+func (s *ConversationStore) GetMessagePolicy(ctx context.Context, userID int64) (string, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `SELECT message_policy FROM users WHERE id = $1`
+
+	var policy string
+	if err := s.db.QueryRowContext(ctx, query, userID).Scan(&policy); err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrResourceNotFound
+		default:
+			return "", err
+		}
+	}
+	return policy, nil
+}
+
+// SetMessagePolicy changes who may start a conversation with the user.
+// Conversations already started are kept.
+func (s *ConversationStore) SetMessagePolicy(ctx context.Context, userID int64, policy string) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		query := `UPDATE users SET message_policy = $2 WHERE id = $1`
+
+		res, err := tx.ExecContext(ctx, query, userID, policy)
+		if err != nil {
+			return err
+		}
+
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rows == 0 {
+			return ErrResourceNotFound
+		}
+
+		data := MessagePolicyEvent{Policy: policy}
+		return event.Record(ctx, tx, AggregateUser, userID, EventUserMessagePolicyChanged, data)
+	})
+}
+
+// checkMessaging tells whether the sender may message every recipient: the
+// recipients exist and are active and neither side blocked the other. With
+// checkPolicy, the recipients who only accept messages from people they
+// follow must also follow the sender.
+func checkMessaging(ctx context.Context, tx *sql.Tx, senderID int64, recipientIDs []int64, checkPolicy bool) error {
+	query := `
+		SELECT u.is_active
+			, ` + notBlocked("u.id", "$1") + `
+			, NOT $3 OR u.message_policy = 'everyone' OR EXISTS (
+				SELECT 1 FROM followers f WHERE f.user_id = $1 AND f.follower_id = u.id
+			)
+		FROM users u
+		WHERE u.id = ANY($2)
+	`
+
+	rows, err := tx.QueryContext(ctx, query, senderID, pq.Array(recipientIDs), checkPolicy)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	found := 0
+	for rows.Next() {
+		var active, unblocked, accepts bool
+		if err := rows.Scan(&active, &unblocked, &accepts); err != nil {
+			return err
+		}
+
+		if !active {
+			return ErrResourceNotFound
+		}
+
+		if !unblocked || !accepts {
+			return ErrMessagingNotAllowed
+		}
+		found++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if found < len(recipientIDs) {
+		return ErrResourceNotFound
+	}
+	return nil
+}
+
+// conversationAudience returns the members of a conversation that events of
+// the user are pushed to: all but the user and those on either side of a
+// block with them.
+func conversationAudience(ctx context.Context, tx *sql.Tx, conversationID, userID int64) ([]int64, error) {
+	query := `
+		SELECT cm.user_id FROM conversation_members cm
+		WHERE cm.conversation_id = $1 AND cm.user_id <> $2
+			AND ` + notBlocked("cm.user_id", "$2") + `
+	`
+
+	rows, err := tx.QueryContext(ctx, query, conversationID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,134 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+)
+
+// CounterStore keeps the counters kept along with their rows, such as the
+// followers of users or the reactions to comments, in line with what they
+// count.
+type CounterStore struct {
+	db *sql.DB
+}
+
+// counter is a counter column and the queries checking it. counts returns the
+// id of every row of the table along with what its counter should be. recount
+// is that count for the row t.
+type counter struct {
+	table   string
+	column  string
+	counts  string
+	recount string
+}
+
+var counters = []counter{
+	{
+		table:  "users",
+		column: "followers_count",
+		counts: `
+			SELECT u.id, COUNT(f.user_id) AS count FROM users u
+				LEFT JOIN followers f ON f.user_id = u.id
+			GROUP BY u.id
+		`,
+		recount: `SELECT COUNT(*) FROM followers f WHERE f.user_id = t.id`,
+	},
+	{
+		table:  "comments",
+		column: "reactions_count",
+		counts: `
+			SELECT cm.id, COUNT(r.comment_id) AS count FROM comments cm
+				LEFT JOIN comment_reactions r ON r.comment_id = cm.id
+			GROUP BY cm.id
+		`,
+		recount: `SELECT COUNT(*) FROM comment_reactions r WHERE r.comment_id = t.id`,
+	},
+	{
+		// Posts are read once, counting every tag they have, rather than
+		// once per tag
+		table:  "tags",
+		column: "usage_count",
+		counts: `
+			SELECT tg.id, COALESCE(u.count, 0) AS count FROM tags tg
+				LEFT JOIN (
+					SELECT tag, COUNT(DISTINCT p.id) AS count FROM posts p, unnest(p.tags) tag
+					GROUP BY tag
+				) u ON u.tag = tg.name
+		`,
+		recount: `SELECT COUNT(*) FROM posts p WHERE p.tags @> ARRAY[t.name]`,
+	},
+}
+
+// Reconcile recomputes the counters that drifted from what they count and
+// returns how many rows it fixed.
+func (s *CounterStore) Reconcile(ctx context.Context) (int64, error) {
+	var fixed int64
+	for _, c := range counters {
+		n, err := s.reconcile(ctx, c)
+		if err != nil {
+			return fixed, err
+		}
+		fixed += n
+	}
+	return fixed, nil
+}
+
+// reconcile fixes a counter in its own transaction and timeout, as it goes
+// through a whole table. The rows that look drifted are locked before being
+// counted again, so increments committed meanwhile are seen and those not
+// committed yet wait, and are applied on top of the fixed count.
+func (s *CounterStore) reconcile(ctx context.Context, c counter) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*QueryTimeoutDuraton)
+	defer cancel()
+
+	var fixed int64
+	err := withTx(s.db, ctx, func(tx *sql.Tx) error {
+		query := `
+			SELECT t.id FROM ` + c.table + ` t
+				JOIN (` + c.counts + `) c ON c.id = t.id
+			WHERE t.` + c.column + ` <> c.count
+			ORDER BY t.id
+			FOR UPDATE OF t
+		`
+
+		rows, err := tx.QueryContext(ctx, query)
+		if err != nil {
+			return err
+		}
+
+		var ids []int64
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if len(ids) == 0 {
+			return nil
+		}
+
+		// A new statement sees what was committed until the rows were locked
+		query = `
+			UPDATE ` + c.table + ` t SET ` + c.column + ` = (` + c.recount + `)
+			WHERE t.id = ANY($1) AND t.` + c.column + ` <> (` + c.recount + `)
+		`
+
+		res, err := tx.ExecContext(ctx, query, pq.Array(ids))
+		if err != nil {
+			return err
+		}
+
+		fixed, err = res.RowsAffected()
+		return err
+	})
+	return fixed, err
+}
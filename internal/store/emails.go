@@ -0,0 +1,444 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Email deliveries, which tell how a user is emailed about a type of
+// notification.
+const (
+	EmailInstant = "instant"
+	EmailDigest  = "digest"
+	EmailOff     = "off"
+)
+
+// NotificationTypes lists the types of notification, which users pick an
+// email delivery for.
+var NotificationTypes = []string{
+	NotificationFollow,
+	NotificationComment,
+	NotificationReply,
+	NotificationReaction,
+	NotificationMention,
+}
+
+// DefaultEmailDeliveries are the deliveries of users who did not pick one:
+// conversations addressed to them are emailed right away, the rest go into
+// the digest and reactions are not emailed.
+var DefaultEmailDeliveries = map[string]string{
+	NotificationFollow:   EmailDigest,
+	NotificationComment:  EmailDigest,
+	NotificationReply:    EmailInstant,
+	NotificationReaction: EmailOff,
+	NotificationMention:  EmailInstant,
+}
+
+// NotificationEmail is a notification to email to a user, either on its own
+// or, in a digest, along with the others since the previous digest.
+type NotificationEmail struct {
+	UserID        int64
+	Username      string
+	Email         string
+	Locale        string
+	Notifications []Notification
+}
+
+type EmailPreferenceStore struct {
+	db *sql.DB
+}
+
+// emailDelivery returns the SQL expression of the delivery the recipient of a
+// notification picked for its type, or the default one. The query must name
+// the notification n.
+func emailDelivery() string {
+	types := make([]string, 0, len(DefaultEmailDeliveries))
+	for typ := range DefaultEmailDeliveries {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+
+	var defaults strings.Builder
+	for _, typ := range types {
+		defaults.WriteString(` WHEN '` + typ + `' THEN '` + DefaultEmailDeliveries[typ] + `'`)
+	}
+
+	return `COALESCE((
+		SELECT ep.delivery FROM email_preferences ep WHERE ep.user_id = n.user_id AND ep.type = n.type
+	), CASE n.type` + defaults.String() + ` ELSE '` + EmailOff + `' END)`
+}
+
+// Get returns the delivery of the user for every type of notification.
+func (s *EmailPreferenceStore) Get(ctx context.Context, userID int64) (map[string]string, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `SELECT type, delivery FROM email_preferences WHERE user_id = $1`
+
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	preferences := make(map[string]string, len(DefaultEmailDeliveries))
+	for typ, delivery := range DefaultEmailDeliveries {
+		preferences[typ] = delivery
+	}
+
+	for rows.Next() {
+		var typ, delivery string
+		if err := rows.Scan(&typ, &delivery); err != nil {
+			return nil, err
+		}
+		preferences[typ] = delivery
+	}
+	return preferences, rows.Err()
+}
+
+// Update sets the delivery of the user for the types of notification in
+// preferences, leaving the other types as they were.
+func (s *EmailPreferenceStore) Update(ctx context.Context, userID int64, preferences map[string]string) error {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	types := make([]string, 0, len(preferences))
+	deliveries := make([]string, 0, len(preferences))
+	for typ, delivery := range preferences {
+		types = append(types, typ)
+		deliveries = append(deliveries, delivery)
+	}
+
+	query := `
+		INSERT INTO email_preferences (user_id, type, delivery)
+		SELECT $1, t.type, t.delivery FROM unnest($2::varchar[], $3::varchar[]) t (type, delivery)
+		ON CONFLICT (user_id, type) DO UPDATE SET delivery = EXCLUDED.delivery, updated_at = NOW()
+	`
+
+	_, err := s.db.ExecContext(ctx, query, userID, pq.Array(types), pq.Array(deliveries))
+	return err
+}
+
+// Unsubscribe turns off the emails of the user about a type of
+// notification, or about every type when typ is empty.
+func (s *EmailPreferenceStore) Unsubscribe(ctx context.Context, userID int64, typ string) error {
+	types := NotificationTypes
+	if typ != "" {
+		types = []string{typ}
+	}
+
+	preferences := make(map[string]string, len(types))
+	for _, t := range types {
+		preferences[t] = EmailOff
+	}
+
+	err := s.Update(ctx, userID, preferences)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		return ErrResourceNotFound
+	}
+	return err
+}
+
+// GetLocale returns the locale the user is emailed in, or an empty string
+// when they did not pick one.
+func (s *EmailPreferenceStore) GetLocale(ctx context.Context, userID int64) (string, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `SELECT COALESCE(locale, '') FROM users WHERE id = $1`
+
+	var locale string
+	if err := s.db.QueryRowContext(ctx, query, userID).Scan(&locale); err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrResourceNotFound
+		default:
+			return "", err
+		}
+	}
+	return locale, nil
+}
+
+// SetLocale changes the locale the user is emailed in. An empty locale
+// goes back to the default one.
+func (s *EmailPreferenceStore) SetLocale(ctx context.Context, userID int64, locale string) error {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `UPDATE users SET locale = NULLIF($2, '') WHERE id = $1`
+
+	res, err := s.db.ExecContext(ctx, query, userID, locale)
+	if err != nil {
+		return err
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrResourceNotFound
+	}
+	return nil
+}
+
+// ComposeEmail turns the notifications claimed for a user into the email
+// queued for them.
+type ComposeEmail func(NotificationEmail) (*OutboundEmail, error)
+
+// ClaimInstant takes up to batch unread notifications that are to be emailed
+// right away, marks them emailed and queues the email compose makes of each
+// in the same transaction, so none is marked emailed without its email. It
+// returns how many it took. Notifications of users who are not active, or
+// from users on either side of a block with them, are left out.
+func (s *EmailPreferenceStore) ClaimInstant(ctx context.Context, batch int, compose ComposeEmail) (int, error) {
+
+	var claimed int
+
+	err := withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		emails, err := claimInstant(ctx, tx, batch)
+		if err != nil {
+			return err
+		}
+
+		claimed = len(emails)
+		return enqueueNotificationEmails(ctx, tx, emails, compose)
+	})
+	return claimed, err
+}
+
+func claimInstant(ctx context.Context, tx *sql.Tx, batch int) ([]NotificationEmail, error) {
+	query := `
+		UPDATE notifications n SET emailed_at = NOW()
+		FROM users u, users a
+		WHERE n.id IN (
+				SELECT n.id FROM notifications n
+					JOIN users r ON r.id = n.user_id
+				WHERE n.emailed_at IS NULL AND n.read_at IS NULL AND r.is_active
+					AND ` + emailDelivery() + ` = '` + EmailInstant + `'
+					AND ` + notBlocked("n.user_id", "n.actor_id") + `
+				ORDER BY n.id
+				LIMIT $1
+				FOR UPDATE OF n SKIP LOCKED
+			)
+			AND u.id = n.user_id AND a.id = n.actor_id
+		RETURNING n.user_id, u.username, u.email, COALESCE(u.locale, ''), n.group_id, n.type, n.post_id, n.comment_id
+			, a.id, a.username, n.created_at
+	`
+
+	rows, err := tx.QueryContext(ctx, query, batch)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emails := []NotificationEmail{}
+	for rows.Next() {
+		var e NotificationEmail
+		var n Notification
+		var actor NotificationActor
+
+		err := rows.Scan(&e.UserID,
+			&e.Username,
+			&e.Email,
+			&e.Locale,
+			&n.ID,
+			&n.Type,
+			&n.PostID,
+			&n.CommentID,
+			&actor.ID,
+			&actor.Username,
+			&n.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		n.Actors = []NotificationActor{actor}
+		n.ActorsCount = 1
+		n.Message = describeNotification(&n)
+
+		e.Notifications = []Notification{n}
+		emails = append(emails, e)
+	}
+	return emails, rows.Err()
+}
+
+// enqueueNotificationEmails queues the email compose makes of each of the
+// claimed emails.
+func enqueueNotificationEmails(ctx context.Context, tx *sql.Tx, emails []NotificationEmail, compose ComposeEmail) error {
+	for _, e := range emails {
+		email, err := compose(e)
+		if err != nil {
+			return err
+		}
+
+		if err := enqueueEmail(ctx, tx, email); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ClaimDigests takes up to batch users who have unread notifications for
+// their digest and were not sent one within the last interval, marks those
+// notifications emailed and queues the digest compose makes of them, grouped
+// as in the notification center with the most recent first, in the same
+// transaction. It returns how many users it took.
+func (s *EmailPreferenceStore) ClaimDigests(ctx context.Context, interval time.Duration, batch int, compose ComposeEmail) (int, error) {
+
+	var claimed int
+
+	err := withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		pending := `
+			n.read_at IS NULL AND n.emailed_at IS NULL
+			AND ` + emailDelivery() + ` = '` + EmailDigest + `'
+			AND ` + notBlocked("n.user_id", "n.actor_id")
+
+		// Recording the digest first keeps other replicas from sending it too
+		query := `
+			INSERT INTO email_digests (user_id, sent_at)
+			SELECT u.id, NOW() FROM users u
+			WHERE u.is_active
+				AND EXISTS (SELECT 1 FROM notifications n WHERE n.user_id = u.id AND ` + pending + `)
+				AND NOT EXISTS (
+					SELECT 1 FROM email_digests d
+					WHERE d.user_id = u.id AND d.sent_at > NOW() - make_interval(secs => $1)
+				)
+			LIMIT $2
+			ON CONFLICT (user_id) DO UPDATE SET sent_at = EXCLUDED.sent_at
+				WHERE email_digests.sent_at <= NOW() - make_interval(secs => $1)
+			RETURNING user_id
+		`
+
+		rows, err := tx.QueryContext(ctx, query, interval.Seconds(), batch)
+		if err != nil {
+			return err
+		}
+
+		var userIDs []int64
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			userIDs = append(userIDs, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if len(userIDs) == 0 {
+			return nil
+		}
+
+		query = `
+			WITH claimed AS (
+				UPDATE notifications n SET emailed_at = NOW()
+				FROM users u, users a
+				WHERE n.user_id = ANY($1) AND ` + pending + `
+					AND u.id = n.user_id AND a.id = n.actor_id
+				RETURNING n.user_id, u.username, u.email, COALESCE(u.locale, ''), n.group_id, n.type, n.post_id, n.comment_id
+					, a.id AS actor_id, a.username AS actor_username, n.created_at
+			)
+			SELECT * FROM claimed ORDER BY user_id, group_id, created_at DESC
+		`
+
+		rows, err = tx.QueryContext(ctx, query, pq.Array(userIDs))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		// Rows come by group, the most recent first
+		byUser := map[int64]*NotificationEmail{}
+		var group *Notification
+		var seen map[int64]bool
+
+		flush := func(userID int64) {
+			if group == nil {
+				return
+			}
+			if len(group.Actors) > maxNotificationActors {
+				group.Actors = group.Actors[:maxNotificationActors]
+			}
+			group.Message = describeNotification(group)
+
+			e := byUser[userID]
+			e.Notifications = append(e.Notifications, *group)
+		}
+
+		var userID int64
+		for rows.Next() {
+			var e NotificationEmail
+			var n Notification
+			var actor NotificationActor
+
+			err := rows.Scan(&e.UserID,
+				&e.Username,
+				&e.Email,
+				&e.Locale,
+				&n.ID,
+				&n.Type,
+				&n.PostID,
+				&n.CommentID,
+				&actor.ID,
+				&actor.Username,
+				&n.CreatedAt)
+			if err != nil {
+				return err
+			}
+
+			if byUser[e.UserID] == nil {
+				byUser[e.UserID] = &e
+			}
+
+			if group == nil || group.ID != n.ID || userID != e.UserID {
+				flush(userID)
+				group, seen, userID = &n, map[int64]bool{}, e.UserID
+			}
+
+			if !seen[actor.ID] {
+				seen[actor.ID] = true
+				group.ActorsCount++
+				group.Actors = append(group.Actors, actor)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		flush(userID)
+		rows.Close()
+
+		emails := make([]NotificationEmail, 0, len(byUser))
+		for _, e := range byUser {
+			sort.Slice(e.Notifications, func(i, j int) bool {
+				return e.Notifications[i].CreatedAt > e.Notifications[j].CreatedAt
+			})
+			emails = append(emails, *e)
+		}
+
+		claimed = len(emails)
+		return enqueueNotificationEmails(ctx, tx, emails, compose)
+	})
+	return claimed, err
+}
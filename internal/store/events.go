@@ -0,0 +1,152 @@
+package store
+
+// Aggregates the domain events are about.
+const (
+	AggregatePost         = "post"
+	AggregateComment      = "comment"
+	AggregateUser         = "user"
+	AggregateConversation = "conversation"
+	AggregateWebhook      = "webhook"
+)
+
+// Domain events, recorded in the transaction of every change and published
+// by the event relay.
+const (
+	EventPostCreated              = "post.created"
+	EventPostUpdated              = "post.updated"
+	EventPostDeleted              = "post.deleted"
+	EventPostRemoteLiked          = "post.remote_liked"
+	EventPostRemoteUnliked        = "post.remote_unliked"
+	EventPostRemoteReplied        = "post.remote_replied"
+	EventCommentCreated           = "comment.created"
+	EventCommentUpdated           = "comment.updated"
+	EventCommentDeleted           = "comment.deleted"
+	EventCommentReacted           = "comment.reacted"
+	EventCommentUnreacted         = "comment.unreacted"
+	EventUserCreated              = "user.created"
+	EventUserActivated            = "user.activated"
+	EventUserDeleted              = "user.deleted"
+	EventUserFollowed             = "user.followed"
+	EventUserUnfollowed           = "user.unfollowed"
+	EventUserBlocked              = "user.blocked"
+	EventUserUnblocked            = "user.unblocked"
+	EventUserRemoteFollowed       = "user.remote_followed"
+	EventUserRemoteUnfollowed     = "user.remote_unfollowed"
+	EventUserMessagePolicyChanged = "user.message_policy_changed"
+	EventConversationCreated      = "conversation.created"
+	EventMessageSent              = "conversation.message_sent"
+	EventMessageRead              = "conversation.message_read"
+	EventWebhookCreated           = "webhook.created"
+	EventWebhookUpdated           = "webhook.updated"
+	EventWebhookDeleted           = "webhook.deleted"
+)
+
+// PostEvent is the data of the post events, about the post. Deleted posts
+// only carry their ID and author.
+type PostEvent struct {
+	ID         int64    `json:"id"`
+	UserID     int64    `json:"user_id"`
+	Title      string   `json:"title,omitempty"`
+	Content    string   `json:"content,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+	Language   string   `json:"language,omitempty"`
+	Visibility string   `json:"visibility,omitempty"`
+	Version    int      `json:"version,omitempty"`
+	CreatedAt  string   `json:"created_at,omitempty"`
+	UpdatedAt  string   `json:"updated_at,omitempty"`
+}
+
+func newPostEvent(p *Post) PostEvent {
+	return PostEvent{
+		ID:         p.ID,
+		UserID:     p.UserID,
+		Title:      p.Title,
+		Content:    p.Content,
+		Tags:       p.Tags,
+		Language:   p.Language,
+		Visibility: p.Visibility,
+		Version:    p.Version,
+		CreatedAt:  p.CreatedAt,
+		UpdatedAt:  p.UpdatedAt,
+	}
+}
+
+// CommentEvent is the data of the comment events, about the comment. Deleted
+// comments only carry their ID and post. New comments also carry the author
+// of their post, who is told about them.
+type CommentEvent struct {
+	ID           int64  `json:"id"`
+	PostID       int64  `json:"post_id"`
+	PostAuthorID int64  `json:"post_author_id,omitempty"`
+	UserID       int64  `json:"user_id,omitempty"`
+	ParentID     *int64 `json:"parent_id,omitempty"`
+	Content      string `json:"content,omitempty"`
+	Version      int    `json:"version,omitempty"`
+	CreatedAt    string `json:"created_at,omitempty"`
+}
+
+// EngagementEvent is the data of reactions, recorded on the comment they are
+// about. AuthorID wrote it.
+type EngagementEvent struct {
+	UserID   int64 `json:"user_id"`
+	AuthorID int64 `json:"author_id"`
+}
+
+// UserEvent is the data of the events about the lifecycle of a user.
+type UserEvent struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username,omitempty"`
+}
+
+// MessagePolicyEvent is the data of user.message_policy_changed.
+type MessagePolicyEvent struct {
+	Policy string `json:"policy"`
+}
+
+// RemoteEvent is the data of the activities of remote actors, recorded on the
+// local user they follow or the post they like or reply to. URI identifies
+// the activity, or the note of a reply.
+type RemoteEvent struct {
+	ActorID int64  `json:"actor_id"`
+	URI     string `json:"uri"`
+	Content string `json:"content,omitempty"`
+}
+
+// ConversationEvent is the data of conversation.created. Messages are
+// recorded on their conversation with the data of the Message, and read
+// receipts with the member and the last message they read.
+type ConversationEvent struct {
+	ID        int64   `json:"id"`
+	CreatorID int64   `json:"creator_id"`
+	MemberIDs []int64 `json:"member_ids"`
+	Title     *string `json:"title,omitempty"`
+}
+
+// WebhookEvent is the data of the webhook events, without the secret.
+// Deleted webhooks only carry their ID and owner.
+type WebhookEvent struct {
+	ID     int64    `json:"id"`
+	UserID int64    `json:"user_id"`
+	URL    string   `json:"url,omitempty"`
+	Events []string `json:"events,omitempty"`
+	Global bool     `json:"global,omitempty"`
+	Active bool     `json:"active,omitempty"`
+}
+
+func newWebhookEvent(w *Webhook) WebhookEvent {
+	return WebhookEvent{
+		ID:     w.ID,
+		UserID: w.UserID,
+		URL:    w.URL,
+		Events: w.Events,
+		Global: w.Global,
+		Active: w.Active,
+	}
+}
+
+// RelationshipEvent is the data of follows, recorded on the followed user,
+// and of blocks, recorded on the user who blocked.
+type RelationshipEvent struct {
+	UserID  int64 `json:"user_id"`
+	OtherID int64 `json:"other_id"`
+}
@@ -0,0 +1,265 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"com.github/jrovieri/golang/social/internal/parser"
+	"github.com/lib/pq"
+)
+
+type Mention struct {
+	UserID   int64  `json:"user_id"`
+	Username string `json:"username"`
+	Start    int    `json:"start"`
+	End      int    `json:"end"`
+}
+
+type MentionStore struct {
+	db *sql.DB
+}
+
+// GetMentionedPosts returns the posts whose content mentions the user, leaving
+// out the ones written by users on either side of a block.
+func (s *MentionStore) GetMentionedPosts(ctx context.Context, userID int64, fq PaginatedFeedQuery) ([]PostWithMetadata, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `
+		SELECT p.id, p.user_id, p.title, p.content, p.created_at, p.version, p.tags
+			, u.id, u.username
+			, (SELECT COUNT(*) FROM comments c WHERE c.post_id = p.id) AS comments_count
+		FROM posts p
+			JOIN users u ON u.id = p.user_id
+		WHERE p.id IN (
+				SELECT m.post_id FROM mentions m
+				WHERE m.user_id = $1 AND m.comment_id IS NULL
+			)
+			AND ` + visibleTo("$1") + `
+			AND NOT EXISTS (
+				SELECT 1 FROM user_blocks b
+				WHERE (b.user_id = $1 AND b.blocked_id = p.user_id)
+					OR (b.user_id = p.user_id AND b.blocked_id = $1)
+			)
+			AND ($4::timestamptz IS NULL OR p.created_at >= $4)
+			AND ($5::timestamptz IS NULL OR p.created_at < $5)
+		ORDER BY p.created_at ` + fq.Sort + `, p.id ` + fq.Sort + `
+		LIMIT $2 OFFSET $3
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, userID, fq.Limit, fq.Offset, fq.Since, fq.Until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	posts := []PostWithMetadata{}
+	for rows.Next() {
+		var p PostWithMetadata
+
+		err := rows.Scan(&p.ID,
+			&p.UserID,
+			&p.Title,
+			&p.Content,
+			&p.CreatedAt,
+			&p.Version,
+			pq.Array(&p.Tags),
+			&p.User.ID,
+			&p.User.Username,
+			&p.CommentCount)
+		if err != nil {
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ids := make([]int64, len(posts))
+	for i, p := range posts {
+		ids[i] = p.ID
+	}
+
+	mentions, err := getPostMentions(ctx, s.db, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range posts {
+		posts[i].Mentions = mentions[posts[i].ID]
+	}
+	return posts, nil
+}
+
+// syncMentions replaces the mentions stored for a post, or for one of its
+// comments when commentID is set, with the ones found in content. Mentions of
+// unknown, inactive or blocked users are dropped. Usernames match regardless
+// of case, preferring the user whose username matches exactly. Users
+// mentioned for the first time are notified; edits do not notify them again.
+func syncMentions(ctx context.Context, tx *sql.Tx, authorID, postID int64, commentID *int64, content string) ([]Mention, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `DELETE FROM mentions WHERE post_id = $1 AND comment_id IS NOT DISTINCT FROM $2 RETURNING user_id`
+	rows, err := tx.QueryContext(ctx, query, postID, commentID)
+	if err != nil {
+		return nil, err
+	}
+
+	mentioned := map[int64]bool{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		mentioned[id] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	spans := parser.Mentions(content)
+	if len(spans) == 0 {
+		return []Mention{}, nil
+	}
+
+	names := parser.Unique(spans)
+	for i := range names {
+		names[i] = strings.ToLower(names[i])
+	}
+
+	query = `
+		SELECT u.id, u.username FROM users u
+		WHERE lower(u.username) = ANY($1) AND u.is_active
+			AND NOT EXISTS (
+				SELECT 1 FROM user_blocks b
+				WHERE (b.user_id = u.id AND b.blocked_id = $2)
+					OR (b.user_id = $2 AND b.blocked_id = u.id)
+			)
+		ORDER BY u.id
+	`
+	rows, err = tx.QueryContext(ctx, query, pq.Array(names), authorID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Users by their username, and by its lower case for the mentions that
+	// do not match one exactly
+	users := map[string]Mention{}
+	folded := map[string]Mention{}
+	for rows.Next() {
+		var u Mention
+		if err := rows.Scan(&u.UserID, &u.Username); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		users[u.Username] = u
+		if _, ok := folded[strings.ToLower(u.Username)]; !ok {
+			folded[strings.ToLower(u.Username)] = u
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `
+		INSERT INTO mentions (user_id, author_id, post_id, comment_id, start_offset, end_offset)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+
+	mentions := []Mention{}
+	for _, span := range spans {
+		u, ok := users[span.Value]
+		if !ok {
+			u, ok = folded[strings.ToLower(span.Value)]
+		}
+		if !ok {
+			continue
+		}
+
+		_, err := tx.ExecContext(ctx, query, u.UserID, authorID, postID, commentID, span.Start, span.End)
+		if err != nil {
+			return nil, err
+		}
+
+		mentions = append(mentions, Mention{
+			UserID:   u.UserID,
+			Username: u.Username,
+			Start:    span.Start,
+			End:      span.End,
+		})
+
+		if mentioned[u.UserID] {
+			continue
+		}
+		mentioned[u.UserID] = true
+
+		err = notify(ctx, tx, notification{
+			userID:    u.UserID,
+			actorID:   authorID,
+			typ:       NotificationMention,
+			postID:    &postID,
+			commentID: commentID,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mentions, nil
+}
+
+// getPostMentions loads the mentions made in the content of the given posts,
+// keyed by post ID.
+func getPostMentions(ctx context.Context, db *sql.DB, postIDs []int64) (map[int64][]Mention, error) {
+	query := `
+		SELECT m.post_id, m.user_id, u.username, m.start_offset, m.end_offset
+		FROM mentions m
+			JOIN users u ON u.id = m.user_id
+		WHERE m.post_id = ANY($1) AND m.comment_id IS NULL
+		ORDER BY m.start_offset
+	`
+	return queryMentions(ctx, db, query, postIDs)
+}
+
+// getCommentMentions loads the mentions made in the given comments, keyed by
+// comment ID.
+func getCommentMentions(ctx context.Context, db *sql.DB, commentIDs []int64) (map[int64][]Mention, error) {
+	query := `
+		SELECT m.comment_id, m.user_id, u.username, m.start_offset, m.end_offset
+		FROM mentions m
+			JOIN users u ON u.id = m.user_id
+		WHERE m.comment_id = ANY($1)
+		ORDER BY m.start_offset
+	`
+	return queryMentions(ctx, db, query, commentIDs)
+}
+
+func queryMentions(ctx context.Context, db *sql.DB, query string, ids []int64) (map[int64][]Mention, error) {
+	mentions := map[int64][]Mention{}
+	if len(ids) == 0 {
+		return mentions, nil
+	}
+
+	rows, err := db.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var m Mention
+		if err := rows.Scan(&id, &m.UserID, &m.Username, &m.Start, &m.End); err != nil {
+			return nil, err
+		}
+		mentions[id] = append(mentions[id], m)
+	}
+	return mentions, rows.Err()
+}
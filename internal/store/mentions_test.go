@@ -0,0 +1,32 @@
+package store
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestMentionsMatchUsernamesRegardlessOfCase(t *testing.T) {
+	conn := newTestDB(t)
+	s := NewStorage(conn, Config{FanoutThreshold: DefaultFanoutThreshold, SearchLanguage: DefaultSearchLanguage})
+	ctx := context.Background()
+
+	author, mentioned := createTestUser(t, conn), createTestUser(t, conn)
+
+	var username string
+	if err := conn.QueryRowContext(ctx, `SELECT username FROM users WHERE id = $1`, mentioned).Scan(&username); err != nil {
+		t.Fatal(err)
+	}
+
+	post := &Post{Title: "hello", Content: "hi @" + strings.ToUpper(username), UserID: author}
+	if err := s.Posts.Create(ctx, post); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(post.Mentions) != 1 {
+		t.Fatalf("got %d mentions, want 1", len(post.Mentions))
+	}
+	if m := post.Mentions[0]; m.UserID != mentioned || m.Username != username {
+		t.Errorf("mention = %+v, want user %d (%s)", m, mentioned, username)
+	}
+}
@@ -0,0 +1,345 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/lib/pq"
+)
+
+// Notification types.
+const (
+	NotificationFollow   = "follow"
+	NotificationComment  = "comment"
+	NotificationReply    = "reply"
+	NotificationReaction = "reaction"
+	NotificationMention  = "mention"
+)
+
+// maxNotificationActors is the number of actors listed by name in a
+// notification; the others are only counted.
+const maxNotificationActors = 3
+
+// Notification groups the events of one type on the same target that happened
+// since the user last read them, such as every reaction to a comment. ID is the
+// ID of the group and is what marks it read.
+type Notification struct {
+	ID          int64               `json:"id"`
+	Type        string              `json:"type"`
+	PostID      *int64              `json:"post_id"`
+	CommentID   *int64              `json:"comment_id"`
+	Actors      []NotificationActor `json:"actors"`
+	ActorsCount int                 `json:"actors_count"`
+	Message     string              `json:"message"`
+	Read        bool                `json:"read"`
+	CreatedAt   string              `json:"created_at"`
+}
+
+type NotificationActor struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+}
+
+type NotificationStore struct {
+	db *sql.DB
+}
+
+// GetByUserID returns a page of the notifications of a user, most recent
+// first, along with the cursor of the next page.
+func (s *NotificationStore) GetByUserID(ctx context.Context, userID int64, q PaginatedNotificationQuery) ([]Notification, *Cursor, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	var key any
+	var id int64
+	if q.Cursor != nil {
+		if q.Cursor.Sort != "notifications" {
+			return nil, nil, ErrInvalidCursor
+		}
+
+		t, err := q.Cursor.timeKey()
+		if err != nil {
+			return nil, nil, err
+		}
+		key, id = t, q.Cursor.ID
+	}
+
+	query := `
+		SELECT g.group_id, g.type, g.post_id, g.comment_id, g.actors_count, g.unread, g.created_at
+			, a.ids, a.usernames
+		FROM (
+			SELECT n.group_id, MIN(n.type) AS type, MAX(n.post_id) AS post_id
+				, (array_agg(n.comment_id ORDER BY n.id DESC))[1] AS comment_id
+				, COUNT(DISTINCT n.actor_id) AS actors_count
+				, bool_or(n.read_at IS NULL) AS unread
+				, MAX(n.created_at) AS created_at
+			FROM notifications n
+				LEFT JOIN posts p ON p.id = n.post_id
+			WHERE n.user_id = $1
+				AND (p.id IS NULL OR ` + visibleTo("$1") + `)
+				AND NOT EXISTS (
+					SELECT 1 FROM user_blocks b
+					WHERE (b.user_id = $1 AND b.blocked_id = n.actor_id)
+						OR (b.user_id = n.actor_id AND b.blocked_id = $1)
+				)
+			GROUP BY n.group_id
+		) g
+			CROSS JOIN LATERAL (
+				SELECT array_agg(l.id ORDER BY l.created_at DESC, l.id) AS ids
+					, array_agg(l.username ORDER BY l.created_at DESC, l.id) AS usernames
+				FROM (
+					SELECT u.id, u.username, MAX(n.created_at) AS created_at
+					FROM notifications n
+						JOIN users u ON u.id = n.actor_id
+					WHERE n.user_id = $1 AND n.group_id = g.group_id AND ` + notBlocked("u.id", "$1") + `
+					GROUP BY u.id, u.username
+					ORDER BY created_at DESC, u.id
+					LIMIT ` + strconv.Itoa(maxNotificationActors) + `
+				) l
+			) a
+		WHERE ($2::timestamptz IS NULL OR (g.created_at, g.group_id) < ($2::timestamptz, $3::bigint))
+			AND (NOT $4 OR g.unread)
+		ORDER BY g.created_at DESC, g.group_id DESC
+		LIMIT $5
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, userID, key, id, q.Unread, q.Limit+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		var n Notification
+		var unread bool
+		var ids []int64
+		var usernames []string
+
+		err := rows.Scan(&n.ID,
+			&n.Type,
+			&n.PostID,
+			&n.CommentID,
+			&n.ActorsCount,
+			&unread,
+			&n.CreatedAt,
+			pq.Array(&ids),
+			pq.Array(&usernames))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		n.Read = !unread
+		n.Actors = make([]NotificationActor, len(ids))
+		for i := range ids {
+			n.Actors[i] = NotificationActor{ID: ids[i], Username: usernames[i]}
+		}
+		n.Message = describeNotification(&n)
+
+		notifications = append(notifications, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var next *Cursor
+	if len(notifications) > q.Limit {
+		notifications = notifications[:q.Limit]
+		last := notifications[len(notifications)-1]
+		next = &Cursor{Sort: "notifications", Key: last.CreatedAt, ID: last.ID}
+	}
+	return notifications, next, nil
+}
+
+// CountUnread returns the number of notifications the user has not read yet,
+// counting each group once.
+func (s *NotificationStore) CountUnread(ctx context.Context, userID int64) (int, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `
+		SELECT COUNT(DISTINCT n.group_id)
+		FROM notifications n
+			LEFT JOIN posts p ON p.id = n.post_id
+		WHERE n.user_id = $1 AND n.read_at IS NULL
+			AND (p.id IS NULL OR ` + visibleTo("$1") + `)
+			AND NOT EXISTS (
+				SELECT 1 FROM user_blocks b
+				WHERE (b.user_id = $1 AND b.blocked_id = n.actor_id)
+					OR (b.user_id = n.actor_id AND b.blocked_id = $1)
+			)
+	`
+
+	var count int
+	if err := s.db.QueryRowContext(ctx, query, userID).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// MarkRead marks a notification of the user as read. Reading a notification
+// that was already read is not an error.
+func (s *NotificationStore) MarkRead(ctx context.Context, userID, id int64) error {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `
+		WITH marked AS (
+			UPDATE notifications SET read_at = NOW()
+			WHERE user_id = $1 AND group_id = $2 AND read_at IS NULL
+		)
+		SELECT EXISTS (SELECT 1 FROM notifications WHERE user_id = $1 AND group_id = $2)
+	`
+
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, query, userID, id).Scan(&exists); err != nil {
+		return err
+	}
+
+	if !exists {
+		return ErrResourceNotFound
+	}
+	return nil
+}
+
+// MarkAllRead marks every notification of the user as read.
+func (s *NotificationStore) MarkAllRead(ctx context.Context, userID int64) error {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `UPDATE notifications SET read_at = NOW() WHERE user_id = $1 AND read_at IS NULL`
+	_, err := s.db.ExecContext(ctx, query, userID)
+	return err
+}
+
+// notification is an event to notify a user about.
+type notification struct {
+	userID    int64
+	actorID   int64
+	typ       string
+	postID    *int64
+	commentID *int64
+}
+
+// groupKey identifies the target of the event. Unread notifications sharing
+// it are shown as one. Comments and replies carry the new comment, so they
+// are grouped by post.
+func (n notification) groupKey() string {
+	switch n.typ {
+	case NotificationFollow:
+		return n.typ
+	case NotificationComment, NotificationReply:
+		return fmt.Sprintf("%s:post:%d", n.typ, *n.postID)
+	}
+
+	if n.commentID != nil {
+		return fmt.Sprintf("%s:comment:%d", n.typ, *n.commentID)
+	}
+	return fmt.Sprintf("%s:post:%d", n.typ, *n.postID)
+}
+
+// notify records a notification within the transaction of the event that
+// caused it. It joins the unread group of its target when there is one and
+// starts a new group otherwise. Users are not notified of their own actions,
+// nor of the actions of users on either side of a block.
+func notify(ctx context.Context, tx *sql.Tx, n notification) error {
+
+	query := `
+		INSERT INTO notifications (id, user_id, actor_id, type, post_id, comment_id, group_key, group_id)
+		SELECT s.id, $1, $2, $3, $4, $5, $6, COALESCE((
+				SELECT g.group_id FROM notifications g
+				WHERE g.user_id = $1 AND g.group_key = $6 AND g.read_at IS NULL
+				LIMIT 1
+			), s.id)
+		FROM (SELECT nextval(pg_get_serial_sequence('notifications', 'id')) AS id) s
+		WHERE $1 <> $2
+			AND NOT EXISTS (
+				SELECT 1 FROM user_blocks b
+				WHERE (b.user_id = $1 AND b.blocked_id = $2)
+					OR (b.user_id = $2 AND b.blocked_id = $1)
+			)
+		RETURNING group_id
+	`
+
+	var groupID int64
+	err := tx.QueryRowContext(ctx, query, n.userID, n.actorID, n.typ, n.postID, n.commentID, n.groupKey()).
+		Scan(&groupID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+
+	event := notificationEvent{
+		ID:        groupID,
+		Type:      n.typ,
+		ActorID:   n.actorID,
+		PostID:    n.postID,
+		CommentID: n.commentID,
+	}
+	return publish(ctx, tx, StreamNotification, event, []int64{n.userID})
+}
+
+// notificationEvent is the data of the stream event sent for a new
+// notification. ID is the ID of the notification group it joined.
+type notificationEvent struct {
+	ID        int64  `json:"id"`
+	Type      string `json:"type"`
+	ActorID   int64  `json:"actor_id"`
+	PostID    *int64 `json:"post_id"`
+	CommentID *int64 `json:"comment_id"`
+}
+
+// unnotify removes the notification an undone event had caused, such as the
+// one of a reaction that was taken back.
+func unnotify(ctx context.Context, tx *sql.Tx, n notification) error {
+	query := `DELETE FROM notifications WHERE user_id = $1 AND actor_id = $2 AND group_key = $3`
+	_, err := tx.ExecContext(ctx, query, n.userID, n.actorID, n.groupKey())
+	return err
+}
+
+// describeNotification phrases a notification as shown to the user, such as
+// "alice and 4 others liked your post".
+func describeNotification(n *Notification) string {
+	var who string
+	switch {
+	case len(n.Actors) == 0:
+		who = "Someone"
+	case n.ActorsCount == 1:
+		who = n.Actors[0].Username
+	case n.ActorsCount == 2 && len(n.Actors) == 2:
+		who = n.Actors[0].Username + " and " + n.Actors[1].Username
+	case n.ActorsCount == 2:
+		who = n.Actors[0].Username + " and 1 other"
+	default:
+		who = fmt.Sprintf("%s and %d others", n.Actors[0].Username, n.ActorsCount-1)
+	}
+
+	target := "post"
+	if n.CommentID != nil {
+		target = "comment"
+	}
+
+	switch n.Type {
+	case NotificationFollow:
+		return who + " followed you"
+	case NotificationComment:
+		return who + " commented on your post"
+	case NotificationReply:
+		return who + " replied to your comment"
+	case NotificationReaction:
+		return who + " liked your " + target
+	case NotificationMention:
+		return who + " mentioned you in a " + target
+	default:
+		return who
+	}
+}
@@ -0,0 +1,152 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"com.github/jrovieri/golang/social/internal/job"
+)
+
+// MaxEmailAttempts is how many times an email is tried before it is moved to
+// the dead letters.
+const MaxEmailAttempts = 8
+
+// OutboundEmail is an email waiting in the outbox. Data is the data of its
+// template, as JSON, and Locale the preferred locale of the recipient.
+type OutboundEmail struct {
+	ID        int64
+	Template  string
+	Locale    string
+	Username  string
+	Email     string
+	Data      json.RawMessage
+	Attempts  int
+	CreatedAt string
+}
+
+// NewOutboundEmail returns an email rendering the template with data, which
+// must survive a round trip through JSON.
+func NewOutboundEmail(template, locale, username, email string, data any) (*OutboundEmail, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OutboundEmail{
+		Template: template,
+		Locale:   locale,
+		Username: username,
+		Email:    email,
+		Data:     payload,
+	}, nil
+}
+
+// SendEmailArgs are the arguments of the job sending an email of the outbox.
+type SendEmailArgs struct {
+	EmailID int64 `json:"email_id"`
+}
+
+func (SendEmailArgs) Kind() string { return "send_email" }
+
+type EmailOutboxStore struct {
+	db *sql.DB
+}
+
+// GetPending returns an email of the outbox that was not sent yet.
+func (s *EmailOutboxStore) GetPending(ctx context.Context, id int64) (*OutboundEmail, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `
+		SELECT id, template, locale, username, email, data, attempts, created_at
+		FROM email_outbox
+		WHERE id = $1 AND status = 'pending'
+	`
+
+	var e OutboundEmail
+	err := s.db.QueryRowContext(ctx, query, id).
+		Scan(&e.ID, &e.Template, &e.Locale, &e.Username, &e.Email, &e.Data, &e.Attempts, &e.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrResourceNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &e, nil
+}
+
+// MarkSent records that an email was sent and drops its data, which holds
+// what the email was about and is not needed anymore.
+func (s *EmailOutboxStore) MarkSent(ctx context.Context, id int64) error {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `
+		UPDATE email_outbox
+		SET status = 'sent', sent_at = NOW(), attempts = attempts + 1, last_error = NULL, data = '{}'
+		WHERE id = $1
+	`
+	_, err := s.db.ExecContext(ctx, query, id)
+	return err
+}
+
+// MarkFailed records an attempt to send an email that failed, and moves the
+// email to the dead letters when it was the last one.
+func (s *EmailOutboxStore) MarkFailed(ctx context.Context, id int64, cause error, dead bool) error {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	status := "pending"
+	if dead {
+		status = "dead"
+	}
+
+	query := `UPDATE email_outbox SET status = $2, attempts = attempts + 1, last_error = $3 WHERE id = $1`
+	_, err := s.db.ExecContext(ctx, query, id, status, cause.Error())
+	return err
+}
+
+// Prune deletes the emails sent before the retention and the dead ones queued
+// before it, returning how many were deleted. Dead emails are kept until then
+// for inspection.
+func (s *EmailOutboxStore) Prune(ctx context.Context, retention time.Duration) (int64, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `
+		DELETE FROM email_outbox
+		WHERE (status = 'sent' AND sent_at < NOW() - make_interval(secs => $1))
+			OR (status = 'dead' AND created_at < NOW() - make_interval(secs => $1))
+	`
+
+	res, err := s.db.ExecContext(ctx, query, retention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// enqueueEmail adds an email to the outbox within the transaction of the
+// change it is about, so it is sent if and only if the change is committed.
+func enqueueEmail(ctx context.Context, tx *sql.Tx, e *OutboundEmail) error {
+	query := `
+		INSERT INTO email_outbox (template, locale, username, email, data) VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`
+	err := tx.QueryRowContext(ctx, query, e.Template, e.Locale, e.Username, e.Email, e.Data).Scan(&e.ID, &e.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = job.Enqueue(ctx, tx, SendEmailArgs{EmailID: e.ID}, job.InQueue("mail"), job.MaxAttempts(MaxEmailAttempts))
+	return err
+}
@@ -1,20 +1,26 @@
 package store
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// PaginatedFeedQuery filters and pages a list of posts. Since and Until bound
+// the creation date of the posts as a half-open range [Since, Until).
 type PaginatedFeedQuery struct {
-	Limit  int      `json:"limit" validate:"gte=1,lte=20"`
-	Offset int      `json:"offset" validate:"gte=0"`
-	Sort   string   `json:"sort" validate:"oneof=asc desc"`
-	Tags   []string `json:"tags" validate:"max=5"`
-	Search string   `json:"search" validate:"max=100"`
-	Since  string   `json:"since"`
-	Until  string   `json:"until"`
+	Limit  int        `json:"limit" validate:"gte=1,lte=20"`
+	Offset int        `json:"offset" validate:"gte=0"`
+	Sort   string     `json:"sort" validate:"oneof=asc desc"`
+	Mode   string     `json:"mode" validate:"omitempty,oneof=chronological ranked"`
+	Tags   []string   `json:"tags" validate:"max=5"`
+	Search string     `json:"search" validate:"max=100"`
+	Since  *time.Time `json:"since"`
+	Until  *time.Time `json:"until"`
+	Cursor *Cursor    `json:"-"`
 }
 
 func (q PaginatedFeedQuery) Parse(r *http.Request) (PaginatedFeedQuery, error) {
@@ -25,7 +31,7 @@ func (q PaginatedFeedQuery) Parse(r *http.Request) (PaginatedFeedQuery, error) {
 	if limit != "" {
 		value, err := strconv.Atoi(limit)
 		if err != nil {
-			return q, nil
+			return q, err
 		}
 		q.Limit = value
 	}
@@ -44,9 +50,18 @@ func (q PaginatedFeedQuery) Parse(r *http.Request) (PaginatedFeedQuery, error) {
 		q.Sort = sort
 	}
 
+	mode := queryStr.Get("mode")
+	if mode != "" {
+		q.Mode = mode
+	}
+
 	tags := queryStr.Get("tags")
 	if tags != "" {
-		q.Tags = strings.Split(tags, ",")
+		for _, tag := range strings.Split(tags, ",") {
+			if tag = NormalizeTag(tag); tag != "" {
+				q.Tags = append(q.Tags, tag)
+			}
+		}
 	}
 
 	search := queryStr.Get("search")
@@ -54,22 +69,289 @@ func (q PaginatedFeedQuery) Parse(r *http.Request) (PaginatedFeedQuery, error) {
 		q.Search = search
 	}
 
+	loc := time.UTC
+	if tz := queryStr.Get("tz"); tz != "" {
+		var err error
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			return q, fmt.Errorf("invalid tz %q: must be an IANA time zone such as Europe/Lisbon", tz)
+		}
+	}
+
 	since := queryStr.Get("since")
 	if since != "" {
-		q.Since = parseTime(since)
+		t, _, err := parseTime(since, loc)
+		if err != nil {
+			return q, fmt.Errorf("invalid since %q: %w", since, err)
+		}
+		q.Since = &t
 	}
 
 	until := queryStr.Get("until")
 	if until != "" {
-		q.Until = parseTime(until)
+		t, dateOnly, err := parseTime(until, loc)
+		if err != nil {
+			return q, fmt.Errorf("invalid until %q: %w", until, err)
+		}
+
+		// A bare date covers the whole day
+		if dateOnly {
+			t = t.AddDate(0, 0, 1)
+		}
+		q.Until = &t
+	}
+
+	if q.Since != nil && q.Until != nil && !q.Since.Before(*q.Until) {
+		return q, errors.New("since must be before until")
 	}
 	return q, nil
 }
 
-func parseTime(s string) string {
-	t, err := time.Parse(time.DateTime, s)
+// Cursor marks the edge row of a page for keyset pagination. Key holds the
+// value of the sort column, ID breaks ties between rows sharing it and Prev
+// tells whether the rows before the cursor are wanted instead of the ones after.
+// Ranked pages are keyed on the score of the post, computed as of At. Search
+// pages, which have no stable key, use Offset for their position instead.
+type Cursor struct {
+	Sort   string `json:"s"`
+	Key    string `json:"k"`
+	ID     int64  `json:"i,omitempty"`
+	Prev   bool   `json:"p,omitempty"`
+	Offset int    `json:"o,omitempty"`
+	At     string `json:"a,omitempty"`
+}
+
+// timeKey returns the key of a cursor over a timestamp column, so a key that
+// is not one is rejected as an invalid cursor rather than by Postgres.
+func (c *Cursor) timeKey() (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, c.Key)
+	if err != nil {
+		return time.Time{}, ErrInvalidCursor
+	}
+	return t, nil
+}
+
+// floatKey returns the key of a cursor over a score.
+func (c *Cursor) floatKey() (float64, error) {
+	f, err := strconv.ParseFloat(c.Key, 64)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	return f, nil
+}
+
+// intKey returns the key of a cursor over an integer column.
+func (c *Cursor) intKey() (int, error) {
+	n, err := strconv.Atoi(c.Key)
 	if err != nil {
-		return ""
+		return 0, ErrInvalidCursor
+	}
+	return n, nil
+}
+
+type PaginatedCommentQuery struct {
+	Limit  int     `json:"limit" validate:"gte=1,lte=50"`
+	Sort   string  `json:"sort" validate:"oneof=newest oldest most-reacted"`
+	Cursor *Cursor `json:"-"`
+}
+
+func (q PaginatedCommentQuery) Parse(r *http.Request) (PaginatedCommentQuery, error) {
+
+	queryStr := r.URL.Query()
+
+	limit := queryStr.Get("limit")
+	if limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil {
+			return q, err
+		}
+		q.Limit = value
+	}
+
+	sort := queryStr.Get("sort")
+	if sort != "" {
+		q.Sort = sort
+	}
+	return q, nil
+}
+
+// PaginatedNotificationQuery pages through the notifications of a user,
+// optionally only the unread ones.
+type PaginatedNotificationQuery struct {
+	Limit  int     `json:"limit" validate:"gte=1,lte=50"`
+	Unread bool    `json:"unread"`
+	Cursor *Cursor `json:"-"`
+}
+
+func (q PaginatedNotificationQuery) Parse(r *http.Request) (PaginatedNotificationQuery, error) {
+
+	queryStr := r.URL.Query()
+
+	limit := queryStr.Get("limit")
+	if limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil {
+			return q, err
+		}
+		q.Limit = value
+	}
+
+	unread := queryStr.Get("unread")
+	if unread != "" {
+		value, err := strconv.ParseBool(unread)
+		if err != nil {
+			return q, err
+		}
+		q.Unread = value
+	}
+	return q, nil
+}
+
+// PaginatedConversationQuery pages through the conversations of a user,
+// optionally only the ones with unread messages.
+type PaginatedConversationQuery struct {
+	Limit  int     `json:"limit" validate:"gte=1,lte=50"`
+	Unread bool    `json:"unread"`
+	Cursor *Cursor `json:"-"`
+}
+
+func (q PaginatedConversationQuery) Parse(r *http.Request) (PaginatedConversationQuery, error) {
+
+	queryStr := r.URL.Query()
+
+	limit := queryStr.Get("limit")
+	if limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil {
+			return q, err
+		}
+		q.Limit = value
+	}
+
+	unread := queryStr.Get("unread")
+	if unread != "" {
+		value, err := strconv.ParseBool(unread)
+		if err != nil {
+			return q, err
+		}
+		q.Unread = value
+	}
+	return q, nil
+}
+
+// PaginatedMessageQuery pages back through the messages of a conversation or,
+// when After is set, fetches the ones sent after that message.
+type PaginatedMessageQuery struct {
+	Limit  int     `json:"limit" validate:"gte=1,lte=100"`
+	After  *int64  `json:"after" validate:"omitempty,gte=0"`
+	Cursor *Cursor `json:"-"`
+}
+
+func (q PaginatedMessageQuery) Parse(r *http.Request) (PaginatedMessageQuery, error) {
+
+	queryStr := r.URL.Query()
+
+	limit := queryStr.Get("limit")
+	if limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil {
+			return q, err
+		}
+		q.Limit = value
+	}
+
+	after := queryStr.Get("after")
+	if after != "" {
+		value, err := strconv.ParseInt(after, 10, 64)
+		if err != nil {
+			return q, err
+		}
+		q.After = &value
+	}
+	return q, nil
+}
+
+// PaginatedDeliveryQuery pages through the delivery log of a webhook,
+// optionally only the deliveries in one status.
+type PaginatedDeliveryQuery struct {
+	Limit  int     `json:"limit" validate:"gte=1,lte=100"`
+	Status string  `json:"status" validate:"omitempty,oneof=pending delivered dead"`
+	Cursor *Cursor `json:"-"`
+}
+
+func (q PaginatedDeliveryQuery) Parse(r *http.Request) (PaginatedDeliveryQuery, error) {
+
+	queryStr := r.URL.Query()
+
+	limit := queryStr.Get("limit")
+	if limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil {
+			return q, err
+		}
+		q.Limit = value
+	}
+
+	status := queryStr.Get("status")
+	if status != "" {
+		q.Status = status
+	}
+	return q, nil
+}
+
+// SearchQuery is a full-text search over one type of content. Language is
+// the text search configuration the query is parsed with.
+type SearchQuery struct {
+	Query    string  `json:"q" validate:"required,max=200"`
+	Type     string  `json:"type" validate:"oneof=posts comments users"`
+	Language string  `json:"lang"`
+	Limit    int     `json:"limit" validate:"gte=1,lte=50"`
+	Cursor   *Cursor `json:"-"`
+}
+
+func (q SearchQuery) Parse(r *http.Request) (SearchQuery, error) {
+
+	queryStr := r.URL.Query()
+
+	q.Query = strings.TrimSpace(queryStr.Get("q"))
+
+	typ := queryStr.Get("type")
+	if typ != "" {
+		q.Type = typ
+	}
+
+	lang := queryStr.Get("lang")
+	if lang != "" {
+		if !SearchLanguages[lang] {
+			return q, fmt.Errorf("unsupported lang %q", lang)
+		}
+		q.Language = lang
+	}
+
+	limit := queryStr.Get("limit")
+	if limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil {
+			return q, err
+		}
+		q.Limit = value
+	}
+	return q, nil
+}
+
+// parseTime reads an RFC 3339 timestamp or a date-only value. Values without
+// an offset are taken in loc.
+func parseTime(s string, loc *time.Location) (time.Time, bool, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, false, nil
+	}
+
+	if t, err := time.ParseInLocation(time.DateTime, s, loc); err == nil {
+		return t, false, nil
+	}
+
+	if t, err := time.ParseInLocation(time.DateOnly, s, loc); err == nil {
+		return t, true, nil
 	}
-	return t.Format(time.DateTime)
+	return time.Time{}, false, errors.New("must be an RFC 3339 timestamp (2006-01-02T15:04:05Z07:00) or a date (2006-01-02)")
 }
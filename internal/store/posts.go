@@ -4,56 +4,111 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"slices"
 
+	"com.github/jrovieri/golang/social/internal/event"
 	"github.com/lib/pq"
 )
 
 type Post struct {
-	ID        int64     `json:"id"`
-	Content   string    `json:"content"`
-	Title     string    `json:"title"`
-	UserID    int64     `json:"user_id"`
-	Tags      []string  `json:"tags"`
-	CreatedAt string    `json:"created_at"`
-	UpdatedAt string    `json:"updated_at"`
-	Version   int       `json:"version"`
-	Comments  []Comment `json:"comments"`
+	ID         int64     `json:"id"`
+	Content    string    `json:"content"`
+	Title      string    `json:"title"`
+	UserID     int64     `json:"user_id"`
+	Tags       []string  `json:"tags"`
+	Language   string    `json:"language"`
+	Visibility string    `json:"visibility"`
+	CreatedAt  string    `json:"created_at"`
+	UpdatedAt  string    `json:"updated_at"`
+	Version    int       `json:"version"`
+	Comments   []Comment `json:"comments"`
+	Mentions   []Mention `json:"mentions"`
+
+	CommentCount       int    `json:"comment_count"`
+	CommentsNextCursor string `json:"comments_next_cursor,omitempty"`
 }
 
 type PostWithMetadata struct {
 	Post
-	User         User `json:"user"`
-	CommentCount int  `json:"comment_count"`
+	User User `json:"user"`
+}
+
+// FeedPage is a page of the feed along with the cursors of the pages around
+// it. A nil cursor means there is no page in that direction.
+type FeedPage struct {
+	Posts []PostWithMetadata
+	Next  *Cursor
+	Prev  *Cursor
 }
 
 type PostStore struct {
-	db *sql.DB
+	db              *sql.DB
+	fanoutThreshold int
+	searchLanguage  string
+}
+
+// visibleTo is the condition under which the post p can be seen by the user
+// whose ID is in param: the post is public, or the user wrote it or follows
+// its author.
+func visibleTo(param string) string {
+	return `(p.visibility = 'public' OR p.user_id = ` + param + ` OR EXISTS (
+		SELECT 1 FROM followers vf WHERE vf.user_id = p.user_id AND vf.follower_id = ` + param + `
+	))`
 }
 
 func (s *PostStore) Create(ctx context.Context, p *Post) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
 
-	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
-	defer cancel()
+		p.Tags = NormalizeTags(p.Tags, p.Content)
+		if p.Language == "" {
+			p.Language = s.searchLanguage
+		}
+		if p.Visibility == "" {
+			p.Visibility = "public"
+		}
 
-	query := `INSERT INTO posts (content, title, user_id, tags) 
-		VALUES ($1, $2, $3, $4)
-		RETURNING id, created_at, updated_at`
-	err := s.db.QueryRowContext(
-		ctx,
-		query,
-		p.Content,
-		p.Title,
-		p.UserID,
-		pq.Array(p.Tags)).
-		Scan(
-			&p.ID,
-			&p.CreatedAt,
-			&p.UpdatedAt,
-		)
-	if err != nil {
-		return err
-	}
-	return nil
+		query := `INSERT INTO posts (content, title, user_id, tags, language, visibility) 
+			VALUES ($1, $2, $3, $4, $5::regconfig, $6)
+			RETURNING id, created_at, updated_at`
+		err := tx.QueryRowContext(
+			ctx,
+			query,
+			p.Content,
+			p.Title,
+			p.UserID,
+			pq.Array(p.Tags),
+			p.Language,
+			p.Visibility).
+			Scan(
+				&p.ID,
+				&p.CreatedAt,
+				&p.UpdatedAt,
+			)
+		if err != nil {
+			return err
+		}
+
+		if err := updateTagUsage(ctx, tx, nil, p.Tags); err != nil {
+			return err
+		}
+
+		if err := enqueueFanout(ctx, tx, p); err != nil {
+			return err
+		}
+
+		if err := enqueuePostDelivery(ctx, tx, p); err != nil {
+			return err
+		}
+
+		p.Mentions, err = syncMentions(ctx, tx, p.UserID, p.ID, nil, p.Content)
+		if err != nil {
+			return err
+		}
+
+		return event.Record(ctx, tx, AggregatePost, p.ID, EventPostCreated, newPostEvent(p))
+	})
 }
 
 func (s *PostStore) GetByID(ctx context.Context, id int64) (*Post, error) {
@@ -61,7 +116,7 @@ func (s *PostStore) GetByID(ctx context.Context, id int64) (*Post, error) {
 	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
 	defer cancel()
 
-	query := `SELECT id, user_id, title, content, tags, created_at, updated_at, version 
+	query := `SELECT id, user_id, title, content, tags, language::text, visibility, created_at, updated_at, version
 		FROM posts WHERE id = $1`
 
 	var post Post
@@ -71,6 +126,8 @@ func (s *PostStore) GetByID(ctx context.Context, id int64) (*Post, error) {
 		&post.Title,
 		&post.Content,
 		pq.Array(&post.Tags),
+		&post.Language,
+		&post.Visibility,
 		&post.CreatedAt,
 		&post.UpdatedAt,
 		&post.Version)
@@ -82,82 +139,245 @@ func (s *PostStore) GetByID(ctx context.Context, id int64) (*Post, error) {
 			return nil, err
 		}
 	}
+
+	mentions, err := getPostMentions(ctx, s.db, []int64{post.ID})
+	if err != nil {
+		return nil, err
+	}
+	post.Mentions = mentions[post.ID]
+
 	return &post, nil
 }
 
 func (s *PostStore) Update(ctx context.Context, post *Post) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
 
-	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
-	defer cancel()
+		post.Tags = NormalizeTags(post.Tags, post.Content)
 
-	query := `
-		UPDATE posts SET title = $1, content = $2, version = version + 1 
-			WHERE id = $3 AND version = $4 
-			RETURNING version
-	`
-	err := s.db.QueryRowContext(ctx, query, post.Title, post.Content, post.ID, post.Version).
-		Scan(&post.Version)
-	if err != nil {
-		switch {
-		case errors.Is(err, sql.ErrNoRows):
-			return ErrResourceNotFound
-		default:
+		query := `
+			WITH old AS (SELECT tags FROM posts WHERE id = $3 FOR UPDATE)
+			UPDATE posts SET title = $1, content = $2, tags = $5, visibility = $6, updated_at = NOW(), version = version + 1 
+				WHERE id = $3 AND version = $4 
+				RETURNING version, updated_at, (SELECT tags FROM old)
+		`
+
+		var oldTags []string
+		err := tx.QueryRowContext(ctx, query, post.Title, post.Content, post.ID, post.Version, pq.Array(post.Tags),
+			post.Visibility).
+			Scan(&post.Version, &post.UpdatedAt, pq.Array(&oldTags))
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrResourceNotFound
+			default:
+				return err
+			}
+		}
+
+		if err := updateTagUsage(ctx, tx, oldTags, post.Tags); err != nil {
 			return err
 		}
-	}
-	return nil
+
+		post.Mentions, err = syncMentions(ctx, tx, post.UserID, post.ID, nil, post.Content)
+		if err != nil {
+			return err
+		}
+
+		return event.Record(ctx, tx, AggregatePost, post.ID, EventPostUpdated, newPostEvent(post))
+	})
 }
 
 func (s *PostStore) Delete(ctx context.Context, postID int64) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		query := `DELETE FROM posts WHERE id = $1 RETURNING tags, user_id`
+
+		var tags []string
+		var userID int64
+		err := tx.QueryRowContext(ctx, query, postID).Scan(pq.Array(&tags), &userID)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrResourceNotFound
+			default:
+				return err
+			}
+		}
+
+		if err := updateTagUsage(ctx, tx, tags, nil); err != nil {
+			return err
+		}
+
+		return event.Record(ctx, tx, AggregatePost, postID, EventPostDeleted, PostEvent{ID: postID, UserID: userID})
+	})
+}
+
+// GetUserFeed returns a page of the user feed. When the query carries a cursor
+// the page is fetched with keyset pagination and the offset is ignored.
+func (s *PostStore) GetUserFeed(ctx context.Context, id int64, fq PaginatedFeedQuery) (*FeedPage, error) {
 
 	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
 	defer cancel()
 
-	query := `DELETE FROM posts WHERE id = $1`
-	res, err := s.db.ExecContext(ctx, query, postID)
+	ks, err := newFeedKeyset(fq)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	rows, err := res.RowsAffected()
-	if err != nil {
-		return err
-	}
+	// Filters shared by both sources of the feed. Timeline entries carry the
+	// creation date of their post, so the keyset is compared on the timeline
+	// columns there, which its index covers, and on the post columns for the
+	// posts pulled from big accounts. Posts of users on either side of a block
+	// with the reader are left out, as they can still come through a followed
+	// tag.
+	filters := visibleTo("$1") + ` AND ` + notBlocked("p.user_id", "$1")
 
-	if rows == 0 {
-		return ErrResourceNotFound
-	}
-	return nil
+	// The feed is read from the materialized timeline of the user, merged with
+	// the posts of followed accounts that are too big to be fanned out.
+	query := `
+		WITH entries AS (
+			(
+				SELECT p.id, p.created_at FROM timelines t
+					JOIN posts p ON p.id = t.post_id
+				WHERE t.user_id = $1 AND ` + feedFilters(ks, "t.created_at", "t.post_id") + ` AND ` + filters + `
+				ORDER BY t.created_at ` + ks.order + `, t.post_id ` + ks.order + `
+				LIMIT $2 + $3
+			)
+			UNION
+			(
+				SELECT p.id, p.created_at FROM posts p
+					JOIN users a ON a.id = p.user_id
+					JOIN followers f ON f.user_id = p.user_id AND f.follower_id = $1
+				WHERE a.followers_count >= $10 AND ` + feedFilters(ks, "p.created_at", "p.id") + ` AND ` + filters + `
+				ORDER BY p.created_at ` + ks.order + `, p.id ` + ks.order + `
+				LIMIT $2 + $3
+			)
+		)
+		SELECT p.id, p.user_id, p.title, p.content, p.created_at, p.updated_at, p.version, p.tags
+			, u.id, u.username
+			, (SELECT COUNT(*) FROM comments c WHERE c.post_id = p.id) AS comments_count 
+		FROM entries e
+			JOIN posts p ON p.id = e.id
+			JOIN users u ON p.user_id = u.id
+		ORDER BY e.created_at ` + ks.order + `, e.id ` + ks.order + `
+		LIMIT $2 OFFSET $3
+	`
+
+	return s.queryFeedPage(ctx, ks, fq, query, id, fq.Limit+1, ks.offset, fq.Search, pq.Array(fq.Tags),
+		ks.key, ks.id, fq.Since, fq.Until, s.fanoutThreshold)
+}
+
+// GetUserPosts returns a page of the posts written by authorID that the
+// viewer is allowed to see, newest first unless fq asks otherwise. Readers who
+// are not logged in use AnonymousUserID and only get public posts.
+func (s *PostStore) GetUserPosts(ctx context.Context, authorID, viewerID int64, fq PaginatedFeedQuery) (*FeedPage, error) {
+	return s.getPostsPage(ctx, `p.user_id = $10 AND `+visibleTo("$1"), viewerID, fq, authorID)
 }
 
-func (s *PostStore) GetUserFeed(ctx context.Context, id int64, fq PaginatedFeedQuery) ([]PostWithMetadata, error) {
+// GetPublicTimeline returns a page of the public posts of everyone, leaving
+// out the ones written by users on either side of a block with the viewer.
+func (s *PostStore) GetPublicTimeline(ctx context.Context, viewerID int64, fq PaginatedFeedQuery) (*FeedPage, error) {
+	return s.getPostsPage(ctx, `p.visibility = 'public'`, viewerID, fq)
+}
+
+// getPostsPage pages through the posts matching cond with the filters and
+// cursor of fq. cond can refer to the viewer as $1 and to args from $10 on.
+func (s *PostStore) getPostsPage(ctx context.Context, cond string, viewerID int64, fq PaginatedFeedQuery, args ...any) (*FeedPage, error) {
 
 	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
 	defer cancel()
 
+	ks, err := newFeedKeyset(fq)
+	if err != nil {
+		return nil, err
+	}
+
 	query := `
-		SELECT p.id, p.user_id, p.title, p.content, p.created_at, p.version, p.tags
+		SELECT p.id, p.user_id, p.title, p.content, p.created_at, p.updated_at, p.version, p.tags
 			, u.id, u.username
-			, COUNT(c.id) AS comments_count 
+			, (SELECT COUNT(*) FROM comments c WHERE c.post_id = p.id) AS comments_count
 		FROM posts p
-			LEFT JOIN comments c ON c.post_id = p.id
-			LEFT JOIN users u ON p.user_id = u.id
-			JOIN followers f ON f.follower_id = p.user_id OR p.user_id = $1
-		WHERE (f.user_id = $1 OR u.id = $1)
-			AND (p.title ILIKE '%' || $4 || '%' OR p.content ILIKE '%' || $4 || '%') 
-			AND (p.tags @> $5 OR $5 IS NULL)
-		GROUP BY p.id, u.username, u.id	
-		ORDER BY p.created_at ` + fq.Sort + ` 
+			JOIN users u ON u.id = p.user_id
+		WHERE ` + cond + ` AND ` + feedFilters(ks, "p.created_at", "p.id") + `
+			AND NOT EXISTS (
+				SELECT 1 FROM user_blocks b
+				WHERE (b.user_id = $1 AND b.blocked_id = p.user_id)
+					OR (b.user_id = p.user_id AND b.blocked_id = $1)
+			)
+		ORDER BY p.created_at ` + ks.order + `, p.id ` + ks.order + `
 		LIMIT $2 OFFSET $3
 	`
 
-	rows, err := s.db.QueryContext(ctx, query, id, fq.Limit, fq.Offset, fq.Search, pq.Array(fq.Tags))
+	args = append([]any{viewerID, fq.Limit + 1, ks.offset, fq.Search, pq.Array(fq.Tags),
+		ks.key, ks.id, fq.Since, fq.Until}, args...)
+	return s.queryFeedPage(ctx, ks, fq, query, args...)
+}
+
+// feedKeyset holds where a page of posts sorted by creation date starts and
+// in which direction it is read.
+type feedKeyset struct {
+	key       any
+	id        int64
+	offset    int
+	backwards bool
+	order     string
+	op        string
+}
+
+func newFeedKeyset(fq PaginatedFeedQuery) (*feedKeyset, error) {
+	ks := &feedKeyset{offset: fq.Offset}
+	if fq.Cursor != nil {
+		if fq.Cursor.Sort != fq.Sort {
+			return nil, ErrInvalidCursor
+		}
+
+		key, err := fq.Cursor.timeKey()
+		if err != nil {
+			return nil, err
+		}
+		ks.key, ks.id = key, fq.Cursor.ID
+		ks.offset = 0
+	}
+
+	// Walking back to a previous page flips the ordering; rows are put back in
+	// the requested order once fetched.
+	ks.backwards = fq.Cursor != nil && fq.Cursor.Prev
+	ks.order, ks.op = "DESC", "<"
+	if (fq.Sort == "asc") != ks.backwards {
+		ks.order, ks.op = "ASC", ">"
+	}
+	return ks, nil
+}
+
+// feedFilters is the condition applying the search ($4), tags ($5), keyset
+// ($6, $7) and date range ($8, $9) of a feed query to the post p. The keyset
+// and date range are compared on the createdAt and id columns, so rows read
+// from another table than posts can use its own index.
+func feedFilters(ks *feedKeyset, createdAt, id string) string {
+	return `
+		($4 = '' OR p.search_vector @@ websearch_to_tsquery(p.language, $4))
+		AND (p.tags @> $5 OR $5 IS NULL)
+		AND ($6::timestamptz IS NULL OR (` + createdAt + `, ` + id + `) ` + ks.op + ` ($6::timestamptz, $7::bigint))
+		AND ($8::timestamptz IS NULL OR ` + createdAt + ` >= $8)
+		AND ($9::timestamptz IS NULL OR ` + createdAt + ` < $9)
+	`
+}
+
+// queryFeedPage runs a query fetching one more post than the page holds, so
+// it can tell whether there is a next page, and builds the page cursors.
+func (s *PostStore) queryFeedPage(ctx context.Context, ks *feedKeyset, fq PaginatedFeedQuery, query string, args ...any) (*FeedPage, error) {
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var feed []PostWithMetadata
+	feed := []PostWithMetadata{}
 
 	for rows.Next() {
 		var p PostWithMetadata
@@ -167,6 +387,7 @@ func (s *PostStore) GetUserFeed(ctx context.Context, id int64, fq PaginatedFeedQ
 			&p.Title,
 			&p.Content,
 			&p.CreatedAt,
+			&p.UpdatedAt,
 			&p.Version,
 			pq.Array(&p.Tags),
 			&p.User.ID,
@@ -177,21 +398,44 @@ func (s *PostStore) GetUserFeed(ctx context.Context, id int64, fq PaginatedFeedQ
 		}
 		feed = append(feed, p)
 	}
-	return feed, nil
-}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	hasMore := len(feed) > fq.Limit
+	if hasMore {
+		feed = feed[:fq.Limit]
+	}
+
+	if ks.backwards {
+		slices.Reverse(feed)
+	}
+
+	page := &FeedPage{Posts: feed}
+	if len(feed) > 0 {
+		first, last := feed[0], feed[len(feed)-1]
 
-func getFilterByDateString(fq PaginatedFeedQuery) string {
-	queryStr := " AND "
-	if fq.Since != "" && fq.Until != "" {
-		queryStr += " p.created_at BETWEEN $1 AND $2 "
+		if hasMore || ks.backwards {
+			page.Next = &Cursor{Sort: fq.Sort, Key: last.CreatedAt, ID: last.ID}
+		}
+
+		if (ks.backwards && hasMore) || (!ks.backwards && (fq.Cursor != nil || ks.offset > 0)) {
+			page.Prev = &Cursor{Sort: fq.Sort, Key: first.CreatedAt, ID: first.ID, Prev: true}
+		}
 	}
 
-	if fq.Since != "" {
-		queryStr += " p.created_at >= $1 "
+	ids := make([]int64, len(feed))
+	for i, p := range feed {
+		ids[i] = p.ID
+	}
+
+	mentions, err := getPostMentions(ctx, s.db, ids)
+	if err != nil {
+		return nil, err
 	}
 
-	if fq.Until != "" {
-		queryStr += " p.created_at >= $1 "
+	for i := range feed {
+		feed[i].Mentions = mentions[feed[i].ID]
 	}
-	return ""
+	return page, nil
 }
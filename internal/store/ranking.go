@@ -0,0 +1,215 @@
+package store
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// RankingCandidateWindow bounds how old the posts considered for the
+	// ranked feed can be.
+	RankingCandidateWindow = 7 * 24 * time.Hour
+	// RankingAffinityWindow is how far back the interactions of the viewer
+	// with an author are counted.
+	RankingAffinityWindow = 30 * 24 * time.Hour
+)
+
+// RankingWeights tunes how the ranked feed scores a post:
+//
+//	score = Recency * 0.5^(age / HalfLife)
+//	      + Affinity * ln(1 + viewer interactions with the author)
+//	      + Engagement * ln(1 + likes + 2*comments + reactions to comments)
+//
+// HalfLife must be positive.
+type RankingWeights struct {
+	Recency    float64
+	Affinity   float64
+	Engagement float64
+	HalfLife   time.Duration
+}
+
+// GetRankedFeed returns a page of the "For You" feed. Candidates come from the
+// user timeline, the big accounts they follow and the trending posts of the
+// day. Every page of a ranking is scored as of the same instant, carried in the
+// cursor along with the score and ID of the post at the edge of the page, so
+// posts keep their place while the user pages through it.
+func (s *PostStore) GetRankedFeed(ctx context.Context, id int64, fq PaginatedFeedQuery, w RankingWeights) (*FeedPage, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	asOf := time.Now().UTC()
+	var key *float64
+	var keyID int64
+	if fq.Cursor != nil {
+		if fq.Cursor.Sort != "ranked" {
+			return nil, ErrInvalidCursor
+		}
+
+		t, err := time.Parse(time.RFC3339Nano, fq.Cursor.At)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+
+		score, err := fq.Cursor.floatKey()
+		if err != nil {
+			return nil, err
+		}
+		asOf, key, keyID = t, &score, fq.Cursor.ID
+	}
+
+	// Walking back to a previous page flips the ordering; rows are put back in
+	// the requested order once fetched.
+	backwards := fq.Cursor != nil && fq.Cursor.Prev
+	order, op := "DESC", "<"
+	if backwards {
+		order, op = "ASC", ">"
+	}
+
+	// Everything the score depends on is read as of $8, so the score of a
+	// post is the same on every page
+	query := `
+		WITH candidates AS (
+			SELECT t.post_id AS id FROM timelines t
+			WHERE t.user_id = $1 AND t.created_at > $8::timestamptz - $14 * INTERVAL '1 second'
+			UNION
+			SELECT p.id FROM posts p
+				JOIN users a ON a.id = p.user_id
+				JOIN followers f ON f.user_id = p.user_id AND f.follower_id = $1
+			WHERE a.followers_count >= $9
+				AND p.created_at > $8::timestamptz - $14 * INTERVAL '1 second'
+			UNION
+			SELECT tp.post_id FROM trending_posts tp WHERE tp.time_window = 'day'
+		), affinity AS (
+			SELECT i.author_id, COUNT(*) AS interactions FROM (
+				SELECT p.user_id AS author_id FROM comments c
+					JOIN posts p ON p.id = c.post_id
+				WHERE c.user_id = $1
+					AND c.created_at > $8::timestamptz - $15 * INTERVAL '1 second' AND c.created_at <= $8
+				UNION ALL
+				SELECT c.user_id FROM comment_reactions r
+					JOIN comments c ON c.id = r.comment_id
+				WHERE r.user_id = $1
+					AND r.created_at > $8::timestamptz - $15 * INTERVAL '1 second' AND r.created_at <= $8
+			) i
+			GROUP BY i.author_id
+		), scored AS (
+			SELECT p.id
+				, $10 * EXP(-LN(2) * EXTRACT(EPOCH FROM $8::timestamptz - p.created_at) / $13)
+				+ $11 * LN(1 + COALESCE(a.interactions, 0))
+				+ $12 * LN(1
+					+ (SELECT COUNT(*) FROM remote_reactions rr WHERE rr.post_id = p.id AND rr.created_at <= $8)
+					+ (SELECT 2 * COUNT(*) FROM comments c WHERE c.post_id = p.id AND c.created_at <= $8)
+					+ (SELECT COUNT(*) FROM comment_reactions r
+						JOIN comments c ON c.id = r.comment_id
+						WHERE c.post_id = p.id AND r.created_at <= $8)) AS score
+			FROM candidates cd
+				JOIN posts p ON p.id = cd.id
+				LEFT JOIN affinity a ON a.author_id = p.user_id
+			WHERE p.created_at <= $8
+				AND ($4 = '' OR p.search_vector @@ websearch_to_tsquery(p.language, $4))
+				AND (p.tags @> $5 OR $5 IS NULL)
+				AND ($6::timestamptz IS NULL OR p.created_at >= $6)
+				AND ($7::timestamptz IS NULL OR p.created_at < $7)
+				AND ` + visibleTo("$1") + `
+				AND NOT EXISTS (
+					SELECT 1 FROM user_blocks b
+					WHERE (b.user_id = $1 AND b.blocked_id = p.user_id)
+						OR (b.user_id = p.user_id AND b.blocked_id = $1)
+				)
+		)
+		SELECT p.id, p.user_id, p.title, p.content, p.created_at, p.updated_at, p.version, p.tags
+			, u.id, u.username
+			, (SELECT COUNT(*) FROM comments c WHERE c.post_id = p.id) AS comments_count
+			, sc.score
+		FROM scored sc
+			JOIN posts p ON p.id = sc.id
+			JOIN users u ON u.id = p.user_id
+		WHERE $3::float8 IS NULL OR (sc.score, p.id) ` + op + ` ($3::float8, $16::bigint)
+		ORDER BY sc.score ` + order + `, p.id ` + order + `
+		LIMIT $2
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, id, fq.Limit+1, key, fq.Search, pq.Array(fq.Tags),
+		fq.Since, fq.Until, asOf, s.fanoutThreshold, w.Recency, w.Affinity, w.Engagement,
+		w.HalfLife.Seconds(), RankingCandidateWindow.Seconds(), RankingAffinityWindow.Seconds(), keyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	feed := []PostWithMetadata{}
+	scores := []float64{}
+	for rows.Next() {
+		var p PostWithMetadata
+		var score float64
+
+		err := rows.Scan(&p.ID,
+			&p.UserID,
+			&p.Title,
+			&p.Content,
+			&p.CreatedAt,
+			&p.UpdatedAt,
+			&p.Version,
+			pq.Array(&p.Tags),
+			&p.User.ID,
+			&p.User.Username,
+			&p.CommentCount,
+			&score)
+		if err != nil {
+			return nil, err
+		}
+		feed = append(feed, p)
+		scores = append(scores, score)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	hasMore := len(feed) > fq.Limit
+	if hasMore {
+		feed, scores = feed[:fq.Limit], scores[:fq.Limit]
+	}
+
+	if backwards {
+		slices.Reverse(feed)
+		slices.Reverse(scores)
+	}
+
+	page := &FeedPage{}
+	at := asOf.Format(time.RFC3339Nano)
+	cursor := func(i int, prev bool) *Cursor {
+		key := strconv.FormatFloat(scores[i], 'g', -1, 64)
+		return &Cursor{Sort: "ranked", Key: key, ID: feed[i].ID, At: at, Prev: prev}
+	}
+
+	if len(feed) > 0 {
+		if hasMore || backwards {
+			page.Next = cursor(len(feed)-1, false)
+		}
+
+		if (backwards && hasMore) || (!backwards && fq.Cursor != nil) {
+			page.Prev = cursor(0, true)
+		}
+	}
+
+	ids := make([]int64, len(feed))
+	for i, p := range feed {
+		ids[i] = p.ID
+	}
+
+	mentions, err := getPostMentions(ctx, s.db, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range feed {
+		feed[i].Mentions = mentions[feed[i].ID]
+	}
+	page.Posts = feed
+	return page, nil
+}
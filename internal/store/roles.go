@@ -0,0 +1,41 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+)
+
+type Role struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	Level       int    `json:"level"`
+	Description string `json:"description"`
+}
+
+type RoleStore struct {
+	db *sql.DB
+}
+
+func (s *RoleStore) GetByName(ctx context.Context, name string) (*Role, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `SELECT id, name, level, COALESCE(description, '') FROM roles WHERE name = $1`
+
+	var role Role
+	err := s.db.QueryRowContext(ctx, query, name).Scan(
+		&role.ID,
+		&role.Name,
+		&role.Level,
+		&role.Description)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			return nil, ErrResourceNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &role, nil
+}
@@ -0,0 +1,311 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+// DefaultSearchLanguage is the search language of the stores built without
+// one. See Config.
+const DefaultSearchLanguage = "english"
+
+// SearchLanguages lists the text search configurations posts can be indexed
+// with and searches can be parsed with.
+var SearchLanguages = map[string]bool{
+	"simple":     true,
+	"english":    true,
+	"portuguese": true,
+	"spanish":    true,
+	"french":     true,
+	"german":     true,
+	"italian":    true,
+}
+
+// SearchHeadlineOptions tells ts_headline how to build the snippets of the
+// search results. Matches are wrapped in <mark> tags.
+const SearchHeadlineOptions = "StartSel=<mark>, StopSel=</mark>, MaxWords=35, MinWords=15, MaxFragments=2"
+
+type SearchResult struct {
+	Type     string            `json:"type"`
+	Rank     float64           `json:"rank"`
+	Headline string            `json:"headline"`
+	Post     *PostWithMetadata `json:"post,omitempty"`
+	Comment  *Comment          `json:"comment,omitempty"`
+	User     *User             `json:"user,omitempty"`
+}
+
+type SearchStore struct {
+	db *sql.DB
+}
+
+// Search returns a page of the posts, comments or users matching the query,
+// best matches first, along with the cursor of the next page. Quoted phrases,
+// OR and -exclusions follow the websearch syntax of Postgres, and terms ending
+// in * match as prefixes. Users are also matched by trigram similarity so typos
+// in usernames still find them. Content from users on either side of a block
+// with the viewer is left out.
+func (s *SearchStore) Search(ctx context.Context, viewerID int64, q SearchQuery) ([]SearchResult, *Cursor, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	offset := 0
+	if q.Cursor != nil {
+		if q.Cursor.Sort != "search" || q.Cursor.Key != q.Type {
+			return nil, nil, ErrInvalidCursor
+		}
+		offset = q.Cursor.Offset
+	}
+
+	web, prefix := splitSearchQuery(q.Query)
+
+	var results []SearchResult
+	var err error
+	switch q.Type {
+	case "posts":
+		results, err = s.searchPosts(ctx, viewerID, q, web, prefix, offset)
+	case "comments":
+		results, err = s.searchComments(ctx, viewerID, q, web, prefix, offset)
+	case "users":
+		results, err = s.searchUsers(ctx, viewerID, q, web, prefix, offset)
+	default:
+		return nil, nil, ErrInvalidSort
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var next *Cursor
+	if len(results) > q.Limit {
+		results = results[:q.Limit]
+		next = &Cursor{Sort: "search", Key: q.Type, Offset: offset + q.Limit}
+	}
+	return results, next, nil
+}
+
+func (s *SearchStore) searchPosts(ctx context.Context, viewerID int64, q SearchQuery, web, prefix string, offset int) ([]SearchResult, error) {
+	query := `
+		WITH q AS (
+			SELECT websearch_to_tsquery($1::regconfig, $2) && to_tsquery($1::regconfig, $3) AS query
+		)
+		SELECT p.id, p.user_id, p.title, p.content, p.created_at, p.version, p.tags, p.language::text
+			, u.id, u.username
+			, (SELECT COUNT(*) FROM comments c WHERE c.post_id = p.id) AS comments_count
+			, ts_rank_cd(p.search_vector, q.query) AS rank
+			, ts_headline(p.language, p.title || ' ' || p.content, q.query, $7)
+		FROM posts p
+			JOIN users u ON u.id = p.user_id
+			CROSS JOIN q
+		WHERE p.search_vector @@ q.query
+			AND ` + visibleTo("$4") + `
+			AND NOT EXISTS (
+				SELECT 1 FROM user_blocks b
+				WHERE (b.user_id = $4 AND b.blocked_id = p.user_id)
+					OR (b.user_id = p.user_id AND b.blocked_id = $4)
+			)
+		ORDER BY rank DESC, p.id DESC
+		LIMIT $5 OFFSET $6
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, q.Language, web, prefix, viewerID, q.Limit+1, offset, SearchHeadlineOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		r := SearchResult{Type: "post", Post: &PostWithMetadata{}}
+		p := r.Post
+
+		err := rows.Scan(&p.ID,
+			&p.UserID,
+			&p.Title,
+			&p.Content,
+			&p.CreatedAt,
+			&p.Version,
+			pq.Array(&p.Tags),
+			&p.Language,
+			&p.User.ID,
+			&p.User.Username,
+			&p.CommentCount,
+			&r.Rank,
+			&r.Headline)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ids := make([]int64, len(results))
+	for i, r := range results {
+		ids[i] = r.Post.ID
+	}
+
+	mentions, err := getPostMentions(ctx, s.db, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range results {
+		r.Post.Mentions = mentions[r.Post.ID]
+	}
+	return results, nil
+}
+
+func (s *SearchStore) searchComments(ctx context.Context, viewerID int64, q SearchQuery, web, prefix string, offset int) ([]SearchResult, error) {
+	query := `
+		WITH q AS (
+			SELECT websearch_to_tsquery($1::regconfig, $2) && to_tsquery($1::regconfig, $3) AS query
+		)
+		SELECT c.id, c.post_id, c.user_id, c.parent_id, c.content, c.created_at, c.updated_at
+			, c.version, c.reactions_count, u.id, u.username
+			, ts_rank_cd(c.search_vector, q.query) AS rank
+			, ts_headline(p.language, c.content, q.query, $7)
+		FROM comments c
+			JOIN posts p ON p.id = c.post_id
+			JOIN users u ON u.id = c.user_id
+			CROSS JOIN q
+		WHERE c.search_vector @@ q.query AND c.deleted_at IS NULL
+			AND ` + visibleTo("$4") + `
+			AND NOT EXISTS (
+				SELECT 1 FROM user_blocks b
+				WHERE (b.user_id = $4 AND b.blocked_id IN (c.user_id, p.user_id))
+					OR (b.user_id IN (c.user_id, p.user_id) AND b.blocked_id = $4)
+			)
+		ORDER BY rank DESC, c.id DESC
+		LIMIT $5 OFFSET $6
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, q.Language, web, prefix, viewerID, q.Limit+1, offset, SearchHeadlineOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		r := SearchResult{Type: "comment", Comment: &Comment{}}
+		c := r.Comment
+
+		err := rows.Scan(&c.ID,
+			&c.PostID,
+			&c.UserID,
+			&c.ParentID,
+			&c.Content,
+			&c.CreatedAt,
+			&c.EditedAt,
+			&c.Version,
+			&c.ReactionsCount,
+			&c.User.ID,
+			&c.User.Username,
+			&r.Rank,
+			&r.Headline)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ids := make([]int64, len(results))
+	for i, r := range results {
+		ids[i] = r.Comment.ID
+	}
+
+	mentions, err := getCommentMentions(ctx, s.db, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range results {
+		r.Comment.Mentions = mentions[r.Comment.ID]
+	}
+	return results, nil
+}
+
+// searchUsers matches usernames, which are indexed with the simple
+// configuration since they are not words of any language.
+func (s *SearchStore) searchUsers(ctx context.Context, viewerID int64, q SearchQuery, web, prefix string, offset int) ([]SearchResult, error) {
+	query := `
+		WITH q AS (
+			SELECT websearch_to_tsquery('simple', $1) && to_tsquery('simple', $2) AS query
+		)
+		SELECT u.id, u.username, u.created_at
+			, GREATEST(ts_rank_cd(u.search_vector, q.query), similarity(u.username, $3)) AS rank
+			, ts_headline('simple', u.username, q.query, $7)
+		FROM users u
+			CROSS JOIN q
+		WHERE (u.search_vector @@ q.query OR u.username % $3)
+			AND u.is_active
+			AND NOT EXISTS (
+				SELECT 1 FROM user_blocks b
+				WHERE (b.user_id = $4 AND b.blocked_id = u.id)
+					OR (b.user_id = u.id AND b.blocked_id = $4)
+			)
+		ORDER BY rank DESC, u.id DESC
+		LIMIT $5 OFFSET $6
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, web, prefix, q.Query, viewerID, q.Limit+1, offset, SearchHeadlineOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		r := SearchResult{Type: "user", User: &User{}}
+
+		err := rows.Scan(&r.User.ID, &r.User.Username, &r.User.CreatedAt, &r.Rank, &r.Headline)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// splitSearchQuery takes the terms ending in * out of a search, since the
+// websearch syntax has no prefix matching, and turns them into a to_tsquery
+// expression. Terms inside quoted phrases are left alone.
+func splitSearchQuery(q string) (string, string) {
+	var web, prefixes []string
+
+	quoted := false
+	for _, field := range strings.Fields(q) {
+		starts := quoted
+		quoted = quoted != (strings.Count(field, `"`)%2 == 1)
+
+		if starts || strings.Contains(field, `"`) || !strings.HasSuffix(field, "*") {
+			web = append(web, field)
+			continue
+		}
+
+		negated := strings.HasPrefix(field, "-")
+		term := strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				return r
+			}
+			return -1
+		}, field)
+		if term == "" {
+			continue
+		}
+
+		if negated {
+			term = "!" + term
+		}
+		prefixes = append(prefixes, term+":*")
+	}
+	return strings.Join(web, " "), strings.Join(prefixes, " & ")
+}
@@ -5,11 +5,16 @@ import (
 	"database/sql"
 	"errors"
 	"time"
+
+	"com.github/jrovieri/golang/social/internal/event"
 )
 
 var (
 	ErrResourceNotFound = errors.New("resource not found")
 	ErrConflict         = errors.New("resource alreay exists")
+	ErrInvalidCursor    = errors.New("invalid cursor")
+	ErrInvalidSort      = errors.New("invalid sort")
+	ErrInvalidWindow    = errors.New("invalid window")
 	QueryTimeoutDuraton = 5 * time.Second
 )
 
@@ -19,29 +24,168 @@ type Storage struct {
 		GetByID(context.Context, int64) (*Post, error)
 		Update(context.Context, *Post) error
 		Delete(context.Context, int64) error
-		GetUserFeed(context.Context, int64, PaginatedFeedQuery) ([]PostWithMetadata, error)
+		GetUserFeed(context.Context, int64, PaginatedFeedQuery) (*FeedPage, error)
+		GetRankedFeed(context.Context, int64, PaginatedFeedQuery, RankingWeights) (*FeedPage, error)
+		GetUserPosts(context.Context, int64, int64, PaginatedFeedQuery) (*FeedPage, error)
+		GetPublicTimeline(context.Context, int64, PaginatedFeedQuery) (*FeedPage, error)
 	}
 	Users interface {
 		Create(context.Context, *sql.Tx, *User) error
 		GetByID(context.Context, int64) (*User, error)
 		GetByEmail(context.Context, string) (*User, error)
+		GetByUsername(context.Context, string) (*User, error)
 		Follow(context.Context, int64, int64) error
 		UnFollow(context.Context, int64, int64) error
-		CreateAndInvite(context.Context, *User, string, time.Duration) error
+		Block(context.Context, int64, int64) error
+		UnBlock(context.Context, int64, int64) error
+		IsBlocked(context.Context, int64, int64) (bool, error)
+		IsFollowing(context.Context, int64, int64) (bool, error)
+		CreateAndInvite(context.Context, *User, string, time.Duration, *OutboundEmail) error
 		Activate(context.Context, string) error
 		Delete(context.Context, int64) error
+		DeleteExpiredInvitations(context.Context) (int64, error)
 	}
 	Comments interface {
-		GetByPostID(context.Context, int64) ([]Comment, error)
+		GetByPostID(context.Context, int64, PaginatedCommentQuery) ([]Comment, *Cursor, error)
+		CountByPostID(context.Context, int64) (int, error)
 		Create(context.Context, *Comment) (*Comment, error)
+		GetByID(context.Context, int64) (*Comment, error)
+		Update(context.Context, *Comment) error
+		Delete(context.Context, int64) error
+		React(context.Context, int64, int64) error
+		UnReact(context.Context, int64, int64) error
+	}
+	Roles interface {
+		GetByName(context.Context, string) (*Role, error)
+	}
+	Mentions interface {
+		GetMentionedPosts(context.Context, int64, PaginatedFeedQuery) ([]PostWithMetadata, error)
+	}
+	Tags interface {
+		Search(context.Context, string, int) ([]Tag, error)
+		GetPosts(context.Context, string, int64, PaginatedFeedQuery) ([]PostWithMetadata, error)
+		Follow(context.Context, string, int64) error
+		UnFollow(context.Context, string, int64) error
+	}
+	Timelines interface {
+		Fanout(context.Context, int) (int, error)
+	}
+	Trending interface {
+		Recompute(context.Context, string) error
+		GetTags(context.Context, string, int) ([]TrendingTag, error)
+		GetPosts(context.Context, string, int) ([]TrendingPost, error)
+	}
+	Suggestions interface {
+		Get(context.Context, int64, int) ([]Suggestion, error)
+		EnqueueStale(context.Context, time.Duration) error
+		Refresh(context.Context, int) (int, error)
+	}
+	ActivityPub interface {
+		GetKey(context.Context, int64) (*ActorKey, error)
+		SaveKey(context.Context, *ActorKey) (*ActorKey, error)
+		GetRemoteActorByKeyID(context.Context, string) (*RemoteActor, error)
+		SaveRemoteActor(context.Context, *RemoteActor) error
+		AddRemoteFollower(context.Context, int64, int64, string) error
+		RemoveRemoteFollower(context.Context, int64, int64, string) error
+		CountRemoteFollowers(context.Context, int64) (int, error)
+		AddRemoteReaction(context.Context, int64, int64, string) error
+		RemoveRemoteReaction(context.Context, int64, string) error
+		AddRemoteReply(context.Context, int64, int64, string, string) error
+		EnqueueDelivery(context.Context, int64, string, []byte) error
+		ClaimDeliveries(context.Context, int) ([]ActivityDelivery, error)
+		MarkDelivered(context.Context, int64) error
+		MarkFailed(context.Context, *ActivityDelivery, error) error
+		PruneDeliveries(context.Context, time.Duration) (int64, error)
+	}
+	Notifications interface {
+		GetByUserID(context.Context, int64, PaginatedNotificationQuery) ([]Notification, *Cursor, error)
+		CountUnread(context.Context, int64) (int, error)
+		MarkRead(context.Context, int64, int64) error
+		MarkAllRead(context.Context, int64) error
 	}
+	Streams interface {
+		GetEvents(context.Context, int64, int64, int) ([]StreamEvent, error)
+		LatestEventID(context.Context, int64) (int64, error)
+		Prune(context.Context, time.Duration) error
+	}
+	Webhooks interface {
+		Create(context.Context, *Webhook) error
+		GetByID(context.Context, int64) (*Webhook, error)
+		GetByUserID(context.Context, int64) ([]Webhook, error)
+		Update(context.Context, *Webhook) error
+		Delete(context.Context, int64) error
+		GetDeliveries(context.Context, int64, PaginatedDeliveryQuery) ([]WebhookDelivery, *Cursor, error)
+		Redeliver(context.Context, int64, int64) (*WebhookDelivery, error)
+		ClaimDeliveries(context.Context, int) ([]WebhookDelivery, error)
+		MarkDelivered(context.Context, int64, int) error
+		MarkFailed(context.Context, *WebhookDelivery, int, error) error
+		PruneDeliveries(context.Context, time.Duration) (int64, error)
+		EnqueueEvent(context.Context, event.Event) error
+	}
+	Conversations interface {
+		Create(context.Context, int64, []int64, *string) (*Conversation, bool, error)
+		GetByID(context.Context, int64, int64) (*Conversation, error)
+		GetByUserID(context.Context, int64, PaginatedConversationQuery) ([]Conversation, *Cursor, error)
+		GetMessages(context.Context, int64, int64, PaginatedMessageQuery) ([]Message, *Cursor, error)
+		Send(context.Context, *Message) error
+		MarkRead(context.Context, int64, int64, int64) error
+		GetMessagePolicy(context.Context, int64) (string, error)
+		SetMessagePolicy(context.Context, int64, string) error
+	}
+	EmailPreferences interface {
+		Get(context.Context, int64) (map[string]string, error)
+		Update(context.Context, int64, map[string]string) error
+		Unsubscribe(context.Context, int64, string) error
+		GetLocale(context.Context, int64) (string, error)
+		SetLocale(context.Context, int64, string) error
+		ClaimInstant(context.Context, int, ComposeEmail) (int, error)
+		ClaimDigests(context.Context, time.Duration, int, ComposeEmail) (int, error)
+	}
+	EmailOutbox interface {
+		GetPending(context.Context, int64) (*OutboundEmail, error)
+		MarkSent(context.Context, int64) error
+		MarkFailed(context.Context, int64, error, bool) error
+		Prune(context.Context, time.Duration) (int64, error)
+	}
+	Counters interface {
+		Reconcile(context.Context) (int64, error)
+	}
+	Search interface {
+		Search(context.Context, int64, SearchQuery) ([]SearchResult, *Cursor, error)
+	}
+}
+
+// Config tunes the stores.
+type Config struct {
+	// FanoutThreshold is the number of followers above which the posts of a
+	// user are no longer copied into the timelines of their followers. Those
+	// posts are pulled into the feed at read time instead.
+	FanoutThreshold int
+	// SearchLanguage is the text search configuration posts created without
+	// a language are indexed with. It must be one of SearchLanguages.
+	SearchLanguage string
 }
 
-func NewStorage(db *sql.DB) Storage {
+func NewStorage(db *sql.DB, cfg Config) Storage {
 	return Storage{
-		Posts:    &PostStore{db},
-		Users:    &UserStore{db},
-		Comments: &CommentStore{db},
+		Posts:            &PostStore{db: db, fanoutThreshold: cfg.FanoutThreshold, searchLanguage: cfg.SearchLanguage},
+		Users:            &UserStore{db: db, fanoutThreshold: cfg.FanoutThreshold},
+		Comments:         &CommentStore{db},
+		Roles:            &RoleStore{db},
+		Mentions:         &MentionStore{db},
+		Tags:             &TagStore{db},
+		Trending:         &TrendingStore{db},
+		Timelines:        &TimelineStore{db: db, fanoutThreshold: cfg.FanoutThreshold},
+		Search:           &SearchStore{db},
+		Suggestions:      &SuggestionStore{db},
+		ActivityPub:      &ActivityPubStore{db},
+		Notifications:    &NotificationStore{db},
+		Streams:          &StreamStore{db},
+		Webhooks:         &WebhookStore{db},
+		Conversations:    &ConversationStore{db},
+		EmailPreferences: &EmailPreferenceStore{db},
+		EmailOutbox:      &EmailOutboxStore{db},
+		Counters:         &CounterStore{db},
 	}
 }
 
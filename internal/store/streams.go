@@ -0,0 +1,148 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// StreamChannel is the Postgres channel notified with the IDs of the users
+// who have new stream events, so every API replica can wake up the streams
+// it holds for them.
+const StreamChannel = "stream_events"
+
+// maxNotifyPayload keeps NOTIFY payloads under the 8000 bytes Postgres
+// accepts.
+const maxNotifyPayload = 7900
+
+// Stream event types.
+const (
+	StreamFeedItem       = "feed.item"
+	StreamNotification   = "notification"
+	StreamCommentCreated = "comment.created"
+	StreamMessageCreated = "message.created"
+	StreamMessageRead    = "message.read"
+)
+
+// StreamEvent is an event pushed to the streams of a user. IDs number the
+// events of the user in the order they were committed, so clients resume from
+// the last one they saw.
+type StreamEvent struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt string          `json:"created_at"`
+}
+
+type StreamStore struct {
+	db *sql.DB
+}
+
+// GetEvents returns up to limit events of a user that came after afterID, in
+// order.
+func (s *StreamStore) GetEvents(ctx context.Context, userID, afterID int64, limit int) ([]StreamEvent, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `
+		SELECT sequence, type, data, created_at FROM stream_events
+		WHERE user_id = $1 AND sequence > $2
+		ORDER BY sequence
+		LIMIT $3
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, userID, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []StreamEvent{}
+	for rows.Next() {
+		var e StreamEvent
+		if err := rows.Scan(&e.ID, &e.Type, &e.Data, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// LatestEventID returns the ID of the last event of a user, which is where
+// streams opened without a Last-Event-ID start from.
+func (s *StreamStore) LatestEventID(ctx context.Context, userID int64) (int64, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `SELECT COALESCE((SELECT sequence FROM stream_sequences WHERE user_id = $1), 0)`
+
+	var id int64
+	if err := s.db.QueryRowContext(ctx, query, userID).Scan(&id); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// Prune deletes the events older than maxAge. Streams cannot resume from
+// before that.
+func (s *StreamStore) Prune(ctx context.Context, maxAge time.Duration) error {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `DELETE FROM stream_events WHERE created_at < NOW() - make_interval(secs => $1)`
+	_, err := s.db.ExecContext(ctx, query, maxAge.Seconds())
+	return err
+}
+
+// publish records an event for each of the users within the transaction that
+// caused it and notifies StreamChannel, which Postgres delivers only once the
+// transaction commits. The sequences of the users stay locked until then, in
+// the order of their IDs, so the events of a user are committed in order.
+func publish(ctx context.Context, tx *sql.Tx, typ string, data any, userIDs []int64) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		WITH seq AS (
+			INSERT INTO stream_sequences (user_id, sequence)
+			SELECT DISTINCT u, 1 FROM unnest($1::bigint[]) u ORDER BY u
+			ON CONFLICT (user_id) DO UPDATE SET sequence = stream_sequences.sequence + 1
+			RETURNING user_id, sequence
+		)
+		INSERT INTO stream_events (user_id, sequence, type, data)
+		SELECT user_id, sequence, $2, $3 FROM seq
+	`
+	if _, err := tx.ExecContext(ctx, query, pq.Array(userIDs), typ, payload); err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	for i, id := range userIDs {
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.FormatInt(id, 10))
+
+		if b.Len() >= maxNotifyPayload || i == len(userIDs)-1 {
+			if _, err := tx.ExecContext(ctx, `SELECT pg_notify($1, $2)`, StreamChannel, b.String()); err != nil {
+				return err
+			}
+			b.Reset()
+		}
+	}
+	return nil
+}
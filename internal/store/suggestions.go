@@ -0,0 +1,257 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// MaxSuggestions is the number of suggestions kept per user.
+	MaxSuggestions = 50
+	// SuggestionsPopularPool is the number of most followed accounts that are
+	// always considered, so users who follow nobody still get suggestions.
+	SuggestionsPopularPool = 100
+	// SuggestionsTagWindow bounds how old the posts matching the followed tags
+	// of a user can be.
+	SuggestionsTagWindow = 30 * 24 * time.Hour
+)
+
+type Suggestion struct {
+	User        User    `json:"user"`
+	Score       float64 `json:"score"`
+	Reason      string  `json:"reason"`
+	MutualCount int     `json:"mutual_count"`
+	SharedTags  int     `json:"shared_tags_count"`
+}
+
+type SuggestionStore struct {
+	db *sql.DB
+}
+
+// Get returns the precomputed suggestions of a user, best first. Accounts the
+// user followed or blocked since the last refresh are left out. Users whose
+// suggestions were never computed get the most followed accounts instead.
+func (s *SuggestionStore) Get(ctx context.Context, userID int64, limit int) ([]Suggestion, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `
+		WITH computed AS (
+			SELECT fs.suggested_id, fs.score, fs.reason, fs.mutual_count, fs.shared_tags_count
+			FROM follow_suggestions fs
+			WHERE fs.user_id = $1
+		), fallback AS (
+			SELECT u.id AS suggested_id, LN(1 + u.followers_count) AS score, 'popular' AS reason
+				, 0 AS mutual_count, 0 AS shared_tags_count
+			FROM users u
+			WHERE NOT EXISTS (SELECT 1 FROM follow_suggestions_refreshes r WHERE r.user_id = $1)
+			ORDER BY u.followers_count DESC
+			LIMIT $3
+		)
+		SELECT u.id, u.username, s.score, s.reason, s.mutual_count, s.shared_tags_count
+		FROM (SELECT * FROM computed UNION ALL SELECT * FROM fallback) s
+			JOIN users u ON u.id = s.suggested_id
+		WHERE u.id <> $1 AND u.is_active
+			AND NOT EXISTS (
+				SELECT 1 FROM followers f WHERE f.user_id = u.id AND f.follower_id = $1
+			)
+			AND NOT EXISTS (
+				SELECT 1 FROM user_blocks b
+				WHERE (b.user_id = $1 AND b.blocked_id = u.id)
+					OR (b.user_id = u.id AND b.blocked_id = $1)
+			)
+		ORDER BY s.score DESC, u.id
+		LIMIT $2
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, userID, limit, SuggestionsPopularPool)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suggestions := []Suggestion{}
+	for rows.Next() {
+		var sg Suggestion
+
+		err := rows.Scan(&sg.User.ID,
+			&sg.User.Username,
+			&sg.Score,
+			&sg.Reason,
+			&sg.MutualCount,
+			&sg.SharedTags)
+		if err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, sg)
+	}
+	return suggestions, rows.Err()
+}
+
+// EnqueueStale queues for a refresh the active users whose suggestions were
+// never computed or are older than maxAge, so they follow the changes of the
+// people they did not interact with directly. Users already queued are left
+// where they are.
+func (s *SuggestionStore) EnqueueStale(ctx context.Context, maxAge time.Duration) error {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `
+		INSERT INTO follow_suggestions_queue (user_id)
+		SELECT u.id FROM users u
+			LEFT JOIN follow_suggestions_refreshes r ON r.user_id = u.id
+		WHERE u.is_active AND (r.refreshed_at IS NULL OR r.refreshed_at < NOW() - $1 * INTERVAL '1 second')
+			AND NOT EXISTS (SELECT 1 FROM follow_suggestions_queue q WHERE q.user_id = u.id)
+		ON CONFLICT DO NOTHING
+	`
+
+	_, err := s.db.ExecContext(ctx, query, maxAge.Seconds())
+	return err
+}
+
+// Refresh recomputes the suggestions of up to batch queued users, each in its
+// own transaction so a slow user does not hold the others back. It returns how
+// many users were refreshed, so callers can keep going while the queue is not
+// empty.
+func (s *SuggestionStore) Refresh(ctx context.Context, batch int) (int, error) {
+	refreshed := 0
+	for refreshed < batch {
+		found, err := s.refreshNext(ctx)
+		if err != nil {
+			return refreshed, err
+		}
+		if !found {
+			break
+		}
+		refreshed++
+	}
+	return refreshed, nil
+}
+
+// refreshNext recomputes the suggestions of the user queued first, telling
+// whether there was one.
+func (s *SuggestionStore) refreshNext(ctx context.Context) (bool, error) {
+	found := false
+
+	err := withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		query := `
+			SELECT user_id FROM follow_suggestions_queue
+			ORDER BY created_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		`
+
+		var id int64
+		if err := tx.QueryRowContext(ctx, query).Scan(&id); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			return err
+		}
+
+		if err := computeSuggestions(ctx, tx, id); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `DELETE FROM follow_suggestions_queue WHERE user_id = $1`, id); err != nil {
+			return err
+		}
+		found = true
+		return nil
+	})
+	return found, err
+}
+
+// computeSuggestions replaces the suggestions of a user. Candidates are the
+// accounts followed by the people the user follows, the authors of recent
+// posts on the tags the user follows and the most followed accounts. Mutual
+// follows weigh the most, then shared tags, then popularity.
+func computeSuggestions(ctx context.Context, tx *sql.Tx, userID int64) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM follow_suggestions WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+
+	query := `
+		WITH mutual AS (
+			SELECT f2.user_id AS candidate, COUNT(*) AS mutual_count
+			FROM followers f1
+				JOIN followers f2 ON f2.follower_id = f1.user_id
+			WHERE f1.follower_id = $1
+			GROUP BY f2.user_id
+		), shared AS (
+			SELECT p.user_id AS candidate, COUNT(DISTINCT tg.id) AS shared_tags_count
+			FROM tag_followers tf
+				JOIN tags tg ON tg.id = tf.tag_id
+				JOIN posts p ON tg.name = ANY (p.tags)
+			WHERE tf.user_id = $1 AND p.visibility = 'public'
+				AND p.created_at > NOW() - $4 * INTERVAL '1 second'
+			GROUP BY p.user_id
+		), popular AS (
+			SELECT id AS candidate FROM users
+			WHERE is_active
+			ORDER BY followers_count DESC
+			LIMIT $3
+		), candidates AS (
+			SELECT candidate FROM mutual
+			UNION
+			SELECT candidate FROM shared
+			UNION
+			SELECT candidate FROM popular
+		)
+		INSERT INTO follow_suggestions (user_id, suggested_id, score, reason, mutual_count, shared_tags_count)
+		SELECT $1, u.id
+			, 3 * COALESCE(m.mutual_count, 0) + 2 * COALESCE(s.shared_tags_count, 0) + LN(1 + u.followers_count)
+			, CASE
+				WHEN m.mutual_count > 0 THEN 'mutual'
+				WHEN s.shared_tags_count > 0 THEN 'shared_tags'
+				ELSE 'popular'
+			END
+			, COALESCE(m.mutual_count, 0), COALESCE(s.shared_tags_count, 0)
+		FROM candidates c
+			JOIN users u ON u.id = c.candidate
+			LEFT JOIN mutual m ON m.candidate = c.candidate
+			LEFT JOIN shared s ON s.candidate = c.candidate
+		WHERE u.id <> $1 AND u.is_active
+			AND NOT EXISTS (
+				SELECT 1 FROM followers f WHERE f.user_id = u.id AND f.follower_id = $1
+			)
+			AND NOT EXISTS (
+				SELECT 1 FROM user_blocks b
+				WHERE (b.user_id = $1 AND b.blocked_id = u.id)
+					OR (b.user_id = u.id AND b.blocked_id = $1)
+			)
+		ORDER BY 3 DESC
+		LIMIT $2
+	`
+	_, err := tx.ExecContext(ctx, query, userID, MaxSuggestions, SuggestionsPopularPool, SuggestionsTagWindow.Seconds())
+	if err != nil {
+		return err
+	}
+
+	query = `
+		INSERT INTO follow_suggestions_refreshes (user_id) VALUES ($1)
+		ON CONFLICT (user_id) DO UPDATE SET refreshed_at = NOW()
+	`
+	_, err = tx.ExecContext(ctx, query, userID)
+	return err
+}
+
+// enqueueSuggestions queues the users whose follow graph or interests just
+// changed so their suggestions are refreshed by the next run.
+func enqueueSuggestions(ctx context.Context, tx *sql.Tx, userIDs ...int64) error {
+	query := `
+		INSERT INTO follow_suggestions_queue (user_id) SELECT unnest($1::bigint[])
+		ON CONFLICT DO NOTHING
+	`
+	_, err := tx.ExecContext(ctx, query, pq.Array(userIDs))
+	return err
+}
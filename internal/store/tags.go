@@ -0,0 +1,277 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"strings"
+	"unicode"
+
+	"com.github/jrovieri/golang/social/internal/parser"
+	"github.com/lib/pq"
+)
+
+const MaxTagLength = 100
+
+// MaxTags is how many tags a post has at most, counting the hashtags of its
+// content.
+const MaxTags = 10
+
+type Tag struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	UsageCount int    `json:"usage_count"`
+	CreatedAt  string `json:"created_at"`
+}
+
+type TagStore struct {
+	db *sql.DB
+}
+
+// NormalizeTag lowercases a tag and strips its leading # and any whitespace,
+// so "Self Improvement" and "#selfimprovement" end up being the same tag.
+func NormalizeTag(tag string) string {
+	tag = strings.TrimLeft(strings.TrimSpace(tag), "#")
+	tag = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, tag)
+
+	if runes := []rune(tag); len(runes) > MaxTagLength {
+		tag = string(runes[:MaxTagLength])
+	}
+	return tag
+}
+
+// NormalizeTags merges the explicit tags of a post with the hashtags found in
+// its content, normalized and without duplicates. Explicit tags come first,
+// and tags past MaxTags are dropped.
+func NormalizeTags(tags []string, content string) []string {
+	for _, span := range parser.Hashtags(content) {
+		tags = append(tags, span.Value)
+	}
+
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = NormalizeTag(tag)
+		if tag == "" || slices.Contains(normalized, tag) {
+			continue
+		}
+
+		normalized = append(normalized, tag)
+		if len(normalized) == MaxTags {
+			break
+		}
+	}
+	return normalized
+}
+
+// WithoutHashtags returns the tags of a post that were not extracted from the
+// hashtags of its content.
+func WithoutHashtags(tags []string, content string) []string {
+	hashtags := NormalizeTags(nil, content)
+
+	explicit := []string{}
+	for _, tag := range tags {
+		if !slices.Contains(hashtags, tag) {
+			explicit = append(explicit, tag)
+		}
+	}
+	return explicit
+}
+
+// Search returns the most used tags starting with prefix.
+func (s *TagStore) Search(ctx context.Context, prefix string, limit int) ([]Tag, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `
+		SELECT id, name, usage_count, created_at
+		FROM tags
+		WHERE name LIKE $1 || '%' AND usage_count > 0
+		ORDER BY usage_count DESC, name
+		LIMIT $2
+	`
+
+	prefix = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(NormalizeTag(prefix))
+
+	rows, err := s.db.QueryContext(ctx, query, prefix, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []Tag{}
+	for rows.Next() {
+		var t Tag
+		if err := rows.Scan(&t.ID, &t.Name, &t.UsageCount, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+// GetPosts returns the public posts of a tag, leaving out the ones written by
+// users on either side of a block with the viewer.
+func (s *TagStore) GetPosts(ctx context.Context, tag string, viewerID int64, fq PaginatedFeedQuery) ([]PostWithMetadata, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `
+		SELECT p.id, p.user_id, p.title, p.content, p.created_at, p.updated_at, p.version, p.tags
+			, u.id, u.username
+			, (SELECT COUNT(*) FROM comments c WHERE c.post_id = p.id) AS comments_count
+		FROM posts p
+			JOIN users u ON u.id = p.user_id
+		WHERE p.tags @> ARRAY[$1]::varchar(100)[] AND p.visibility = 'public'
+			AND ($4 = '' OR p.search_vector @@ websearch_to_tsquery(p.language, $4))
+			AND ($5::timestamptz IS NULL OR p.created_at >= $5)
+			AND ($6::timestamptz IS NULL OR p.created_at < $6)
+			AND ` + notBlocked("p.user_id", "$7") + `
+		ORDER BY p.created_at ` + fq.Sort + `, p.id ` + fq.Sort + `
+		LIMIT $2 OFFSET $3
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, NormalizeTag(tag), fq.Limit, fq.Offset, fq.Search, fq.Since, fq.Until, viewerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	posts := []PostWithMetadata{}
+	for rows.Next() {
+		var p PostWithMetadata
+
+		err := rows.Scan(&p.ID,
+			&p.UserID,
+			&p.Title,
+			&p.Content,
+			&p.CreatedAt,
+			&p.UpdatedAt,
+			&p.Version,
+			pq.Array(&p.Tags),
+			&p.User.ID,
+			&p.User.Username,
+			&p.CommentCount)
+		if err != nil {
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ids := make([]int64, len(posts))
+	for i, p := range posts {
+		ids[i] = p.ID
+	}
+
+	mentions, err := getPostMentions(ctx, s.db, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range posts {
+		posts[i].Mentions = mentions[posts[i].ID]
+	}
+	return posts, nil
+}
+
+func (s *TagStore) Follow(ctx context.Context, tag string, userID int64) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		query := `
+			INSERT INTO tags (name) VALUES ($1)
+			ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name
+			RETURNING id
+		`
+
+		var tagID int64
+		if err := tx.QueryRowContext(ctx, query, NormalizeTag(tag)).Scan(&tagID); err != nil {
+			return err
+		}
+
+		query = `INSERT INTO tag_followers (tag_id, user_id) VALUES ($1, $2)`
+		if _, err := tx.ExecContext(ctx, query, tagID, userID); err != nil {
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+				return ErrConflict
+			}
+			return err
+		}
+
+		if err := enqueueSuggestions(ctx, tx, userID); err != nil {
+			return err
+		}
+
+		return backfillTag(ctx, tx, userID, NormalizeTag(tag))
+	})
+}
+
+func (s *TagStore) UnFollow(ctx context.Context, tag string, userID int64) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		tag = NormalizeTag(tag)
+
+		query := `
+			DELETE FROM tag_followers
+			WHERE user_id = $2 AND tag_id = (SELECT id FROM tags WHERE name = $1)
+		`
+
+		if _, err := tx.ExecContext(ctx, query, tag, userID); err != nil {
+			return err
+		}
+
+		if err := enqueueSuggestions(ctx, tx, userID); err != nil {
+			return err
+		}
+		return removeTag(ctx, tx, userID, tag)
+	})
+}
+
+// updateTagUsage keeps the usage count of tags in sync when a post goes from
+// having the old tags to having the new ones.
+func updateTagUsage(ctx context.Context, tx *sql.Tx, old, new []string) error {
+
+	var added, removed []string
+	for _, tag := range new {
+		if !slices.Contains(old, tag) {
+			added = append(added, tag)
+		}
+	}
+	for _, tag := range old {
+		if !slices.Contains(new, tag) {
+			removed = append(removed, tag)
+		}
+	}
+
+	if len(added) > 0 {
+		query := `
+			INSERT INTO tags (name, usage_count) SELECT unnest($1::varchar(100)[]), 1
+			ON CONFLICT (name) DO UPDATE SET usage_count = tags.usage_count + 1
+		`
+		if _, err := tx.ExecContext(ctx, query, pq.Array(added)); err != nil {
+			return err
+		}
+	}
+
+	if len(removed) > 0 {
+		query := `
+			UPDATE tags SET usage_count = GREATEST(usage_count - 1, 0)
+			WHERE name = ANY($1)
+		`
+		if _, err := tx.ExecContext(ctx, query, pq.Array(removed)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
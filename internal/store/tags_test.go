@@ -0,0 +1,91 @@
+package store
+
+import (
+	"context"
+	"testing"
+)
+
+func TestFollowedTagsLeaveOutBlockedAuthors(t *testing.T) {
+	conn := newTestDB(t)
+	s := NewStorage(conn, Config{FanoutThreshold: DefaultFanoutThreshold, SearchLanguage: DefaultSearchLanguage})
+	ctx := context.Background()
+
+	reader, blocked, other := createTestUser(t, conn), createTestUser(t, conn), createTestUser(t, conn)
+	tag := uniqueName("tag")
+
+	if err := s.Tags.Follow(ctx, tag, reader); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Users.Block(ctx, reader, blocked); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, author := range []int64{blocked, other} {
+		post := &Post{Title: "tagged", Content: "a tagged post", UserID: author, Tags: []string{tag}}
+		if err := s.Posts.Create(ctx, post); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for {
+		n, err := s.Timelines.Fanout(ctx, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n < 100 {
+			break
+		}
+	}
+
+	var timelined int
+	query := `SELECT COUNT(*) FROM timelines WHERE user_id = $1 AND author_id = $2`
+	if err := conn.QueryRowContext(ctx, query, reader, blocked).Scan(&timelined); err != nil {
+		t.Fatal(err)
+	}
+	if timelined != 0 {
+		t.Errorf("the post of the blocked author was fanned out to the reader")
+	}
+
+	fq := PaginatedFeedQuery{Limit: 20, Sort: "desc"}
+
+	page, err := s.Posts.GetUserFeed(ctx, reader, fq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAuthors(t, "feed", page.Posts, other, blocked)
+
+	posts, err := s.Tags.GetPosts(ctx, tag, reader, fq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAuthors(t, "tag posts", posts, other, blocked)
+
+	// Anyone else still sees both
+	posts, err = s.Tags.GetPosts(ctx, tag, AnonymousUserID, fq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 2 {
+		t.Errorf("tag posts = %d for anonymous readers, want 2", len(posts))
+	}
+}
+
+// checkAuthors checks that posts have one written by want and none by
+// blocked.
+func checkAuthors(t *testing.T, name string, posts []PostWithMetadata, want, blocked int64) {
+	t.Helper()
+
+	var found bool
+	for _, p := range posts {
+		switch p.UserID {
+		case blocked:
+			t.Errorf("%s has post %d of the blocked author", name, p.ID)
+		case want:
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("%s misses the post of the author who is not blocked", name)
+	}
+}
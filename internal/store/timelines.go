@@ -0,0 +1,215 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+)
+
+// DefaultFanoutThreshold is the fan-out threshold of the stores built without
+// one. See Config.
+const DefaultFanoutThreshold = 10_000
+
+// TimelineBackfillSize is the number of recent posts copied into a timeline
+// when the user starts following someone or a tag.
+const TimelineBackfillSize = 100
+
+type TimelineStore struct {
+	db              *sql.DB
+	fanoutThreshold int
+}
+
+// Fanout copies up to batch queued posts into the timelines of the followers
+// of their authors and of their tags. It returns how many posts were fanned
+// out, so callers can keep going while the queue is not empty.
+func (s *TimelineStore) Fanout(ctx context.Context, batch int) (int, error) {
+	fanned := 0
+
+	err := withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		query := `
+			SELECT post_id FROM timeline_fanout_queue
+			ORDER BY created_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		`
+
+		rows, err := tx.QueryContext(ctx, query, batch)
+		if err != nil {
+			return err
+		}
+
+		var ids []int64
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		query = `
+			INSERT INTO timelines (user_id, post_id, author_id, created_at)
+			SELECT r.user_id, p.id, p.user_id, p.created_at
+			FROM posts p
+				JOIN users a ON a.id = p.user_id
+				CROSS JOIN LATERAL (
+					SELECT f.follower_id AS user_id FROM followers f
+					WHERE f.user_id = p.user_id AND a.followers_count < $2
+					UNION
+					SELECT tf.user_id FROM tag_followers tf
+						JOIN tags t ON t.id = tf.tag_id
+					WHERE t.name = ANY (p.tags) AND p.visibility = 'public'
+						AND ` + notBlocked("tf.user_id", "p.user_id") + `
+				) r
+			WHERE p.id = $1
+			ON CONFLICT DO NOTHING
+			RETURNING user_id, author_id
+		`
+
+		for _, id := range ids {
+			if err := fanoutPost(ctx, tx, query, id, s.fanoutThreshold); err != nil {
+				return err
+			}
+
+			if _, err := tx.ExecContext(ctx, `DELETE FROM timeline_fanout_queue WHERE post_id = $1`, id); err != nil {
+				return err
+			}
+			fanned++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return fanned, nil
+}
+
+// fanoutPost runs the fan-out query of a post and publishes the new feed item
+// to the streams of the users it reached.
+func fanoutPost(ctx context.Context, tx *sql.Tx, query string, postID int64, threshold int) error {
+	rows, err := tx.QueryContext(ctx, query, postID, threshold)
+	if err != nil {
+		return err
+	}
+
+	var userIDs []int64
+	var authorID int64
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID, &authorID); err != nil {
+			rows.Close()
+			return err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return publish(ctx, tx, StreamFeedItem, feedItemEvent{PostID: postID, AuthorID: authorID}, userIDs)
+}
+
+// feedItemEvent is the data of the stream event sent when a post lands in a
+// feed.
+type feedItemEvent struct {
+	PostID   int64 `json:"post_id"`
+	AuthorID int64 `json:"author_id"`
+}
+
+// enqueueFanout adds a new post to its author's timeline right away and queues
+// it to be fanned out to everyone else.
+func enqueueFanout(ctx context.Context, tx *sql.Tx, p *Post) error {
+	query := `
+		INSERT INTO timelines (user_id, post_id, author_id, created_at)
+		VALUES ($1, $2, $1, $3)
+	`
+	if _, err := tx.ExecContext(ctx, query, p.UserID, p.ID, p.CreatedAt); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO timeline_fanout_queue (post_id) VALUES ($1)`, p.ID); err != nil {
+		return err
+	}
+
+	return publish(ctx, tx, StreamFeedItem, feedItemEvent{PostID: p.ID, AuthorID: p.UserID}, []int64{p.UserID})
+}
+
+// backfillAuthor copies the recent posts of an author into the timeline of a
+// new follower, unless the author is above the fan-out threshold.
+func backfillAuthor(ctx context.Context, tx *sql.Tx, userID, authorID int64, threshold int) error {
+	query := `
+		INSERT INTO timelines (user_id, post_id, author_id, created_at)
+		SELECT $1, p.id, p.user_id, p.created_at FROM posts p
+			JOIN users a ON a.id = p.user_id
+		WHERE p.user_id = $2 AND a.followers_count < $3
+		ORDER BY p.created_at DESC
+		LIMIT $4
+		ON CONFLICT DO NOTHING
+	`
+	_, err := tx.ExecContext(ctx, query, userID, authorID, threshold, TimelineBackfillSize)
+	return err
+}
+
+// removeAuthor drops the posts of an author from a timeline, keeping the public
+// ones that are still there because of a followed tag unless either user
+// blocked the other.
+func removeAuthor(ctx context.Context, tx *sql.Tx, userID, authorID int64) error {
+	query := `
+		DELETE FROM timelines t USING posts p
+		WHERE t.user_id = $1 AND t.author_id = $2 AND p.id = t.post_id
+			AND NOT (p.visibility = 'public' AND ` + notBlocked("$1", "$2") + ` AND COALESCE(p.tags, '{}') && ARRAY(
+				SELECT tg.name FROM tag_followers tf
+					JOIN tags tg ON tg.id = tf.tag_id
+				WHERE tf.user_id = $1
+			))
+	`
+	_, err := tx.ExecContext(ctx, query, userID, authorID)
+	return err
+}
+
+// backfillTag copies the recent public posts of a tag into the timeline of a
+// user who just started following it, leaving out the users on either side
+// of a block with them.
+func backfillTag(ctx context.Context, tx *sql.Tx, userID int64, tag string) error {
+	query := `
+		INSERT INTO timelines (user_id, post_id, author_id, created_at)
+		SELECT $1, p.id, p.user_id, p.created_at FROM posts p
+		WHERE p.tags @> ARRAY[$2]::varchar(100)[] AND p.visibility = 'public'
+			AND ` + notBlocked("p.user_id", "$1") + `
+		ORDER BY p.created_at DESC
+		LIMIT $3
+		ON CONFLICT DO NOTHING
+	`
+	_, err := tx.ExecContext(ctx, query, userID, tag, TimelineBackfillSize)
+	return err
+}
+
+// removeTag drops the posts of a tag from a timeline, keeping the ones that
+// are still there because of their author or of another followed tag.
+func removeTag(ctx context.Context, tx *sql.Tx, userID int64, tag string) error {
+	query := `
+		DELETE FROM timelines t USING posts p
+		WHERE t.user_id = $1 AND p.id = t.post_id
+			AND p.tags @> ARRAY[$2::varchar(100)]
+			AND t.author_id <> $1
+			AND NOT EXISTS (
+				SELECT 1 FROM followers f
+				WHERE f.follower_id = $1 AND f.user_id = t.author_id
+			)
+			AND NOT COALESCE(p.tags, '{}') && ARRAY(
+				SELECT tg.name FROM tag_followers tf
+					JOIN tags tg ON tg.id = tf.tag_id
+				WHERE tf.user_id = $1 AND tg.name <> $2::varchar(100)
+			)
+	`
+	_, err := tx.ExecContext(ctx, query, userID, tag)
+	return err
+}
@@ -0,0 +1,204 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// TrendingWindows are the sliding windows trending scores are computed over.
+var TrendingWindows = map[string]time.Duration{
+	"hour": time.Hour,
+	"day":  24 * time.Hour,
+	"week": 7 * 24 * time.Hour,
+}
+
+// MaxTrendingResults is the number of tags and posts kept per window.
+const MaxTrendingResults = 100
+
+type TrendingTag struct {
+	Tag        string  `json:"tag"`
+	Score      float64 `json:"score"`
+	ComputedAt string  `json:"computed_at"`
+}
+
+type TrendingPost struct {
+	PostWithMetadata
+	Score      float64 `json:"score"`
+	ComputedAt string  `json:"computed_at"`
+}
+
+type TrendingStore struct {
+	db *sql.DB
+}
+
+// engagementEvents lists the comments, reactions to comments and likes of
+// remote actors made within the window ($1, in seconds) weighted by kind and
+// decayed with a half-life ($2, in seconds) so recent engagement counts more
+// than older one.
+const engagementEvents = `
+	WITH events AS (
+		SELECT post_id, created_at, 2.0 AS weight FROM comments
+		WHERE created_at > NOW() - $1 * INTERVAL '1 second'
+		UNION ALL
+		SELECT c.post_id, r.created_at, 1.0 AS weight FROM comment_reactions r
+			JOIN comments c ON c.id = r.comment_id
+		WHERE r.created_at > NOW() - $1 * INTERVAL '1 second'
+		UNION ALL
+		SELECT post_id, created_at, 1.0 AS weight FROM remote_reactions
+		WHERE created_at > NOW() - $1 * INTERVAL '1 second'
+		UNION ALL
+		SELECT id, created_at, 1.0 AS weight FROM posts
+		WHERE created_at > NOW() - $1 * INTERVAL '1 second'
+	), decayed AS (
+		SELECT post_id, weight * EXP(-LN(2) * EXTRACT(EPOCH FROM NOW() - created_at) / $2) AS score
+		FROM events
+	)
+`
+
+// Recompute replaces the trending tags and posts of a window with freshly
+// computed scores.
+func (s *TrendingStore) Recompute(ctx context.Context, window string) error {
+	duration, ok := TrendingWindows[window]
+	if !ok {
+		return ErrInvalidWindow
+	}
+
+	seconds := duration.Seconds()
+	halfLife := seconds / 4
+
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		if _, err := tx.ExecContext(ctx, `DELETE FROM trending_posts WHERE time_window = $1`, window); err != nil {
+			return err
+		}
+
+		query := engagementEvents + `
+			INSERT INTO trending_posts (time_window, post_id, score)
+			SELECT $3, d.post_id, SUM(d.score) FROM decayed d
+				JOIN posts p ON p.id = d.post_id
+			WHERE p.visibility = 'public'
+			GROUP BY d.post_id
+			ORDER BY SUM(d.score) DESC
+			LIMIT $4
+		`
+		if _, err := tx.ExecContext(ctx, query, seconds, halfLife, window, MaxTrendingResults); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `DELETE FROM trending_tags WHERE time_window = $1`, window); err != nil {
+			return err
+		}
+
+		query = engagementEvents + `
+			INSERT INTO trending_tags (time_window, tag, score)
+			SELECT $3, t.tag, SUM(d.score) FROM decayed d
+				JOIN posts p ON p.id = d.post_id
+				CROSS JOIN LATERAL unnest(p.tags) AS t(tag)
+			WHERE p.visibility = 'public'
+			GROUP BY t.tag
+			ORDER BY SUM(d.score) DESC
+			LIMIT $4
+		`
+		_, err := tx.ExecContext(ctx, query, seconds, halfLife, window, MaxTrendingResults)
+		return err
+	})
+}
+
+func (s *TrendingStore) GetTags(ctx context.Context, window string, limit int) ([]TrendingTag, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `
+		SELECT tag, score, computed_at FROM trending_tags
+		WHERE time_window = $1
+		ORDER BY score DESC, tag
+		LIMIT $2
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, window, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []TrendingTag{}
+	for rows.Next() {
+		var t TrendingTag
+		if err := rows.Scan(&t.Tag, &t.Score, &t.ComputedAt); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+func (s *TrendingStore) GetPosts(ctx context.Context, window string, limit int) ([]TrendingPost, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `
+		SELECT p.id, p.user_id, p.title, p.content, p.created_at, p.version, p.tags
+			, u.id, u.username
+			, (SELECT COUNT(*) FROM comments c WHERE c.post_id = p.id) AS comments_count
+			, tp.score, tp.computed_at
+		FROM trending_posts tp
+			JOIN posts p ON p.id = tp.post_id
+			JOIN users u ON u.id = p.user_id
+		WHERE tp.time_window = $1
+		ORDER BY tp.score DESC, p.id DESC
+		LIMIT $2
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, window, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	posts := []TrendingPost{}
+	for rows.Next() {
+		var p TrendingPost
+
+		err := rows.Scan(&p.ID,
+			&p.UserID,
+			&p.Title,
+			&p.Content,
+			&p.CreatedAt,
+			&p.Version,
+			pq.Array(&p.Tags),
+			&p.User.ID,
+			&p.User.Username,
+			&p.CommentCount,
+			&p.Score,
+			&p.ComputedAt)
+		if err != nil {
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ids := make([]int64, len(posts))
+	for i, p := range posts {
+		ids[i] = p.ID
+	}
+
+	mentions, err := getPostMentions(ctx, s.db, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range posts {
+		posts[i].Mentions = mentions[posts[i].ID]
+	}
+	return posts, nil
+}
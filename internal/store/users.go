@@ -8,6 +8,7 @@ import (
 	"errors"
 	"time"
 
+	"com.github/jrovieri/golang/social/internal/event"
 	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -17,8 +18,13 @@ var (
 	ErrDuplicateUsername = errors.New("a user with that username already exists")
 )
 
+// AnonymousUserID stands for readers who are not logged in. It matches no user,
+// so they only see what is public.
+const AnonymousUserID int64 = 0
+
 type UserStore struct {
-	db *sql.DB
+	db              *sql.DB
+	fanoutThreshold int
 }
 
 type User struct {
@@ -28,6 +34,11 @@ type User struct {
 	Password  password `json:"-"`
 	CreatedAt string   `json:"created_at,omitempty"`
 	IsActive  bool     `json:"is_active"`
+	RoleID    int64    `json:"role_id"`
+	Role      Role     `json:"role"`
+	Locale    string   `json:"-"`
+
+	FollowersCount int `json:"followers_count"`
 }
 
 type password struct {
@@ -60,14 +71,25 @@ func (s *UserStore) Create(ctx context.Context, tx *sql.Tx, u *User) error {
 	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
 	defer cancel()
 
-	query := `INSERT INTO users (username, password, email) VALUES ($1, $2, $3) RETURNING id, created_at`
+	query := `
+		INSERT INTO users (username, password, email, role_id, locale) 
+			VALUES ($1, $2, $3, (SELECT id FROM roles WHERE name = $4), NULLIF($5, '')) 
+		RETURNING id, created_at, role_id`
+
+	role := u.Role.Name
+	if role == "" {
+		role = "user"
+	}
+
 	err := tx.QueryRowContext(
 		ctx,
 		query,
 		u.Username,
 		u.Password.hash,
-		u.Email).
-		Scan(&u.ID, &u.CreatedAt)
+		u.Email,
+		role,
+		u.Locale).
+		Scan(&u.ID, &u.CreatedAt, &u.RoleID)
 
 	if err != nil {
 		switch {
@@ -79,7 +101,8 @@ func (s *UserStore) Create(ctx context.Context, tx *sql.Tx, u *User) error {
 			return err
 		}
 	}
-	return nil
+
+	return event.Record(ctx, tx, AggregateUser, u.ID, EventUserCreated, UserEvent{ID: u.ID, Username: u.Username})
 }
 
 func (s *UserStore) GetByID(ctx context.Context, id int64) (*User, error) {
@@ -88,9 +111,11 @@ func (s *UserStore) GetByID(ctx context.Context, id int64) (*User, error) {
 	defer cancel()
 
 	query := `
-		SELECT id, username, email, password, created_at 
-		FROM users 
-		WHERE id = $1
+		SELECT u.id, u.username, u.email, u.password, u.created_at, u.is_active, u.followers_count
+			, r.id, r.name, r.level, COALESCE(r.description, '')
+		FROM users u
+			JOIN roles r ON r.id = u.role_id
+		WHERE u.id = $1
 	`
 	var user User
 
@@ -100,6 +125,12 @@ func (s *UserStore) GetByID(ctx context.Context, id int64) (*User, error) {
 		&user.Email,
 		&user.Password.hash,
 		&user.CreatedAt,
+		&user.IsActive,
+		&user.FollowersCount,
+		&user.Role.ID,
+		&user.Role.Name,
+		&user.Role.Level,
+		&user.Role.Description,
 	)
 	if err != nil {
 		switch err {
@@ -109,6 +140,7 @@ func (s *UserStore) GetByID(ctx context.Context, id int64) (*User, error) {
 			return nil, err
 		}
 	}
+	user.RoleID = user.Role.ID
 	return &user, nil
 }
 
@@ -142,37 +174,238 @@ func (s *UserStore) GetByEmail(ctx context.Context, email string) (*User, error)
 	return &user, nil
 }
 
-func (s *UserStore) Follow(ctx context.Context, followerID int64, userID int64) error {
+func (s *UserStore) GetByUsername(ctx context.Context, username string) (*User, error) {
 
 	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
 	defer cancel()
 
 	query := `
-		INSERT INTO followers (user_id, follower_id) VALUES ($1, $2)
+		SELECT id, username, created_at, is_active
+		FROM users
+		WHERE username = $1 AND is_active = true
 	`
-	_, err := s.db.ExecContext(ctx, query, userID, followerID)
+	var user User
+
+	err := s.db.QueryRowContext(ctx, query, username).Scan(
+		&user.ID,
+		&user.Username,
+		&user.CreatedAt,
+		&user.IsActive,
+	)
 	if err != nil {
-		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
-			return ErrConflict
+		switch err {
+		case sql.ErrNoRows:
+			return nil, ErrResourceNotFound
+		default:
+			return nil, err
 		}
 	}
-	return err
+	return &user, nil
 }
 
+// Follow makes followerID follow userID and backfills the follower timeline
+// with the recent posts of the followed user.
+func (s *UserStore) Follow(ctx context.Context, followerID int64, userID int64) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		query := `
+			INSERT INTO followers (user_id, follower_id) VALUES ($1, $2)
+		`
+		_, err := tx.ExecContext(ctx, query, userID, followerID)
+		if err != nil {
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+				return ErrConflict
+			}
+			return err
+		}
+
+		query = `UPDATE users SET followers_count = followers_count + 1 WHERE id = $1`
+		if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+			return err
+		}
+
+		if err := enqueueSuggestions(ctx, tx, followerID); err != nil {
+			return err
+		}
+
+		err = notify(ctx, tx, notification{userID: userID, actorID: followerID, typ: NotificationFollow})
+		if err != nil {
+			return err
+		}
+
+		follow := RelationshipEvent{UserID: userID, OtherID: followerID}
+		if err := event.Record(ctx, tx, AggregateUser, userID, EventUserFollowed, follow); err != nil {
+			return err
+		}
+
+		return backfillAuthor(ctx, tx, followerID, userID, s.fanoutThreshold)
+	})
+}
+
+// UnFollow makes followerID stop following userID and removes the posts of
+// the unfollowed user from the follower timeline.
 func (s *UserStore) UnFollow(ctx context.Context, followerID int64, userID int64) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		query := `
+			DELETE FROM followers WHERE follower_id = $1 AND user_id = $2
+		`
+
+		res, err := tx.ExecContext(ctx, query, followerID, userID)
+		if err != nil {
+			return err
+		}
+
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rows == 0 {
+			return nil
+		}
+
+		query = `UPDATE users SET followers_count = followers_count - 1 WHERE id = $1`
+		if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+			return err
+		}
+
+		if err := enqueueSuggestions(ctx, tx, followerID); err != nil {
+			return err
+		}
+
+		err = unnotify(ctx, tx, notification{userID: userID, actorID: followerID, typ: NotificationFollow})
+		if err != nil {
+			return err
+		}
+
+		follow := RelationshipEvent{UserID: userID, OtherID: followerID}
+		if err := event.Record(ctx, tx, AggregateUser, userID, EventUserUnfollowed, follow); err != nil {
+			return err
+		}
+
+		return removeAuthor(ctx, tx, followerID, userID)
+	})
+}
+
+// Block blocks userID on behalf of blockerID and removes the follow
+// relationship between them in both directions.
+func (s *UserStore) Block(ctx context.Context, blockerID int64, userID int64) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		query := `INSERT INTO user_blocks (user_id, blocked_id) VALUES ($1, $2)`
+		if _, err := tx.ExecContext(ctx, query, blockerID, userID); err != nil {
+			if pqErr, ok := err.(*pq.Error); ok {
+				switch pqErr.Code {
+				case "23505":
+					return ErrConflict
+				case "23503":
+					return ErrResourceNotFound
+				}
+			}
+			return err
+		}
+
+		query = `
+			DELETE FROM followers 
+			WHERE (user_id = $1 AND follower_id = $2) OR (user_id = $2 AND follower_id = $1)
+		`
+		if _, err := tx.ExecContext(ctx, query, blockerID, userID); err != nil {
+			return err
+		}
+
+		query = `
+			UPDATE users u SET followers_count = (SELECT COUNT(*) FROM followers f WHERE f.user_id = u.id)
+			WHERE u.id IN ($1, $2)
+		`
+		if _, err := tx.ExecContext(ctx, query, blockerID, userID); err != nil {
+			return err
+		}
+
+		if err := enqueueSuggestions(ctx, tx, blockerID, userID); err != nil {
+			return err
+		}
+
+		block := RelationshipEvent{UserID: blockerID, OtherID: userID}
+		if err := event.Record(ctx, tx, AggregateUser, blockerID, EventUserBlocked, block); err != nil {
+			return err
+		}
+
+		if err := removeAuthor(ctx, tx, blockerID, userID); err != nil {
+			return err
+		}
+		return removeAuthor(ctx, tx, userID, blockerID)
+	})
+}
+
+func (s *UserStore) UnBlock(ctx context.Context, blockerID int64, userID int64) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		query := `DELETE FROM user_blocks WHERE user_id = $1 AND blocked_id = $2`
+
+		res, err := tx.ExecContext(ctx, query, blockerID, userID)
+		if err != nil {
+			return err
+		}
+
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rows == 0 {
+			return nil
+		}
+
+		block := RelationshipEvent{UserID: blockerID, OtherID: userID}
+		return event.Record(ctx, tx, AggregateUser, blockerID, EventUserUnblocked, block)
+	})
+}
+
+// IsBlocked tells whether either of the users blocked the other.
+func (s *UserStore) IsBlocked(ctx context.Context, userID int64, otherID int64) (bool, error) {
 
 	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
 	defer cancel()
 
 	query := `
-		DELETE FROM followers WHERE follower_id = $1 AND user_id = $2
+		SELECT EXISTS (
+			SELECT 1 FROM user_blocks
+			WHERE (user_id = $1 AND blocked_id = $2) OR (user_id = $2 AND blocked_id = $1)
+		)
 	`
 
-	_, err := s.db.ExecContext(ctx, query, userID, followerID)
-	return err
+	var blocked bool
+	err := s.db.QueryRowContext(ctx, query, userID, otherID).Scan(&blocked)
+	return blocked, err
+}
+
+// IsFollowing tells whether followerID follows userID.
+func (s *UserStore) IsFollowing(ctx context.Context, followerID int64, userID int64) (bool, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `SELECT EXISTS (SELECT 1 FROM followers WHERE user_id = $1 AND follower_id = $2)`
+
+	var following bool
+	err := s.db.QueryRowContext(ctx, query, userID, followerID).Scan(&following)
+	return following, err
 }
 
-func (s *UserStore) CreateAndInvite(ctx context.Context, user *User, token string, invitationExp time.Duration) error {
+// CreateAndInvite creates a user along with their invitation and queues the
+// invitation email, which is only sent once the user is committed.
+func (s *UserStore) CreateAndInvite(ctx context.Context, user *User, token string, invitationExp time.Duration,
+	invitation *OutboundEmail) error {
+
 	return withTx(s.db, ctx, func(tx *sql.Tx) error {
 		if err := s.Create(ctx, tx, user); err != nil {
 			return err
@@ -181,7 +414,11 @@ func (s *UserStore) CreateAndInvite(ctx context.Context, user *User, token strin
 		if err := s.createUserInvitation(ctx, tx, token, invitationExp, user.ID); err != nil {
 			return err
 		}
-		return nil
+
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		return enqueueEmail(ctx, tx, invitation)
 	})
 }
 
@@ -201,7 +438,12 @@ func (s *UserStore) Activate(ctx context.Context, token string) error {
 		if err := s.deleteUserInvitation(ctx, tx, user.ID); err != nil {
 			return err
 		}
-		return nil
+
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		data := UserEvent{ID: user.ID, Username: user.Username}
+		return event.Record(ctx, tx, AggregateUser, user.ID, EventUserActivated, data)
 	})
 }
 
@@ -215,8 +457,63 @@ func (s *UserStore) Delete(ctx context.Context, userID int64) error {
 			return err
 		}
 
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		return event.Record(ctx, tx, AggregateUser, userID, EventUserDeleted, UserEvent{ID: userID})
+	})
+}
+
+// DeleteExpiredInvitations deletes the invitations that expired along with
+// the users who never activated their account, freeing their username and
+// email. It returns how many users were deleted.
+func (s *UserStore) DeleteExpiredInvitations(ctx context.Context) (int64, error) {
+
+	var deleted []UserEvent
+	err := withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		query := `
+			WITH expired AS (
+				DELETE FROM user_invitations WHERE expiry < NOW()
+				RETURNING user_id
+			)
+			DELETE FROM users u
+			WHERE u.id IN (SELECT user_id FROM expired) AND NOT u.is_active
+				AND NOT EXISTS (SELECT 1 FROM user_invitations i WHERE i.user_id = u.id AND i.expiry >= NOW())
+			RETURNING u.id, u.username
+		`
+
+		rows, err := tx.QueryContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var u UserEvent
+			if err := rows.Scan(&u.ID, &u.Username); err != nil {
+				return err
+			}
+			deleted = append(deleted, u)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		for _, u := range deleted {
+			if err := event.Record(ctx, tx, AggregateUser, u.ID, EventUserDeleted, u); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(deleted)), nil
 }
 
 func (s *UserStore) createUserInvitation(ctx context.Context, tx *sql.Tx, token string,
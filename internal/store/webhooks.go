@@ -0,0 +1,535 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"com.github/jrovieri/golang/social/internal/event"
+	"github.com/lib/pq"
+)
+
+// Webhook events, the domain events webhooks can subscribe to.
+const (
+	WebhookPostCreated    = EventPostCreated
+	WebhookPostUpdated    = EventPostUpdated
+	WebhookPostDeleted    = EventPostDeleted
+	WebhookUserFollowed   = EventUserFollowed
+	WebhookCommentCreated = EventCommentCreated
+)
+
+// WebhookEvents lists the webhook events.
+var WebhookEvents = []string{
+	WebhookPostCreated,
+	WebhookPostUpdated,
+	WebhookPostDeleted,
+	WebhookUserFollowed,
+	WebhookCommentCreated,
+}
+
+// MaxWebhookAttempts is the number of times a webhook delivery is tried
+// before it is moved to the dead letters.
+const MaxWebhookAttempts = 10
+
+// Webhook sends events to an URL. User webhooks receive the events about the
+// posts, followers and comments of their owner; global webhooks, which only
+// admins register, receive every event. The secret signs the payloads and is
+// only shown when the webhook is created.
+type Webhook struct {
+	ID        int64    `json:"id"`
+	UserID    int64    `json:"user_id"`
+	URL       string   `json:"url"`
+	Secret    string   `json:"secret,omitempty"`
+	Events    []string `json:"events"`
+	Global    bool     `json:"global"`
+	Active    bool     `json:"active"`
+	CreatedAt string   `json:"created_at"`
+	UpdatedAt string   `json:"updated_at"`
+}
+
+// WebhookDelivery is one attempt at sending an event to a webhook, retried
+// until it is delivered or dead. Redelivering creates a new delivery of the
+// same payload.
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	WebhookID      int64           `json:"webhook_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload" swaggertype:"object"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  string          `json:"next_attempt_at"`
+	LastStatusCode *int            `json:"last_status_code"`
+	LastError      *string         `json:"last_error"`
+	DeliveredAt    *string         `json:"delivered_at"`
+	RedeliveryOf   *int64          `json:"redelivery_of"`
+	CreatedAt      string          `json:"created_at"`
+
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+// WebhookPayload is the body sent to webhooks. ID identifies the event and
+// stays the same across retries and redeliveries, so receivers can drop
+// duplicates.
+type WebhookPayload struct {
+	ID        string `json:"id"`
+	Event     string `json:"event"`
+	CreatedAt string `json:"created_at"`
+	Data      any    `json:"data"`
+}
+
+// webhookPost is the data of the post events.
+type webhookPost struct {
+	ID         int64    `json:"id"`
+	UserID     int64    `json:"user_id"`
+	Title      string   `json:"title"`
+	Content    string   `json:"content"`
+	Tags       []string `json:"tags"`
+	Language   string   `json:"language"`
+	Visibility string   `json:"visibility"`
+	CreatedAt  string   `json:"created_at,omitempty"`
+	UpdatedAt  string   `json:"updated_at,omitempty"`
+	Version    int      `json:"version,omitempty"`
+}
+
+func newWebhookPost(p PostEvent) webhookPost {
+	return webhookPost{
+		ID:         p.ID,
+		UserID:     p.UserID,
+		Title:      p.Title,
+		Content:    p.Content,
+		Tags:       p.Tags,
+		Language:   p.Language,
+		Visibility: p.Visibility,
+		CreatedAt:  p.CreatedAt,
+		UpdatedAt:  p.UpdatedAt,
+		Version:    p.Version,
+	}
+}
+
+// webhookDeletedPost is the data of post.deleted.
+type webhookDeletedPost struct {
+	ID     int64 `json:"id"`
+	UserID int64 `json:"user_id"`
+}
+
+// webhookFollow is the data of user.followed.
+type webhookFollow struct {
+	UserID     int64 `json:"user_id"`
+	FollowerID int64 `json:"follower_id"`
+}
+
+type WebhookStore struct {
+	db *sql.DB
+}
+
+func (s *WebhookStore) Create(ctx context.Context, w *Webhook) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		query := `
+			INSERT INTO webhooks (user_id, url, secret, events, global) VALUES ($1, $2, $3, $4, $5)
+			RETURNING id, active, created_at, updated_at
+		`
+		err := tx.QueryRowContext(ctx, query, w.UserID, w.URL, w.Secret, pq.Array(w.Events), w.Global).
+			Scan(&w.ID, &w.Active, &w.CreatedAt, &w.UpdatedAt)
+		if err != nil {
+			return err
+		}
+		return event.Record(ctx, tx, AggregateWebhook, w.ID, EventWebhookCreated, newWebhookEvent(w))
+	})
+}
+
+func (s *WebhookStore) GetByID(ctx context.Context, id int64) (*Webhook, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `
+		SELECT id, user_id, url, secret, events, global, active, created_at, updated_at
+		FROM webhooks WHERE id = $1
+	`
+
+	var w Webhook
+	err := s.db.QueryRowContext(ctx, query, id).Scan(
+		&w.ID,
+		&w.UserID,
+		&w.URL,
+		&w.Secret,
+		pq.Array(&w.Events),
+		&w.Global,
+		&w.Active,
+		&w.CreatedAt,
+		&w.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrResourceNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &w, nil
+}
+
+// GetByUserID returns the webhooks registered by a user, without their
+// secrets.
+func (s *WebhookStore) GetByUserID(ctx context.Context, userID int64) ([]Webhook, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `
+		SELECT id, user_id, url, events, global, active, created_at, updated_at
+		FROM webhooks WHERE user_id = $1
+		ORDER BY id
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var w Webhook
+		err := rows.Scan(&w.ID,
+			&w.UserID,
+			&w.URL,
+			pq.Array(&w.Events),
+			&w.Global,
+			&w.Active,
+			&w.CreatedAt,
+			&w.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	return webhooks, rows.Err()
+}
+
+func (s *WebhookStore) Update(ctx context.Context, w *Webhook) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		query := `
+			UPDATE webhooks SET url = $2, events = $3, active = $4, updated_at = NOW()
+			WHERE id = $1
+			RETURNING updated_at
+		`
+		err := tx.QueryRowContext(ctx, query, w.ID, w.URL, pq.Array(w.Events), w.Active).Scan(&w.UpdatedAt)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrResourceNotFound
+			default:
+				return err
+			}
+		}
+		return event.Record(ctx, tx, AggregateWebhook, w.ID, EventWebhookUpdated, newWebhookEvent(w))
+	})
+}
+
+func (s *WebhookStore) Delete(ctx context.Context, id int64) error {
+	return withTx(s.db, ctx, func(tx *sql.Tx) error {
+		ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+		defer cancel()
+
+		var userID int64
+		err := tx.QueryRowContext(ctx, `DELETE FROM webhooks WHERE id = $1 RETURNING user_id`, id).Scan(&userID)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrResourceNotFound
+			default:
+				return err
+			}
+		}
+
+		data := WebhookEvent{ID: id, UserID: userID}
+		return event.Record(ctx, tx, AggregateWebhook, id, EventWebhookDeleted, data)
+	})
+}
+
+const webhookDeliveryColumns = `d.id, d.webhook_id, d.event, d.payload, d.status, d.attempts, d.next_attempt_at
+	, d.last_status_code, d.last_error, d.delivered_at, d.redelivery_of, d.created_at`
+
+func scanWebhookDelivery(row interface{ Scan(...any) error }, d *WebhookDelivery, extra ...any) error {
+	return row.Scan(append([]any{
+		&d.ID,
+		&d.WebhookID,
+		&d.Event,
+		&d.Payload,
+		&d.Status,
+		&d.Attempts,
+		&d.NextAttemptAt,
+		&d.LastStatusCode,
+		&d.LastError,
+		&d.DeliveredAt,
+		&d.RedeliveryOf,
+		&d.CreatedAt,
+	}, extra...)...)
+}
+
+// GetDeliveries returns a page of the delivery log of a webhook, most recent
+// first, along with the cursor of the next page.
+func (s *WebhookStore) GetDeliveries(ctx context.Context, webhookID int64, q PaginatedDeliveryQuery) ([]WebhookDelivery, *Cursor, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	var id *int64
+	if q.Cursor != nil {
+		if q.Cursor.Sort != "deliveries" {
+			return nil, nil, ErrInvalidCursor
+		}
+		id = &q.Cursor.ID
+	}
+
+	query := `
+		SELECT ` + webhookDeliveryColumns + `
+		FROM webhook_deliveries d
+		WHERE d.webhook_id = $1
+			AND ($2::bigint IS NULL OR d.id < $2)
+			AND ($3 = '' OR d.status = $3)
+		ORDER BY d.id DESC
+		LIMIT $4
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, webhookID, id, q.Status, q.Limit+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := scanWebhookDelivery(rows, &d); err != nil {
+			return nil, nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var next *Cursor
+	if len(deliveries) > q.Limit {
+		deliveries = deliveries[:q.Limit]
+		next = &Cursor{Sort: "deliveries", ID: deliveries[q.Limit-1].ID}
+	}
+	return deliveries, next, nil
+}
+
+// Redeliver queues the payload of a past delivery of the webhook again, as a
+// new delivery.
+func (s *WebhookStore) Redeliver(ctx context.Context, webhookID, deliveryID int64) (*WebhookDelivery, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `
+		INSERT INTO webhook_deliveries (webhook_id, event, payload, redelivery_of)
+		SELECT webhook_id, event, payload, id FROM webhook_deliveries
+		WHERE id = $1 AND webhook_id = $2
+		RETURNING id
+	`
+
+	var id int64
+	if err := s.db.QueryRowContext(ctx, query, deliveryID, webhookID).Scan(&id); err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrResourceNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	query = `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries d WHERE d.id = $1`
+
+	var d WebhookDelivery
+	if err := scanWebhookDelivery(s.db.QueryRowContext(ctx, query, id), &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// ClaimDeliveries takes up to batch deliveries that are due, along with the
+// URL and secret of their webhook, and leases them to the caller, counting
+// the attempt. Deliveries of webhooks that were deactivated wait until they
+// are active again.
+func (s *WebhookStore) ClaimDeliveries(ctx context.Context, batch int) ([]WebhookDelivery, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `
+		WITH claimed AS (
+			UPDATE webhook_deliveries
+			SET attempts = attempts + 1, next_attempt_at = NOW() + $2 * INTERVAL '1 second'
+			WHERE id IN (
+				SELECT d.id FROM webhook_deliveries d
+					JOIN webhooks w ON w.id = d.webhook_id
+				WHERE d.status = 'pending' AND d.next_attempt_at <= NOW() AND w.active
+				ORDER BY d.next_attempt_at
+				LIMIT $1
+				FOR UPDATE OF d SKIP LOCKED
+			)
+			RETURNING *
+		)
+		SELECT ` + webhookDeliveryColumns + `, w.url, w.secret
+		FROM claimed d
+			JOIN webhooks w ON w.id = d.webhook_id
+		ORDER BY d.id
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, batch, DeliveryLease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := scanWebhookDelivery(rows, &d, &d.URL, &d.Secret); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (s *WebhookStore) MarkDelivered(ctx context.Context, id int64, statusCode int) error {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `
+		UPDATE webhook_deliveries
+		SET status = 'delivered', last_status_code = $2, last_error = NULL, delivered_at = NOW()
+		WHERE id = $1
+	`
+	_, err := s.db.ExecContext(ctx, query, id, statusCode)
+	return err
+}
+
+// MarkFailed schedules the retry of a delivery with an exponential backoff,
+// or moves it to the dead letters once it ran out of attempts. statusCode is
+// zero when no response was received.
+func (s *WebhookStore) MarkFailed(ctx context.Context, d *WebhookDelivery, statusCode int, cause error) error {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	status := failedDeliveryStatus(d.Attempts, MaxWebhookAttempts)
+
+	var code *int
+	if statusCode != 0 {
+		code = &statusCode
+	}
+
+	query := `
+		UPDATE webhook_deliveries
+		SET status = $2, last_status_code = $3, last_error = $4, next_attempt_at = NOW() + $5 * INTERVAL '1 second'
+		WHERE id = $1
+	`
+	_, err := s.db.ExecContext(ctx, query, d.ID, status, code, cause.Error(), DeliveryBackoff(d.Attempts).Seconds())
+	return err
+}
+
+// PruneDeliveries deletes the deliveries delivered before the retention and the
+// dead ones queued before it, returning how many were deleted.
+func (s *WebhookStore) PruneDeliveries(ctx context.Context, retention time.Duration) (int64, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `
+		DELETE FROM webhook_deliveries
+		WHERE (status = 'delivered' AND delivered_at < NOW() - make_interval(secs => $1))
+			OR (status = 'dead' AND created_at < NOW() - make_interval(secs => $1))
+	`
+
+	res, err := s.db.ExecContext(ctx, query, retention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// EnqueueEvent queues a domain event for the active webhooks that subscribed
+// to it: the ones of its owner and the global ones. It is a handler of the
+// event bus; the payload is identified by the event, and a webhook is only
+// queued an event once, so publishing it again queues nothing. Events webhooks
+// cannot subscribe to are ignored.
+func (s *WebhookStore) EnqueueEvent(ctx context.Context, e event.Event) error {
+
+	ownerID, data, err := webhookData(e)
+	if err != nil || data == nil {
+		return err
+	}
+
+	payload, err := json.Marshal(WebhookPayload{
+		ID:        fmt.Sprintf("evt_%d", e.ID),
+		Event:     e.Type,
+		CreatedAt: e.CreatedAt.UTC().Format(time.RFC3339),
+		Data:      data,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeoutDuraton)
+	defer cancel()
+
+	query := `
+		INSERT INTO webhook_deliveries (webhook_id, event, payload, event_id)
+		SELECT w.id, $1, $3, $4 FROM webhooks w
+		WHERE w.active AND $1 = ANY (w.events) AND (w.global OR w.user_id = $2)
+		ON CONFLICT (webhook_id, event_id) DO NOTHING
+	`
+	_, err = s.db.ExecContext(ctx, query, e.Type, ownerID, payload, e.ID)
+	return err
+}
+
+// webhookData returns the owner of a domain event and the data webhooks are
+// sent about it, which is nil for the events they cannot subscribe to.
+func webhookData(e event.Event) (int64, any, error) {
+	switch e.Type {
+	case WebhookPostCreated, WebhookPostUpdated:
+		var p PostEvent
+		if err := e.Decode(&p); err != nil {
+			return 0, nil, err
+		}
+		return p.UserID, newWebhookPost(p), nil
+	case WebhookPostDeleted:
+		var p PostEvent
+		if err := e.Decode(&p); err != nil {
+			return 0, nil, err
+		}
+		return p.UserID, webhookDeletedPost{ID: p.ID, UserID: p.UserID}, nil
+	case WebhookUserFollowed:
+		var r RelationshipEvent
+		if err := e.Decode(&r); err != nil {
+			return 0, nil, err
+		}
+		return r.UserID, webhookFollow{UserID: r.UserID, FollowerID: r.OtherID}, nil
+	case WebhookCommentCreated:
+		var c CommentEvent
+		if err := e.Decode(&c); err != nil {
+			return 0, nil, err
+		}
+		return c.PostAuthorID, newCommentEvent(c), nil
+	default:
+		return 0, nil, nil
+	}
+}
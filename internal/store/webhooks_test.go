@@ -0,0 +1,89 @@
+package store
+
+import (
+	"encoding/json"
+	"testing"
+
+	"com.github/jrovieri/golang/social/internal/event"
+)
+
+func newEvent(t *testing.T, typ string, data any) event.Event {
+	t.Helper()
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event.Event{ID: 1, Type: typ, Data: raw}
+}
+
+func TestWebhookData(t *testing.T) {
+	parentID := int64(3)
+
+	tests := []struct {
+		name  string
+		event event.Event
+		owner int64
+		want  string
+	}{
+		{
+			name: "post created",
+			event: newEvent(t, EventPostCreated, PostEvent{ID: 1, UserID: 2, Title: "title", Content: "content",
+				Tags: []string{"go"}, Language: "en", Visibility: "public", CreatedAt: "2026-01-01T00:00:00Z"}),
+			owner: 2,
+			want: `{"id":1,"user_id":2,"title":"title","content":"content","tags":["go"],"language":"en",` +
+				`"visibility":"public","created_at":"2026-01-01T00:00:00Z"}`,
+		},
+		{
+			name:  "post deleted",
+			event: newEvent(t, EventPostDeleted, PostEvent{ID: 1, UserID: 2}),
+			owner: 2,
+			want:  `{"id":1,"user_id":2}`,
+		},
+		{
+			name:  "user followed",
+			event: newEvent(t, EventUserFollowed, RelationshipEvent{UserID: 2, OtherID: 5}),
+			owner: 2,
+			want:  `{"user_id":2,"follower_id":5}`,
+		},
+		{
+			name: "comment created",
+			event: newEvent(t, EventCommentCreated, CommentEvent{ID: 4, PostID: 1, PostAuthorID: 2, UserID: 5,
+				ParentID: &parentID, Content: "reply", CreatedAt: "2026-01-01T00:00:00Z"}),
+			owner: 2,
+			want: `{"id":4,"post_id":1,"user_id":5,"parent_id":3,"content":"reply",` +
+				`"created_at":"2026-01-01T00:00:00Z"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			owner, data, err := webhookData(tt.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if owner != tt.owner {
+				t.Errorf("owner = %d, want %d", owner, tt.owner)
+			}
+
+			got, err := json.Marshal(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(got) != tt.want {
+				t.Errorf("data = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookDataIgnoresOtherEvents(t *testing.T) {
+	for _, typ := range []string{EventCommentDeleted, EventUserBlocked, EventWebhookCreated} {
+		_, data, err := webhookData(newEvent(t, typ, struct{}{}))
+		if err != nil || data != nil {
+			t.Errorf("webhookData(%s) = %v, %v, want nothing", typ, data, err)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Package stream pushes events to clients over Server-Sent Events and
+// WebSocket connections.
+//
+// Events themselves live in the database. The hub only wakes up the
+// connections of a user when Postgres notifies that the user has new events,
+// and every connection then reads them from its own position. Slow clients
+// fall behind in the database rather than in memory.
+package stream
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// pingInterval is how often an idle listener checks its connection.
+const pingInterval = 90 * time.Second
+
+// ErrClosed is returned by streams ended because the hub was closed.
+var ErrClosed = errors.New("stream: hub closed")
+
+// Subscription is a connection waiting for the events of a user. C receives a
+// value whenever new events may be available; wake-ups that happen while one
+// is pending are merged into it. Done is closed when the hub is, telling the
+// connection to end.
+type Subscription struct {
+	UserID int64
+	C      <-chan struct{}
+	Done   <-chan struct{}
+
+	wake chan struct{}
+	hub  *Hub
+}
+
+// Close stops the subscription.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+
+	subs := s.hub.subs[s.UserID]
+	delete(subs, s)
+	if len(subs) == 0 {
+		delete(s.hub.subs, s.UserID)
+	}
+}
+
+// Hub tracks the subscriptions held by this replica.
+type Hub struct {
+	mu     sync.Mutex
+	subs   map[int64]map[*Subscription]struct{}
+	done   chan struct{}
+	closed bool
+}
+
+func NewHub() *Hub {
+	return &Hub{subs: map[int64]map[*Subscription]struct{}{}, done: make(chan struct{})}
+}
+
+// Subscribe starts waiting for the events of a user. Subscriptions made once
+// the hub is closed are done from the start.
+func (h *Hub) Subscribe(userID int64) *Subscription {
+	wake := make(chan struct{}, 1)
+	s := &Subscription{UserID: userID, C: wake, Done: h.done, wake: wake, hub: h}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subs[userID] == nil {
+		h.subs[userID] = map[*Subscription]struct{}{}
+	}
+	h.subs[userID][s] = struct{}{}
+	return s
+}
+
+// Wake tells the subscriptions of a user that new events may be available.
+func (h *Hub) Wake(userID int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for s := range h.subs[userID] {
+		s.signal()
+	}
+}
+
+// WakeAll wakes every subscription, for when notifications may have been
+// missed.
+func (h *Hub) WakeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, subs := range h.subs {
+		for s := range subs {
+			s.signal()
+		}
+	}
+}
+
+// Close tells every connection to end, so the server can shut down without
+// waiting for streams that would otherwise never finish. Clients reconnect,
+// to another replica.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.closed {
+		h.closed = true
+		close(h.done)
+	}
+}
+
+// Count returns the number of open subscriptions.
+func (h *Hub) Count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := 0
+	for _, subs := range h.subs {
+		n += len(subs)
+	}
+	return n
+}
+
+func (s *Subscription) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Listen wakes subscriptions as the notifications of channel arrive, until
+// ctx is done. Payloads are comma-separated user IDs. Since notifications
+// sent while the listener was reconnecting are lost, every subscription is
+// woken once it is back.
+func (h *Hub) Listen(ctx context.Context, l *pq.Listener, channel string) error {
+	if err := l.Listen(channel); err != nil {
+		return err
+	}
+	defer l.Close()
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case n := <-l.Notify:
+			if n == nil {
+				h.WakeAll()
+				continue
+			}
+
+			for _, value := range strings.Split(n.Extra, ",") {
+				if id, err := strconv.ParseInt(value, 10, 64); err == nil {
+					h.Wake(id)
+				}
+			}
+		case <-ticker.C:
+			go l.Ping()
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// SSE writes events to a Server-Sent Events response.
+type SSE struct {
+	w            http.ResponseWriter
+	rc           *http.ResponseController
+	writeTimeout time.Duration
+}
+
+// NewSSE starts an event stream response. Every write must complete within
+// writeTimeout, so a client that stops reading is dropped instead of holding
+// the stream forever. retry is the reconnection delay suggested to clients.
+func NewSSE(w http.ResponseWriter, writeTimeout, retry time.Duration) (*SSE, error) {
+	s := &SSE{w: w, rc: http.NewResponseController(w), writeTimeout: writeTimeout}
+
+	// The server read timeout would otherwise end the stream once it passes
+	if err := s.rc.SetReadDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return nil, err
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	return s, s.write(fmt.Sprintf("retry: %d\n\n", retry.Milliseconds()))
+}
+
+// WriteEvent sends an event. data must fit in one line, which JSON values
+// encoded without indentation always do.
+func (s *SSE) WriteEvent(id int64, event string, data []byte) error {
+	if bytes.ContainsAny(data, "\r\n") {
+		return errors.New("stream: event data spans several lines")
+	}
+	return s.write(fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", id, event, data))
+}
+
+// WriteHeartbeat sends a comment, which keeps proxies from closing an idle
+// stream and lets the server notice clients that went away.
+func (s *SSE) WriteHeartbeat() error {
+	return s.write(": heartbeat\n\n")
+}
+
+func (s *SSE) write(frame string) error {
+	if err := s.rc.SetWriteDeadline(time.Now().Add(s.writeTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+
+	if _, err := s.w.Write([]byte(frame)); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
@@ -0,0 +1,324 @@
+package stream
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocketGUID is appended to the client key to build the accept header
+// (RFC 6455, section 1.3).
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxFrameSize bounds the frames accepted from clients, which are only
+// expected to send control frames.
+const maxFrameSize = 4096
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Close codes (RFC 6455, section 7.4.1).
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+	closeNoStatusPresent = 1005
+)
+
+var (
+	ErrNotWebSocket    = errors.New("stream: not a websocket handshake")
+	ErrForbiddenOrigin = errors.New("stream: origin is not allowed")
+)
+
+// IsWebSocket tells whether the request asks to upgrade to WebSocket.
+func IsWebSocket(r *http.Request) bool {
+	return headerContains(r.Header, "Connection", "upgrade") &&
+		headerContains(r.Header, "Upgrade", "websocket")
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// originAllowed tells whether the Origin of a handshake is the allowed one.
+// Clients that are not browsers send no Origin and are let through. An allowed
+// origin without a scheme, such as "localhost:4040", matches on the host only.
+func originAllowed(origin, allowed string) bool {
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	if !strings.Contains(allowed, "://") {
+		return strings.EqualFold(u.Host, allowed)
+	}
+
+	a, err := url.Parse(allowed)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Scheme, a.Scheme) && strings.EqualFold(u.Host, a.Host)
+}
+
+// WebSocket is a server side WebSocket connection that sends events as text
+// messages. It answers pings and tracks pongs, and ignores the messages sent
+// by the client.
+type WebSocket struct {
+	conn         net.Conn
+	br           *bufio.Reader
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// Upgrade completes the WebSocket handshake and takes over the connection.
+// Browsers must open it from allowedOrigin, so other sites cannot open one
+// on behalf of their visitors. The client must show a sign of life, a pong or
+// any frame, at least every idleTimeout, and every write must complete within
+// writeTimeout.
+func Upgrade(w http.ResponseWriter, r *http.Request, allowedOrigin string, writeTimeout, idleTimeout time.Duration) (*WebSocket, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !IsWebSocket(r) || key == "" {
+		return nil, ErrNotWebSocket
+	}
+
+	if !originAllowed(r.Header.Get("Origin"), allowedOrigin) {
+		return nil, ErrForbiddenOrigin
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, fmt.Errorf("%w: unsupported version", ErrNotWebSocket)
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+
+	// Hijacking keeps the deadlines set by the server
+	if err := conn.SetDeadline(time.Now().Add(writeTimeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ws := &WebSocket{
+		conn:         conn,
+		br:           brw.Reader,
+		writeTimeout: writeTimeout,
+		idleTimeout:  idleTimeout,
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(idleTimeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// WriteEvent sends an event as a JSON text message.
+func (ws *WebSocket) WriteEvent(data []byte) error {
+	return ws.writeFrame(opText, data)
+}
+
+// WriteHeartbeat sends a ping. The pong that answers it keeps the connection
+// from being considered idle.
+func (ws *WebSocket) WriteHeartbeat() error {
+	return ws.writeFrame(opPing, nil)
+}
+
+// ReadLoop reads the frames sent by the client until the connection closes,
+// answering pings and close frames. It returns nil when the client closed the
+// connection cleanly.
+func (ws *WebSocket) ReadLoop() error {
+	for {
+		op, payload, err := ws.readFrame()
+		if err != nil {
+			return err
+		}
+
+		if err := ws.conn.SetReadDeadline(time.Now().Add(ws.idleTimeout)); err != nil {
+			return err
+		}
+
+		switch op {
+		case opPing:
+			if err := ws.writeFrame(opPong, payload); err != nil {
+				return err
+			}
+		case opClose:
+			code := closeNoStatusPresent
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			if code == closeNoStatusPresent {
+				code = CloseNormal
+			}
+			ws.Close(code)
+			return nil
+		}
+	}
+}
+
+// Close sends a close frame with code and closes the connection.
+func (ws *WebSocket) Close(code int) error {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	_ = ws.writeFrame(opClose, payload)
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.closed {
+		return nil
+	}
+	ws.closed = true
+	return ws.conn.Close()
+}
+
+func (ws *WebSocket) writeFrame(op byte, payload []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.closed {
+		return net.ErrClosed
+	}
+
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | op
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+
+	if err := ws.conn.SetWriteDeadline(time.Now().Add(ws.writeTimeout)); err != nil {
+		return err
+	}
+
+	if _, err := ws.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readFrame reads one whole message. Clients must mask their frames and may
+// fragment data messages, but not beyond maxFrameSize.
+func (ws *WebSocket) readFrame() (byte, []byte, error) {
+	var message []byte
+	var messageOp byte
+
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(ws.br, head[:]); err != nil {
+			return 0, nil, err
+		}
+
+		fin := head[0]&0x80 != 0
+		op := head[0] & 0x0F
+		masked := head[1]&0x80 != 0
+		length := uint64(head[1] & 0x7F)
+
+		if head[0]&0x70 != 0 || !masked {
+			ws.Close(CloseProtocolError)
+			return 0, nil, errors.New("stream: malformed websocket frame")
+		}
+
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(ws.br, ext[:]); err != nil {
+				return 0, nil, err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(ws.br, ext[:]); err != nil {
+				return 0, nil, err
+			}
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+
+		if length+uint64(len(message)) > maxFrameSize {
+			ws.Close(CloseMessageTooBig)
+			return 0, nil, errors.New("stream: websocket message too big")
+		}
+
+		var mask [4]byte
+		if _, err := io.ReadFull(ws.br, mask[:]); err != nil {
+			return 0, nil, err
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(ws.br, payload); err != nil {
+			return 0, nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		// Control frames may arrive between the fragments of a message
+		if op >= opClose {
+			if !fin || length > 125 {
+				ws.Close(CloseProtocolError)
+				return 0, nil, errors.New("stream: malformed websocket control frame")
+			}
+			return op, payload, nil
+		}
+
+		if op != opContinuation {
+			messageOp = op
+		}
+		message = append(message, payload...)
+
+		if fin {
+			return messageOp, message, nil
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package syndication
+
+import (
+	"time"
+)
+
+// Feed is a list of entries that can be rendered as Atom 1.0, RSS 2.0 or
+// JSON Feed 1.1.
+type Feed struct {
+	ID          string
+	Title       string
+	Description string
+	Link        string
+	Self        string
+	Updated     time.Time
+	Author      *Author
+	Entries     []Entry
+}
+
+type Author struct {
+	Name string
+	URI  string
+}
+
+type Entry struct {
+	ID        string
+	Title     string
+	Link      string
+	Content   string
+	Author    Author
+	Tags      []string
+	Published time.Time
+	Updated   time.Time
+}
+
+// Format describes how a feed is rendered and served.
+type Format struct {
+	ContentType string
+	Render      func(*Feed) ([]byte, error)
+}
+
+var Formats = map[string]Format{
+	"atom": {ContentType: "application/atom+xml; charset=utf-8", Render: Atom},
+	"rss":  {ContentType: "application/rss+xml; charset=utf-8", Render: RSS},
+	"json": {ContentType: "application/feed+json; charset=utf-8", Render: JSON},
+}
@@ -0,0 +1,62 @@
+package syndication
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type jsonFeed struct {
+	Version     string       `json:"version"`
+	Title       string       `json:"title"`
+	HomePageURL string       `json:"home_page_url"`
+	FeedURL     string       `json:"feed_url"`
+	Description string       `json:"description,omitempty"`
+	Authors     []jsonAuthor `json:"authors,omitempty"`
+	Items       []jsonItem   `json:"items"`
+}
+
+type jsonAuthor struct {
+	Name string `json:"name"`
+	URL  string `json:"url,omitempty"`
+}
+
+type jsonItem struct {
+	ID            string       `json:"id"`
+	URL           string       `json:"url"`
+	Title         string       `json:"title"`
+	ContentText   string       `json:"content_text"`
+	DatePublished string       `json:"date_published"`
+	DateModified  string       `json:"date_modified"`
+	Authors       []jsonAuthor `json:"authors"`
+	Tags          []string     `json:"tags,omitempty"`
+}
+
+// JSON renders the feed as a JSON Feed 1.1 document.
+func JSON(f *Feed) ([]byte, error) {
+	feed := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       f.Title,
+		HomePageURL: f.Link,
+		FeedURL:     f.Self,
+		Description: f.Description,
+		Items:       []jsonItem{},
+	}
+
+	if f.Author != nil {
+		feed.Authors = []jsonAuthor{{Name: f.Author.Name, URL: f.Author.URI}}
+	}
+
+	for _, e := range f.Entries {
+		feed.Items = append(feed.Items, jsonItem{
+			ID:            e.ID,
+			URL:           e.Link,
+			Title:         e.Title,
+			ContentText:   e.Content,
+			DatePublished: e.Published.UTC().Format(time.RFC3339),
+			DateModified:  e.Updated.UTC().Format(time.RFC3339),
+			Authors:       []jsonAuthor{{Name: e.Author.Name, URL: e.Author.URI}},
+			Tags:          e.Tags,
+		})
+	}
+	return json.MarshalIndent(feed, "", "  ")
+}
@@ -0,0 +1,187 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"com.github/jrovieri/golang/social/internal/netguard"
+)
+
+const testSecret = "whsec_test"
+
+// verify checks a signature the way receivers are told to: recompute the
+// HMAC of "<timestamp>.<body>" and reject old timestamps.
+func verify(header, secret string, body []byte, tolerance time.Duration) error {
+	var timestamp, signature string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signature = value
+		}
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("missing timestamp")
+	}
+
+	if age := time.Since(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+		return errors.New("stale timestamp")
+	}
+
+	sum, err := hex.DecodeString(signature)
+	if err != nil {
+		return errors.New("missing signature")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+func TestDeliverSignsPayload(t *testing.T) {
+	body := []byte(`{"id":"evt_1","event":"post.created"}`)
+
+	var received *http.Request
+	var receivedBody []byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		receivedBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	client := NewClient(5*time.Second, true)
+
+	status, err := client.Deliver(context.Background(), receiver.URL, testSecret, 42, "post.created", body)
+	if err != nil {
+		t.Fatalf("Deliver() = %v", err)
+	}
+
+	if status != http.StatusNoContent {
+		t.Errorf("status = %d, want %d", status, http.StatusNoContent)
+	}
+
+	if string(receivedBody) != string(body) {
+		t.Errorf("body = %s, want %s", receivedBody, body)
+	}
+
+	if got := received.Header.Get("X-Webhook-Event"); got != "post.created" {
+		t.Errorf("X-Webhook-Event = %q", got)
+	}
+
+	if got := received.Header.Get("X-Webhook-Delivery"); got != "42" {
+		t.Errorf("X-Webhook-Delivery = %q", got)
+	}
+
+	signature := received.Header.Get("X-Webhook-Signature")
+	if err := verify(signature, testSecret, receivedBody, 5*time.Minute); err != nil {
+		t.Errorf("signature %q: %v", signature, err)
+	}
+
+	if err := verify(signature, "other secret", receivedBody, 5*time.Minute); err == nil {
+		t.Error("signature verified with another secret")
+	}
+
+	if err := verify(signature, testSecret, []byte(`{"id":"evt_2"}`), 5*time.Minute); err == nil {
+		t.Error("signature verified for another body")
+	}
+}
+
+func TestSignRejectsReplays(t *testing.T) {
+	body := []byte(`{}`)
+
+	old := Sign(testSecret, time.Now().Add(-time.Hour), body)
+	if err := verify(old, testSecret, body, 5*time.Minute); err == nil {
+		t.Error("signature of an hour ago verified")
+	}
+}
+
+func TestDeliverFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		status  int
+	}{
+		{
+			name:    "server error",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) },
+			status:  http.StatusInternalServerError,
+		},
+		{
+			name: "redirect",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Redirect(w, r, "http://169.254.169.254/", http.StatusFound)
+			},
+			status: http.StatusFound,
+		},
+	}
+
+	client := NewClient(5*time.Second, true)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := httptest.NewServer(tt.handler)
+			defer receiver.Close()
+
+			status, err := client.Deliver(context.Background(), receiver.URL, testSecret, 1, "post.created", []byte(`{}`))
+			if err == nil {
+				t.Fatal("Deliver() = nil, want an error")
+			}
+
+			if status != tt.status {
+				t.Errorf("status = %d, want %d", status, tt.status)
+			}
+		})
+	}
+
+	t.Run("unreachable", func(t *testing.T) {
+		receiver := httptest.NewServer(http.NotFoundHandler())
+		receiver.Close()
+
+		status, err := client.Deliver(context.Background(), receiver.URL, testSecret, 1, "post.created", []byte(`{}`))
+		if err == nil || status != 0 {
+			t.Errorf("Deliver() = %d, %v, want 0 and an error", status, err)
+		}
+	})
+}
+
+func TestDeliverRefusesPrivateAddresses(t *testing.T) {
+	var hits int
+	receiver := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+	}))
+	defer receiver.Close()
+
+	client := NewClient(5*time.Second, false)
+
+	_, err := client.Deliver(context.Background(), receiver.URL, testSecret, 1, "post.created", []byte(`{}`))
+	if !errors.Is(err, netguard.ErrForbiddenAddress) {
+		t.Fatalf("Deliver() = %v, want %v", err, netguard.ErrForbiddenAddress)
+	}
+
+	if hits != 0 {
+		t.Errorf("receiver was reached %d times", hits)
+	}
+
+	if err := client.CheckURL("http://example.com/hook"); err == nil {
+		t.Error("CheckURL() accepted http")
+	}
+}